@@ -9,9 +9,13 @@ import (
 	"github.com/scott-ace-newton/users-rw-sql/users"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -31,10 +35,16 @@ func main() {
 	})
 	sqlDSN := app.String(cli.StringOpt{
 		Name:      "sqlDSN",
-		Desc:      "DSN to connect to the db e.g. host/schema",
+		Desc:      "Address of the db e.g. host:3306",
 		EnvVar:    "SQL_DSN",
 		HideValue: true,
 	})
+	sqlDatabase := app.String(cli.StringOpt{
+		Name:   "sqlDatabase",
+		Value:  "dev",
+		Desc:   "Name of the database the tables are in",
+		EnvVar: "SQL_DATABASE",
+	})
 	queueURL := app.String(cli.StringOpt{
 		Name:      "queueURL",
 		Desc:      "Url of queue to send messages to",
@@ -47,6 +57,99 @@ func main() {
 		Desc:   "Port to listen on",
 		EnvVar: "APP_PORT",
 	})
+	messageFormat := app.String(cli.StringOpt{
+		Name:   "messageFormat",
+		Value:  "json",
+		Desc:   "Format of messages sent to the queue, one of json, protobuf or avro",
+		EnvVar: "MESSAGE_FORMAT",
+	})
+	publishMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "publishMaxAttempts",
+		Value:  3,
+		Desc:   "Number of times to attempt sending a message to the queue before dead lettering it",
+		EnvVar: "PUBLISH_MAX_ATTEMPTS",
+	})
+	publishInitialBackoff := app.String(cli.StringOpt{
+		Name:   "publishInitialBackoff",
+		Value:  "100ms",
+		Desc:   "Delay before the first retry of a failed message, doubling on each further retry",
+		EnvVar: "PUBLISH_INITIAL_BACKOFF",
+	})
+	publishMaxBackoff := app.String(cli.StringOpt{
+		Name:   "publishMaxBackoff",
+		Value:  "2s",
+		Desc:   "Maximum delay between retries of a failed message",
+		EnvVar: "PUBLISH_MAX_BACKOFF",
+	})
+	deadLetterDir := app.String(cli.StringOpt{
+		Name:   "deadLetterDir",
+		Value:  "dead-letters",
+		Desc:   "Directory to store messages which could not be delivered to the queue",
+		EnvVar: "DEAD_LETTER_DIR",
+	})
+	deletedUserRetention := app.String(cli.StringOpt{
+		Name:   "deletedUserRetention",
+		Value:  "720h",
+		Desc:   "How long soft deleted users can be restored for before they are permanently purged",
+		EnvVar: "DELETED_USER_RETENTION",
+	})
+	purgeInterval := app.String(cli.StringOpt{
+		Name:   "purgeInterval",
+		Value:  "1h",
+		Desc:   "How often to purge users deleted longer ago than the retention period",
+		EnvVar: "PURGE_INTERVAL",
+	})
+	eventBufferSize := app.Int(cli.IntOpt{
+		Name:   "eventBufferSize",
+		Value:  1000,
+		Desc:   "Number of recent user events kept for event stream clients resuming with Last-Event-ID",
+		EnvVar: "EVENT_BUFFER_SIZE",
+	})
+	requireIfMatch := app.Bool(cli.BoolOpt{
+		Name:   "requireIfMatch",
+		Value:  false,
+		Desc:   "Reject PATCH and DELETE requests without an If-Match header with 428 Precondition Required",
+		EnvVar: "REQUIRE_IF_MATCH",
+	})
+	requireTenant := app.Bool(cli.BoolOpt{
+		Name:   "requireTenant",
+		Value:  false,
+		Desc:   "Reject requests which do not name a tenant with 400 rather than using the default tenant",
+		EnvVar: "REQUIRE_TENANT",
+	})
+	idempotencyKeyTTL := app.String(cli.StringOpt{
+		Name:   "idempotencyKeyTTL",
+		Value:  "24h",
+		Desc:   "How long responses to requests with an Idempotency-Key are replayed to retries, 0 to ignore the header",
+		EnvVar: "IDEMPOTENCY_KEY_TTL",
+	})
+	maxBatchSize := app.Int(cli.IntOpt{
+		Name:   "maxBatchSize",
+		Value:  1000,
+		Desc:   "Maximum number of operations in a batch create, update or delete request",
+		EnvVar: "MAX_BATCH_SIZE",
+	})
+	jwksFile := app.String(cli.StringOpt{
+		Name:   "jwksFile",
+		Desc:   "JWKS file of the keys verifying Bearer JWTs, requests are not authenticated if not set",
+		EnvVar: "JWKS_FILE",
+	})
+	jwtIssuer := app.String(cli.StringOpt{
+		Name:   "jwtIssuer",
+		Desc:   "Issuer JWTs must be issued by, any if not set",
+		EnvVar: "JWT_ISSUER",
+	})
+	jwtAudience := app.String(cli.StringOpt{
+		Name:   "jwtAudience",
+		Desc:   "Audience JWTs must be issued for, any if not set",
+		EnvVar: "JWT_AUDIENCE",
+	})
+	apiKeyAuth := app.Bool(cli.BoolOpt{
+		Name:   "apiKeyAuth",
+		Value:  false,
+		Desc:   "Authenticate requests sending API keys created with the apikey command",
+		EnvVar: "API_KEY_AUTH",
+	})
 	logLevel := app.String(cli.StringOpt{
 		Name:   "logLevel",
 		Value:  "info",
@@ -75,19 +178,68 @@ func main() {
 			log.Fatalf("SQL Username and password not set")
 			return
 		}
+		retention, err := time.ParseDuration(*deletedUserRetention)
+		if err != nil {
+			log.WithError(err).Fatal("invalid deleted user retention period")
+			return
+		}
+		interval, err := time.ParseDuration(*purgeInterval)
+		if err != nil || interval <= 0 {
+			log.WithField("purgeInterval", *purgeInterval).Fatal("purge interval must be a positive duration")
+			return
+		}
 
-		sqlClient, err := persistence.NewClient(*sqlDSN, *sqlCredentials)
+		keyTTL, err := time.ParseDuration(*idempotencyKeyTTL)
+		if err != nil || keyTTL < 0 {
+			log.WithField("idempotencyKeyTTL", *idempotencyKeyTTL).Fatal("idempotency key TTL must be a duration of at least 0")
+			return
+		}
+		if *maxBatchSize < 1 {
+			log.WithField("maxBatchSize", *maxBatchSize).Fatal("max batch size must be at least 1")
+			return
+		}
+		var authenticators []users.Authenticator
+		if *jwksFile != "" {
+			jwtAuthenticator, err := users.NewJWTAuthenticator(*jwksFile, *jwtIssuer, *jwtAudience)
+			if err != nil {
+				log.WithError(err).Fatal("could not configure JWT authentication")
+				return
+			}
+			authenticators = append(authenticators, jwtAuthenticator)
+		}
+		sqlClient, err := persistence.NewClient(*sqlDSN, *sqlCredentials, *sqlDatabase)
+		if err != nil {
+			return
+		}
+		if *apiKeyAuth {
+			authenticators = append(authenticators, users.NewAPIKeyAuthenticator(sqlClient))
+		}
+		if len(authenticators) == 0 {
+			log.Warn("neither JWKS file nor API key authentication set, requests will not be authenticated")
+		}
+
+		queueClient, err := newQueueClient(*queueURL, *messageFormat, *publishMaxAttempts, *publishInitialBackoff, *publishMaxBackoff, *deadLetterDir)
 		if err != nil {
+			log.WithError(err).Fatal("could not configure queue client")
 			return
 		}
 
-		queueClient := notification.NewQueueClient(*queueURL)
+		events := notification.NewEventStream(*eventBufferSize)
 
-		h := users.NewUsersHandler(sqlClient, queueClient)
+		h := users.NewUsersHandler(sqlClient, queueClient, events, users.Config{
+			RequireIfMatch: *requireIfMatch,
+			RequireTenant: *requireTenant,
+			IdempotencyKeyTTL: keyTTL,
+			MaxBatchSize: *maxBatchSize,
+			Authenticators: authenticators,
+		})
 		r := mux.NewRouter()
 		h.RegisterHandlers(r)
 
-		sig := make(chan os.Signal)
+		stopPurge := make(chan struct{})
+		go h.RunPurgeJob(interval, retention, stopPurge)
+
+		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
 
@@ -106,13 +258,421 @@ func main() {
 			sig <- os.Interrupt
 		}()
 		<-sig
+		close(stopPurge)
 		log.Info("shutting down HTTP server...")
 		time.Sleep(2 * time.Second)
 		os.Exit(0)
 	}
+	app.Command("dlq", "Operate on messages which could not be delivered to the queue", func(cmd *cli.Cmd) {
+		cmd.Command("list", "List dead lettered messages", func(list *cli.Cmd) {
+			list.Action = func() {
+				store, err := notification.NewDeadLetterStore(*deadLetterDir)
+				if err != nil {
+					log.WithError(err).Fatal("could not open dead letter store")
+				}
+				deadLetters, err := store.List()
+				if err != nil {
+					log.WithError(err).Fatal("could not list dead letters")
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tTYPE\tUSER ID\tATTEMPTS\tFAILED AT\tERROR")
+				for _, dl := range deadLetters {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", dl.ID, dl.Message.Type, dl.Message.UserID, dl.Attempts, dl.FailedAt.Format(time.RFC3339), dl.Error)
+				}
+				w.Flush()
+			}
+		})
+		cmd.Command("replay", "Resend dead lettered messages to the queue", func(replay *cli.Cmd) {
+			replay.Action = func() {
+				if *queueURL == "" {
+					log.Fatal("queue url not set")
+				}
+				queueClient, err := newQueueClient(*queueURL, *messageFormat, *publishMaxAttempts, *publishInitialBackoff, *publishMaxBackoff, *deadLetterDir)
+				if err != nil {
+					log.WithError(err).Fatal("could not configure queue client")
+				}
+				replayed, failed, err := queueClient.ReplayDeadLetters()
+				if err != nil {
+					log.WithError(err).Fatal("could not replay dead letters")
+				}
+				log.Infof("replayed %d dead letters, %d could still not be delivered", replayed, failed)
+			}
+		})
+		cmd.Command("purge", "Permanently delete all dead lettered messages", func(purge *cli.Cmd) {
+			purge.Action = func() {
+				store, err := notification.NewDeadLetterStore(*deadLetterDir)
+				if err != nil {
+					log.WithError(err).Fatal("could not open dead letter store")
+				}
+				purged, err := store.Purge()
+				if err != nil {
+					log.WithError(err).Fatal("could not purge dead letters")
+				}
+				log.Infof("purged %d dead letters", purged)
+			}
+		})
+	})
+
+	app.Command("snapshot", "Publish a USER_SNAPSHOT event for every user so downstream consumers can rebuild their state", func(cmd *cli.Cmd) {
+		filters := cmd.Strings(cli.StringsOpt{
+			Name: "filter",
+			Desc: "Only export users matching a GET /users search param e.g. --filter country=Italy, may be repeated",
+		})
+		rate := cmd.Int(cli.IntOpt{
+			Name:  "rate",
+			Value: 100,
+			Desc:  "Maximum number of events to publish per second, 0 for no limit",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batchSize",
+			Value: 500,
+			Desc:  "Number of users to read from the db at a time",
+		})
+		checkpointFile := cmd.String(cli.StringOpt{
+			Name: "checkpointFile",
+			Desc: "File recording progress, an interrupted export re-run with the same file resumes where it stopped",
+		})
+		dryRun := cmd.Bool(cli.BoolOpt{
+			Name: "dryRun",
+			Desc: "Count the users which would be exported without publishing any events",
+		})
+		tenant := cmd.String(cli.StringOpt{
+			Name:  "tenant",
+			Value: persistence.DefaultTenant,
+			Desc:  "Tenant whose users are exported",
+		})
+
+		cmd.Action = func() {
+			params := url.Values{}
+			for _, filter := range *filters {
+				parts := strings.SplitN(filter, "=", 2)
+				if len(parts) != 2 {
+					log.Fatalf("filter %s should be in 'param=value' format", filter)
+				}
+				params.Add(parts[0], parts[1])
+			}
+			sqlClient, queueClient := mustConnect(*sqlDSN, *sqlCredentials, *sqlDatabase, *queueURL, *messageFormat, *publishMaxAttempts, *publishInitialBackoff, *publishMaxBackoff, *deadLetterDir)
+
+			result, err := users.NewSnapshotter(sqlClient, &queueClient).Run(users.SnapshotOptions{
+				Filters:        params,
+				Rate:           *rate,
+				BatchSize:      *batchSize,
+				CheckpointFile: *checkpointFile,
+				DryRun:         *dryRun,
+				TenantID:       *tenant,
+			})
+			if err != nil {
+				log.WithError(err).Fatalf("snapshot stopped after user %s", result.LastUserID)
+			}
+			if *dryRun {
+				log.Infof("dry run: would publish %d snapshot events", result.Published)
+				return
+			}
+			log.Infof("published %d snapshot events, %d could not be delivered and were dead lettered", result.Published, result.Failed)
+		}
+	})
+
+	app.Command("import", "Add users from a csv or ndjson file, writing rejected rows to an error file", func(cmd *cli.Cmd) {
+		format := cmd.String(cli.StringOpt{
+			Name:  "format",
+			Value: "csv",
+			Desc:  "Format of the file, csv with a header row naming the user fields or ndjson with a user per line",
+		})
+		file := cmd.String(cli.StringOpt{
+			Name: "file",
+			Desc: "File of users to import",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batchSize",
+			Value: 500,
+			Desc:  "Number of users to add to the db at a time",
+		})
+		errorFile := cmd.String(cli.StringOpt{
+			Name:  "errorFile",
+			Value: "import-errors.csv",
+			Desc:  "File to write rejected rows to with their line number and the reason",
+		})
+		startLine := cmd.Int(cli.IntOpt{
+			Name:  "startLine",
+			Value: 1,
+			Desc:  "First line of the file to import, used to resume an interrupted import",
+		})
+		dryRun := cmd.Bool(cli.BoolOpt{
+			Name: "dryRun",
+			Desc: "Validate the file without adding any users",
+		})
+		tenant := cmd.String(cli.StringOpt{
+			Name:  "tenant",
+			Value: persistence.DefaultTenant,
+			Desc:  "Tenant to add the users to",
+		})
+
+		cmd.Action = func() {
+			if *file == "" {
+				log.Fatal("--file is required")
+			}
+			in, err := os.Open(*file)
+			if err != nil {
+				log.WithError(err).Fatal("could not open import file")
+			}
+			defer in.Close()
+
+			//a resumed import appends to the rows rejected before it was interrupted
+			flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+			if *startLine > 1 {
+				flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+			}
+			rejects, err := os.OpenFile(*errorFile, flags, 0644)
+			if err != nil {
+				log.WithError(err).Fatal("could not open error file")
+			}
+			defer rejects.Close()
+			if *startLine <= 1 {
+				fmt.Fprintln(rejects, "line,emailAddress,reason")
+			}
+
+			sqlClient, queueClient := mustConnect(*sqlDSN, *sqlCredentials, *sqlDatabase, *queueURL, *messageFormat, *publishMaxAttempts, *publishInitialBackoff, *publishMaxBackoff, *deadLetterDir)
+			result, err := users.NewImporter(sqlClient, &queueClient).Run(in, rejects, users.ImportOptions{
+				Format:    *format,
+				BatchSize: *batchSize,
+				StartLine: *startLine,
+				DryRun:    *dryRun,
+				TenantID:  *tenant,
+			})
+			if err != nil {
+				log.WithError(err).Fatalf("import stopped after line %d, resume with --startLine %d", result.LastLine, result.LastLine+1)
+			}
+			if *dryRun {
+				log.Infof("dry run: would import %d users, %d rows rejected and written to %s", result.Imported, result.Rejected, *errorFile)
+				return
+			}
+			log.Infof("imported %d users, %d rows rejected and written to %s", result.Imported, result.Rejected, *errorFile)
+		}
+	})
+
+	app.Command("export", "Stream users to a csv, ndjson or parquet file, without their passwords", func(cmd *cli.Cmd) {
+		format := cmd.String(cli.StringOpt{
+			Name:  "format",
+			Value: "csv",
+			Desc:  "Format of the export, csv, ndjson or parquet",
+		})
+		file := cmd.String(cli.StringOpt{
+			Name: "file",
+			Desc: "File to write the users to, stdout if not set",
+		})
+		filters := cmd.Strings(cli.StringsOpt{
+			Name: "filter",
+			Desc: "Only export users matching a GET /users search param e.g. --filter country=Italy, may be repeated",
+		})
+		fields := cmd.String(cli.StringOpt{
+			Name: "fields",
+			Desc: "Comma separated user fields to export, in order, every field except password if not set",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batchSize",
+			Value: 500,
+			Desc:  "Number of users to read from the db at a time",
+		})
+		tenant := cmd.String(cli.StringOpt{
+			Name:  "tenant",
+			Value: persistence.DefaultTenant,
+			Desc:  "Tenant whose users are exported",
+		})
+
+		cmd.Action = func() {
+			params := url.Values{}
+			for _, filter := range *filters {
+				parts := strings.SplitN(filter, "=", 2)
+				if len(parts) != 2 {
+					log.Fatalf("filter %s should be in 'param=value' format", filter)
+				}
+				params.Add(parts[0], parts[1])
+			}
+			out := os.Stdout
+			if *file != "" {
+				var err error
+				if out, err = os.Create(*file); err != nil {
+					log.WithError(err).Fatal("could not create export file")
+				}
+				defer out.Close()
+			}
+
+			sqlClient := mustConnectDB(*sqlDSN, *sqlCredentials, *sqlDatabase)
+			var selected []string
+			if *fields != "" {
+				selected = strings.Split(*fields, ",")
+			}
+			result, err := users.NewExporter(sqlClient).Run(out, users.ExportOptions{
+				Format:    *format,
+				Filters:   params,
+				Fields:    selected,
+				BatchSize: *batchSize,
+				TenantID:  *tenant,
+			})
+			if err != nil {
+				log.WithError(err).Fatalf("export stopped after user %s", result.LastUserID)
+			}
+			log.Infof("exported %d users", result.Exported)
+		}
+	})
+
+	app.Command("dedupe-report", "Report the pairs of users who could be duplicates as csv, most likely first", func(cmd *cli.Cmd) {
+		file := cmd.String(cli.StringOpt{
+			Name: "file",
+			Desc: "File to write the report to, stdout if not set",
+		})
+		minScore := cmd.String(cli.StringOpt{
+			Name:  "minScore",
+			Value: "0.4",
+			Desc:  "Lowest score, from 0 to 1, of the pairs of users to report",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batchSize",
+			Value: 500,
+			Desc:  "Number of users to read from the db at a time",
+		})
+		tenant := cmd.String(cli.StringOpt{
+			Name:  "tenant",
+			Value: persistence.DefaultTenant,
+			Desc:  "Tenant whose users are compared",
+		})
+
+		cmd.Action = func() {
+			score, err := strconv.ParseFloat(*minScore, 64)
+			if err != nil || score < 0 || score > 1 {
+				log.Fatalf("minScore %s should be between 0 and 1", *minScore)
+			}
+			out := os.Stdout
+			if *file != "" {
+				if out, err = os.Create(*file); err != nil {
+					log.WithError(err).Fatal("could not create report file")
+				}
+				defer out.Close()
+			}
+
+			sqlClient := mustConnectDB(*sqlDSN, *sqlCredentials, *sqlDatabase)
+			result, err := users.NewDuplicateReporter(sqlClient).Run(out, users.DedupeOptions{
+				MinScore:  score,
+				BatchSize: *batchSize,
+				TenantID:  *tenant,
+			})
+			if err != nil {
+				log.WithError(err).Fatal("could not report duplicate users")
+			}
+			log.Infof("found %d possible duplicates among %d users", result.Duplicates, result.Scanned)
+		}
+	})
+
+	app.Command("apikey", "Manage the API keys services authenticate with", func(cmd *cli.Cmd) {
+		cmd.Command("create", "Create an API key, which is only shown once", func(create *cli.Cmd) {
+			name := create.String(cli.StringOpt{
+				Name: "name",
+				Desc: "Name of the service the key is for, recorded as the actor of its changes",
+			})
+			scopes := create.Strings(cli.StringsOpt{
+				Name: "scope",
+				Desc: "Scope granted to the key, may be repeated",
+			})
+			tenant := create.String(cli.StringOpt{
+				Name: "tenant",
+				Desc: "Only tenant the key may access, if not set admin keys may name any tenant and others use the default",
+			})
+			create.Action = func() {
+				key, created, err := users.NewAPIKeyAuthenticator(mustConnectDB(*sqlDSN, *sqlCredentials, *sqlDatabase)).Create(*name, *scopes, *tenant)
+				if err != nil {
+					log.WithError(err).Fatal("could not create API key")
+				}
+				fmt.Printf("created API key %s for %s, send it as the header\n\nAuthorization: ApiKey %s\n", created.KeyID, created.Name, key)
+			}
+		})
+		cmd.Command("list", "List API keys, including revoked keys", func(list *cli.Cmd) {
+			list.Action = func() {
+				keys, err := users.NewAPIKeyAuthenticator(mustConnectDB(*sqlDSN, *sqlCredentials, *sqlDatabase)).List()
+				if err != nil {
+					log.WithError(err).Fatal("could not list API keys")
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tNAME\tSCOPES\tTENANT\tCREATED AT\tLAST USED AT\tREVOKED AT")
+				for _, key := range keys {
+					tenant := key.TenantID
+					if tenant == "" {
+						tenant = "*"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.KeyID, key.Name, strings.Join(key.Scopes, " "), tenant, formatTime(key.CreatedAt), formatTime(key.LastUsedAt), formatTime(key.RevokedAt))
+				}
+				w.Flush()
+			}
+		})
+		cmd.Command("revoke", "Revoke an API key so it can no longer authenticate requests", func(revoke *cli.Cmd) {
+			keyID := revoke.StringArg("KEY_ID", "", "ID of the key to revoke")
+			revoke.Action = func() {
+				if err := users.NewAPIKeyAuthenticator(mustConnectDB(*sqlDSN, *sqlCredentials, *sqlDatabase)).Revoke(*keyID); err != nil {
+					log.WithError(err).Fatal("could not revoke API key")
+				}
+				log.Infof("revoked API key %s", *keyID)
+			}
+		})
+	})
+
 	err = app.Run(os.Args)
 	if err != nil {
 		log.Errorf("app could not start, error=[%s]\n", err)
 		return
 	}
 }
+
+func newQueueClient(queueURL, messageFormat string, maxAttempts int, initialBackoff, maxBackoff, deadLetterDir string) (notification.QueueClient, error) {
+	serializer, err := notification.NewSerializer(messageFormat)
+	if err != nil {
+		return notification.QueueClient{}, err
+	}
+	policy := notification.DefaultRetryPolicy()
+	policy.MaxAttempts = maxAttempts
+	if policy.InitialBackoff, err = time.ParseDuration(initialBackoff); err != nil {
+		return notification.QueueClient{}, fmt.Errorf("invalid initial back-off: %v", err)
+	}
+	if policy.MaxBackoff, err = time.ParseDuration(maxBackoff); err != nil {
+		return notification.QueueClient{}, fmt.Errorf("invalid max back-off: %v", err)
+	}
+	store, err := notification.NewDeadLetterStore(deadLetterDir)
+	if err != nil {
+		return notification.QueueClient{}, fmt.Errorf("could not open dead letter store: %v", err)
+	}
+	return notification.NewQueueClient(queueURL, serializer, policy, store), nil
+}
+
+//mustConnect returns configured sql and queue clients for commands, exiting if they cannot be created
+func mustConnect(sqlDSN, sqlCredentials, sqlDatabase, queueURL, messageFormat string, maxAttempts int, initialBackoff, maxBackoff, deadLetterDir string) (persistence.Clienter, notification.QueueClient) {
+	if queueURL == "" {
+		log.Fatal("queue url not set")
+	}
+	sqlClient := mustConnectDB(sqlDSN, sqlCredentials, sqlDatabase)
+	queueClient, err := newQueueClient(queueURL, messageFormat, maxAttempts, initialBackoff, maxBackoff, deadLetterDir)
+	if err != nil {
+		log.WithError(err).Fatal("could not configure queue client")
+	}
+	return sqlClient, queueClient
+}
+
+//formatTime formats optional times for tables, - if they are not set
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+//mustConnectDB connects to the db for commands which do not publish messages
+func mustConnectDB(sqlDSN, sqlCredentials, sqlDatabase string) persistence.Clienter {
+	if sqlDSN == "" {
+		log.Fatal("SQL connection string not set")
+	}
+	if sqlCredentials == "" {
+		log.Fatal("SQL Username and password not set")
+	}
+	sqlClient, err := persistence.NewClient(sqlDSN, sqlCredentials, sqlDatabase)
+	if err != nil {
+		log.WithError(err).Fatal("could not connect to db")
+	}
+	return sqlClient
+}
@@ -0,0 +1,329 @@
+package notification
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//avroMagic starts every avro single object encoded message
+var avroMagic = []byte{0xC3, 0x01}
+
+//avroSchema is the subset of an avro record schema used by the message schemas
+type avroSchema struct {
+	Type      string      `json:"type"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Fields    []avroField `json:"fields"`
+}
+
+type avroField struct {
+	Name    string          `json:"name"`
+	Type    json.RawMessage `json:"type"`
+	Default json.RawMessage `json:"default"`
+}
+
+//avroSerializer encodes messages using avro single object encoding, prefixing the payload with
+//the fingerprint of the schema it was written with. Messages written with any published
+//version of schemas/<version>/user_event.avsc can be decoded
+type avroSerializer struct {
+	writer      avroSchema
+	fingerprint uint64
+	versions    map[uint64]avroSchema
+}
+
+func newAvroSerializer() (Serializer, error) {
+	versions, err := schemaVersions()
+	if err != nil {
+		return nil, err
+	}
+	s := avroSerializer{versions: make(map[uint64]avroSchema)}
+	for _, version := range versions {
+		schema, err := loadAvroSchema(version)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint := avroFingerprint(schema.canonicalForm())
+		s.versions[fingerprint] = schema
+		//versions are in ascending order so the latest is used to write
+		s.writer, s.fingerprint = schema, fingerprint
+	}
+	return s, nil
+}
+
+func (s avroSerializer) Format() string {
+	return "avro"
+}
+
+func (s avroSerializer) Serialize(msg persistence.Message) ([]byte, error) {
+	buf := append([]byte{}, avroMagic...)
+	buf = binary.LittleEndian.AppendUint64(buf, s.fingerprint)
+	for _, field := range s.writer.Fields {
+		value, ok := messageFieldValue(msg, field.Name)
+		if !ok {
+			return nil, fmt.Errorf("message has no field %s", field.Name)
+		}
+		var err error
+		if buf, err = appendAvroValue(buf, field.Type, value); err != nil {
+			return nil, fmt.Errorf("could not encode field %s: %v", field.Name, err)
+		}
+	}
+	return buf, nil
+}
+
+//Deserialize decodes a message using the schema version it was written with, ignoring
+//fields the message model does not have and defaulting fields the writer did not have
+func (s avroSerializer) Deserialize(data []byte) (persistence.Message, error) {
+	var msg persistence.Message
+	if len(data) < 10 || !bytes.Equal(data[:2], avroMagic) {
+		return msg, fmt.Errorf("not an avro single object encoded message")
+	}
+	writer, ok := s.versions[binary.LittleEndian.Uint64(data[2:10])]
+	if !ok {
+		return msg, fmt.Errorf("message was written with an unknown schema")
+	}
+
+	r := bytes.NewReader(data[10:])
+	written := make(map[string]bool)
+	for _, field := range writer.Fields {
+		value, err := readAvroValue(r, field.Type)
+		if err != nil {
+			return msg, fmt.Errorf("could not decode field %s: %v", field.Name, err)
+		}
+		setMessageField(&msg, field.Name, value)
+		written[field.Name] = true
+	}
+	for _, field := range s.writer.Fields {
+		if !written[field.Name] && field.Default != nil {
+			var value interface{}
+			if err := json.Unmarshal(field.Default, &value); err != nil {
+				return msg, fmt.Errorf("invalid default for field %s: %v", field.Name, err)
+			}
+			setMessageField(&msg, field.Name, value)
+		}
+	}
+	return msg, nil
+}
+
+//messageFieldValue returns the value of the message field with the provided avro field name
+func messageFieldValue(msg persistence.Message, name string) (interface{}, bool) {
+	switch name {
+	case "type":
+		return msg.Type, true
+	case "userID":
+		return msg.UserID, true
+	case "nickname":
+		return msg.Nickname, true
+	case "userIDs":
+		return msg.UserIDs, true
+	case "tenantID":
+		return msg.TenantID, true
+	default:
+		return nil, false
+	}
+}
+
+//setMessageField sets the message field with the provided avro field name, ignoring unknown fields
+func setMessageField(msg *persistence.Message, name string, value interface{}) {
+	s, _ := value.(string)
+	switch name {
+	case "type":
+		msg.Type = s
+	case "userID":
+		msg.UserID = s
+	case "nickname":
+		msg.Nickname = s
+	case "userIDs":
+		msg.UserIDs = stringSlice(value)
+	case "tenantID":
+		msg.TenantID = s
+	}
+}
+
+//stringSlice converts a decoded array, or its json default, to strings. Empty arrays are nil as they are in messages
+func stringSlice(value interface{}) []string {
+	var values []string
+	switch v := value.(type) {
+	case []string:
+		values = v
+	case []interface{}:
+		for _, item := range v {
+			s, _ := item.(string)
+			values = append(values, s)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+//avroArrayItems returns the item type of an array field type, or false if the type is not an array
+func avroArrayItems(fieldType json.RawMessage) (json.RawMessage, bool) {
+	var complexType struct {
+		Type  string          `json:"type"`
+		Items json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(fieldType, &complexType); err != nil || complexType.Type != "array" {
+		return nil, false
+	}
+	return complexType.Items, true
+}
+
+func appendAvroValue(buf []byte, fieldType json.RawMessage, value interface{}) ([]byte, error) {
+	if items, ok := avroArrayItems(fieldType); ok {
+		values, ok := value.([]string)
+		if !ok {
+			return buf, fmt.Errorf("expected a list of strings")
+		}
+		//arrays are written as a single block followed by an empty block
+		if len(values) > 0 {
+			buf = binary.AppendVarint(buf, int64(len(values)))
+			for _, item := range values {
+				var err error
+				if buf, err = appendAvroValue(buf, items, item); err != nil {
+					return buf, err
+				}
+			}
+		}
+		return binary.AppendVarint(buf, 0), nil
+	}
+
+	var primitive string
+	if err := json.Unmarshal(fieldType, &primitive); err != nil || primitive != "string" {
+		return buf, fmt.Errorf("unsupported type %s", fieldType)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return buf, fmt.Errorf("expected a string")
+	}
+	buf = binary.AppendVarint(buf, int64(len(s)))
+	return append(buf, s...), nil
+}
+
+func readAvroValue(r *bytes.Reader, fieldType json.RawMessage) (interface{}, error) {
+	if items, ok := avroArrayItems(fieldType); ok {
+		var values []string
+		for {
+			count, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return values, nil
+			}
+			if count < 0 {
+				//a negative count is followed by the size of the block in bytes, which is not needed to read it
+				count = -count
+				if _, err := binary.ReadVarint(r); err != nil {
+					return nil, err
+				}
+			}
+			if count > int64(r.Len()) {
+				return nil, fmt.Errorf("invalid array block count %d", count)
+			}
+			for i := int64(0); i < count; i++ {
+				item, err := readAvroValue(r, items)
+				if err != nil {
+					return nil, err
+				}
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a string")
+				}
+				values = append(values, s)
+			}
+		}
+	}
+
+	var primitive string
+	if err := json.Unmarshal(fieldType, &primitive); err != nil || primitive != "string" {
+		return nil, fmt.Errorf("unsupported type %s", fieldType)
+	}
+	length, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > int64(r.Len()) {
+		return nil, fmt.Errorf("invalid string length %d", length)
+	}
+	value := make([]byte, length)
+	_, err = io.ReadFull(r, value)
+	return string(value), err
+}
+
+//fullName returns the namespace qualified name of the record
+func (s avroSchema) fullName() string {
+	if s.Namespace != "" && !strings.Contains(s.Name, ".") {
+		return s.Namespace + "." + s.Name
+	}
+	return s.Name
+}
+
+//canonicalForm returns the avro parsing canonical form of the schema, which is what its fingerprint is taken from
+func (s avroSchema) canonicalForm() string {
+	fields := make([]string, len(s.Fields))
+	for i, field := range s.Fields {
+		fields[i] = fmt.Sprintf(`{"name":%s,"type":%s}`, strconv.Quote(field.Name), canonicalType(field.Type))
+	}
+	return fmt.Sprintf(`{"name":%s,"type":"record","fields":[%s]}`, strconv.Quote(s.fullName()), strings.Join(fields, ","))
+}
+
+//canonicalType returns the canonical form of a primitive or array field type
+func canonicalType(fieldType json.RawMessage) string {
+	var primitive string
+	if err := json.Unmarshal(fieldType, &primitive); err == nil {
+		return strconv.Quote(primitive)
+	}
+	var complexType struct {
+		Type  string          `json:"type"`
+		Items json.RawMessage `json:"items"`
+	}
+	json.Unmarshal(fieldType, &complexType)
+	if complexType.Type == "array" {
+		return fmt.Sprintf(`{"type":"array","items":%s}`, canonicalType(complexType.Items))
+	}
+	return strconv.Quote(complexType.Type)
+}
+
+//avroEmptyFingerprint seeds the CRC-64-AVRO fingerprint
+const avroEmptyFingerprint uint64 = 0xc15d213aa4d7a795
+
+var avroFingerprintTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (avroEmptyFingerprint & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	return table
+}()
+
+//avroFingerprint returns the CRC-64-AVRO fingerprint of a schema's canonical form
+func avroFingerprint(canonicalForm string) uint64 {
+	fp := avroEmptyFingerprint
+	for _, b := range []byte(canonicalForm) {
+		fp = (fp >> 8) ^ avroFingerprintTable[byte(fp)^b]
+	}
+	return fp
+}
+
+func loadAvroSchema(version string) (avroSchema, error) {
+	var schema avroSchema
+	data, err := schemas.ReadFile(path.Join("schemas", version, "user_event.avsc"))
+	if err != nil {
+		return schema, err
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return schema, fmt.Errorf("could not parse %s avro schema: %v", version, err)
+	}
+	return schema, nil
+}
@@ -1,24 +1,123 @@
 package notification
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 //QueueClient is a simple queue client
 type QueueClient struct {
 	queueURL string
+	serializer Serializer
+	retryPolicy RetryPolicy
+	deadLetters *DeadLetterStore
+	send func(string, []byte) error
+	sleep func(time.Duration)
 }
 
-//NewQueueClient returns simple queue client
-func NewQueueClient(queueURL string) QueueClient {
-	return QueueClient{queueURL}
+//NewQueueClient returns simple queue client which encodes messages with the provided serializer,
+//retries failed messages according to the provided policy and then moves them to the dead letter store,
+//if one is provided
+func NewQueueClient(queueURL string, serializer Serializer, retryPolicy RetryPolicy, deadLetters *DeadLetterStore) QueueClient {
+	if retryPolicy.MaxAttempts < 1 {
+		retryPolicy.MaxAttempts = 1
+	}
+	return QueueClient{
+		queueURL: queueURL,
+		serializer: serializer,
+		retryPolicy: retryPolicy,
+		deadLetters: deadLetters,
+		send: sendToQueue,
+		sleep: time.Sleep,
+	}
 }
 
-//AddMessageToQueue would add the provided message to the configured queue.
-//As this is a test application however it simply prints the message to the terminal
-func(qc *QueueClient) AddMessageToQueue(msg persistence.Message) {
-	fmt.Printf("adding message to queue: %v\n", msg)
+//AddMessageToQueue sends the provided message to the configured queue, retrying with back-off.
+//If every attempt fails the message is moved to the dead letter store and an error is returned
+func(qc *QueueClient) AddMessageToQueue(msg persistence.Message) error {
+	attempts, err := qc.deliver(msg)
+	if err == nil {
+		return nil
+	}
+	if qc.deadLetters == nil {
+		return fmt.Errorf("could not deliver %s message after %d attempts: %v", msg.Type, attempts, err)
+	}
+
+	dlqErr := qc.deadLetters.Add(DeadLetter{
+		Message: msg,
+		Error: err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	})
+	if dlqErr != nil {
+		log.WithError(dlqErr).WithField("UserID", msg.UserID).Errorf("could not add %s message to dead letter store", msg.Type)
+		return fmt.Errorf("could not deliver %s message after %d attempts: %v, and could not dead letter it: %v", msg.Type, attempts, err, dlqErr)
+	}
+	return fmt.Errorf("could not deliver %s message after %d attempts, moved to dead letter store: %v", msg.Type, attempts, err)
+}
+
+//ReplayDeadLetters attempts to redeliver every dead letter, removing those which are delivered.
+//Messages which still cannot be delivered stay in the store with their attempt count updated
+func(qc *QueueClient) ReplayDeadLetters() (replayed int, failed int, err error) {
+	if qc.deadLetters == nil {
+		return 0, 0, fmt.Errorf("no dead letter store configured")
+	}
+	deadLetters, err := qc.deadLetters.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dl := range deadLetters {
+		attempts, sendErr := qc.deliver(dl.Message)
+		if sendErr != nil {
+			failed++
+			dl.Attempts += attempts
+			dl.Error = sendErr.Error()
+			dl.FailedAt = time.Now().UTC()
+			if err := qc.deadLetters.Add(dl); err != nil {
+				return replayed, failed, err
+			}
+			continue
+		}
+		if err := qc.deadLetters.Remove(dl.ID); err != nil {
+			return replayed, failed, err
+		}
+		replayed++
+	}
+	return replayed, failed, nil
+}
+
+//deliver sends the message, retrying as configured, and returns how many attempts were made
+func(qc *QueueClient) deliver(msg persistence.Message) (int, error) {
+	payload, err := qc.serializer.Serialize(msg)
+	if err != nil {
+		//retrying cannot help a message which cannot be encoded
+		return 0, fmt.Errorf("could not serialize message as %s: %v", qc.serializer.Format(), err)
+	}
+	for attempt := 1; attempt <= qc.retryPolicy.MaxAttempts; attempt++ {
+		if err = qc.send(qc.serializer.Format(), payload); err == nil {
+			return attempt, nil
+		}
+		log.WithError(err).WithField("UserID", msg.UserID).Warnf("attempt %d to send %s message failed", attempt, msg.Type)
+		if attempt < qc.retryPolicy.MaxAttempts {
+			qc.sleep(qc.retryPolicy.backoff(attempt))
+		}
+	}
+	return qc.retryPolicy.MaxAttempts, err
+}
+
+//sendToQueue would add the provided encoded message to the configured queue.
+//As this is a test application however it simply prints the message to the terminal,
+//base64 encoding binary formats
+func sendToQueue(format string, payload []byte) error {
+	body := string(payload)
+	if format != "json" {
+		body = base64.StdEncoding.EncodeToString(payload)
+	}
+	_, err := fmt.Printf("adding %s message to queue: %s\n", format, body)
+	return err
 }
 
 //QueueIsWritable is the healthcheck of the configured queue.
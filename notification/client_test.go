@@ -0,0 +1,102 @@
+package notification
+
+import (
+	"errors"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestQueueClient(t *testing.T, sendErrors ...error) (QueueClient, *DeadLetterStore, *[]persistence.Message, func()) {
+	dir, err := ioutil.TempDir("", "dead-letters")
+	assert.NoError(t, err, "test failed: could not create dead letter dir")
+	store, err := NewDeadLetterStore(dir)
+	assert.NoError(t, err, "test failed: could not create dead letter store")
+
+	var sent []persistence.Message
+	qc := NewQueueClient("/dev/null", jsonSerializer{}, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2}, store)
+	qc.sleep = func(time.Duration) {}
+	qc.send = func(_ string, payload []byte) error {
+		if len(sendErrors) > 0 {
+			err := sendErrors[0]
+			sendErrors = sendErrors[1:]
+			if err != nil {
+				return err
+			}
+		}
+		msg, err := qc.serializer.Deserialize(payload)
+		if err != nil {
+			return err
+		}
+		sent = append(sent, msg)
+		return nil
+	}
+	return qc, store, &sent, func() { os.RemoveAll(dir) }
+}
+
+func TestQueueClient_RetriesFailedMessages(t *testing.T) {
+	qc, store, sent, cleanUp := newTestQueueClient(t, errors.New("timeout"), errors.New("timeout"))
+	defer cleanUp()
+
+	msg := persistence.Message{Type: "USER_CREATED", UserID: "1"}
+	assert.NoError(t, qc.AddMessageToQueue(msg), "test failed: message should be delivered on third attempt")
+	assert.Equal(t, []persistence.Message{msg}, *sent)
+
+	deadLetters, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestQueueClient_DeadLettersUndeliverableMessages(t *testing.T) {
+	qc, store, sent, cleanUp := newTestQueueClient(t, errors.New("timeout"), errors.New("timeout"), errors.New("queue unavailable"))
+	defer cleanUp()
+
+	msg := persistence.Message{Type: "NICKNAME_CHANGED", UserID: "1", Nickname: "Smithy"}
+	assert.Error(t, qc.AddMessageToQueue(msg), "test failed: exhausting retries should return an error")
+	assert.Empty(t, *sent)
+
+	deadLetters, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, msg, deadLetters[0].Message)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Equal(t, "queue unavailable", deadLetters[0].Error)
+
+	//replay succeeds now the queue has recovered
+	replayed, failed, err := qc.ReplayDeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, []persistence.Message{msg}, *sent)
+
+	deadLetters, err = store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters, "test failed: replayed messages should be removed from the store")
+}
+
+func TestDeadLetterStore_Purge(t *testing.T) {
+	_, store, _, cleanUp := newTestQueueClient(t)
+	defer cleanUp()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, store.Add(DeadLetter{Message: persistence.Message{Type: "USER_CREATED"}, FailedAt: time.Now()}))
+	}
+	purged, err := store.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, purged)
+
+	deadLetters, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delay := policy.backoff(attempt + 1)
+		assert.True(t, delay >= max/2 && delay <= max, "test failed: back-off %s for attempt %d should be between %s and %s", delay, attempt+1, max/2, max)
+	}
+}
@@ -0,0 +1,114 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//DeadLetter is a message which could not be delivered to the queue
+type DeadLetter struct {
+	ID       string              `json:"id"`
+	Message  persistence.Message `json:"message"`
+	Error    string              `json:"error"`
+	Attempts int                 `json:"attempts"`
+	FailedAt time.Time           `json:"failedAt"`
+}
+
+//DeadLetterStore keeps undeliverable messages in a local directory, one file per message,
+//so that the running service and the dlq command can safely use it at the same time
+type DeadLetterStore struct {
+	dir string
+}
+
+//NewDeadLetterStore returns a dead letter store backed by the provided directory, creating it if needed
+func NewDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+//Add stores a dead letter, assigning it an ID if it does not have one
+func (s *DeadLetterStore) Add(dl DeadLetter) error {
+	if dl.ID == "" {
+		//IDs sort in the order the messages failed
+		dl.ID = fmt.Sprintf("%d-%s", dl.FailedAt.UnixNano(), uuid.New().String())
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	//write to a temporary file first so readers never see a partial dead letter
+	tmp := filepath.Join(s.dir, "."+dl.ID+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(dl.ID))
+}
+
+//List returns all dead letters, oldest first
+func (s *DeadLetterStore) List() ([]DeadLetter, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") && !strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var deadLetters []DeadLetter
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			//removed by a concurrent replay or purge
+			continue
+		} else if err != nil {
+			return deadLetters, err
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return deadLetters, fmt.Errorf("could not decode dead letter %s: %v", name, err)
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	return deadLetters, nil
+}
+
+//Remove deletes the dead letter with the provided ID
+func (s *DeadLetterStore) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Purge deletes all dead letters, returning how many were removed
+func (s *DeadLetterStore) Purge() (int, error) {
+	deadLetters, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	for i, dl := range deadLetters {
+		if err := s.Remove(dl.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(deadLetters), nil
+}
+
+func (s *DeadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
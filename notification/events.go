@@ -0,0 +1,87 @@
+package notification
+
+import (
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"sync"
+)
+
+//subscriberBuffer is how many events a subscriber may fall behind by before it is dropped
+const subscriberBuffer = 64
+
+//Event is a message published to the event stream along with its sequence ID
+type Event struct {
+	ID      uint64
+	Message persistence.Message
+}
+
+//EventStream fans published messages out to live subscribers and keeps
+//a bounded buffer of recent events so that subscribers can resume
+type EventStream struct {
+	mu          sync.Mutex
+	lastID      uint64
+	buffer      []Event
+	size        int
+	subscribers map[chan Event]struct{}
+}
+
+//NewEventStream returns an event stream replaying at most bufferSize events
+func NewEventStream(bufferSize int) *EventStream {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &EventStream{
+		size:        bufferSize,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+//Publish assigns the message the next sequence ID, adds it to the replay buffer and
+//sends it to every subscriber. Subscribers that have fallen too far behind are dropped
+//and are expected to reconnect using the ID of the last event they received
+func (es *EventStream) Publish(msg persistence.Message) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	es.lastID++
+	event := Event{ID: es.lastID, Message: msg}
+	if len(es.buffer) == es.size {
+		es.buffer = append(es.buffer[:0], es.buffer[1:]...)
+	}
+	es.buffer = append(es.buffer, event)
+
+	for sub := range es.subscribers {
+		select {
+		case sub <- event:
+		default:
+			delete(es.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+//Subscribe returns the buffered events published after lastEventID, a channel of events
+//published from now on and a function which must be called to unsubscribe.
+//The channel is closed if the subscriber is dropped for falling behind
+func (es *EventStream) Subscribe(lastEventID uint64) ([]Event, <-chan Event, func()) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	var replay []Event
+	for _, event := range es.buffer {
+		if event.ID > lastEventID {
+			replay = append(replay, event)
+		}
+	}
+
+	sub := make(chan Event, subscriberBuffer)
+	es.subscribers[sub] = struct{}{}
+	cancel := func() {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		if _, ok := es.subscribers[sub]; ok {
+			delete(es.subscribers, sub)
+			close(sub)
+		}
+	}
+	return replay, sub, cancel
+}
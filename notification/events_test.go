@@ -0,0 +1,53 @@
+package notification
+
+import (
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEventStream_ReplaysBufferedEventsAfterLastID(t *testing.T) {
+	es := NewEventStream(2)
+	es.Publish(persistence.Message{Type: "USER_CREATED", UserID: "1"})
+	es.Publish(persistence.Message{Type: "USER_CREATED", UserID: "2"})
+	es.Publish(persistence.Message{Type: "USER_CREATED", UserID: "3"})
+
+	replay, _, cancel := es.Subscribe(0)
+	defer cancel()
+	assert.Equal(t, []Event{
+		{ID: 2, Message: persistence.Message{Type: "USER_CREATED", UserID: "2"}},
+		{ID: 3, Message: persistence.Message{Type: "USER_CREATED", UserID: "3"}},
+	}, replay, "test failed: buffer should only hold the most recent events")
+
+	replay, _, cancel2 := es.Subscribe(2)
+	defer cancel2()
+	assert.Equal(t, []Event{{ID: 3, Message: persistence.Message{Type: "USER_CREATED", UserID: "3"}}}, replay)
+}
+
+func TestEventStream_DeliversLiveEvents(t *testing.T) {
+	es := NewEventStream(10)
+	replay, live, cancel := es.Subscribe(0)
+	assert.Empty(t, replay)
+
+	es.Publish(persistence.Message{Type: "NICKNAME_CHANGED", UserID: "1", Nickname: "Smithy"})
+	assert.Equal(t, Event{ID: 1, Message: persistence.Message{Type: "NICKNAME_CHANGED", UserID: "1", Nickname: "Smithy"}}, <-live)
+
+	cancel()
+	_, open := <-live
+	assert.False(t, open, "test failed: channel should be closed after unsubscribing")
+}
+
+func TestEventStream_DropsSlowSubscribers(t *testing.T) {
+	es := NewEventStream(10)
+	_, live, cancel := es.Subscribe(0)
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		es.Publish(persistence.Message{Type: "USER_CREATED"})
+	}
+	received := 0
+	for range live {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received, "test failed: slow subscriber should be disconnected once its buffer is full")
+}
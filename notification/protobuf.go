@@ -0,0 +1,109 @@
+package notification
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+)
+
+//field numbers from the latest schemas/<version>/user_event.proto
+const (
+	protoFieldType     = 1
+	protoFieldUserID   = 2
+	protoFieldNickname = 3
+	protoFieldUserIDs  = 4
+	protoFieldTenantID = 5
+)
+
+//protobuf wire types
+const (
+	wireVarint          = 0
+	wireFixed64         = 1
+	wireLengthDelimited = 2
+	wireFixed32         = 5
+)
+
+//protobufSerializer encodes messages in the protobuf wire format as described by schemas/<version>/user_event.proto
+type protobufSerializer struct{}
+
+func (protobufSerializer) Format() string {
+	return "protobuf"
+}
+
+func (protobufSerializer) Serialize(msg persistence.Message) ([]byte, error) {
+	var buf []byte
+	buf = appendProtoString(buf, protoFieldType, msg.Type)
+	buf = appendProtoString(buf, protoFieldUserID, msg.UserID)
+	buf = appendProtoString(buf, protoFieldNickname, msg.Nickname)
+	for _, userID := range msg.UserIDs {
+		//repeated strings are written as a field per value, including empty values
+		buf = binary.AppendUvarint(buf, uint64(protoFieldUserIDs<<3|wireLengthDelimited))
+		buf = binary.AppendUvarint(buf, uint64(len(userID)))
+		buf = append(buf, userID...)
+	}
+	buf = appendProtoString(buf, protoFieldTenantID, msg.TenantID)
+	return buf, nil
+}
+
+//Deserialize decodes a message, skipping fields it does not know about so that
+//messages written with newer versions of the schema can still be read
+func (protobufSerializer) Deserialize(data []byte) (persistence.Message, error) {
+	var msg persistence.Message
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return msg, fmt.Errorf("invalid protobuf field key")
+		}
+		data = data[n:]
+		field, wireType := key>>3, key&7
+
+		switch wireType {
+		case wireVarint:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return msg, fmt.Errorf("invalid varint for field %d", field)
+			}
+			data = data[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return msg, fmt.Errorf("truncated field %d", field)
+			}
+			data = data[size:]
+		case wireLengthDelimited:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return msg, fmt.Errorf("truncated field %d", field)
+			}
+			value := string(data[n : n+int(length)])
+			data = data[n+int(length):]
+			switch field {
+			case protoFieldType:
+				msg.Type = value
+			case protoFieldUserID:
+				msg.UserID = value
+			case protoFieldNickname:
+				msg.Nickname = value
+			case protoFieldUserIDs:
+				msg.UserIDs = append(msg.UserIDs, value)
+			case protoFieldTenantID:
+				msg.TenantID = value
+			}
+		default:
+			return msg, fmt.Errorf("unsupported wire type %d for field %d", wireType, field)
+		}
+	}
+	return msg, nil
+}
+
+//appendProtoString appends a string field, omitting it when empty as proto3 does
+func appendProtoString(buf []byte, field int, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireLengthDelimited))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
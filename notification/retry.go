@@ -0,0 +1,37 @@
+package notification
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+//RetryPolicy configures how many times publishing is attempted and how long to wait between attempts
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+//DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+	}
+}
+
+//backoff returns how long to wait after the given failed attempt (starting at 1).
+//The exponential delay is capped at MaxBackoff and jittered to between half and all of it
+//so that publishers failing at the same time do not retry in lockstep
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(rp.InitialBackoff) * math.Pow(rp.Multiplier, float64(attempt-1))
+	if delay > float64(rp.MaxBackoff) {
+		delay = float64(rp.MaxBackoff)
+	}
+	half := delay / 2
+	return time.Duration(half + rand.Float64()*half)
+}
@@ -0,0 +1,73 @@
+package notification
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//schemas holds every published version of the message schemas, one directory per version
+//go:embed schemas
+var schemas embed.FS
+
+//Serializer encodes messages for the queue and decodes them for consumers
+type Serializer interface {
+	Format() string
+	Serialize(persistence.Message) ([]byte, error)
+	Deserialize([]byte) (persistence.Message, error)
+}
+
+//NewSerializer returns the serializer for the provided format, one of json, protobuf or avro
+func NewSerializer(format string) (Serializer, error) {
+	switch format {
+	case "json":
+		return jsonSerializer{}, nil
+	case "protobuf":
+		return protobufSerializer{}, nil
+	case "avro":
+		return newAvroSerializer()
+	default:
+		return nil, fmt.Errorf("unsupported message format %s; valid formats are [json, protobuf, avro]", format)
+	}
+}
+
+//jsonSerializer encodes messages as described by schemas/<version>/user_event.schema.json
+type jsonSerializer struct{}
+
+func (jsonSerializer) Format() string {
+	return "json"
+}
+
+func (jsonSerializer) Serialize(msg persistence.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonSerializer) Deserialize(data []byte) (persistence.Message, error) {
+	var msg persistence.Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+//schemaVersions returns the directories of the published schema versions in ascending order
+func schemaVersions() ([]string, error) {
+	entries, err := schemas.ReadDir("schemas")
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "v") {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		vi, _ := strconv.Atoi(strings.TrimPrefix(versions[i], "v"))
+		vj, _ := strconv.Atoi(strings.TrimPrefix(versions[j], "v"))
+		return vi < vj
+	})
+	return versions, nil
+}
@@ -0,0 +1,209 @@
+package notification
+
+import (
+	"encoding/json"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//publishedMessages are the messages encoded in testdata/<version> with each version of the schemas.
+//When publishing a new schema version add its encoded messages to testdata so that they keep being read
+var publishedMessages = map[string]persistence.Message{
+	"v1": {Type: "NICKNAME_CHANGED", UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", Nickname: "KingSmithy"},
+	"v2": {Type: "USERS_CREATED", UserIDs: []string{"3f685356-02a0-3c55-8b8d-c8bac4b79426", "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}},
+	"v3": {Type: "USER_CREATED", UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", TenantID: "acme"},
+}
+
+var formatExtensions = map[string]string{
+	"json":     "json",
+	"protobuf": "pb",
+	"avro":     "avro",
+}
+
+func TestSerializers_RoundTrip(t *testing.T) {
+	messages := []persistence.Message{
+		{Type: "USER_CREATED", UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426"},
+		{Type: "NICKNAME_CHANGED", UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", Nickname: "Smithy ☃"},
+		{Type: "USERS_DELETED", UserIDs: []string{"3f685356-02a0-3c55-8b8d-c8bac4b79426", "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}},
+		{Type: "USER_PURGED", UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", TenantID: "acme"},
+	}
+	for format := range formatExtensions {
+		serializer, err := NewSerializer(format)
+		assert.NoError(t, err, "test failed: could not create %s serializer", format)
+		for _, msg := range messages {
+			data, err := serializer.Serialize(msg)
+			assert.NoError(t, err, "test failed: could not serialize %s", format)
+			decoded, err := serializer.Deserialize(data)
+			assert.NoError(t, err, "test failed: could not deserialize %s", format)
+			assert.Equal(t, msg, decoded, "test failed: %s round trip changed message", format)
+		}
+	}
+
+	_, err := NewSerializer("xml")
+	assert.Error(t, err, "test failed: unknown formats should be rejected")
+}
+
+//TestSerializers_ReadPublishedVersions fails if messages written with an earlier schema version
+//can no longer be read, i.e. a schema change is not backwards compatible for consumers
+func TestSerializers_ReadPublishedVersions(t *testing.T) {
+	versions, err := schemaVersions()
+	assert.NoError(t, err)
+	for _, version := range versions {
+		expected, ok := publishedMessages[version]
+		assert.True(t, ok, "test failed: no published message for schema %s, add one to testdata", version)
+		for format, ext := range formatExtensions {
+			serializer, err := NewSerializer(format)
+			assert.NoError(t, err)
+			data, err := ioutil.ReadFile(filepath.Join("testdata", version, "user_event."+ext))
+			assert.NoError(t, err, "test failed: no %s message published with schema %s", format, version)
+			msg, err := serializer.Deserialize(data)
+			assert.NoError(t, err, "test failed: could not read %s message published with schema %s", format, version)
+			assert.Equal(t, expected, msg, "test failed: %s message published with schema %s read incorrectly", format, version)
+		}
+	}
+}
+
+//TestSchemas_Compatible fails if a schema version changes an earlier version in a way that
+//breaks consumers still using it
+func TestSchemas_Compatible(t *testing.T) {
+	versions, err := schemaVersions()
+	assert.NoError(t, err)
+	for i := 1; i < len(versions); i++ {
+		previous, current := versions[i-1], versions[i]
+
+		oldProto, newProto := readProtoFields(t, previous), readProtoFields(t, current)
+		for number, field := range oldProto.fields {
+			if newField, ok := newProto.fields[number]; ok {
+				assert.Equal(t, field, newField, "test failed: %s changes protobuf field %d", current, number)
+			} else {
+				assert.True(t, newProto.reserved[number], "test failed: %s removes protobuf field %d without reserving it", current, number)
+			}
+		}
+
+		oldAvro, err := loadAvroSchema(previous)
+		assert.NoError(t, err)
+		newAvro, err := loadAvroSchema(current)
+		assert.NoError(t, err)
+		assert.Equal(t, oldAvro.fullName(), newAvro.fullName(), "test failed: %s renames the avro record", current)
+		oldFields, newFields := avroFieldsByName(oldAvro), avroFieldsByName(newAvro)
+		for name, field := range newFields {
+			if oldField, ok := oldFields[name]; ok {
+				assert.Equal(t, canonicalType(oldField.Type), canonicalType(field.Type), "test failed: %s changes type of avro field %s", current, name)
+			} else {
+				assert.NotNil(t, field.Default, "test failed: %s adds avro field %s without a default", current, name)
+			}
+		}
+		for name, field := range oldFields {
+			if _, ok := newFields[name]; !ok {
+				assert.NotNil(t, field.Default, "test failed: %s removes avro field %s which has no default", current, name)
+			}
+		}
+
+		oldJSON, newJSON := readJSONSchema(t, previous), readJSONSchema(t, current)
+		assert.Equal(t, oldJSON.Required, newJSON.Required, "test failed: %s changes required json fields", current)
+		for name, property := range oldJSON.Properties {
+			assert.Equal(t, property, newJSON.Properties[name], "test failed: %s changes or removes json field %s", current, name)
+		}
+	}
+}
+
+//TestSchemas_MatchSerializers fails if the serializers do not implement the latest schema version
+func TestSchemas_MatchSerializers(t *testing.T) {
+	versions, err := schemaVersions()
+	assert.NoError(t, err)
+	latest := versions[len(versions)-1]
+
+	proto := readProtoFields(t, latest)
+	assert.Equal(t, map[int]protoField{
+		protoFieldType:     {Type: "string", Name: "type"},
+		protoFieldUserID:   {Type: "string", Name: "user_id"},
+		protoFieldNickname: {Type: "string", Name: "nickname"},
+		protoFieldUserIDs:  {Type: "repeated string", Name: "user_ids"},
+		protoFieldTenantID: {Type: "string", Name: "tenant_id"},
+	}, proto.fields, "test failed: protobuf serializer does not match %s schema", latest)
+
+	avro, err := loadAvroSchema(latest)
+	assert.NoError(t, err)
+	for _, field := range avro.Fields {
+		_, ok := messageFieldValue(persistence.Message{}, field.Name)
+		assert.True(t, ok, "test failed: avro serializer cannot write %s field %s", latest, field.Name)
+	}
+
+	schema := readJSONSchema(t, latest)
+	var tags []string
+	messageType := reflect.TypeOf(persistence.Message{})
+	for i := 0; i < messageType.NumField(); i++ {
+		tags = append(tags, strings.Split(messageType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	var properties []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	sort.Strings(tags)
+	sort.Strings(properties)
+	assert.Equal(t, properties, tags, "test failed: json serializer does not match %s schema", latest)
+}
+
+type protoField struct {
+	Type string
+	Name string
+}
+
+type protoSchema struct {
+	fields   map[int]protoField
+	reserved map[int]bool
+}
+
+var (
+	protoFieldPattern    = regexp.MustCompile(`^\s*((?:repeated\s+)?\w+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+	protoReservedPattern = regexp.MustCompile(`^\s*reserved\s+([\d,\s]+);`)
+)
+
+func readProtoFields(t *testing.T, version string) protoSchema {
+	data, err := schemas.ReadFile(path.Join("schemas", version, "user_event.proto"))
+	assert.NoError(t, err, "test failed: no protobuf schema for %s", version)
+	schema := protoSchema{fields: make(map[int]protoField), reserved: make(map[int]bool)}
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := protoFieldPattern.FindStringSubmatch(line); match != nil {
+			number, _ := strconv.Atoi(match[3])
+			schema.fields[number] = protoField{Type: match[1], Name: match[2]}
+		} else if match := protoReservedPattern.FindStringSubmatch(line); match != nil {
+			for _, n := range strings.Split(match[1], ",") {
+				number, _ := strconv.Atoi(strings.TrimSpace(n))
+				schema.reserved[number] = true
+			}
+		}
+	}
+	return schema
+}
+
+type jsonSchema struct {
+	Properties map[string]json.RawMessage `json:"properties"`
+	Required   []string                   `json:"required"`
+}
+
+func readJSONSchema(t *testing.T, version string) jsonSchema {
+	var schema jsonSchema
+	data, err := schemas.ReadFile(path.Join("schemas", version, "user_event.schema.json"))
+	assert.NoError(t, err, "test failed: no json schema for %s", version)
+	assert.NoError(t, json.Unmarshal(data, &schema), "test failed: could not parse %s json schema", version)
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func avroFieldsByName(schema avroSchema) map[string]avroField {
+	fields := make(map[string]avroField)
+	for _, field := range schema.Fields {
+		fields[field.Name] = field
+	}
+	return fields
+}
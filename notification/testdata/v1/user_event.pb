@@ -0,0 +1,3 @@
+
+NICKNAME_CHANGED$3f685356-02a0-3c55-8b8d-c8bac4b79426
+KingSmithy
\ No newline at end of file
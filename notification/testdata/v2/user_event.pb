@@ -0,0 +1,2 @@
+
+USERS_CREATED"$3f685356-02a0-3c55-8b8d-c8bac4b79426"$e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d
\ No newline at end of file
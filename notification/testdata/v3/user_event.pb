@@ -0,0 +1,2 @@
+
+USER_CREATED$3f685356-02a0-3c55-8b8d-c8bac4b79426*acme
\ No newline at end of file
@@ -0,0 +1,115 @@
+package persistence
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+//APIKey is a key authenticating a service calling the API. Only a hash of the secret part of the key is stored
+type APIKey struct {
+	KeyID string `json:"keyID"`
+	//Name identifies the service the key was created for
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+	//TenantID is the only tenant the key may access. Admin keys without one may access any tenant, others the default
+	TenantID string `json:"tenantID,omitempty"`
+	//SecretHash is the hex encoded SHA-256 hash of the key's secret
+	SecretHash string `json:"-"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+var apiKeyColumns = []string{"key_id", "name", "scopes", "tenant_id", "secret_hash", "created_at", "last_used_at", "revoked_at"}
+
+//CreateAPIKey stores a new API key
+func (c *Client) CreateAPIKey(key APIKey) Status {
+	_, err := c.db.Exec(`INSERT INTO api_keys (key_id, name, scopes, tenant_id, secret_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP());`, key.KeyID, key.Name, strings.Join(key.Scopes, " "), key.TenantID, key.SecretHash)
+	if err != nil {
+		log.WithError(err).WithField("KeyID", key.KeyID).Error("could not create API key")
+		return BACKEND_ERROR
+	}
+	return CREATED
+}
+
+//RetrieveAPIKey returns the API key with the ID, including revoked keys
+func (c *Client) RetrieveAPIKey(keyID string) (APIKey, Status) {
+	keys, status := c.queryAPIKeys(fmt.Sprintf(`SELECT %s FROM api_keys WHERE key_id = ?;`, strings.Join(apiKeyColumns, ", ")), keyID)
+	if status != OK {
+		return APIKey{}, status
+	}
+	return keys[0], OK
+}
+
+//RetrieveAPIKeys returns every API key, including revoked keys, oldest first
+func (c *Client) RetrieveAPIKeys() ([]APIKey, Status) {
+	return c.queryAPIKeys(fmt.Sprintf(`SELECT %s FROM api_keys ORDER BY created_at ASC, key_id ASC;`, strings.Join(apiKeyColumns, ", ")))
+}
+
+func (c *Client) queryAPIKeys(query string, args ...interface{}) ([]APIKey, Status) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		log.WithError(err).Error("could not retrieve API keys")
+		return nil, BACKEND_ERROR
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var createdAt time.Time
+		var lastUsedAt, revokedAt mysql.NullTime
+		if err := rows.Scan(&key.KeyID, &key.Name, &scopes, &key.TenantID, &key.SecretHash, &createdAt, &lastUsedAt, &revokedAt); err != nil {
+			log.WithError(err).Error("could not read API key")
+			return nil, BACKEND_ERROR
+		}
+		key.Scopes = strings.Fields(scopes)
+		key.CreatedAt = &createdAt
+		key.LastUsedAt = validateTime(lastUsedAt)
+		key.RevokedAt = validateTime(revokedAt)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Error("could not read API keys")
+		return nil, BACKEND_ERROR
+	}
+	if len(keys) == 0 {
+		return nil, NOT_FOUND
+	}
+	return keys, OK
+}
+
+//RecordAPIKeyUse sets when the API key was last used, unless it has already been recorded as used since usedSince so
+//that keys used for every request are not updated for every request
+func (c *Client) RecordAPIKeyUse(keyID string, usedAt time.Time, usedSince time.Time) Status {
+	_, err := c.db.Exec(`UPDATE api_keys SET last_used_at = ?
+		WHERE key_id = ? AND (last_used_at IS NULL OR last_used_at < ?);`, usedAt.UTC(), keyID, usedSince.UTC())
+	if err != nil {
+		log.WithError(err).WithField("KeyID", keyID).Error("could not record API key use")
+		return BACKEND_ERROR
+	}
+	return UPDATED
+}
+
+//RevokeAPIKey stops the API key authenticating callers, returning NOT_FOUND if there is no unrevoked key with the ID
+func (c *Client) RevokeAPIKey(keyID string) Status {
+	results, err := c.db.Exec(`UPDATE api_keys SET revoked_at = UTC_TIMESTAMP() WHERE key_id = ? AND revoked_at IS NULL;`, keyID)
+	if err != nil {
+		log.WithError(err).WithField("KeyID", keyID).Error("could not revoke API key")
+		return BACKEND_ERROR
+	}
+	rows, err := results.RowsAffected()
+	if err != nil {
+		log.WithError(err).Error("error processing request")
+		return BACKEND_ERROR
+	}
+	if rows == 0 {
+		return NOT_FOUND
+	}
+	return DELETED
+}
@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+//redacted replaces the values of secret fields in the audit trail
+const redacted = "[REDACTED]"
+
+//purgeCaller is recorded as the caller of purges, which are run by the service itself
+var purgeCaller = Caller{Actor: "system"}
+
+//secretFields are the fields whose values are never written to the audit trail
+var secretFields = map[string]bool{
+	"password": true,
+}
+
+//diffRecords returns the changes between two versions of a user, keyed by their json field names
+func diffRecords(before, after UserRecord) []FieldChange {
+	fields := []struct {
+		name string
+		from string
+		to string
+	}{
+		{"userID", before.UserID, after.UserID},
+		{"firstName", before.FirstName, after.FirstName},
+		{"lastName", before.LastName, after.LastName},
+		{"emailAddress", before.EmailAddress, after.EmailAddress},
+		{"password", before.Password, after.Password},
+		{"nickname", before.NickName, after.NickName},
+		{"country", before.Country, after.Country},
+	}
+	var changes []FieldChange
+	for _, field := range fields {
+		if field.from == field.to {
+			continue
+		}
+		change := FieldChange{Field: field.name, From: field.from, To: field.to}
+		if secretFields[field.name] {
+			change.From, change.To = redactValue(field.from), redactValue(field.to)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+//redactValue hides a secret value while still recording whether it was set
+func redactValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+//changedFields returns the names of the changed fields
+func changedFields(changes []FieldChange) []string {
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+	return fields
+}
+
+//insertAuditEntry appends a change to the user's history as part of the transaction making the change
+func insertAuditEntry(tx *sql.Tx, caller Caller, userID, action string, changes []FieldChange) error {
+	return insertAuditEntries(tx, caller, action, []auditChange{{userID: userID, changes: changes}})
+}
+
+//auditChange is the change made to one of the users changed by a statement
+type auditChange struct {
+	userID string
+	changes []FieldChange
+}
+
+//insertAuditEntries appends the same action made to several users of the caller's tenant to their histories with a
+//single statement
+func insertAuditEntries(tx *sql.Tx, caller Caller, action string, entries []auditChange) error {
+	if caller.TenantID == "" {
+		return errNoTenant
+	}
+	rows := make([]string, len(entries))
+	args := make([]interface{}, 0, 7*len(entries))
+	for i, entry := range entries {
+		changes := entry.changes
+		if changes == nil {
+			changes = []FieldChange{}
+		}
+		encoded, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		rows[i] = "(?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())"
+		args = append(args, caller.TenantID, entry.userID, action, caller.Actor, caller.RequestID, caller.SourceIP, string(encoded))
+	}
+	_, err := tx.Exec(`INSERT INTO user_audit (tenant_id, user_id, action, actor, request_id, source_ip, changes, created_at)
+		VALUES `+strings.Join(rows, ", ")+`;`, args...)
+	return err
+}
+
+//RetrieveAuditEntries will find the history of the provided user of the tenant, most recent first, returning a page of
+//at most limit entries after skipping offset entries along with the total number of entries
+func (c *Client) RetrieveAuditEntries(tenantID, userID string, limit, offset int) ([]AuditEntry, int, Status) {
+	if tenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", userID).Error("could not retrieve user history")
+		return nil, 0, BACKEND_ERROR
+	}
+	var total int
+	if err := c.db.QueryRow(`SELECT COUNT(*) FROM user_audit WHERE tenant_id = ? AND user_id = ?;`, tenantID, userID).Scan(&total); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not count user history")
+		return nil, 0, BACKEND_ERROR
+	}
+	if total == 0 {
+		log.WithField("UserID", userID).Info("no history found for user")
+		return nil, 0, NOT_FOUND
+	}
+
+	rows, err := c.db.Query(`SELECT user_id, action, actor, request_id, source_ip, changes, created_at
+						  FROM user_audit
+						  WHERE tenant_id = ? AND user_id = ?
+						  ORDER BY audit_id DESC
+						  LIMIT ? OFFSET ?;`, tenantID, userID, limit, offset)
+	if err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not retrieve user history")
+		return nil, 0, BACKEND_ERROR
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var changes string
+		var createdAt time.Time
+		if err := rows.Scan(&entry.UserID, &entry.Action, &entry.Actor, &entry.RequestID, &entry.SourceIP, &changes, &createdAt); err != nil {
+			log.WithError(err).WithField("UserID", userID).Error("could not read user history")
+			return nil, 0, BACKEND_ERROR
+		}
+		if err := json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+			log.WithError(err).WithField("UserID", userID).Error("could not decode user history changes")
+			return nil, 0, BACKEND_ERROR
+		}
+		entry.Timestamp = createdAt.UTC()
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not read user history")
+		return nil, 0, BACKEND_ERROR
+	}
+	return entries, total, OK
+}
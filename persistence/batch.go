@@ -0,0 +1,364 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+//RecordUpdate is an edit of certain fields of a user made by UpdateRecords
+type RecordUpdate struct {
+	UserID string
+	//Fields maps the columns being updated to their new values
+	Fields map[string]string
+	//ExpectedVersion is the version the user must be at to be updated, 0 for any version
+	ExpectedVersion int
+}
+
+//RecordVersion identifies a user changed by a batch along with the version they must be at, 0 for any version
+type RecordVersion struct {
+	UserID string
+	ExpectedVersion int
+}
+
+//CreateRecords will add the provided users to the DB with multi-row statements, returning the status of each user
+//in the order provided. Users whose ID or email already exists, including earlier in the batch, are ALREADY_EXISTS.
+//In atomic mode no users are added if any cannot be, and the users which could have been are ABORTED
+func (c *Client) CreateRecords(caller Caller, records []UserRecord, atomic bool) []Status {
+	return c.runBatch("create", caller.TenantID, len(records), atomic, CREATED, func(tx *sql.Tx) ([]Status, error) {
+		args := make([]interface{}, 0, 2*len(records)+1)
+		args = append(args, caller.TenantID)
+		for _, record := range records {
+			args = append(args, record.UserID)
+		}
+		for _, record := range records {
+			args = append(args, record.EmailAddress)
+		}
+		//deleted users keep their ID and email until they are purged
+		rows, err := tx.Query(fmt.Sprintf(`SELECT user_id, email FROM Users WHERE tenant_id = ? AND (user_id IN (%[1]s) OR email IN (%[1]s)) FOR UPDATE;`,
+			placeholders(len(records))), args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		taken := make(map[string]bool)
+		for rows.Next() {
+			var userID, email string
+			if err := rows.Scan(&userID, &email); err != nil {
+				return nil, err
+			}
+			//emails are unique ignoring case, as the collation of the column is case insensitive
+			taken["id:"+userID], taken["email:"+strings.ToLower(email)] = true, true
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		statuses := make([]Status, len(records))
+		for i, record := range records {
+			email := "email:" + strings.ToLower(record.EmailAddress)
+			if taken["id:"+record.UserID] || taken[email] {
+				log.WithField("UserID", record.UserID).Errorf("user with this email: %s already exists!", record.EmailAddress)
+				statuses[i] = ALREADY_EXISTS
+				continue
+			}
+			taken["id:"+record.UserID], taken[email] = true, true
+			statuses[i] = OK
+		}
+		return statuses, nil
+	}, func(tx *sql.Tx, valid []int) (map[int]Status, error) {
+		err := inSavepoint(tx, func() error {
+			return insertRecords(tx, caller, records, valid)
+		})
+		if err == nil || atomic {
+			return nil, err
+		}
+		//in partial mode a user the check did not catch only fails themselves, so the users are added one at a time
+		log.WithError(err).Info("could not add batch of users with one statement, adding them one at a time")
+		failed := make(map[int]Status)
+		for _, i := range valid {
+			err := inSavepoint(tx, func() error {
+				return insertRecords(tx, caller, records, []int{i})
+			})
+			if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+				log.WithError(err).WithField("UserID", records[i].UserID).Errorf("user with this email: %s already exists!", records[i].EmailAddress)
+				failed[i] = ALREADY_EXISTS
+			} else if err != nil {
+				log.WithError(err).WithField("UserID", records[i].UserID).Error("could not add user to db")
+				failed[i] = BACKEND_ERROR
+			}
+		}
+		return failed, nil
+	})
+}
+
+//insertRecords adds the users with the provided indexes with a multi-row statement, auditing their creation
+func insertRecords(tx *sql.Tx, caller Caller, records []UserRecord, indexes []int) error {
+	rows := make([]string, len(indexes))
+	args := make([]interface{}, 0, 9*len(indexes))
+	entries := make([]auditChange, len(indexes))
+	for n, i := range indexes {
+		record := records[i]
+		rows[n] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())"
+		args = append(args, caller.TenantID, record.UserID, record.FirstName, record.LastName, record.EmailAddress, record.Password, record.NickName, record.Country, Soundex(record.LastName))
+		entries[n] = auditChange{userID: record.UserID, changes: diffRecords(UserRecord{}, record)}
+	}
+	if _, err := tx.Exec(`INSERT INTO Users (tenant_id, user_id, first_name, last_name, email, password, nickname, country, last_name_soundex, created_at, updated_at)
+		VALUES `+strings.Join(rows, ", ")+`;`, args...); err != nil {
+		return err
+	}
+	return insertAuditEntries(tx, caller, "create", entries)
+}
+
+//inSavepoint runs changes which are rolled back, leaving the rest of the transaction intact, if they fail
+func inSavepoint(tx *sql.Tx, changes func() error) error {
+	if _, err := tx.Exec("SAVEPOINT batch_changes;"); err != nil {
+		return err
+	}
+	if err := changes(); err != nil {
+		if _, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT batch_changes;"); rollbackErr != nil {
+			log.WithError(rollbackErr).Error("could not roll back to savepoint")
+		}
+		return err
+	}
+	return nil
+}
+
+//UpdateRecords will edit certain fields of the provided users in the DB with a single statement, incrementing their
+//versions and returning the status of each update in the order provided. Users which do not exist are NOT_FOUND and
+//users not at their expected version are VERSION_MISMATCH. In atomic mode no users are updated if any cannot be,
+//and the users which could have been are ABORTED
+func (c *Client) UpdateRecords(caller Caller, updates []RecordUpdate, atomic bool) []Status {
+	current := make(map[string]UserRecord)
+	return c.runBatch("update", caller.TenantID, len(updates), atomic, UPDATED, func(tx *sql.Tx) ([]Status, error) {
+		userIDs := make([]string, len(updates))
+		for i, update := range updates {
+			userIDs[i] = update.UserID
+		}
+		records, err := selectRecordsForUpdate(tx, caller.TenantID, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			current[record.UserID] = record
+		}
+
+		statuses := make([]Status, len(updates))
+		seen := make(map[string]bool)
+		for i, update := range updates {
+			statuses[i] = checkVersion(current, seen, update.UserID, update.ExpectedVersion)
+			for column := range update.Fields {
+				if !updatableColumns[column] {
+					log.WithField("UserID", update.UserID).Errorf("could not update user as column %s cannot be updated", column)
+					statuses[i] = BACKEND_ERROR
+				}
+			}
+		}
+		return statuses, nil
+	}, func(tx *sql.Tx, valid []int) (map[int]Status, error) {
+		//each column is set with a CASE choosing the new value of every user updating it
+		cases := make(map[string][]string)
+		caseArgs := make(map[string][]interface{})
+		userIDs := make([]interface{}, len(valid))
+		entries := make([]auditChange, len(valid))
+		for n, i := range valid {
+			update := updates[i]
+			updated := current[update.UserID]
+			for column, value := range update.Fields {
+				cases[column] = append(cases[column], "WHEN ? THEN ?")
+				caseArgs[column] = append(caseArgs[column], update.UserID, value)
+				setColumn(&updated, column, value)
+				if soundexColumn, ok := soundexColumns[column]; ok {
+					cases[soundexColumn] = append(cases[soundexColumn], "WHEN ? THEN ?")
+					caseArgs[soundexColumn] = append(caseArgs[soundexColumn], update.UserID, Soundex(value))
+				}
+			}
+			userIDs[n] = update.UserID
+			entries[n] = auditChange{userID: update.UserID, changes: diffRecords(current[update.UserID], updated)}
+		}
+		columns := make([]string, 0, len(cases))
+		for column := range cases {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		assignments := make([]string, len(columns))
+		args := make([]interface{}, 0, len(userIDs)+1)
+		for i, column := range columns {
+			assignments[i] = fmt.Sprintf("%[1]s = CASE user_id %[2]s ELSE %[1]s END", column, strings.Join(cases[column], " "))
+			args = append(args, caseArgs[column]...)
+		}
+		args = append(args, caller.TenantID)
+		args = append(args, userIDs...)
+		updateTemplate := fmt.Sprintf(`UPDATE Users
+						SET %s, version = version + 1, updated_at = UTC_TIMESTAMP()
+						WHERE tenant_id = ? AND user_id IN (%s);`, strings.Join(assignments, ", "), placeholders(len(userIDs)))
+		log.Debugf("batch update query: %s", updateTemplate)
+		if _, err := tx.Exec(updateTemplate, args...); err != nil {
+			return nil, err
+		}
+		return nil, insertAuditEntries(tx, caller, "update", entries)
+	})
+}
+
+//DeleteRecords will soft delete the provided users in the DB with a single statement, returning the status of each
+//user in the order provided. Users which do not exist are NOT_FOUND and users not at their expected version are
+//VERSION_MISMATCH. In atomic mode no users are deleted if any cannot be, and the users which could have been are ABORTED
+func (c *Client) DeleteRecords(caller Caller, users []RecordVersion, atomic bool) []Status {
+	return c.runBatch("delete", caller.TenantID, len(users), atomic, DELETED, func(tx *sql.Tx) ([]Status, error) {
+		userIDs := make([]string, len(users))
+		for i, user := range users {
+			userIDs[i] = user.UserID
+		}
+		records, err := selectRecordsForUpdate(tx, caller.TenantID, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]UserRecord)
+		for _, record := range records {
+			current[record.UserID] = record
+		}
+
+		statuses := make([]Status, len(users))
+		seen := make(map[string]bool)
+		for i, user := range users {
+			statuses[i] = checkVersion(current, seen, user.UserID, user.ExpectedVersion)
+		}
+		return statuses, nil
+	}, func(tx *sql.Tx, valid []int) (map[int]Status, error) {
+		args := make([]interface{}, 0, len(valid)+1)
+		args = append(args, caller.TenantID)
+		entries := make([]auditChange, len(valid))
+		for n, i := range valid {
+			args = append(args, users[i].UserID)
+			entries[n] = auditChange{userID: users[i].UserID}
+		}
+		deleteTemplate := fmt.Sprintf(`UPDATE Users
+					   SET deleted_at = UTC_TIMESTAMP(), version = version + 1, updated_at = UTC_TIMESTAMP()
+					   WHERE tenant_id = ? AND user_id IN (%s);`, placeholders(len(valid)))
+		if _, err := tx.Exec(deleteTemplate, args...); err != nil {
+			return nil, err
+		}
+		return nil, insertAuditEntries(tx, caller, "delete", entries)
+	})
+}
+
+//runBatch runs a batch of size changes to users of the tenant in a transaction. check locks the users being changed
+//and returns the status of each change, OK for those which can be applied, then apply makes the changes which can be
+//applied, identified by their index, returning the status of any which turned out not to be. Applied changes are
+//given the applied status. In atomic mode nothing is applied unless every change can be
+func (c *Client) runBatch(action, tenantID string, size int, atomic bool, applied Status, check func(*sql.Tx) ([]Status, error), apply func(*sql.Tx, []int) (map[int]Status, error)) []Status {
+	statuses := make([]Status, size)
+	if size == 0 {
+		return statuses
+	}
+	setStatus := func(indexes []int, status Status) []Status {
+		for _, i := range indexes {
+			statuses[i] = status
+		}
+		return statuses
+	}
+	all := make([]int, size)
+	for i := range all {
+		all[i] = i
+	}
+
+	if tenantID == "" {
+		log.WithError(errNoTenant).Errorf("could not %s batch of users in db", action)
+		return setStatus(all, BACKEND_ERROR)
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).Errorf("could not start batch %s transaction", action)
+		return setStatus(all, BACKEND_ERROR)
+	}
+	defer tx.Rollback()
+
+	checked, err := check(tx)
+	if err != nil {
+		log.WithError(err).Errorf("could not check users for batch %s", action)
+		return setStatus(all, BACKEND_ERROR)
+	}
+	copy(statuses, checked)
+	var valid []int
+	for i, status := range statuses {
+		if status == OK {
+			valid = append(valid, i)
+		}
+	}
+	if len(valid) == 0 {
+		return statuses
+	}
+	if atomic && len(valid) < size {
+		log.Infof("aborted atomic batch %s as %d of %d users could not be changed", action, size-len(valid), size)
+		return setStatus(valid, ABORTED)
+	}
+
+	failed, err := apply(tx, valid)
+	if err != nil {
+		log.WithError(err).Errorf("could not %s batch of users in db", action)
+		return setStatus(valid, BACKEND_ERROR)
+	}
+	if len(failed) > 0 {
+		var changed []int
+		for _, i := range valid {
+			if status, ok := failed[i]; ok {
+				statuses[i] = status
+			} else {
+				changed = append(changed, i)
+			}
+		}
+		valid = changed
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Errorf("could not commit batch %s transaction", action)
+		return setStatus(valid, BACKEND_ERROR)
+	}
+	log.Infof("batch %s changed %d of %d users", action, len(valid), size)
+	return setStatus(valid, applied)
+}
+
+//selectRecordsForUpdate returns the provided users of the tenant which are not deleted, locking their rows until the
+//transaction ends
+func selectRecordsForUpdate(tx *sql.Tx, tenantID string, userIDs []string) ([]UserRecord, error) {
+	args := make([]interface{}, 0, len(userIDs)+1)
+	args = append(args, tenantID)
+	for _, userID := range userIDs {
+		args = append(args, userID)
+	}
+	records, status := queryRecords(tx, userColumns, `SELECT `+strings.Join(userColumns, ", ")+`
+						  FROM Users
+						  WHERE tenant_id = ? AND user_id IN (`+placeholders(len(userIDs))+`) AND deleted_at IS NULL
+						  FOR UPDATE;`, args...)
+	if status != OK {
+		return nil, fmt.Errorf("could not select users for update")
+	}
+	return records, nil
+}
+
+//checkVersion returns OK if the user exists at the expected version, 0 for any version, and has not already been
+//changed earlier in the batch, which would make the expected version ambiguous
+func checkVersion(current map[string]UserRecord, seen map[string]bool, userID string, expectedVersion int) Status {
+	record, ok := current[userID]
+	switch {
+	case !ok:
+		log.WithField("UserID", userID).Info("could not change user as they do not exist")
+		return NOT_FOUND
+	case seen[userID]:
+		log.WithField("UserID", userID).Info("could not change user as they appear more than once in the batch")
+		return ALREADY_EXISTS
+	case expectedVersion != 0 && record.Version != expectedVersion:
+		log.WithField("UserID", userID).Infof("user is at version %d not %d", record.Version, expectedVersion)
+		return VERSION_MISMATCH
+	}
+	seen[userID] = true
+	return OK
+}
+
+//placeholders returns a comma separated list of n query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,167 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"unicode"
+)
+
+//gmailDomains are the domains whose mail is delivered ignoring dots in the local part of the address
+var gmailDomains = []string{"gmail.com", "googlemail.com"}
+
+//emailKeyColumn is the generated column holding the EmailLocalKey of each user's email, and lastNameSoundexColumn
+//the one holding the Soundex code of their last name, which are indexed so that duplicate candidates are found
+//without computing them for every user. The Soundex code is written with the last name, as MySQL's SOUNDEX is not
+//the American Soundex the duplicates are scored with
+var (
+	emailKeyColumn = fmt.Sprintf(`email_key varchar(150) AS (LOWER(IF(LOWER(SUBSTRING_INDEX(TRIM(email), '@', -1)) IN ('%s'),
+		REPLACE(SUBSTRING_INDEX(SUBSTRING_INDEX(TRIM(email), '@', 1), '+', 1), '.', ''),
+		SUBSTRING_INDEX(SUBSTRING_INDEX(TRIM(email), '@', 1), '+', 1)))) STORED`, strings.Join(gmailDomains, "', '"))
+	lastNameSoundexColumn = "last_name_soundex varchar(4) NOT NULL DEFAULT ''"
+)
+
+//soundexColumns are the columns holding the Soundex code of an updatable column, which are set whenever it is
+var soundexColumns = map[string]string{
+	"last_name": "last_name_soundex",
+}
+
+//RetrieveDuplicateCandidates returns the other users of the tenant in the DB who could be duplicates of the user, those
+//whose last name has the same Soundex code or whose email has the same EmailLocalKey. Soft deleted users are not
+//candidates
+func (c *Client) RetrieveDuplicateCandidates(tenantID string, user UserRecord) ([]UserRecord, Status) {
+	if tenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", user.UserID).Error("could not retrieve duplicate candidates")
+		return nil, BACKEND_ERROR
+	}
+	//last names without a Soundex code do not sound like each other
+	match, args := "email_key = ?", []interface{}{tenantID, user.UserID, EmailLocalKey(user.EmailAddress)}
+	if code := Soundex(user.LastName); code != "" {
+		match, args = "last_name_soundex = ? OR "+match, []interface{}{tenantID, user.UserID, code, EmailLocalKey(user.EmailAddress)}
+	}
+	candidatesTemplate := fmt.Sprintf(`SELECT %s
+						  FROM Users
+						  WHERE tenant_id = ? AND deleted_at IS NULL AND user_id != ?
+							AND (%s)
+							ORDER BY user_id ASC;`, strings.Join(readableColumns, ", "), match)
+	log.Debugf("duplicate candidates query is %s", candidatesTemplate)
+
+	candidates, status := queryRecords(c.db, readableColumns, candidatesTemplate, args...)
+	if status != OK {
+		return nil, status
+	}
+	if candidates == nil {
+		candidates = []UserRecord{}
+	}
+	return candidates, OK
+}
+
+//NormaliseEmail returns the address mail sent to the email is delivered to, ignoring case and +tags, and for Gmail
+//dots in the local part and the googlemail.com domain
+func NormaliseEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") {
+		return email
+	}
+	local, domain := emailLocalPart(email), email[strings.LastIndex(email, "@")+1:]
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+//EmailLocalKey returns the local part of the normalised email, which duplicate candidates share. It is the value of
+//the email_key column
+func EmailLocalKey(email string) string {
+	return emailLocalPart(strings.ToLower(strings.TrimSpace(email)))
+}
+
+//emailLocalPart returns the part of the lower case email before the @, without any +tag, or for Gmail any dots
+func emailLocalPart(email string) string {
+	local := strings.SplitN(strings.SplitN(email, "@", 2)[0], "+", 2)[0]
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		for _, domain := range gmailDomains {
+			if email[at+1:] == domain {
+				return strings.Replace(local, ".", "", -1)
+			}
+		}
+	}
+	return local
+}
+
+//soundexCodes are the Soundex digits of the letters a to z, 0 for letters which are not coded
+const soundexCodes = "01230120022455012623010202"
+
+//Soundex returns the American Soundex code of the name, so that names which sound alike such as Smith and Smyth
+//have the same code. Characters other than the letters a to z are ignored, and names without any have no code. It is
+//the value of the last_name_soundex column
+func Soundex(name string) string {
+	var code []byte
+	var last byte
+	for _, r := range strings.ToLower(name) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		digit := soundexCodes[r-'a']
+		if len(code) == 0 {
+			code = append(code, byte(unicode.ToUpper(r)))
+			last = digit
+			continue
+		}
+		//h and w do not separate letters with the same code, vowels do
+		if r == 'h' || r == 'w' {
+			continue
+		}
+		if digit != '0' && digit != last {
+			if code = append(code, digit); len(code) == 4 {
+				break
+			}
+		}
+		last = digit
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+//backfillLastNameSoundex sets the last_name_soundex column of every user, one at a time as it is computed from their
+//last name in Go
+func backfillLastNameSoundex(db *sql.DB) error {
+	rows, err := db.Query("SELECT tenant_id, user_id, last_name FROM Users;")
+	if err != nil {
+		return err
+	}
+	type user struct {
+		tenantID, userID, lastName string
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.tenantID, &u.userID, &u.lastName); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range users {
+		if _, err := tx.Exec("UPDATE Users SET last_name_soundex = ? WHERE tenant_id = ? AND user_id = ?;", Soundex(u.lastName), u.tenantID, u.userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+//IdempotencyRecord is a request made with an Idempotency-Key and, once it has completed, the response to replay
+//when the request is retried. Keys are unique to the tenant the request was made for and the caller who made it
+type IdempotencyRecord struct {
+	TenantID string
+	//Subject identifies the caller who made the request, empty if they were not authenticated
+	Subject string
+	Key string
+	//Fingerprint identifies the request so reuse of the key for a different request can be rejected
+	Fingerprint string
+	//Completed is false while the first request with the key is still being processed
+	Completed bool
+	StatusCode int
+	Header map[string][]string
+	Body []byte
+	ExpiresAt time.Time
+}
+
+//ReserveIdempotencyKey records that a request with the key is being processed, returning CREATED. If an unexpired
+//request was already made with the key ALREADY_EXISTS is returned along with that request
+func (c *Client) ReserveIdempotencyKey(record IdempotencyRecord) (IdempotencyRecord, Status) {
+	if record.TenantID == "" {
+		log.WithError(errNoTenant).Error("could not reserve idempotency key")
+		return IdempotencyRecord{}, BACKEND_ERROR
+	}
+	//expired keys may be reused
+	if _, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND expires_at < UTC_TIMESTAMP();`, record.TenantID, record.Subject, record.Key); err != nil {
+		log.WithError(err).Error("could not remove expired idempotency key")
+		return IdempotencyRecord{}, BACKEND_ERROR
+	}
+
+	_, err := c.db.Exec(`INSERT INTO idempotency_keys (tenant_id, subject, idempotency_key, fingerprint, completed, status_code, header, body, expires_at)
+		VALUES (?, ?, ?, ?, FALSE, 0, '{}', '', ?);`, record.TenantID, record.Subject, record.Key, record.Fingerprint, record.ExpiresAt.UTC())
+	if err == nil {
+		return record, CREATED
+	}
+	if sqlError, ok := err.(*mysql.MySQLError); !ok || sqlError.Number != 1062 {
+		log.WithError(err).Error("could not reserve idempotency key")
+		return IdempotencyRecord{}, BACKEND_ERROR
+	}
+
+	existing, status := c.retrieveIdempotencyKey(record)
+	if status == NOT_FOUND {
+		//the existing key expired and was removed since the insert, so the client can retry
+		log.Info("idempotency key was removed while being reserved")
+		return IdempotencyRecord{}, BACKEND_ERROR
+	}
+	if status != OK {
+		return IdempotencyRecord{}, status
+	}
+	return existing, ALREADY_EXISTS
+}
+
+//retrieveIdempotencyKey returns the request made with the key of the reservation by the same caller of the same tenant
+func (c *Client) retrieveIdempotencyKey(reservation IdempotencyRecord) (IdempotencyRecord, Status) {
+	record := IdempotencyRecord{TenantID: reservation.TenantID, Subject: reservation.Subject, Key: reservation.Key}
+	var header string
+	err := c.db.QueryRow(`SELECT fingerprint, completed, status_code, header, body, expires_at
+		FROM idempotency_keys
+		WHERE tenant_id = ? AND subject = ? AND idempotency_key = ?;`, record.TenantID, record.Subject, record.Key).Scan(&record.Fingerprint, &record.Completed, &record.StatusCode, &header, &record.Body, &record.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return record, NOT_FOUND
+	} else if err != nil {
+		log.WithError(err).Error("could not retrieve idempotency key")
+		return record, BACKEND_ERROR
+	}
+	if err := json.Unmarshal([]byte(header), &record.Header); err != nil {
+		log.WithError(err).Error("could not decode idempotency key response headers")
+		return record, BACKEND_ERROR
+	}
+	return record, OK
+}
+
+//CompleteIdempotencyKey stores the response to a request reserved with ReserveIdempotencyKey
+func (c *Client) CompleteIdempotencyKey(record IdempotencyRecord) Status {
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		log.WithError(err).Error("could not encode idempotency key response headers")
+		return BACKEND_ERROR
+	}
+	_, err = c.db.Exec(`UPDATE idempotency_keys
+		SET completed = TRUE, status_code = ?, header = ?, body = ?
+		WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND fingerprint = ?;`, record.StatusCode, string(header), record.Body, record.TenantID, record.Subject, record.Key, record.Fingerprint)
+	if err != nil {
+		log.WithError(err).Error("could not store idempotency key response")
+		return BACKEND_ERROR
+	}
+	return UPDATED
+}
+
+//ReleaseIdempotencyKey removes a key reserved with ReserveIdempotencyKey whose request failed so that it can be retried
+func (c *Client) ReleaseIdempotencyKey(record IdempotencyRecord) Status {
+	if _, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND completed = FALSE;`, record.TenantID, record.Subject, record.Key); err != nil {
+		log.WithError(err).Error("could not release idempotency key")
+		return BACKEND_ERROR
+	}
+	return DELETED
+}
+
+//PurgeIdempotencyKeys removes keys which expired before the provided time, returning how many were removed
+func (c *Client) PurgeIdempotencyKeys(expiredBefore time.Time) (int, Status) {
+	results, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < ?;`, expiredBefore.UTC())
+	if err != nil {
+		log.WithError(err).Error("could not purge idempotency keys")
+		return 0, BACKEND_ERROR
+	}
+	rows, err := results.RowsAffected()
+	if err != nil {
+		log.WithError(err).Error("error processing request")
+		return 0, BACKEND_ERROR
+	}
+	return int(rows), OK
+}
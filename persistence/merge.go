@@ -0,0 +1,204 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+//MergeStrategy chooses which user's value of a column the survivor of a merge keeps
+type MergeStrategy string
+const (
+	//KEEP_TARGET keeps the surviving user's value, the default for columns without a strategy
+	KEEP_TARGET MergeStrategy = "target"
+	//KEEP_SOURCE takes the merged user's value
+	KEEP_SOURCE MergeStrategy = "source"
+	//KEEP_NON_EMPTY keeps the surviving user's value unless it is empty, when the merged user's value is taken
+	KEEP_NON_EMPTY MergeStrategy = "nonEmpty"
+)
+
+//MergeRecords merges the source user into the target user of the caller's tenant in a single transaction. The target's updatable columns
+//are resolved with the strategies, the source is soft deleted and an alias is recorded so the source's ID, and any
+//IDs previously merged into the source, resolve to the target. If expectedVersion is not 0 the target is only merged
+//into at that version. Returns MERGED with the target as they are after the merge. NOT_FOUND is returned with no
+//user if the target does not exist, or with the target if the source does not, as deleted users cannot be merged
+func (c *Client) MergeRecords(caller Caller, targetID, sourceID string, strategies map[string]MergeStrategy, expectedVersion int) (UserRecord, Status) {
+	if targetID == sourceID {
+		log.WithField("UserID", targetID).Error("could not merge user into themselves")
+		return UserRecord{}, BACKEND_ERROR
+	}
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", targetID).Error("could not merge user")
+		return UserRecord{}, BACKEND_ERROR
+	}
+	columns := make([]string, 0, len(strategies))
+	for column, strategy := range strategies {
+		if !updatableColumns[column] {
+			log.WithField("UserID", targetID).Errorf("could not merge user as column %s cannot be updated", column)
+			return UserRecord{}, BACKEND_ERROR
+		}
+		if strategy != KEEP_TARGET && strategy != KEEP_SOURCE && strategy != KEEP_NON_EMPTY {
+			log.WithField("UserID", targetID).Errorf("could not merge user as strategy %s is unknown", strategy)
+			return UserRecord{}, BACKEND_ERROR
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).WithField("UserID", targetID).Error("could not start merge transaction")
+		return UserRecord{}, BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	//both users are locked in ID order so concurrent merges of the same users cannot deadlock
+	locked, status := queryRecords(tx, userColumns, `SELECT `+strings.Join(userColumns, ", ")+`
+						  FROM Users
+						  WHERE tenant_id = ? AND user_id IN (?, ?) AND deleted_at IS NULL
+						  ORDER BY user_id
+						  FOR UPDATE;`, caller.TenantID, targetID, sourceID)
+	if status != OK {
+		return UserRecord{}, status
+	}
+	var target, source UserRecord
+	for _, record := range locked {
+		if record.UserID == targetID {
+			target = record
+		} else {
+			source = record
+		}
+	}
+	if target.UserID == "" {
+		log.WithField("UserID", targetID).Info("could not merge into user as they do not exist")
+		return UserRecord{}, NOT_FOUND
+	}
+	if expectedVersion != 0 && target.Version != expectedVersion {
+		log.WithField("UserID", targetID).Infof("user is at version %d not %d", target.Version, expectedVersion)
+		return target, VERSION_MISMATCH
+	}
+	if source.UserID == "" {
+		log.WithField("UserID", targetID).Infof("could not merge user %s as they do not exist", sourceID)
+		return target, NOT_FOUND
+	}
+
+	merged := target
+	assignments := []string{"version = version + 1", "updated_at = UTC_TIMESTAMP()"}
+	var args []interface{}
+	for _, column := range columns {
+		value := columnValue(target, column)
+		switch strategies[column] {
+		case KEEP_SOURCE:
+			value = columnValue(source, column)
+		case KEEP_NON_EMPTY:
+			if value == "" {
+				value = columnValue(source, column)
+			}
+		}
+		if value != columnValue(target, column) {
+			assignments = append(assignments, column+" = ?")
+			args = append(args, value)
+			setColumn(&merged, column, value)
+			if soundexColumn, ok := soundexColumns[column]; ok {
+				assignments = append(assignments, soundexColumn+" = ?")
+				args = append(args, Soundex(value))
+			}
+		}
+	}
+	updateTemplate := fmt.Sprintf(`UPDATE Users
+						SET %s
+						WHERE tenant_id = ? AND user_id = ?;`, strings.Join(assignments, ", "))
+	if _, err := tx.Exec(updateTemplate, append(args, caller.TenantID, targetID)...); err != nil {
+		log.WithError(err).WithField("UserID", targetID).Error("could not update user merged into")
+		return target, BACKEND_ERROR
+	}
+	deleteTemplate := `UPDATE Users
+					   SET deleted_at = UTC_TIMESTAMP(), version = version + 1, updated_at = UTC_TIMESTAMP()
+					   WHERE tenant_id = ? AND user_id = ?;`
+	if _, err := tx.Exec(deleteTemplate, caller.TenantID, sourceID); err != nil {
+		log.WithError(err).WithField("UserID", sourceID).Error("could not delete merged user")
+		return target, BACKEND_ERROR
+	}
+	if err := insertAlias(tx, caller.TenantID, sourceID, targetID); err != nil {
+		log.WithError(err).WithField("UserID", sourceID).Error("could not alias merged user")
+		return target, BACKEND_ERROR
+	}
+
+	targetChanges := append(diffRecords(target, merged), FieldChange{Field: "mergedFrom", To: sourceID})
+	if err := insertAuditEntry(tx, caller, targetID, "merge", targetChanges); err != nil {
+		log.WithError(err).WithField("UserID", targetID).Error("could not audit user merge")
+		return target, BACKEND_ERROR
+	}
+	if err := insertAuditEntry(tx, caller, sourceID, "merge", []FieldChange{{Field: "mergedInto", To: targetID}}); err != nil {
+		log.WithError(err).WithField("UserID", sourceID).Error("could not audit user merge")
+		return target, BACKEND_ERROR
+	}
+
+	survivor, status := queryRecords(tx, readableColumns, `SELECT `+strings.Join(readableColumns, ", ")+`
+						  FROM Users
+						  WHERE tenant_id = ? AND user_id = ?;`, caller.TenantID, targetID)
+	if status != OK || len(survivor) != 1 {
+		log.WithField("UserID", targetID).Error("could not read user merged into")
+		return target, BACKEND_ERROR
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", targetID).Error("could not commit merge transaction")
+		return target, BACKEND_ERROR
+	}
+	log.WithField("UserID", targetID).Infof("merged user %s, changing fields: %v", sourceID, changedFields(diffRecords(target, merged)))
+	return survivor[0], MERGED
+}
+
+//insertAlias records that the alias resolves to the user of the tenant, repointing aliases of the alias so that every
+//alias resolves directly to a user who has not been merged. Any alias of the user themselves, left from a merge before
+//they were restored, is removed so no alias can resolve to itself
+func insertAlias(tx *sql.Tx, tenantID, aliasID, userID string) error {
+	if _, err := tx.Exec(`DELETE FROM user_aliases WHERE tenant_id = ? AND alias_id = ?;`, tenantID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE user_aliases SET user_id = ? WHERE tenant_id = ? AND user_id = ?;`, userID, tenantID, aliasID); err != nil {
+		return err
+	}
+	//a merged user who was restored can be merged again
+	_, err := tx.Exec(`INSERT INTO user_aliases (tenant_id, alias_id, user_id, created_at)
+		VALUES (?, ?, ?, UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), created_at = VALUES(created_at);`, tenantID, aliasID, userID)
+	return err
+}
+
+//RetrieveAlias returns the ID of the user of the tenant the provided ID was merged into, or NOT_FOUND if it was not
+//merged
+func (c *Client) RetrieveAlias(tenantID, aliasID string) (string, Status) {
+	if tenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", aliasID).Error("could not retrieve user alias")
+		return "", BACKEND_ERROR
+	}
+	var userID string
+	err := c.db.QueryRow(`SELECT user_id FROM user_aliases WHERE tenant_id = ? AND alias_id = ?;`, tenantID, aliasID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", NOT_FOUND
+	} else if err != nil {
+		log.WithError(err).WithField("UserID", aliasID).Error("could not retrieve user alias")
+		return "", BACKEND_ERROR
+	}
+	return userID, OK
+}
+
+//columnValue returns the value of the updatable column of the record
+func columnValue(record UserRecord, column string) string {
+	switch column {
+	case "first_name":
+		return record.FirstName
+	case "last_name":
+		return record.LastName
+	case "password":
+		return record.Password
+	case "nickname":
+		return record.NickName
+	case "country":
+		return record.Country
+	}
+	return ""
+}
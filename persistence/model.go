@@ -1,5 +1,7 @@
 package persistence
 
+import "time"
+
 //UserRecord is the model for a User
 // swagger:model UserRecord
 type UserRecord struct {
@@ -7,15 +9,73 @@ type UserRecord struct {
 	FirstName string `json:"firstName"`
 	LastName string `json:"lastName"`
 	EmailAddress string `json:"emailAddress"`
-	Password string `json:"password"`
+	//Password is never returned by reads so is only set on requests
+	Password string `json:"password,omitempty"`
 	NickName string `json:"nickname"`
 	Country string `json:"country"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	//Version is incremented on every change to the user, it is returned as the ETag of the user
+	Version int `json:"version,omitempty"`
+	//CreatedAt and UpdatedAt are managed by the DB and ignored when supplied on requests
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
 }
 
 //Message is the model for a message
 // swagger:model Message
 type Message struct {
-	Type string
-	UserID string
-	Nickname string
+	Type string `json:"type"`
+	UserID string `json:"userID"`
+	Nickname string `json:"nickname,omitempty"`
+	//UserIDs are the users changed by a batch event
+	UserIDs []string `json:"userIDs,omitempty"`
+	//TenantID is the tenant the users belong to
+	TenantID string `json:"tenantID,omitempty"`
+}
+
+//Caller identifies who made a change to a user, recorded in the user's audit trail, and the tenant whose users
+//they are changing
+type Caller struct {
+	Actor string
+	RequestID string
+	SourceIP string
+	TenantID string
+}
+
+//AuditEntry is the model for a change recorded in a user's history
+// swagger:model AuditEntry
+type AuditEntry struct {
+	UserID string `json:"userID"`
+	Action string `json:"action"`
+	Actor string `json:"actor"`
+	RequestID string `json:"requestID"`
+	SourceIP string `json:"sourceIP"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//FieldChange is the model for the change of a single user field
+// swagger:model FieldChange
+type FieldChange struct {
+	Field string `json:"field"`
+	From string `json:"from"`
+	To string `json:"to"`
+}
+
+//GroupCount is the model for the number of users sharing a value of a field
+// swagger:model GroupCount
+type GroupCount struct {
+	Value string `json:"value"`
+	Count int `json:"count"`
+}
+
+//SearchResult is the model for a user matching a full-text search
+// swagger:model SearchResult
+type SearchResult struct {
+	User UserRecord `json:"user"`
+	//Relevance ranks how well the user matches the search, higher is better. It is only comparable with the
+	//relevance of other results of the same search
+	Relevance float64 `json:"relevance"`
+	//Highlights are the fields which matched, with each matching term wrapped in <em> tags
+	Highlights map[string]string `json:"highlights,omitempty"`
 }
@@ -0,0 +1,132 @@
+package persistence
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"unicode"
+)
+
+//fullTextColumns are the columns searched by SearchRecords, in the order of the user_search FULLTEXT index
+var fullTextColumns = []string{"first_name", "last_name", "nickname", "email"}
+
+//SearchTerms splits a search query into the terms which are searched for. Punctuation separates terms, as it does
+//in the FULLTEXT index, so an email address is searched for as its parts
+func SearchTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//SearchRecords finds up to limit users matching the provided parameters in the DB whose names, nickname or email
+//contain words starting with every term of the query, most relevant first. The user_search FULLTEXT index is used
+//where it exists, otherwise the search falls back to matching the columns with LIKE, which any SQL backend supports
+//but which must read every user matching the parameters
+func (c *Client) SearchRecords(searchCriteria SearchCriteria, query string, limit int) ([]SearchResult, Status) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		log.Errorf("search query %q has no terms", query)
+		return nil, BACKEND_ERROR
+	}
+	whereClause, args, err := buildWhereClause(searchCriteria)
+	if err != nil {
+		log.WithError(err).Error("invalid search criteria")
+		return nil, BACKEND_ERROR
+	}
+
+	results, err := c.searchFullText(whereClause, args, terms, limit)
+	if err != nil && fullTextUnavailable(err) {
+		log.WithError(err).Warn("full-text search is unavailable, searching with LIKE")
+		results, err = c.searchLike(whereClause, args, terms, limit)
+	}
+	if err != nil {
+		log.WithError(err).Error("could not search users")
+		return nil, BACKEND_ERROR
+	}
+	return results, OK
+}
+
+//searchFullText matches each term as a required word prefix in boolean mode, ranking users by MySQL's relevance
+func (c *Client) searchFullText(whereClause string, args []interface{}, terms []string, limit int) ([]SearchResult, error) {
+	required := make([]string, len(terms))
+	for i, term := range terms {
+		required[i] = "+" + term + "*"
+	}
+	against := strings.Join(required, " ")
+	match := fmt.Sprintf("MATCH(%s) AGAINST(? IN BOOLEAN MODE)", strings.Join(fullTextColumns, ", "))
+
+	searchTemplate := fmt.Sprintf(`SELECT %s, %s AS relevance
+						  FROM Users
+						  %s AND %s
+							ORDER BY relevance DESC, user_id ASC
+							LIMIT ?;`, strings.Join(readableColumns, ", "), match, whereClause, match)
+	log.Debugf("full-text search query is %s", searchTemplate)
+
+	queryArgs := append([]interface{}{against}, args...)
+	return c.querySearchResults(searchTemplate, append(queryArgs, against, limit)...)
+}
+
+//searchLike matches each term anywhere in any of the columns, ranking users by the number of columns each term
+//matches
+func (c *Client) searchLike(whereClause string, args []interface{}, terms []string, limit int) ([]SearchResult, error) {
+	var scores, conditions []string
+	var scoreArgs, conditionArgs []interface{}
+	for _, term := range terms {
+		//terms are only letters and digits so contain no wildcards
+		pattern := "%" + term + "%"
+		var matches []string
+		for _, column := range fullTextColumns {
+			matches = append(matches, column+" LIKE ?")
+			scoreArgs = append(scoreArgs, pattern)
+			conditionArgs = append(conditionArgs, pattern)
+		}
+		scores = append(scores, "("+strings.Join(matches, ") + (")+")")
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	searchTemplate := fmt.Sprintf(`SELECT %s, %s AS relevance
+						  FROM Users
+						  %s AND %s
+							ORDER BY relevance DESC, user_id ASC
+							LIMIT ?;`, strings.Join(readableColumns, ", "), strings.Join(scores, " + "), whereClause, strings.Join(conditions, " AND "))
+	log.Debugf("like search query is %s", searchTemplate)
+
+	queryArgs := append(scoreArgs, args...)
+	queryArgs = append(queryArgs, conditionArgs...)
+	return c.querySearchResults(searchTemplate, append(queryArgs, limit)...)
+}
+
+//querySearchResults scans users selected with readableColumns followed by their relevance
+func (c *Client) querySearchResults(query string, args ...interface{}) ([]SearchResult, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := make([]interface{}, len(readableColumns)+1)
+	for i, column := range readableColumns {
+		targets[i] = scanTarget(column)
+	}
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		targets[len(readableColumns)] = &result.Relevance
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		for i, column := range readableColumns {
+			setScanned(&result.User, column, targets[i])
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+//fullTextUnavailable returns whether the error is because there is no FULLTEXT index to search, as in tables created
+//before it was added, or the storage engine does not support one
+func fullTextUnavailable(err error) bool {
+	sqlError, ok := err.(*mysql.MySQLError)
+	return ok && (sqlError.Number == 1191 || sqlError.Number == 1214)
+}
@@ -2,12 +2,15 @@ package persistence
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	//mysql driver
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"strings"
+	"time"
 )
 
 //Client for SQL database
@@ -26,20 +29,292 @@ const (
 	UPDATED
 	OK
 	DELETED
+	RESTORED
+	VERSION_MISMATCH
+	//ABORTED changes could have been made but were not as another change in the same atomic batch could not be
+	ABORTED
+	MERGED
 )
 
+//DefaultTenant is the tenant of users added before tenants were introduced, and of requests which do not name one
+const DefaultTenant = "default"
+
+//errNoTenant is returned for queries not scoped to a tenant, so that a missing tenant can never read or change every
+//tenant's users
+var errNoTenant = errors.New("tenant is required")
+
 //Clienter provides an interface of Client functions. Useful for mocking
 type Clienter interface {
-	CreateRecord(UserRecord) Status
-	UpdateRecord(string, map[string]string) Status
-	RetrieveRecords(map[string]string) ([]UserRecord, Status)
-	DeleteRecord(string) Status
+	CreateRecord(Caller, UserRecord) Status
+	UpsertRecord(Caller, UserRecord, int) (UserRecord, Status)
+	UpdateRecord(Caller, string, map[string]string, int) Status
+	RetrieveRecords(SearchCriteria) ([]UserRecord, Status)
+	ScanRecords(SearchCriteria, string, int) ([]UserRecord, Status)
+	CountRecords(SearchCriteria) (int, Status)
+	GroupRecords(SearchCriteria, string) ([]GroupCount, Status)
+	SearchRecords(SearchCriteria, string, int) ([]SearchResult, Status)
+	RetrieveDuplicateCandidates(string, UserRecord) ([]UserRecord, Status)
+	MergeRecords(Caller, string, string, map[string]MergeStrategy, int) (UserRecord, Status)
+	RetrieveAlias(string, string) (string, Status)
+	DeleteRecord(Caller, string, int) Status
+	CreateRecords(Caller, []UserRecord, bool) []Status
+	UpdateRecords(Caller, []RecordUpdate, bool) []Status
+	DeleteRecords(Caller, []RecordVersion, bool) []Status
+	RestoreRecord(Caller, string) Status
+	PurgeRecords(time.Time) (map[string][]string, Status)
+	RetrieveAuditEntries(string, string, int, int) ([]AuditEntry, int, Status)
+	ReserveIdempotencyKey(IdempotencyRecord) (IdempotencyRecord, Status)
+	CompleteIdempotencyKey(IdempotencyRecord) Status
+	ReleaseIdempotencyKey(IdempotencyRecord) Status
+	PurgeIdempotencyKeys(time.Time) (int, Status)
+	CreateAPIKey(APIKey) Status
+	RetrieveAPIKey(string) (APIKey, Status)
+	RetrieveAPIKeys() ([]APIKey, Status)
+	RecordAPIKeyUse(string, time.Time, time.Time) Status
+	RevokeAPIKey(string) Status
 	ActiveConnection() bool
 }
 
-//NewClient returns a MySQL client
-func NewClient(dsn string, credentials string) (Clienter, error) {
-	connString := fmt.Sprintf("%s@tcp(%s)/dev?interpolateParams=true&parseTime=true", credentials, dsn)
+//SearchCriteria restricts which users are returned
+type SearchCriteria struct {
+	//TenantID is the tenant whose users are searched, it is required
+	TenantID string
+	//Fields maps db columns to the value they must match
+	Fields map[string]string
+	//IncludeDeleted returns soft deleted users as well
+	IncludeDeleted bool
+	//CreatedAfter, CreatedBefore, UpdatedAfter and UpdatedBefore restrict when users were created
+	//and last updated, zero times are ignored
+	CreatedAfter time.Time
+	CreatedBefore time.Time
+	UpdatedAfter time.Time
+	UpdatedBefore time.Time
+	//Columns are the columns to select, in order, defaulting to readableColumns. Sensitive columns are never selected
+	Columns []string
+}
+
+//tableDefinitions creates the tables used by the client if they do not already exist
+var tableDefinitions = []string{
+	`CREATE TABLE IF NOT EXISTS Users (
+    	tenant_id varchar(64) NOT NULL,
+    	user_id varchar(36)  NOT NULL,
+    	first_name varchar(50) NOT NULL,
+    	last_name varchar(50) NOT NULL,
+    	email varchar(150) NOT NULL,
+    	password varchar(50) NOT NULL,
+    	nickname varchar(50) NOT NULL,
+    	country varchar(50) NOT NULL,
+    	deleted_at datetime NULL,
+    	version int NOT NULL DEFAULT 1,
+    	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    	updated_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    	` + emailKeyColumn + `,
+    	` + lastNameSoundexColumn + `,
+  		PRIMARY KEY (tenant_id, user_id),
+  		UNIQUE KEY email (tenant_id, email),
+  		KEY deleted_at (deleted_at),
+  		KEY created_at (created_at),
+  		KEY updated_at (updated_at),
+  		KEY email_key (tenant_id, email_key),
+  		KEY last_name_soundex (tenant_id, last_name_soundex),
+  		FULLTEXT KEY user_search (first_name, last_name, nickname, email))`,
+	`CREATE TABLE IF NOT EXISTS user_audit (
+    	audit_id bigint NOT NULL AUTO_INCREMENT,
+    	tenant_id varchar(64) NOT NULL,
+    	user_id varchar(36) NOT NULL,
+    	action varchar(20) NOT NULL,
+    	actor varchar(255) NOT NULL,
+    	request_id varchar(64) NOT NULL,
+    	source_ip varchar(45) NOT NULL,
+    	changes text NOT NULL,
+    	created_at datetime NOT NULL,
+  		PRIMARY KEY (audit_id),
+  		KEY user_history (tenant_id, user_id, audit_id))`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+    	tenant_id varchar(64) NOT NULL,
+    	subject varchar(255) NOT NULL DEFAULT '',
+    	idempotency_key varchar(255) CHARACTER SET ascii NOT NULL,
+    	fingerprint char(64) NOT NULL,
+    	completed boolean NOT NULL,
+    	status_code int NOT NULL,
+    	header text NOT NULL,
+    	body blob NOT NULL,
+    	expires_at datetime NOT NULL,
+  		PRIMARY KEY (tenant_id, subject, idempotency_key),
+  		KEY expires_at (expires_at))`,
+	`CREATE TABLE IF NOT EXISTS user_aliases (
+    	tenant_id varchar(64) NOT NULL,
+    	alias_id varchar(36) NOT NULL,
+    	user_id varchar(36) NOT NULL,
+    	created_at datetime NOT NULL,
+  		PRIMARY KEY (tenant_id, alias_id),
+  		KEY user_id (tenant_id, user_id))`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+    	key_id varchar(36) NOT NULL,
+    	name varchar(255) NOT NULL,
+    	scopes varchar(1024) NOT NULL,
+    	tenant_id varchar(64) NOT NULL,
+    	secret_hash char(64) NOT NULL,
+    	created_at datetime NOT NULL,
+    	last_used_at datetime NULL,
+    	revoked_at datetime NULL,
+  		PRIMARY KEY (key_id))`,
+}
+
+//tableMigration adds a column or key to tables created before it was added to tableDefinitions
+type tableMigration struct {
+	table string
+	//column is the column the migration adds, or key the key it adds when it adds no column
+	column string
+	key string
+	//alter adds the column and its indexes, or the key
+	alter string
+	//backfill sets the column of existing rows, optional
+	backfill string
+	//backfillRows sets the column of existing rows when it cannot be set with a query, optional
+	backfillRows func(db *sql.DB) error
+}
+
+//tableMigrations are applied in order to tables which do not have their column or key
+var tableMigrations = []tableMigration{
+	{
+		//emails are unique, so concurrent upserts of the same email cannot both add it
+		table: "Users",
+		key: "email",
+		alter: "ALTER TABLE Users ADD UNIQUE KEY email (email)",
+	},
+	{
+		//users, their history, idempotency keys and aliases created before tenants belong to the default tenant, and
+		//so are keyed by it, while API keys created before tenants may access any tenant
+		table: "Users",
+		column: "tenant_id",
+		alter: `ALTER TABLE Users ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT '` + DefaultTenant + `' FIRST,
+			DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, user_id), DROP KEY email, ADD UNIQUE KEY email (tenant_id, email)`,
+	},
+	{
+		table: "user_audit",
+		column: "tenant_id",
+		alter: `ALTER TABLE user_audit ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT '` + DefaultTenant + `' AFTER audit_id,
+			DROP KEY user_history, ADD KEY user_history (tenant_id, user_id, audit_id)`,
+	},
+	{
+		table: "idempotency_keys",
+		column: "tenant_id",
+		alter: `ALTER TABLE idempotency_keys ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT '` + DefaultTenant + `' FIRST,
+			DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, idempotency_key)`,
+	},
+	{
+		table: "user_aliases",
+		column: "tenant_id",
+		alter: `ALTER TABLE user_aliases ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT '` + DefaultTenant + `' FIRST,
+			DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, alias_id), DROP KEY user_id, ADD KEY user_id (tenant_id, user_id)`,
+	},
+	{
+		table: "api_keys",
+		column: "tenant_id",
+		alter: "ALTER TABLE api_keys ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT '' AFTER scopes",
+	},
+	{
+		table: "Users",
+		column: "deleted_at",
+		alter: "ALTER TABLE Users ADD COLUMN deleted_at datetime NULL AFTER country, ADD KEY deleted_at (deleted_at)",
+	},
+	{
+		//existing users are given version 1 by the column default
+		table: "Users",
+		column: "version",
+		alter: "ALTER TABLE Users ADD COLUMN version int NOT NULL DEFAULT 1 AFTER deleted_at",
+	},
+	{
+		//existing users were created when their first change was audited, if it was, otherwise when the column is
+		//added
+		table: "Users",
+		column: "created_at",
+		alter: "ALTER TABLE Users ADD COLUMN created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER version, ADD KEY created_at (created_at)",
+		backfill: `UPDATE Users u SET created_at = COALESCE((SELECT MIN(a.created_at) FROM user_audit a
+			WHERE a.tenant_id = u.tenant_id AND a.user_id = u.user_id), u.created_at)`,
+	},
+	{
+		table: "Users",
+		column: "updated_at",
+		alter: "ALTER TABLE Users ADD COLUMN updated_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER created_at, ADD KEY updated_at (updated_at)",
+		backfill: `UPDATE Users u SET updated_at = COALESCE((SELECT MAX(a.created_at) FROM user_audit a
+			WHERE a.tenant_id = u.tenant_id AND a.user_id = u.user_id), u.updated_at)`,
+	},
+	{
+		table: "Users",
+		column: "email_key",
+		alter: "ALTER TABLE Users ADD COLUMN " + emailKeyColumn + " AFTER updated_at, ADD KEY email_key (tenant_id, email_key)",
+	},
+	{
+		table: "Users",
+		column: "last_name_soundex",
+		alter: "ALTER TABLE Users ADD COLUMN " + lastNameSoundexColumn + " AFTER email_key, ADD KEY last_name_soundex (tenant_id, last_name_soundex)",
+		backfillRows: backfillLastNameSoundex,
+	},
+	{
+		//existing keys are kept for callers who were not authenticated
+		table: "idempotency_keys",
+		column: "subject",
+		alter: "ALTER TABLE idempotency_keys ADD COLUMN subject varchar(255) NOT NULL DEFAULT '' AFTER tenant_id, DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, subject, idempotency_key)",
+	},
+}
+
+func createTables(db *sql.DB) error {
+	for _, query := range tableDefinitions {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return migrateTables(db)
+}
+
+//migrateTables applies the migrations missing from the tables, so it can be run every time the client starts
+func migrateTables(db *sql.DB) error {
+	for _, migration := range tableMigrations {
+		var count int
+		var err error
+		if migration.key != "" {
+			err = db.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS
+				WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`, migration.table, migration.key).Scan(&count)
+		} else {
+			err = db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+				WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, migration.table, migration.column).Scan(&count)
+		}
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if migration.key != "" {
+			log.Infof("adding key %s to table %s", migration.key, migration.table)
+			if _, err := db.Exec(migration.alter); err != nil {
+				return fmt.Errorf("could not add key %s to table %s: %v", migration.key, migration.table, err)
+			}
+			continue
+		}
+		log.Infof("adding column %s to table %s", migration.column, migration.table)
+		if _, err := db.Exec(migration.alter); err != nil {
+			return fmt.Errorf("could not add column %s to table %s: %v", migration.column, migration.table, err)
+		}
+		if migration.backfill != "" {
+			if _, err := db.Exec(migration.backfill); err != nil {
+				return fmt.Errorf("could not backfill column %s of table %s: %v", migration.column, migration.table, err)
+			}
+		}
+		if migration.backfillRows != nil {
+			if err := migration.backfillRows(db); err != nil {
+				return fmt.Errorf("could not backfill column %s of table %s: %v", migration.column, migration.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+//NewClient returns a MySQL client using the named database
+func NewClient(dsn string, credentials string, database string) (Clienter, error) {
+	connString := fmt.Sprintf("%s@tcp(%s)/%s?interpolateParams=true&parseTime=true", credentials, dsn, database)
 	db, err := sql.Open("mysql", connString)
 	if err != nil {
 		log.WithError(err).Error("error connecting to db")
@@ -51,17 +326,7 @@ func NewClient(dsn string, credentials string) (Clienter, error) {
 		return &Client{}, err
 	}
 
-	query := `CREATE TABLE IF NOT EXISTS Users (
-    	user_id varchar(36)  NOT NULL,
-    	first_name varchar(50) NOT NULL,
-    	last_name varchar(50) NOT NULL,
-    	email varchar(150) NOT NULL,
-    	password varchar(50) NOT NULL,
-    	nickname varchar(50) NOT NULL,
-    	country varchar(50) NOT NULL,
-  		PRIMARY KEY (user_id))`
-	_, err = db.Exec(query)
-	if err != nil {
+	if err = createTables(db); err != nil {
 		log.WithError(err).Error("error creating Users table")
 		return &Client{}, err
 	}
@@ -71,104 +336,470 @@ func NewClient(dsn string, credentials string) (Clienter, error) {
 }
 
 //CreateRecord will attempt to add the provided user to the DB
-func (c *Client) CreateRecord(record UserRecord) Status {
-	dbQuery := `INSERT INTO Users (user_id, first_name, last_name, email, password, nickname, country)
-		VALUES (?, ?, ?, ?, ?, ?, ?);`
-	_, err := c.db.Exec(dbQuery, record.UserID, record.FirstName, record.LastName, record.EmailAddress, record.Password, record.NickName, record.Country)
+func (c *Client) CreateRecord(caller Caller, record UserRecord) Status {
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", record.UserID).Error("could not add user to db")
+		return BACKEND_ERROR
+	}
+	tx, err := c.db.Begin()
 	if err != nil {
-		sqlError, _ := err.(*mysql.MySQLError)
-		if sqlError.Number == 1062 {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not start create transaction")
+		return BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	dbQuery := `INSERT INTO Users (tenant_id, user_id, first_name, last_name, email, password, nickname, country, last_name_soundex, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP());`
+	_, err = tx.Exec(dbQuery, caller.TenantID, record.UserID, record.FirstName, record.LastName, record.EmailAddress, record.Password, record.NickName, record.Country, Soundex(record.LastName))
+	if err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
 			log.WithError(err).WithField("UserID", record.UserID).Errorf("user with this email: %s already exists!", record.EmailAddress)
 			return ALREADY_EXISTS
 		}
 		log.WithError(err).WithField("UserID", record.UserID).Error("could not add user to db")
 		return BACKEND_ERROR
 	}
+
+	if err := insertAuditEntry(tx, caller, record.UserID, "create", diffRecords(UserRecord{}, record)); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not audit user creation")
+		return BACKEND_ERROR
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not commit create transaction")
+		return BACKEND_ERROR
+	}
 	log.WithField("UserID", record.UserID).Infof("created record for user with email %s", record.EmailAddress)
 	return CREATED
 }
 
-//UpdateRecord will attempt to edit certain fields of the provided user in the DB
-func (c *Client) UpdateRecord(userID string, fieldsToUpdate map[string]string) Status {
-	var updates string
-	for k,v := range fieldsToUpdate {
-		updates = fmt.Sprintf("%s%s = '%s',", updates, k, v)
+//UpsertRecord will atomically create the provided user or replace all of their fields if they already exist,
+//returning CREATED or UPDATED along with the user as they were before being replaced. If expectedVersion is
+//not 0 the user is only replaced if they exist at that version. Soft deleted users cannot be replaced and
+//return DELETED, and ALREADY_EXISTS is returned if another user has the email address
+func (c *Client) UpsertRecord(caller Caller, record UserRecord, expectedVersion int) (UserRecord, Status) {
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", record.UserID).Error("could not upsert user in db")
+		return UserRecord{}, BACKEND_ERROR
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not start upsert transaction")
+		return UserRecord{}, BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	existing, status := queryRecords(tx, userColumns, `SELECT `+strings.Join(userColumns, ", ")+`
+						  FROM Users
+						  WHERE tenant_id = ? AND user_id = ?
+						  FOR UPDATE;`, caller.TenantID, record.UserID)
+	if status != OK {
+		return UserRecord{}, status
+	}
+	var current UserRecord
+	if len(existing) > 0 {
+		current = existing[0]
+		if current.DeletedAt != nil {
+			log.WithField("UserID", record.UserID).Info("could not replace user as they have been deleted")
+			return current, DELETED
+		}
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		log.WithField("UserID", record.UserID).Infof("user is at version %d not %d", current.Version, expectedVersion)
+		return current, VERSION_MISMATCH
+	}
+
+	//ON DUPLICATE KEY UPDATE would replace whichever user a duplicate email belongs to, so check it is not taken
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM Users WHERE tenant_id = ? AND email = ? AND user_id <> ? FOR UPDATE;`, caller.TenantID, record.EmailAddress, record.UserID).Scan(&taken); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not check email is available")
+		return current, BACKEND_ERROR
+	}
+	if taken > 0 {
+		log.WithField("UserID", record.UserID).Errorf("user with this email: %s already exists!", record.EmailAddress)
+		return current, ALREADY_EXISTS
+	}
+
+	upsertTemplate := `INSERT INTO Users (tenant_id, user_id, first_name, last_name, email, password, nickname, country, last_name_soundex, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE first_name = VALUES(first_name), last_name = VALUES(last_name), email = VALUES(email),
+			password = VALUES(password), nickname = VALUES(nickname), country = VALUES(country),
+			last_name_soundex = VALUES(last_name_soundex), version = version + 1, updated_at = UTC_TIMESTAMP();`
+	if _, err := tx.Exec(upsertTemplate, caller.TenantID, record.UserID, record.FirstName, record.LastName, record.EmailAddress, record.Password, record.NickName, record.Country, Soundex(record.LastName)); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not upsert user in db")
+		return current, BACKEND_ERROR
+	}
+
+	action, status := "create", CREATED
+	if current.UserID != "" {
+		action, status = "update", UPDATED
+	}
+	changes := diffRecords(current, record)
+	if err := insertAuditEntry(tx, caller, record.UserID, action, changes); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Errorf("could not audit user %s", action)
+		return current, BACKEND_ERROR
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", record.UserID).Error("could not commit upsert transaction")
+		return current, BACKEND_ERROR
+	}
+	log.WithField("UserID", record.UserID).Infof("%sd user fields: %v", action, changedFields(changes))
+	return current, status
+}
+
+//updatableColumns are the columns which may be edited with UpdateRecord
+var updatableColumns = map[string]bool{
+	"first_name": true,
+	"last_name": true,
+	"password": true,
+	"nickname": true,
+	"country": true,
+}
+
+//UpdateRecord will attempt to edit certain fields of the provided user in the DB, incrementing their version.
+//If expectedVersion is not 0 the user is only updated if they are still at that version, otherwise
+//VERSION_MISMATCH is returned
+func (c *Client) UpdateRecord(caller Caller, userID string, fieldsToUpdate map[string]string, expectedVersion int) Status {
+	columns := make([]string, 0, len(fieldsToUpdate))
+	for k := range fieldsToUpdate {
+		if !updatableColumns[k] {
+			log.WithField("UserID", userID).Errorf("could not update user as column %s cannot be updated", k)
+			return BACKEND_ERROR
+		}
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", userID).Error("could not update user")
+		return BACKEND_ERROR
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not start update transaction")
+		return BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	current, status := selectRecordForUpdate(tx, caller.TenantID, userID, expectedVersion)
+	if status != OK {
+		if status == NOT_FOUND {
+			log.WithField("UserID", userID).Info("could not update user as they do not exist")
+		}
+		return status
 	}
 
+	updated := current
+	assignments := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns)+2)
+	for _, column := range columns {
+		assignments = append(assignments, column+" = ?")
+		args = append(args, fieldsToUpdate[column])
+		setColumn(&updated, column, fieldsToUpdate[column])
+		if soundexColumn, ok := soundexColumns[column]; ok {
+			assignments = append(assignments, soundexColumn+" = ?")
+			args = append(args, Soundex(fieldsToUpdate[column]))
+		}
+	}
+	args = append(args, caller.TenantID, userID)
+
 	updateTemplate := fmt.Sprintf(`UPDATE Users
-						SET %s
-						WHERE user_id = ?;`, strings.TrimSuffix(updates, ","))
+						SET %s, version = version + 1, updated_at = UTC_TIMESTAMP()
+						WHERE tenant_id = ? AND user_id = ?;`, strings.Join(assignments, ", "))
 	log.WithField("UserID", userID).Debugf("update query: %s", updateTemplate)
-	results, err := c.db.Exec(updateTemplate, userID)
-	if err != nil {
+	if _, err := tx.Exec(updateTemplate, args...); err != nil {
 		log.WithError(err).WithField("UserID", userID).Error("could not update user due to error running query")
 		return BACKEND_ERROR
 	}
-	rows, err := results.RowsAffected()
-	if err != nil {
-		log.WithError(err).WithField("UserID", userID).Error("could not update user due to error with result set")
+
+	changes := diffRecords(current, updated)
+	if err := insertAuditEntry(tx, caller, userID, "update", changes); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not audit user update")
 		return BACKEND_ERROR
-	} else if rows == 0 {
-		log.WithField("UserID", userID).Info("could not update user as they do not exist")
-		return NOT_FOUND
 	}
-	log.WithField("UserID", userID).Infof("updated user as follows: %s", updates)
- 	return UPDATED
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not commit update transaction")
+		return BACKEND_ERROR
+	}
+	log.WithField("UserID", userID).Infof("updated user fields: %v", changedFields(changes))
+	return UPDATED
+}
+
+//selectRecordForUpdate returns the provided user of the tenant if they are not deleted, locking their row until the
+//transaction ends. Returns VERSION_MISMATCH if expectedVersion is not 0 and the user is at a different version
+func selectRecordForUpdate(tx *sql.Tx, tenantID, userID string, expectedVersion int) (UserRecord, Status) {
+	records, status := queryRecords(tx, userColumns, `SELECT `+strings.Join(userColumns, ", ")+`
+						  FROM Users
+						  WHERE tenant_id = ? AND user_id = ? AND deleted_at IS NULL
+						  FOR UPDATE;`, tenantID, userID)
+	if status != OK {
+		return UserRecord{}, status
+	}
+	if len(records) == 0 {
+		return UserRecord{}, NOT_FOUND
+	}
+	if expectedVersion != 0 && records[0].Version != expectedVersion {
+		log.WithField("UserID", userID).Infof("user is at version %d not %d", records[0].Version, expectedVersion)
+		return records[0], VERSION_MISMATCH
+	}
+	return records[0], OK
+}
+
+//setColumn sets the field of the record stored in the provided column
+func setColumn(record *UserRecord, column, value string) {
+	switch column {
+	case "first_name":
+		record.FirstName = value
+	case "last_name":
+		record.LastName = value
+	case "password":
+		record.Password = value
+	case "nickname":
+		record.NickName = value
+	case "country":
+		record.Country = value
+	}
 }
 
 //RetrieveRecords will find all users matching the provided parameters in the DB
-func (c *Client) RetrieveRecords(fieldsToUpdate map[string]string) ([]UserRecord, Status) {
-	var results []UserRecord
-	var whereClause string
-	clause := "WHERE "
-	for k,v := range fieldsToUpdate {
-		whereClause = fmt.Sprintf("%s %s='%s'", clause, k, v)
-		clause = " AND"
+func (c *Client) RetrieveRecords(searchCriteria SearchCriteria) ([]UserRecord, Status) {
+	whereClause, args, err := buildWhereClause(searchCriteria)
+	if err != nil {
+		log.WithError(err).Error("invalid search criteria")
+		return nil, BACKEND_ERROR
 	}
 
-	retrieveTemplate := fmt.Sprintf(`SELECT user_id as userID, first_name AS firstName, last_name AS lastName, email, password, nickname, country
+	columns, err := selectColumns(searchCriteria.Columns)
+	if err != nil {
+		log.WithError(err).Error("invalid columns")
+		return nil, BACKEND_ERROR
+	}
+
+	retrieveTemplate := fmt.Sprintf(`SELECT %s
 						  FROM Users
 						  %s 
-							ORDER BY userID DESC;`, whereClause)
+							ORDER BY user_id DESC;`, strings.Join(columns, ", "), whereClause)
 	log.Debugf("retrieve query is %s", retrieveTemplate)
 
-	statement, err := c.db.Prepare(retrieveTemplate)
+	results, status := queryRecords(c.db, columns, retrieveTemplate, args...)
+	if status != OK {
+		return results, status
+	}
+	if len(results) == 0 {
+		log.Infof("found no users matching criteria: %s", searchCriteria.Fields)
+		return results, NOT_FOUND
+	}
+
+	log.Infof("users matching criteria are: %v", results)
+	return results, OK
+}
+
+//ScanRecords returns up to limit users matching the provided parameters in the DB whose user ID
+//comes after the provided one, in user ID order. Used to page through the whole table
+func (c *Client) ScanRecords(searchCriteria SearchCriteria, afterUserID string, limit int) ([]UserRecord, Status) {
+	whereClause, args, err := buildWhereClause(searchCriteria)
 	if err != nil {
-		log.WithError(err).Error("failed to prepare query template")
-		return results, BACKEND_ERROR
+		log.WithError(err).Error("invalid search criteria")
+		return nil, BACKEND_ERROR
+	}
+	//the user ID is the cursor so is always selected
+	columns, err := selectColumns(searchCriteria.Columns, "user_id")
+	if err != nil {
+		log.WithError(err).Error("invalid columns")
+		return nil, BACKEND_ERROR
 	}
-	defer statement.Close()
+	whereClause += " AND user_id > ?"
+	args = append(args, afterUserID, limit)
 
-	var userID, firstName, lastName, email, password, nickname, country sql.NullString
+	scanTemplate := fmt.Sprintf(`SELECT %s
+						  FROM Users
+						  %s
+							ORDER BY user_id ASC
+							LIMIT ?;`, strings.Join(columns, ", "), whereClause)
+	log.Debugf("scan query is %s", scanTemplate)
 
-	rows, err := statement.Query()
-	defer rows.Close()
+	results, status := queryRecords(c.db, columns, scanTemplate, args...)
+	if status != OK {
+		return results, status
+	}
+	if len(results) == 0 {
+		return results, NOT_FOUND
+	}
+	return results, OK
+}
+
+//userColumns are every column of a user, selected by changes which need the whole user e.g. to audit them
+var userColumns = []string{"user_id", "first_name", "last_name", "email", "password", "nickname", "country", "deleted_at", "version", "created_at", "updated_at"}
+
+//readableColumns are the columns selected by reads when no columns are requested
+var readableColumns = []string{"user_id", "first_name", "last_name", "email", "nickname", "country", "deleted_at", "version", "created_at", "updated_at"}
+
+//sensitiveColumns can never be selected by reads, whatever columns are requested. Columns holding password hashes
+//or tokens must be added here
+var sensitiveColumns = map[string]bool{
+	"password": true,
+}
+
+//selectColumns returns the requested columns, or readableColumns if none are, followed by any required columns
+//which were not requested
+func selectColumns(requested []string, required ...string) ([]string, error) {
+	if len(requested) == 0 {
+		return readableColumns, nil
+	}
+	columns := make([]string, 0, len(requested)+len(required))
+	selected := make(map[string]bool)
+	for _, column := range requested {
+		if sensitiveColumns[column] {
+			return nil, fmt.Errorf("column %s can never be selected", column)
+		}
+		if !isReadableColumn(column) {
+			return nil, fmt.Errorf("cannot select column %s", column)
+		}
+		if !selected[column] {
+			columns = append(columns, column)
+			selected[column] = true
+		}
+	}
+	for _, column := range required {
+		if !selected[column] {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+func isReadableColumn(column string) bool {
+	for _, readable := range readableColumns {
+		if readable == column {
+			return true
+		}
+	}
+	return false
+}
+
+//queryer is implemented by both sql.DB and sql.Tx
+type queryer interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+//queryRecords runs a query selecting the columns and scans the resulting rows. Columns which are not selected are
+//left empty
+func queryRecords(q queryer, columns []string, query string, args ...interface{}) ([]UserRecord, Status) {
+	var results []UserRecord
+	rows, err := q.Query(query, args...)
 	if err != nil {
 		log.WithError(err).Error("failed to execute query template")
 		return results, BACKEND_ERROR
 	}
+	defer rows.Close()
 
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		targets[i] = scanTarget(column)
+	}
 	for rows.Next() {
-		rows.Scan(&userID, &firstName, &lastName, &email, &password, &nickname, &country)
-		results = append(results, UserRecord{
-			UserID: validateString(userID),
-			FirstName: validateString(firstName),
-			LastName: validateString(lastName),
-			EmailAddress:  validateString(email),
-			Password: validateString(password),
-			NickName: validateString(nickname),
-			Country: validateString(country),
-		})
+		if err := rows.Scan(targets...); err != nil {
+			log.WithError(err).Error("failed to read query results")
+			return results, BACKEND_ERROR
+		}
+		var record UserRecord
+		for i, column := range columns {
+			setScanned(&record, column, targets[i])
+		}
+		results = append(results, record)
 	}
-	if len(results) == 0 {
-		log.Infof("found no users matching criteria: %s", fieldsToUpdate)
-		return results, NOT_FOUND
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Error("failed to read query results")
+		return results, BACKEND_ERROR
 	}
-
-	log.Infof("users matching criteria are: %v", results)
 	return results, OK
 }
 
+//scanTarget returns a value the column can be scanned into
+func scanTarget(column string) interface{} {
+	switch column {
+	case "deleted_at":
+		return &mysql.NullTime{}
+	case "version":
+		return new(int)
+	case "created_at", "updated_at":
+		return new(time.Time)
+	default:
+		return &sql.NullString{}
+	}
+}
+
+//setScanned sets the field of the record stored in the column from the value scanned by its scanTarget
+func setScanned(record *UserRecord, column string, target interface{}) {
+	switch column {
+	case "user_id":
+		record.UserID = validateString(*target.(*sql.NullString))
+	case "email":
+		record.EmailAddress = validateString(*target.(*sql.NullString))
+	case "deleted_at":
+		record.DeletedAt = validateTime(*target.(*mysql.NullTime))
+	case "version":
+		record.Version = *target.(*int)
+	case "created_at":
+		record.CreatedAt = utcTime(*target.(*time.Time))
+	case "updated_at":
+		record.UpdatedAt = utcTime(*target.(*time.Time))
+	default:
+		setColumn(record, column, validateString(*target.(*sql.NullString)))
+	}
+}
+
+//searchableColumns are the columns users may be searched by
+var searchableColumns = map[string]bool{
+	"user_id": true,
+	"first_name": true,
+	"last_name": true,
+	"email": true,
+	"nickname": true,
+	"country": true,
+}
+
+//buildWhereClause returns a WHERE clause matching all of the provided criteria along with its arguments. The clause
+//always restricts users to the criteria's tenant
+func buildWhereClause(searchCriteria SearchCriteria) (string, []interface{}, error) {
+	if searchCriteria.TenantID == "" {
+		return "", nil, errNoTenant
+	}
+	columns := make([]string, 0, len(searchCriteria.Fields))
+	for k := range searchCriteria.Fields {
+		if !searchableColumns[k] {
+			return "", nil, fmt.Errorf("cannot search by column %s", k)
+		}
+		columns = append(columns, k)
+	}
+	//sort so that identical criteria always produce the same query
+	sort.Strings(columns)
+
+	conditions := []string{"tenant_id = ?"}
+	args := []interface{}{searchCriteria.TenantID}
+	for _, column := range columns {
+		conditions = append(conditions, column+" = ?")
+		args = append(args, searchCriteria.Fields[column])
+	}
+	for _, timeRange := range []struct {
+		condition string
+		value time.Time
+	}{
+		{"created_at > ?", searchCriteria.CreatedAfter},
+		{"created_at < ?", searchCriteria.CreatedBefore},
+		{"updated_at > ?", searchCriteria.UpdatedAfter},
+		{"updated_at < ?", searchCriteria.UpdatedBefore},
+	} {
+		if !timeRange.value.IsZero() {
+			conditions = append(conditions, timeRange.condition)
+			args = append(args, timeRange.value.UTC())
+		}
+	}
+	if !searchCriteria.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
 func validateString(value sql.NullString) string {
 	if value.Valid {
 		return value.String
@@ -176,13 +807,93 @@ func validateString(value sql.NullString) string {
 	return ""
 }
 
-//DeleteRecord will attempt to remove the provided user from the DB
-func (c *Client) DeleteRecord(userID string) Status {
-	deleteTemplate := `DELETE FROM Users
-					   WHERE user_id = ?;`
-	results, err := c.db.Exec(deleteTemplate, userID)
+//utcTime returns a pointer to the provided time in UTC, which is how times are stored
+func utcTime(value time.Time) *time.Time {
+	utc := value.UTC()
+	return &utc
+}
+
+func validateTime(value mysql.NullTime) *time.Time {
+	if value.Valid {
+		return &value.Time
+	}
+	return nil
+}
+
+//DeleteRecord will attempt to soft delete the provided user in the DB. Deleted users are hidden
+//from searches until they are restored, or purged once they have been deleted for long enough.
+//If expectedVersion is not 0 the user is only deleted if they are still at that version
+func (c *Client) DeleteRecord(caller Caller, userID string, expectedVersion int) Status {
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", userID).Error("could not delete user in db")
+		return BACKEND_ERROR
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not start delete transaction")
+		return BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	if _, status := selectRecordForUpdate(tx, caller.TenantID, userID, expectedVersion); status != OK {
+		if status == NOT_FOUND {
+			log.WithField("UserID", userID).Info("could not delete user from db as they do not exist")
+		}
+		return status
+	}
+	deleteTemplate := `UPDATE Users
+					   SET deleted_at = UTC_TIMESTAMP(), version = version + 1, updated_at = UTC_TIMESTAMP()
+					   WHERE tenant_id = ? AND user_id = ?;`
+	if _, err := tx.Exec(deleteTemplate, caller.TenantID, userID); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not delete user in db")
+		return BACKEND_ERROR
+	}
+
+	if err := insertAuditEntry(tx, caller, userID, "delete", nil); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not audit user delete")
+		return BACKEND_ERROR
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not commit delete transaction")
+		return BACKEND_ERROR
+	}
+	log.WithField("UserID", userID).Info("user deleted from db")
+	return DELETED
+}
+
+//RestoreRecord will attempt to undo the soft deletion of the provided user in the DB
+func (c *Client) RestoreRecord(caller Caller, userID string) Status {
+	restoreTemplate := `UPDATE Users
+					   SET deleted_at = NULL, version = version + 1, updated_at = UTC_TIMESTAMP()
+					   WHERE tenant_id = ? AND user_id = ? AND deleted_at IS NOT NULL;`
+	status := c.execAudited(caller, userID, "restore", restoreTemplate, caller.TenantID, userID)
+	switch status {
+	case OK:
+		log.WithField("UserID", userID).Info("user restored in db")
+		return RESTORED
+	case NOT_FOUND:
+		log.WithField("UserID", userID).Info("could not restore user as there is no deleted user with this ID")
+	}
+	return status
+}
+
+//execAudited runs a statement changing a single user and records the action in the audit trail in the
+//same transaction. Returns NOT_FOUND if the statement did not change the user
+func (c *Client) execAudited(caller Caller, userID, action, query string, args ...interface{}) Status {
+	if caller.TenantID == "" {
+		log.WithError(errNoTenant).WithField("UserID", userID).Errorf("could not %s user in db", action)
+		return BACKEND_ERROR
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).WithField("UserID", userID).Errorf("could not start %s transaction", action)
+		return BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	results, err := tx.Exec(query, args...)
 	if err != nil {
-		log.WithError(err).WithField("UserID", userID).Error("could not delete user from db")
+		log.WithError(err).WithField("UserID", userID).Errorf("could not %s user in db", action)
 		return BACKEND_ERROR
 	}
 	rows, err := results.RowsAffected()
@@ -190,11 +901,80 @@ func (c *Client) DeleteRecord(userID string) Status {
 		log.WithError(err).WithField("UserID", userID).Error("error processing request")
 		return BACKEND_ERROR
 	} else if rows == 0 {
-		log.WithField("UserID", userID).Info("could not delete user from db as they do not exist")
 		return NOT_FOUND
 	}
-	log.WithField("UserID", userID).Info("user removed from db")
-	return DELETED
+
+	if err := insertAuditEntry(tx, caller, userID, action, nil); err != nil {
+		log.WithError(err).WithField("UserID", userID).Errorf("could not audit user %s", action)
+		return BACKEND_ERROR
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).WithField("UserID", userID).Errorf("could not commit %s transaction", action)
+		return BACKEND_ERROR
+	}
+	return OK
+}
+
+//PurgeRecords will permanently remove users of every tenant soft deleted before the provided time from the DB,
+//returning the IDs of the purged users by tenant
+func (c *Client) PurgeRecords(deletedBefore time.Time) (map[string][]string, Status) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.WithError(err).Error("could not start purge transaction")
+		return nil, BACKEND_ERROR
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT tenant_id, user_id FROM Users WHERE deleted_at < ? ORDER BY tenant_id, user_id FOR UPDATE;`, deletedBefore)
+	if err != nil {
+		log.WithError(err).Error("could not find users to purge")
+		return nil, BACKEND_ERROR
+	}
+	purged := make(map[string][]string)
+	var tenantIDs []string
+	total := 0
+	for rows.Next() {
+		var tenantID, userID string
+		if err := rows.Scan(&tenantID, &userID); err != nil {
+			rows.Close()
+			log.WithError(err).Error("could not read users to purge")
+			return nil, BACKEND_ERROR
+		}
+		if _, ok := purged[tenantID]; !ok {
+			tenantIDs = append(tenantIDs, tenantID)
+		}
+		purged[tenantID] = append(purged[tenantID], userID)
+		total++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Error("could not read users to purge")
+		return nil, BACKEND_ERROR
+	}
+	if total == 0 {
+		return purged, OK
+	}
+
+	if _, err := tx.Exec(`DELETE FROM Users WHERE deleted_at < ?;`, deletedBefore); err != nil {
+		log.WithError(err).Error("could not purge users from db")
+		return nil, BACKEND_ERROR
+	}
+	for _, tenantID := range tenantIDs {
+		caller := purgeCaller
+		caller.TenantID = tenantID
+		for _, userID := range purged[tenantID] {
+			if err := insertAuditEntry(tx, caller, userID, "purge", nil); err != nil {
+				log.WithError(err).WithField("UserID", userID).Error("could not audit user purge")
+				return nil, BACKEND_ERROR
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Error("could not commit purge transaction")
+		return nil, BACKEND_ERROR
+	}
+	log.Infof("purged %d users of %d tenants deleted before %s", total, len(tenantIDs), deletedBefore.Format(time.RFC3339))
+	return purged, OK
 }
 
 //ActiveConnection will check if still connected to DB
@@ -7,7 +7,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -15,7 +17,11 @@ const (
 	caesar  = "ff7dfd22-9134-429b-9482-0888ffdfc64b"
 )
 
+//testTenant is the tenant of the users added by populateUserTable
+const testTenant = DefaultTenant
+
 var client Client
+var testCaller = Caller{Actor: "tester", RequestID: "test-request", SourceIP: "127.0.0.1", TenantID: testTenant}
 var noMatch []UserRecord
 
 func init() {
@@ -53,6 +59,15 @@ func TestClient_GetUsersFromDB(t *testing.T) {
 			resultFilePath: "./fixtures/ukUsers.json",
 			expectedStatus: OK,
 		},
+		{
+			testName: "GetUser_MultipleCriteria",
+			parameters: map[string]string{
+				"country": "United Kingdom",
+				"first_name": "John",
+			},
+			resultFilePath: "./fixtures/johnSmithList.json",
+			expectedStatus: OK,
+		},
 		{
 			testName: "GetUser_NoMatch",
 			parameters: map[string]string{
@@ -65,12 +80,12 @@ func TestClient_GetUsersFromDB(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.testName, func(t *testing.T) {
-			record, status := client.RetrieveRecords(test.parameters)
+			record, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: test.parameters})
 			assert.Equal(t, test.expectedStatus, status, "test failed: could not retrieve users")
 			if test.resultFilePath != "" {
 				expectedRecord, err := readFileAndDecode(t, test.resultFilePath)
 				assert.NoError(t, err, "test failed: could not decode user json")
-				assert.Equal(t, expectedRecord, record, "test failed: found record does not match expected")
+				assert.Equal(t, withoutPasswords(expectedRecord), withoutTimestamps(t, record), "test failed: found record does not match expected")
 				return
 			}
 			assert.Equal(t, noMatch, record, "test failed: found record does not match expected")
@@ -78,6 +93,259 @@ func TestClient_GetUsersFromDB(t *testing.T) {
 	}
 }
 
+func TestClient_ScanUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+
+	//pages through users in user ID order
+	page, status := client.ScanRecords(SearchCriteria{TenantID: testTenant}, "", 2)
+	assert.Equal(t, OK, status, "test failed: could not scan users")
+	assert.Equal(t, []string{janeDoe, "325ef78c-f0ac-424b-814d-7c7cd03ec44d"}, userIDs(page))
+
+	page, status = client.ScanRecords(SearchCriteria{TenantID: testTenant}, "325ef78c-f0ac-424b-814d-7c7cd03ec44d", 2)
+	assert.Equal(t, OK, status, "test failed: could not scan users")
+	assert.Equal(t, []string{"b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59", "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}, userIDs(page))
+
+	page, status = client.ScanRecords(SearchCriteria{TenantID: testTenant}, "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", 2)
+	assert.Equal(t, OK, status, "test failed: could not scan users")
+	assert.Equal(t, []string{caesar}, userIDs(page))
+
+	_, status = client.ScanRecords(SearchCriteria{TenantID: testTenant}, caesar, 2)
+	assert.Equal(t, NOT_FOUND, status, "test failed: should be no users after the last one")
+
+	//applies search criteria
+	page, status = client.ScanRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"country": "United Kingdom"}}, "", 10)
+	assert.Equal(t, OK, status, "test failed: could not scan users")
+	assert.Equal(t, []string{"b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59", "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}, userIDs(page))
+
+	//always selects the user ID used as the cursor
+	page, status = client.ScanRecords(SearchCriteria{TenantID: testTenant, Columns: []string{"nickname"}}, "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", 2)
+	assert.Equal(t, OK, status, "test failed: could not scan users")
+	assert.Equal(t, []UserRecord{{UserID: caesar, NickName: "ETuBrute"}}, page)
+}
+
+func TestClient_CountAndGroupUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+
+	count, status := client.CountRecords(SearchCriteria{TenantID: testTenant})
+	assert.Equal(t, OK, status, "test failed: could not count users")
+	assert.Equal(t, 5, count)
+
+	count, status = client.CountRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"country": "France"}})
+	assert.Equal(t, OK, status, "test failed: counting no users is not an error")
+	assert.Equal(t, 0, count)
+
+	//largest groups come first, then groups are in value order
+	groups, status := client.GroupRecords(SearchCriteria{TenantID: testTenant}, "country")
+	assert.Equal(t, OK, status, "test failed: could not group users")
+	assert.Equal(t, []GroupCount{
+		{"United Kingdom", 2},
+		{"Egypt", 1},
+		{"Italy", 1},
+		{"United States of America", 1},
+	}, groups)
+
+	//applies search criteria and ignores soft deleted users
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, "b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59", 0))
+	groups, status = client.GroupRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"country": "United Kingdom"}}, "first_name")
+	assert.Equal(t, OK, status, "test failed: could not group users")
+	assert.Equal(t, []GroupCount{{"John", 1}}, groups)
+
+	_, status = client.GroupRecords(SearchCriteria{TenantID: testTenant}, "email")
+	assert.Equal(t, BACKEND_ERROR, status, "test failed: should not group by unique columns")
+}
+
+func TestClient_SearchUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+
+	search := func(criteria SearchCriteria, query string) []string {
+		results, status := client.SearchRecords(criteria, query, 10)
+		assert.Equal(t, OK, status, "test failed: could not search users")
+		var userIDs []string
+		for _, result := range results {
+			assert.Empty(t, result.User.Password, "test failed: passwords should never be read")
+			assert.True(t, result.Relevance > 0, "test failed: results should be relevant")
+			userIDs = append(userIDs, result.User.UserID)
+		}
+		return userIDs
+	}
+
+	for _, index := range []string{"full-text", "like"} {
+		//matches word prefixes in any searched column
+		assert.Equal(t, []string{"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}, search(SearchCriteria{TenantID: testTenant}, "smithy"), index)
+		//every term must match
+		assert.Equal(t, []string{"b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59"}, search(SearchCriteria{TenantID: testTenant}, "james bond"), index)
+		//emails are searched by their parts
+		assert.Equal(t, []string{janeDoe}, search(SearchCriteria{TenantID: testTenant}, "jane.doe@gmail"), index)
+		//applies search criteria
+		assert.Equal(t, []string{"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}, search(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"country": "United Kingdom"}}, "john"), index)
+		assert.Empty(t, search(SearchCriteria{TenantID: testTenant}, "brutus"), index)
+
+		//tables created before the FULLTEXT index was added are searched with LIKE
+		if index == "full-text" {
+			_, err := client.db.Exec("ALTER TABLE Users DROP INDEX user_search")
+			assert.NoError(t, err, "test failed: could not drop full-text index")
+		}
+	}
+}
+
+func TestClient_DuplicateCandidates(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+
+	johnSmith := UserRecord{UserID: "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", FirstName: "John", LastName: "Smith", EmailAddress: "john.smith@gmail.com"}
+	candidates, status := client.RetrieveDuplicateCandidates(testTenant, johnSmith)
+	assert.Equal(t, OK, status, "test failed: could not retrieve candidates")
+	assert.Empty(t, candidates, "test failed: no other users are candidates")
+
+	//users whose last names sound alike or whose emails share their local part are candidates
+	for _, user := range []UserRecord{
+		{UserID: "a0", FirstName: "Jon", LastName: "Smyth", EmailAddress: "jon@example.com", Password: "password5", NickName: "jonny", Country: "United Kingdom"},
+		{UserID: "b0", FirstName: "Johnny", LastName: "Doe", EmailAddress: "johnsmith+shop@googlemail.com", Password: "password6", NickName: "jd", Country: "Ireland"},
+		{UserID: "c0", FirstName: "Johnny", LastName: "Doe", EmailAddress: "JohnSmith@example.com", Password: "password7", NickName: "jd", Country: "Ireland"},
+		//dots are only ignored in Gmail addresses
+		{UserID: "d0", FirstName: "Johnny", LastName: "Doe", EmailAddress: "john.smith@example.com", Password: "password8", NickName: "jd", Country: "Ireland"},
+	} {
+		assert.Equal(t, CREATED, client.CreateRecord(testCaller, user))
+	}
+	candidates, status = client.RetrieveDuplicateCandidates(testTenant, johnSmith)
+	assert.Equal(t, OK, status, "test failed: could not retrieve candidates")
+	assert.Equal(t, []string{"a0", "b0", "c0"}, userIDs(candidates))
+
+	//the email_key column holds the same key as EmailLocalKey
+	rows, err := client.db.Query("SELECT email, email_key FROM Users WHERE tenant_id = ?", testTenant)
+	assert.NoError(t, err, "test failed: could not read email keys")
+	for rows.Next() {
+		var email, key string
+		assert.NoError(t, rows.Scan(&email, &key))
+		assert.Equal(t, EmailLocalKey(email), key, "test failed: wrong email key of "+email)
+	}
+	assert.NoError(t, rows.Close())
+	assert.Empty(t, candidates[0].Password, "test failed: passwords should never be read")
+
+	//the last_name_soundex column holds the same code as Soundex, rather than MySQL's SOUNDEX, as names are updated
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, "d0", map[string]string{"last_name": "Tymczak"}, 0))
+	rows, err = client.db.Query("SELECT last_name, last_name_soundex FROM Users WHERE tenant_id = ? AND user_id IN ('a0', 'b0', 'c0', 'd0')", testTenant)
+	assert.NoError(t, err, "test failed: could not read soundex codes")
+	for rows.Next() {
+		var lastName, code string
+		assert.NoError(t, rows.Scan(&lastName, &code))
+		assert.Equal(t, Soundex(lastName), code, "test failed: wrong soundex code of "+lastName)
+	}
+	assert.NoError(t, rows.Close())
+
+	//deleted users are not candidates
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, "a0", 0))
+	candidates, status = client.RetrieveDuplicateCandidates(testTenant, johnSmith)
+	assert.Equal(t, OK, status, "test failed: could not retrieve candidates")
+	assert.Equal(t, []string{"b0", "c0"}, userIDs(candidates))
+}
+
+func TestClient_MergeUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	cleo := "325ef78c-f0ac-424b-814d-7c7cd03ec44d"
+
+	//resolves each column with its strategy, keeping the target's value by default
+	strategies := map[string]MergeStrategy{"nickname": KEEP_SOURCE, "country": KEEP_NON_EMPTY, "password": KEEP_SOURCE}
+	survivor, status := client.MergeRecords(testCaller, janeDoe, cleo, strategies, 1)
+	assert.Equal(t, MERGED, status, "test failed: could not merge users")
+	assert.Equal(t, []UserRecord{{UserID: janeDoe, FirstName: "Jane", LastName: "Doe", EmailAddress: "jane.doe@gmail.com", NickName: "Cle0", Country: "United States of America", Version: 2}},
+		withoutTimestamps(t, []UserRecord{survivor}))
+	var password string
+	assert.NoError(t, client.db.QueryRow("SELECT password FROM Users WHERE user_id = ?", janeDoe).Scan(&password))
+	assert.Equal(t, "password3", password, "test failed: password should be taken from the source")
+
+	//the source is deleted and aliased to the survivor
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": cleo}})
+	assert.Equal(t, NOT_FOUND, status, "test failed: merged user should be deleted")
+	alias, status := client.RetrieveAlias(testTenant, cleo)
+	assert.Equal(t, OK, status, "test failed: could not retrieve alias")
+	assert.Equal(t, janeDoe, alias)
+	_, status = client.RetrieveAlias(testTenant, janeDoe)
+	assert.Equal(t, NOT_FOUND, status, "test failed: survivor should not be aliased")
+
+	history, _, status := client.RetrieveAuditEntries(testTenant, cleo, 1, 0)
+	assert.Equal(t, OK, status, "test failed: could not retrieve history")
+	assert.Equal(t, "merge", history[0].Action)
+	assert.Equal(t, []FieldChange{{Field: "mergedInto", To: janeDoe}}, history[0].Changes)
+
+	//deleted and missing users cannot be merged
+	survivor, status = client.MergeRecords(testCaller, janeDoe, cleo, nil, 0)
+	assert.Equal(t, NOT_FOUND, status, "test failed: deleted users cannot be merged")
+	assert.Equal(t, janeDoe, survivor.UserID, "test failed: target should be returned when the source does not exist")
+	survivor, status = client.MergeRecords(testCaller, cleo, janeDoe, nil, 0)
+	assert.Equal(t, NOT_FOUND, status, "test failed: deleted users cannot be merged into")
+	assert.Empty(t, survivor.UserID)
+
+	//the target must be at the expected version
+	_, status = client.MergeRecords(testCaller, caesar, janeDoe, nil, 2)
+	assert.Equal(t, VERSION_MISMATCH, status)
+	_, status = client.MergeRecords(testCaller, caesar, janeDoe, nil, 1)
+	assert.Equal(t, MERGED, status, "test failed: could not merge users")
+
+	//aliases of a merged user resolve to who they are merged into
+	alias, status = client.RetrieveAlias(testTenant, cleo)
+	assert.Equal(t, OK, status, "test failed: could not retrieve alias")
+	assert.Equal(t, caesar, alias)
+}
+
+func TestClient_SelectColumns(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	byID := SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}}
+
+	//only selects the requested columns
+	byID.Columns = []string{"first_name", "country"}
+	records, status := client.RetrieveRecords(byID)
+	assert.Equal(t, OK, status, "test failed: could not retrieve user")
+	assert.Equal(t, []UserRecord{{FirstName: "Julius", Country: "Italy"}}, records)
+
+	//never selects sensitive columns
+	byID.Columns = []string{"first_name", "password"}
+	_, status = client.RetrieveRecords(byID)
+	assert.Equal(t, BACKEND_ERROR, status, "test failed: should not select passwords")
+	byID.Columns = []string{"address"}
+	_, status = client.RetrieveRecords(byID)
+	assert.Equal(t, BACKEND_ERROR, status, "test failed: should not select unknown columns")
+
+	byID.Columns = nil
+	records, _ = client.RetrieveRecords(byID)
+	assert.Empty(t, records[0].Password, "test failed: passwords should not be read by default")
+}
+
 func TestClient_AddUpdateDeleteUsers(t *testing.T) {
 	var err error
 	var status Status
@@ -96,16 +364,17 @@ func TestClient_AddUpdateDeleteUsers(t *testing.T) {
 		Country: "Italy",
 	}
 	//can create user
-	status = client.CreateRecord(startingUser)
+	status = client.CreateRecord(testCaller, startingUser)
 	assert.Equal(t, CREATED, status, "test failed: could not create user: "+caesar)
 
 	//can return new user
-	readRecord, status := client.RetrieveRecords(map[string]string{"user_id": caesar})
+	readRecord, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
 	assert.Equal(t, OK, status, "test failed: could not retrieve user: "+caesar)
-	assert.Equal(t, startingUser, readRecord[0])
+	startingUser.Version = 1
+	assert.Equal(t, withoutPasswords([]UserRecord{startingUser}), withoutTimestamps(t, readRecord))
 
 	//return error when re-creating existing user_id
-	status = client.CreateRecord(startingUser)
+	status = client.CreateRecord(testCaller, startingUser)
 	assert.Equal(t, ALREADY_EXISTS, status, "test failed: could not re-create user with same id")
 
 
@@ -117,15 +386,16 @@ func TestClient_AddUpdateDeleteUsers(t *testing.T) {
 		Password: "password4",
 		NickName: "eTuBrute",
 		Country: "Italy",
+		Version: 2,
 	}
 	//can update field
-	status = client.UpdateRecord(caesar, map[string]string{"nickname": "eTuBrute"})
+	status = client.UpdateRecord(testCaller, caesar, map[string]string{"nickname": "eTuBrute"}, 0)
 	assert.Equal(t, UPDATED, status, "test failed: could not update user")
 
 	//field has been updated
-	updatedRecord, status := client.RetrieveRecords(map[string]string{"user_id": caesar})
+	updatedRecord, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
 	assert.Equal(t, OK, status, "test failed: could not update user: "+caesar)
-	assert.Equal(t, updatedUser, updatedRecord[0])
+	assert.Equal(t, withoutPasswords([]UserRecord{updatedUser}), withoutTimestamps(t, updatedRecord))
 
 	newUpdatedUser := UserRecord{
 		UserID: "ff7dfd22-9134-429b-9482-0888ffdfc64b",
@@ -135,28 +405,615 @@ func TestClient_AddUpdateDeleteUsers(t *testing.T) {
 		Password: "password4",
 		NickName: "KingOfRome",
 		Country: "Italy",
+		Version: 3,
 	}
 	//can update multiple fields
-	status = client.UpdateRecord(caesar, map[string]string{"nickname": "KingOfRome","first_name":"Augustus"})
+	status = client.UpdateRecord(testCaller, caesar, map[string]string{"nickname": "KingOfRome","first_name":"Augustus"}, 0)
 	assert.Equal(t, UPDATED, status, "test failed: could not update user")
 
 	//both fields have been updated
-	newUpdatedRecord, status := client.RetrieveRecords(map[string]string{"user_id": caesar})
+	newUpdatedRecord, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
 	assert.Equal(t, OK, status, "test failed: could not retrieve user: "+caesar)
-	assert.Equal(t, newUpdatedUser, newUpdatedRecord[0])
+	assert.Equal(t, withoutPasswords([]UserRecord{newUpdatedUser}), withoutTimestamps(t, newUpdatedRecord))
 
 	//can delete record from db
-	status = client.DeleteRecord(caesar)
+	status = client.DeleteRecord(testCaller, caesar, 0)
 	assert.Equal(t, DELETED, status,"test failed: could not delete user")
 
 	//no results were returned for deleted record
-	deletedRecord, status := client.RetrieveRecords(map[string]string{"user_id": caesar})
+	deletedRecord, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
 	assert.Equal(t, NOT_FOUND, status, "test failed: should not retrieve user: "+caesar)
 	assert.Equal(t, noMatch, deletedRecord)
 
 	//Deleting non-existing user results in sql no rows error
-	status = client.DeleteRecord(caesar)
+	status = client.DeleteRecord(testCaller, caesar, 0)
+	assert.Equal(t, NOT_FOUND, status)
+}
+
+func TestClient_SoftDeleteRestorePurgeUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	byID := SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}}
+
+	status := client.DeleteRecord(testCaller, janeDoe, 0)
+	assert.Equal(t, DELETED, status, "test failed: could not delete user")
+
+	//deleted users can only be found when asked for
+	_, status = client.RetrieveRecords(byID)
+	assert.Equal(t, NOT_FOUND, status, "test failed: deleted user should be hidden")
+	byID.IncludeDeleted = true
+	deleted, status := client.RetrieveRecords(byID)
+	assert.Equal(t, OK, status, "test failed: could not retrieve deleted user")
+	assert.NotNil(t, deleted[0].DeletedAt, "test failed: deleted user should have deletion time")
+
+	//deleted users cannot be updated
+	status = client.UpdateRecord(testCaller, janeDoe, map[string]string{"nickname": "GIJoe"}, 0)
+	assert.Equal(t, NOT_FOUND, status, "test failed: should not update deleted user")
+
+	status = client.RestoreRecord(testCaller, janeDoe)
+	assert.Equal(t, RESTORED, status, "test failed: could not restore user")
+	status = client.RestoreRecord(testCaller, janeDoe)
+	assert.Equal(t, NOT_FOUND, status, "test failed: should not restore user who is not deleted")
+	restored, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}})
+	assert.Equal(t, OK, status, "test failed: could not retrieve restored user")
+	assert.Nil(t, restored[0].DeletedAt)
+
+	//only users deleted before the cut off are purged
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, janeDoe, 0))
+	purged, status := client.PurgeRecords(time.Now().UTC().Add(-time.Hour))
+	assert.Equal(t, OK, status, "test failed: could not purge users")
+	assert.Empty(t, purged)
+
+	purged, status = client.PurgeRecords(time.Now().UTC().Add(time.Hour))
+	assert.Equal(t, OK, status, "test failed: could not purge users")
+	assert.Equal(t, map[string][]string{testTenant: {janeDoe}}, purged)
+	_, status = client.RetrieveRecords(byID)
+	assert.Equal(t, NOT_FOUND, status, "test failed: purged user should be removed")
+	assert.Equal(t, NOT_FOUND, client.RestoreRecord(testCaller, janeDoe), "test failed: purged user cannot be restored")
+}
+
+func TestClient_OptimisticConcurrency(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	byID := SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}}
+
+	records, status := client.RetrieveRecords(byID)
+	assert.Equal(t, OK, status)
+	assert.Equal(t, 1, records[0].Version, "test failed: new users should be at version 1")
+
+	//every change increments the version
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, janeDoe, map[string]string{"nickname": "GIJoe"}, 1))
+	records, _ = client.RetrieveRecords(byID)
+	assert.Equal(t, 2, records[0].Version)
+
+	//changes expecting an earlier version are rejected
+	assert.Equal(t, VERSION_MISMATCH, client.UpdateRecord(testCaller, janeDoe, map[string]string{"nickname": "GIJane"}, 1))
+	assert.Equal(t, VERSION_MISMATCH, client.DeleteRecord(testCaller, janeDoe, 1))
+	records, _ = client.RetrieveRecords(byID)
+	assert.Equal(t, "GIJoe", records[0].NickName, "test failed: stale update should not be applied")
+
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, janeDoe, 2))
+	assert.Equal(t, RESTORED, client.RestoreRecord(testCaller, janeDoe))
+	records, _ = client.RetrieveRecords(byID)
+	assert.Equal(t, 4, records[0].Version)
+
+	//unconditional changes apply to any version
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, janeDoe, map[string]string{"nickname": "GIJane"}, 0))
+}
+
+func TestClient_Timestamps(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	byID := SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}}
+
+	records, status := client.RetrieveRecords(byID)
+	assert.Equal(t, OK, status)
+	created := *records[0].CreatedAt
+
+	//MySQL datetimes have second precision so wait for updates to get a later time
+	time.Sleep(time.Second)
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, janeDoe, map[string]string{"nickname": "GIJoe"}, 0))
+	records, _ = client.RetrieveRecords(byID)
+	assert.Equal(t, created, *records[0].CreatedAt, "test failed: updates should not change creation time")
+	assert.True(t, records[0].UpdatedAt.After(created), "test failed: updates should change update time")
+
+	//range filters
+	updated, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, UpdatedAfter: created})
+	assert.Equal(t, OK, status)
+	assert.Equal(t, []string{janeDoe}, userIDs(updated))
+	notUpdated, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, UpdatedBefore: *records[0].UpdatedAt})
+	assert.Equal(t, OK, status)
+	assert.Len(t, notUpdated, 4)
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, CreatedAfter: *records[0].UpdatedAt})
+	assert.Equal(t, NOT_FOUND, status, "test failed: no users were created after the update")
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, CreatedBefore: created})
+	assert.Equal(t, NOT_FOUND, status, "test failed: no users were created before the first")
+}
+
+func TestClient_UpsertUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	const octavian = "0d7c3a6e-6f3c-4d6b-9f4e-5b2c1a8e7d90"
+	user := UserRecord{
+		UserID: octavian,
+		FirstName: "Gaius",
+		LastName: "Octavius",
+		EmailAddress: "octavian@gmail.com",
+		Password: "password5",
+		NickName: "Octavian",
+		Country: "Italy",
+	}
+
+	//creates users who do not exist
+	previous, status := client.UpsertRecord(testCaller, user, 0)
+	assert.Equal(t, CREATED, status, "test failed: could not create user")
+	assert.Equal(t, UserRecord{}, previous)
+
+	//replaces every field of users who exist
+	replacement := user
+	replacement.FirstName, replacement.NickName, replacement.EmailAddress = "Augustus", "FirstCitizen", "augustus@gmail.com"
+	previous, status = client.UpsertRecord(testCaller, replacement, 1)
+	assert.Equal(t, UPDATED, status, "test failed: could not replace user")
+	assert.Equal(t, "Octavian", previous.NickName, "test failed: should return user before replacement")
+	records, _ := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": octavian}})
+	replacement.Version = 2
+	assert.Equal(t, withoutPasswords([]UserRecord{replacement}), withoutTimestamps(t, records))
+
+	//stale versions, emails of other users and deleted users are rejected
+	_, status = client.UpsertRecord(testCaller, replacement, 1)
+	assert.Equal(t, VERSION_MISMATCH, status)
+	taken := replacement
+	taken.EmailAddress = "caesar@gmail.com"
+	_, status = client.UpsertRecord(testCaller, taken, 0)
+	assert.Equal(t, ALREADY_EXISTS, status, "test failed: should not take email of another user")
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, "Julius", records[0].FirstName, "test failed: user with duplicate email should not be replaced")
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, octavian, 0))
+	_, status = client.UpsertRecord(testCaller, replacement, 0)
+	assert.Equal(t, DELETED, status, "test failed: should not replace deleted user")
+
+	entries, _, _ := client.RetrieveAuditEntries(testTenant, octavian, 10, 0)
+	assert.Equal(t, []string{"delete", "update", "create"}, []string{entries[0].Action, entries[1].Action, entries[2].Action})
+}
+
+func TestClient_AuditTrail(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	defer client.clearTestDatabase()
+	user := UserRecord{
+		UserID: caesar,
+		FirstName: "Julius",
+		LastName: "Caesar",
+		EmailAddress: "caesar@gmail.com",
+		Password: "password4",
+		NickName: "KingOfRome",
+		Country: "Italy",
+	}
+	assert.Equal(t, CREATED, client.CreateRecord(testCaller, user))
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, caesar, map[string]string{"nickname": "eTuBrute", "password": "password5"}, 0))
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, caesar, 0))
+
+	//failed changes are not audited
+	assert.Equal(t, NOT_FOUND, client.DeleteRecord(testCaller, caesar, 0))
+	assert.Equal(t, ALREADY_EXISTS, client.CreateRecord(testCaller, user))
+
+	entries, total, status := client.RetrieveAuditEntries(testTenant, caesar, 10, 0)
+	assert.Equal(t, OK, status, "test failed: could not retrieve history")
+	assert.Equal(t, 3, total)
+	assert.Equal(t, []string{"delete", "update", "create"}, []string{entries[0].Action, entries[1].Action, entries[2].Action}, "test failed: history should be most recent first")
+	for _, entry := range entries {
+		assert.Equal(t, testCaller, Caller{Actor: entry.Actor, RequestID: entry.RequestID, SourceIP: entry.SourceIP, TenantID: testTenant})
+	}
+
+	//secrets are redacted from field changes
+	assert.Equal(t, []FieldChange{
+		{Field: "password", From: "[REDACTED]", To: "[REDACTED]"},
+		{Field: "nickname", From: "KingOfRome", To: "eTuBrute"},
+	}, entries[1].Changes)
+	assert.Contains(t, entries[2].Changes, FieldChange{Field: "password", From: "", To: "[REDACTED]"})
+
+	page, total, status := client.RetrieveAuditEntries(testTenant, caesar, 1, 1)
+	assert.Equal(t, OK, status)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, "update", page[0].Action, "test failed: could not page through history")
+
+	_, _, status = client.RetrieveAuditEntries(testTenant, janeDoe, 10, 0)
+	assert.Equal(t, NOT_FOUND, status, "test failed: user without changes should have no history")
+}
+
+func TestClient_BatchUsers(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+	const (
+		octavian = "0d7c3a6e-6f3c-4d6b-9f4e-5b2c1a8e7d90"
+		antony = "5a0c9b7e-3d2f-4e1a-8b6c-7d9e0f1a2b3c"
+	)
+	newUsers := []UserRecord{
+		{UserID: octavian, FirstName: "Gaius", LastName: "Octavius", EmailAddress: "octavian@gmail.com", Password: "password5", NickName: "Octavian", Country: "Italy"},
+		{UserID: antony, FirstName: "Mark", LastName: "Antony", EmailAddress: "caesar@gmail.com", Password: "password6", NickName: "Antony", Country: "Italy"},
+	}
+
+	//atomic batches are not applied if any user cannot be created
+	assert.Equal(t, []Status{ABORTED, ALREADY_EXISTS}, client.CreateRecords(testCaller, newUsers, true))
+	_, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": octavian}})
+	assert.Equal(t, NOT_FOUND, status, "test failed: aborted user should not be created")
+
+	//partial batches apply the users which can be changed
+	assert.Equal(t, []Status{CREATED, ALREADY_EXISTS}, client.CreateRecords(testCaller, newUsers, false))
+
+	//emails which differ only in case are the same email
+	const brutus = "8e1f2a3b-4c5d-4e6f-9a7b-8c9d0e1f2a3b"
+	assert.Equal(t, []Status{ALREADY_EXISTS, CREATED, ALREADY_EXISTS}, client.CreateRecords(testCaller, []UserRecord{
+		{UserID: antony, FirstName: "Mark", LastName: "Antony", EmailAddress: "Caesar@Gmail.com", Password: "password6", NickName: "Antony", Country: "Italy"},
+		{UserID: brutus, FirstName: "Marcus", LastName: "Brutus", EmailAddress: "brutus@gmail.com", Password: "password7", NickName: "Brutus", Country: "Italy"},
+		{UserID: "9f2a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b5c", FirstName: "Decimus", LastName: "Brutus", EmailAddress: "BRUTUS@gmail.com", Password: "password8", NickName: "Decimus", Country: "Italy"},
+	}, false))
+	assert.Equal(t, []Status{UPDATED, UPDATED, VERSION_MISMATCH, NOT_FOUND}, client.UpdateRecords(testCaller, []RecordUpdate{
+		{UserID: octavian, Fields: map[string]string{"first_name": "Augustus", "nickname": "FirstCitizen"}, ExpectedVersion: 1},
+		{UserID: janeDoe, Fields: map[string]string{"nickname": "GIJoe"}},
+		{UserID: caesar, Fields: map[string]string{"nickname": "Dictator"}, ExpectedVersion: 3},
+		{UserID: antony, Fields: map[string]string{"nickname": "Antony"}},
+	}, false))
+	records, _ := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": octavian}})
+	assert.Equal(t, []UserRecord{{UserID: octavian, FirstName: "Augustus", LastName: "Octavius", EmailAddress: "octavian@gmail.com",
+		NickName: "FirstCitizen", Country: "Italy", Version: 2}}, withoutTimestamps(t, records))
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}})
+	assert.Equal(t, "GIJoe", records[0].NickName, "test failed: each user should get their own update")
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, "ETuBrute", records[0].NickName, "test failed: stale update should not be applied")
+
+	assert.Equal(t, []Status{DELETED, DELETED}, client.DeleteRecords(testCaller, []RecordVersion{{UserID: octavian, ExpectedVersion: 2}, {UserID: janeDoe}}, true))
+	assert.Equal(t, []Status{NOT_FOUND, ABORTED}, client.DeleteRecords(testCaller, []RecordVersion{{UserID: octavian}, {UserID: caesar}}, true))
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, OK, status, "test failed: aborted user should not be deleted")
+
+	entries, _, _ := client.RetrieveAuditEntries(testTenant, octavian, 10, 0)
+	assert.Equal(t, []string{"delete", "update", "create"}, []string{entries[0].Action, entries[1].Action, entries[2].Action})
+	assert.Equal(t, []FieldChange{
+		{Field: "firstName", From: "Gaius", To: "Augustus"},
+		{Field: "nickname", From: "Octavian", To: "FirstCitizen"},
+	}, entries[1].Changes)
+}
+
+func TestClient_IdempotencyKeys(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	defer client.clearTestDatabase()
+	reservation := IdempotencyRecord{TenantID: testTenant, Key: "key-1", Fingerprint: "fingerprint", ExpiresAt: time.Now().Add(time.Hour)}
+
+	_, status := client.ReserveIdempotencyKey(reservation)
+	assert.Equal(t, CREATED, status, "test failed: could not reserve key")
+	existing, status := client.ReserveIdempotencyKey(reservation)
+	assert.Equal(t, ALREADY_EXISTS, status, "test failed: key should already be reserved")
+	assert.False(t, existing.Completed, "test failed: key should be in progress")
+
+	reservation.Completed, reservation.StatusCode = true, 201
+	reservation.Header = map[string][]string{"Location": {"/users/" + caesar}}
+	reservation.Body = []byte(`{"message": "created"}`)
+	assert.Equal(t, UPDATED, client.CompleteIdempotencyKey(reservation))
+	existing, status = client.ReserveIdempotencyKey(reservation)
+	assert.Equal(t, ALREADY_EXISTS, status)
+	assert.True(t, existing.Completed)
+	assert.Equal(t, 201, existing.StatusCode)
+	assert.Equal(t, reservation.Header, existing.Header)
+	assert.Equal(t, reservation.Body, existing.Body)
+
+	//completed keys are not released
+	assert.Equal(t, DELETED, client.ReleaseIdempotencyKey(reservation))
+	_, status = client.ReserveIdempotencyKey(reservation)
+	assert.Equal(t, ALREADY_EXISTS, status)
+
+	//keys are unique to the caller who sent them
+	other := IdempotencyRecord{TenantID: testTenant, Subject: "billing", Key: "key-1", Fingerprint: "other", ExpiresAt: time.Now().Add(time.Hour)}
+	_, status = client.ReserveIdempotencyKey(other)
+	assert.Equal(t, CREATED, status, "test failed: another caller should be able to use the key")
+	assert.Equal(t, DELETED, client.ReleaseIdempotencyKey(other))
+	existing, status = client.ReserveIdempotencyKey(reservation)
+	assert.Equal(t, ALREADY_EXISTS, status, "test failed: releasing another caller's key should keep this one")
+	assert.True(t, existing.Completed)
+
+	//expired keys can be reused and are purged
+	expired := IdempotencyRecord{TenantID: testTenant, Key: "key-2", Fingerprint: "fingerprint", ExpiresAt: time.Now().Add(-time.Hour)}
+	_, status = client.ReserveIdempotencyKey(expired)
+	assert.Equal(t, CREATED, status)
+	_, status = client.ReserveIdempotencyKey(expired)
+	assert.Equal(t, CREATED, status, "test failed: expired key should be reusable")
+	purged, status := client.PurgeIdempotencyKeys(time.Now())
+	assert.Equal(t, OK, status)
+	assert.Equal(t, 1, purged)
+}
+
+func TestClient_APIKeys(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	defer client.clearTestDatabase()
+
+	_, status := client.RetrieveAPIKeys()
+	assert.Equal(t, NOT_FOUND, status, "test failed: there should be no keys")
+	key := APIKey{KeyID: "key-1", Name: "billing", Scopes: []string{"users:read", "users:write"}, TenantID: "acme", SecretHash: strings.Repeat("a", 64)}
+	assert.Equal(t, CREATED, client.CreateAPIKey(key))
+	assert.Equal(t, CREATED, client.CreateAPIKey(APIKey{KeyID: "key-2", Name: "reporting", SecretHash: strings.Repeat("b", 64)}))
+
+	stored, status := client.RetrieveAPIKey("key-1")
+	assert.Equal(t, OK, status)
+	assert.Equal(t, key.Scopes, stored.Scopes)
+	assert.Equal(t, key.TenantID, stored.TenantID)
+	assert.Equal(t, key.SecretHash, stored.SecretHash)
+	assert.NotNil(t, stored.CreatedAt)
+	assert.Nil(t, stored.LastUsedAt)
+	_, status = client.RetrieveAPIKey("key-3")
 	assert.Equal(t, NOT_FOUND, status)
+
+	//uses are only recorded if the key has not been used since usedSince
+	usedAt := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, UPDATED, client.RecordAPIKeyUse("key-1", usedAt, usedAt.Add(-time.Minute)))
+	assert.Equal(t, UPDATED, client.RecordAPIKeyUse("key-1", usedAt.Add(30*time.Second), usedAt.Add(-30*time.Second)))
+	stored, _ = client.RetrieveAPIKey("key-1")
+	assert.Equal(t, usedAt, *stored.LastUsedAt, "test failed: use within a minute should not be recorded")
+
+	assert.Equal(t, DELETED, client.RevokeAPIKey("key-1"))
+	assert.Equal(t, NOT_FOUND, client.RevokeAPIKey("key-1"), "test failed: key should already be revoked")
+	keys, status := client.RetrieveAPIKeys()
+	assert.Equal(t, OK, status)
+	assert.Len(t, keys, 2)
+	assert.NotNil(t, keys[0].RevokedAt)
+	assert.Nil(t, keys[1].RevokedAt)
+}
+
+func TestClient_TenantIsolation(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	assert.NoError(t, client.populateUserTable(), "test failed: could not add records to db")
+	defer client.clearTestDatabase()
+
+	acme := Caller{Actor: "tester", RequestID: "acme-request", SourceIP: "127.0.0.1", TenantID: "acme"}
+	acmeUsers := func(fields map[string]string) SearchCriteria {
+		return SearchCriteria{TenantID: "acme", Fields: fields}
+	}
+	const johnSmith = "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"
+
+	//emails and user IDs are only unique within a tenant
+	acmeJohn := UserRecord{UserID: johnSmith, FirstName: "Johnny", LastName: "Smith", EmailAddress: "john.smith@gmail.com", Password: "acme1", NickName: "acmeSmithy", Country: "Canada"}
+	assert.Equal(t, CREATED, client.CreateRecord(acme, acmeJohn), "test failed: email and ID of another tenant's user should be available")
+	assert.Equal(t, ALREADY_EXISTS, client.CreateRecord(acme, UserRecord{UserID: "a1", FirstName: "J", LastName: "S", EmailAddress: "john.smith@gmail.com", Password: "p", NickName: "n", Country: "c"}))
+	statuses := client.CreateRecords(acme, []UserRecord{
+		{UserID: janeDoe, FirstName: "Jane", LastName: "Doe", EmailAddress: "jane.doe@gmail.com", Password: "acme2", NickName: "acmeJane", Country: "Canada"},
+	}, true)
+	assert.Equal(t, []Status{CREATED}, statuses, "test failed: batches should only check emails within the tenant")
+
+	//reads only return the tenant's users
+	records, status := client.RetrieveRecords(acmeUsers(nil))
+	assert.Equal(t, OK, status)
+	assert.Equal(t, []string{johnSmith, janeDoe}, userIDs(records))
+	assert.Equal(t, "acmeSmithy", records[0].NickName)
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": johnSmith}})
+	assert.Equal(t, "smithy12345", records[0].NickName, "test failed: tenants' users with the same ID should be separate")
+	_, status = client.RetrieveRecords(acmeUsers(map[string]string{"user_id": caesar}))
+	assert.Equal(t, NOT_FOUND, status, "test failed: another tenant's user should not be found")
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: "initech"})
+	assert.Equal(t, NOT_FOUND, status, "test failed: a tenant without users should find none")
+	page, _ := client.ScanRecords(SearchCriteria{TenantID: "acme"}, "", 10)
+	assert.Equal(t, []string{janeDoe, johnSmith}, userIDs(page))
+	count, _ := client.CountRecords(SearchCriteria{TenantID: "acme"})
+	assert.Equal(t, 2, count)
+	count, _ = client.CountRecords(SearchCriteria{TenantID: testTenant})
+	assert.Equal(t, 5, count)
+	groups, _ := client.GroupRecords(SearchCriteria{TenantID: "acme"}, "country")
+	assert.Equal(t, []GroupCount{{Value: "Canada", Count: 2}}, groups)
+	results, _ := client.SearchRecords(SearchCriteria{TenantID: "acme"}, "caesar", 10)
+	assert.Empty(t, results, "test failed: search should not find another tenant's users")
+	candidates, _ := client.RetrieveDuplicateCandidates("acme", UserRecord{UserID: "a1", LastName: "Caesar", EmailAddress: "caesar@gmail.com"})
+	assert.Empty(t, candidates, "test failed: another tenant's users should not be duplicate candidates")
+
+	//changes cannot reach another tenant's users
+	assert.Equal(t, NOT_FOUND, client.UpdateRecord(acme, caesar, map[string]string{"nickname": "Brutus"}, 0))
+	assert.Equal(t, NOT_FOUND, client.DeleteRecord(acme, caesar, 0))
+	assert.Equal(t, []Status{NOT_FOUND}, client.UpdateRecords(acme, []RecordUpdate{{UserID: caesar, Fields: map[string]string{"nickname": "Brutus"}}}, false))
+	assert.Equal(t, []Status{NOT_FOUND}, client.DeleteRecords(acme, []RecordVersion{{UserID: caesar}}, false))
+	_, status = client.MergeRecords(acme, johnSmith, caesar, nil, 0)
+	assert.Equal(t, NOT_FOUND, status, "test failed: another tenant's user should not be merged")
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, caesar, 0))
+	assert.Equal(t, NOT_FOUND, client.RestoreRecord(acme, caesar))
+	assert.Equal(t, RESTORED, client.RestoreRecord(testCaller, caesar))
+	_, status = client.UpsertRecord(acme, UserRecord{UserID: caesar, FirstName: "Julius", LastName: "Caesar", EmailAddress: "caesar@gmail.com", Password: "acme3", NickName: "acmeCaesar", Country: "Canada"}, 0)
+	assert.Equal(t, CREATED, status, "test failed: replacing a user should create the tenant's own user")
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, "ETuBrute", records[0].NickName, "test failed: another tenant's user should not be replaced")
+
+	//merges, their aliases and history stay within the tenant
+	_, status = client.MergeRecords(acme, johnSmith, janeDoe, nil, 0)
+	assert.Equal(t, MERGED, status)
+	alias, _ := client.RetrieveAlias("acme", janeDoe)
+	assert.Equal(t, johnSmith, alias)
+	_, status = client.RetrieveAlias(testTenant, janeDoe)
+	assert.Equal(t, NOT_FOUND, status, "test failed: aliases should not resolve in another tenant")
+	records, _ = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}})
+	assert.Nil(t, records[0].DeletedAt, "test failed: another tenant's merged user should not be deleted")
+	entries, _, _ := client.RetrieveAuditEntries("acme", johnSmith, 10, 0)
+	assert.Equal(t, []string{"merge", "create"}, []string{entries[0].Action, entries[1].Action})
+	entries, _, _ = client.RetrieveAuditEntries(testTenant, caesar, 10, 0)
+	assert.Equal(t, []string{"restore", "delete"}, []string{entries[0].Action, entries[1].Action}, "test failed: history should only include the tenant's changes")
+
+	//idempotency keys are unique to each tenant
+	expiresAt := time.Now().Add(time.Hour)
+	_, status = client.ReserveIdempotencyKey(IdempotencyRecord{TenantID: "acme", Key: "key-1", Fingerprint: "acme", ExpiresAt: expiresAt})
+	assert.Equal(t, CREATED, status)
+	_, status = client.ReserveIdempotencyKey(IdempotencyRecord{TenantID: testTenant, Key: "key-1", Fingerprint: "default", ExpiresAt: expiresAt})
+	assert.Equal(t, CREATED, status, "test failed: another tenant's idempotency key should not be reused")
+
+	//users of every tenant are purged
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, caesar, 0))
+	purged, status := client.PurgeRecords(time.Now().UTC().Add(time.Hour))
+	assert.Equal(t, OK, status)
+	assert.Equal(t, map[string][]string{"acme": {janeDoe}, testTenant: {caesar}}, purged)
+
+	//queries without a tenant are rejected rather than reading or changing every tenant's users
+	noTenant := testCaller
+	noTenant.TenantID = ""
+	_, status = client.RetrieveRecords(SearchCriteria{})
+	assert.Equal(t, BACKEND_ERROR, status)
+	_, status = client.CountRecords(SearchCriteria{})
+	assert.Equal(t, BACKEND_ERROR, status)
+	_, status = client.RetrieveAlias("", janeDoe)
+	assert.Equal(t, BACKEND_ERROR, status)
+	_, _, status = client.RetrieveAuditEntries("", johnSmith, 10, 0)
+	assert.Equal(t, BACKEND_ERROR, status)
+	assert.Equal(t, BACKEND_ERROR, client.CreateRecord(noTenant, acmeJohn))
+	assert.Equal(t, BACKEND_ERROR, client.UpdateRecord(noTenant, johnSmith, map[string]string{"nickname": "Brutus"}, 0))
+	assert.Equal(t, BACKEND_ERROR, client.DeleteRecord(noTenant, johnSmith, 0))
+	assert.Equal(t, []Status{BACKEND_ERROR}, client.DeleteRecords(noTenant, []RecordVersion{{UserID: johnSmith}}, false))
+}
+
+func TestClient_MigrateTables(t *testing.T) {
+	var err error
+	client, err = NewTestClient()
+	if err != nil {
+		log.Fatal("could not start test db")
+	}
+	defer client.clearTestDatabase()
+
+	//the first Users table, and the other tables as they were before tenants and idempotency key subjects were added
+	_, err = client.db.Exec("DROP TABLE Users, user_audit, idempotency_keys, user_aliases, api_keys")
+	assert.NoError(t, err, "test failed: could not drop tables")
+	for _, query := range []string{
+		`CREATE TABLE Users (
+			user_id varchar(36) NOT NULL,
+			first_name varchar(50) NOT NULL,
+			last_name varchar(50) NOT NULL,
+			email varchar(150) NOT NULL,
+			password varchar(50) NOT NULL,
+			nickname varchar(50) NOT NULL,
+			country varchar(50) NOT NULL,
+			PRIMARY KEY (user_id))`,
+		`CREATE TABLE user_audit (
+			audit_id bigint NOT NULL AUTO_INCREMENT,
+			user_id varchar(36) NOT NULL,
+			action varchar(20) NOT NULL,
+			actor varchar(255) NOT NULL,
+			request_id varchar(64) NOT NULL,
+			source_ip varchar(45) NOT NULL,
+			changes text NOT NULL,
+			created_at datetime NOT NULL,
+			PRIMARY KEY (audit_id),
+			KEY user_history (user_id, audit_id))`,
+		`CREATE TABLE idempotency_keys (
+			idempotency_key varchar(255) CHARACTER SET ascii NOT NULL,
+			fingerprint char(64) NOT NULL,
+			completed boolean NOT NULL,
+			status_code int NOT NULL,
+			header text NOT NULL,
+			body blob NOT NULL,
+			expires_at datetime NOT NULL,
+			PRIMARY KEY (idempotency_key),
+			KEY expires_at (expires_at))`,
+		`CREATE TABLE user_aliases (
+			alias_id varchar(36) NOT NULL,
+			user_id varchar(36) NOT NULL,
+			created_at datetime NOT NULL,
+			PRIMARY KEY (alias_id),
+			KEY user_id (user_id))`,
+		`CREATE TABLE api_keys (
+			key_id varchar(36) NOT NULL,
+			name varchar(255) NOT NULL,
+			scopes varchar(1024) NOT NULL,
+			secret_hash char(64) NOT NULL,
+			created_at datetime NOT NULL,
+			last_used_at datetime NULL,
+			revoked_at datetime NULL,
+			PRIMARY KEY (key_id))`,
+	} {
+		_, err = client.db.Exec(query)
+		assert.NoError(t, err, "test failed: could not create table")
+	}
+	_, err = client.db.Exec(`INSERT INTO Users (user_id, first_name, last_name, email, password, nickname, country)
+		VALUES (?, 'Julius', 'Caesar', 'caesar@gmail.com', 'password4', 'ETuBrute', 'Italy'),
+		(?, 'Jane', 'Doe', 'jane.doe@gmail.com', 'password2', 'GIJane', 'United States of America')`, caesar, janeDoe)
+	assert.NoError(t, err, "test failed: could not add records to db")
+	created, updated := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2019, 6, 7, 8, 9, 10, 0, time.UTC)
+	_, err = client.db.Exec(`INSERT INTO user_audit (user_id, action, actor, request_id, source_ip, changes, created_at)
+		VALUES (?, 'CREATE', 'tester', 'r1', '', '{}', ?), (?, 'UPDATE', 'tester', 'r2', '', '{}', ?)`, caesar, created, caesar, updated)
+	assert.NoError(t, err, "test failed: could not add audit entries")
+	_, err = client.db.Exec(`INSERT INTO user_aliases (alias_id, user_id, created_at) VALUES ('alias-1', ?, UTC_TIMESTAMP())`, caesar)
+	assert.NoError(t, err, "test failed: could not add alias")
+	_, err = client.db.Exec(`INSERT INTO api_keys (key_id, name, scopes, secret_hash, created_at)
+		VALUES ('key-1', 'billing', 'admin', 'hash', UTC_TIMESTAMP())`)
+	assert.NoError(t, err, "test failed: could not add API key")
+	_, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant})
+	assert.Equal(t, BACKEND_ERROR, status, "test failed: users should not be read without the columns")
+	assert.NoError(t, createTables(client.db), "test failed: could not migrate tables")
+	assert.NoError(t, createTables(client.db), "test failed: migrations should only be applied once")
+
+	users, status := client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, OK, status, "test failed: could not read migrated users")
+	assert.Equal(t, 1, users[0].Version, "test failed: existing users should be at version 1")
+	assert.Equal(t, created, users[0].CreatedAt.UTC(), "test failed: users should have been created when their first change was audited")
+	assert.Equal(t, updated, users[0].UpdatedAt.UTC(), "test failed: users should have been updated when their last change was audited")
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, CreatedBefore: created.Add(time.Second)})
+	assert.Equal(t, OK, status, "test failed: could not filter migrated users by when they were created")
+	assert.Equal(t, UPDATED, client.UpdateRecord(testCaller, caesar, map[string]string{"nickname": "Brutus"}, 1))
+	assert.Equal(t, VERSION_MISMATCH, client.UpdateRecord(testCaller, caesar, map[string]string{"nickname": "Brutus"}, 1))
+
+	assert.Equal(t, DELETED, client.DeleteRecord(testCaller, janeDoe, 0))
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: testTenant, Fields: map[string]string{"user_id": janeDoe}})
+	assert.Equal(t, NOT_FOUND, status, "test failed: deleted users should not be returned")
+	assert.Equal(t, RESTORED, client.RestoreRecord(testCaller, janeDoe))
+	assert.Equal(t, ALREADY_EXISTS, client.CreateRecord(testCaller, UserRecord{UserID: "a0", FirstName: "Julia", LastName: "Caesar",
+		EmailAddress: "caesar@gmail.com", Password: "password5", NickName: "Julia", Country: "Italy"}), "test failed: emails should be unique")
+	candidates, status := client.RetrieveDuplicateCandidates(testTenant, UserRecord{UserID: "a0", LastName: "Caesar", EmailAddress: "julia@example.com"})
+	assert.Equal(t, OK, status, "test failed: could not retrieve candidates from migrated users")
+	assert.Equal(t, []string{caesar}, userIDs(candidates), "test failed: the soundex codes of migrated users should be backfilled")
+
+	_, status = client.ReserveIdempotencyKey(IdempotencyRecord{TenantID: testTenant, Subject: "billing", Key: "key-1", Fingerprint: "fingerprint", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Equal(t, CREATED, status, "test failed: could not reserve key of migrated table")
+
+	userID, status := client.RetrieveAlias(testTenant, "alias-1")
+	assert.Equal(t, OK, status, "test failed: could not resolve alias of migrated table")
+	assert.Equal(t, caesar, userID, "test failed: alias should resolve to the user it was created for")
+	_, status = client.RetrieveRecords(SearchCriteria{TenantID: "acme", Fields: map[string]string{"user_id": caesar}})
+	assert.Equal(t, NOT_FOUND, status, "test failed: migrated users should only be in the default tenant")
+	assert.Equal(t, CREATED, client.CreateRecord(Caller{TenantID: "acme", Actor: "tester"}, UserRecord{UserID: caesar, FirstName: "Julius",
+		LastName: "Caesar", EmailAddress: "caesar@gmail.com", Password: "password4", NickName: "ETuBrute", Country: "Italy"}),
+		"test failed: users and emails should only be unique within a tenant")
+	key, status := client.RetrieveAPIKey("key-1")
+	assert.Equal(t, OK, status, "test failed: could not read key of migrated table")
+	assert.Equal(t, "", key.TenantID, "test failed: keys created before tenants should not be limited to one")
 }
 
 func NewTestClient() (Client, error) {
@@ -172,17 +1029,7 @@ func NewTestClient() (Client, error) {
 		return Client{}, err
 	}
 
-	query := `CREATE TABLE IF NOT EXISTS Users (
-    	user_id varchar(36)  NOT NULL,
-    	first_name varchar(50) NOT NULL,
-    	last_name varchar(50) NOT NULL,
-    	email varchar(150) NOT NULL,
-    	password varchar(50) NOT NULL,
-    	nickname varchar(50) NOT NULL,
-    	country varchar(50) NOT NULL,
-  		PRIMARY KEY (user_id))`
-	_, err = c.Exec(query)
-	if err != nil {
+	if err = createTables(c); err != nil {
 		log.WithError(err).Error("error creating user table")
 		return Client{}, err
 	}
@@ -193,7 +1040,7 @@ func NewTestClient() (Client, error) {
 }
 
 func (c *Client) clearTestDatabase() {
-	query := "DROP TABLE IF EXISTS Users"
+	query := "DROP TABLE IF EXISTS Users, user_audit, idempotency_keys, user_aliases, api_keys"
 	_, err := c.db.Exec(query)
 	if err != nil {
 		log.Fatalf("failed to clear up test data tables with error: %v", err)
@@ -201,12 +1048,12 @@ func (c *Client) clearTestDatabase() {
 }
 
 func (c *Client) populateUserTable() error {
-	dbQuery := `INSERT INTO Users (user_id, first_name, last_name, email, password, nickname, country)
-		VALUES ('e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d','John','Smith','john.smith@gmail.com','password1','smithy12345','United Kingdom'),
-		('16f701dc-5e71-497b-a197-ef7b8618cbea','Jane','Doe','jane.doe@gmail.com','password2','GIJane','United States of America'),
-		('b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59','James','Bond','j.bond@mi6.co.uk','password007','BondJamesBond','United Kingdom'),
-		('325ef78c-f0ac-424b-814d-7c7cd03ec44d','Cleo','Patra','cleopatra@gmail.com','password3','Cle0','Egypt'),
-		('ff7dfd22-9134-429b-9482-0888ffdfc64b','Julius','Caesar','caesar@gmail.com','password4','ETuBrute','Italy');`
+	dbQuery := `INSERT INTO Users (tenant_id, user_id, first_name, last_name, email, password, nickname, country)
+		VALUES ('default','e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d','John','Smith','john.smith@gmail.com','password1','smithy12345','United Kingdom'),
+		('default','16f701dc-5e71-497b-a197-ef7b8618cbea','Jane','Doe','jane.doe@gmail.com','password2','GIJane','United States of America'),
+		('default','b16dc0b3-e0ab-4dbd-89e3-d031a28cbc59','James','Bond','j.bond@mi6.co.uk','password007','BondJamesBond','United Kingdom'),
+		('default','325ef78c-f0ac-424b-814d-7c7cd03ec44d','Cleo','Patra','cleopatra@gmail.com','password3','Cle0','Egypt'),
+		('default','ff7dfd22-9134-429b-9482-0888ffdfc64b','Julius','Caesar','caesar@gmail.com','password4','ETuBrute','Italy');`
 	_, err := c.db.Exec(dbQuery)
 	if err != nil {
 		fmt.Println("Error 2")
@@ -214,6 +1061,37 @@ func (c *Client) populateUserTable() error {
 	return err
 }
 
+//withoutTimestamps checks the DB managed timestamps of the records are set and removes them so the records can be
+//compared with fixtures
+func withoutTimestamps(t *testing.T, records []UserRecord) []UserRecord {
+	stripped := make([]UserRecord, len(records))
+	for i, r := range records {
+		assert.NotNil(t, r.CreatedAt, "test failed: user should have creation time")
+		assert.NotNil(t, r.UpdatedAt, "test failed: user should have update time")
+		r.CreatedAt, r.UpdatedAt = nil, nil
+		stripped[i] = r
+	}
+	return stripped
+}
+
+//withoutPasswords returns the records as they are read, without their passwords
+func withoutPasswords(records []UserRecord) []UserRecord {
+	redacted := make([]UserRecord, len(records))
+	for i, r := range records {
+		r.Password = ""
+		redacted[i] = r
+	}
+	return redacted
+}
+
+func userIDs(records []UserRecord) []string {
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.UserID)
+	}
+	return ids
+}
+
 func readFileAndDecode(t *testing.T, pathToFile string) ([]UserRecord, error) {
 	f, err := os.Open(pathToFile)
 	assert.NoError(t, err, "test failed: could not open file " + pathToFile)
@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+//groupableColumns are the columns users can be counted by. Columns unique to each user are not groupable
+var groupableColumns = map[string]bool{
+	"first_name": true,
+	"last_name": true,
+	"nickname": true,
+	"country": true,
+}
+
+//CountRecords counts the users matching the provided parameters in the DB without retrieving them
+func (c *Client) CountRecords(searchCriteria SearchCriteria) (int, Status) {
+	whereClause, args, err := buildWhereClause(searchCriteria)
+	if err != nil {
+		log.WithError(err).Error("invalid search criteria")
+		return 0, BACKEND_ERROR
+	}
+
+	countTemplate := fmt.Sprintf(`SELECT COUNT(*)
+						  FROM Users
+						  %s;`, whereClause)
+	log.Debugf("count query is %s", countTemplate)
+
+	var count int
+	if err := c.db.QueryRow(countTemplate, args...).Scan(&count); err != nil {
+		log.WithError(err).Error("could not count users")
+		return 0, BACKEND_ERROR
+	}
+	return count, OK
+}
+
+//GroupRecords counts the users matching the provided parameters in the DB by each value of the column, largest
+//groups first
+func (c *Client) GroupRecords(searchCriteria SearchCriteria, column string) ([]GroupCount, Status) {
+	if !groupableColumns[column] {
+		log.Errorf("cannot group by column %s", column)
+		return nil, BACKEND_ERROR
+	}
+	whereClause, args, err := buildWhereClause(searchCriteria)
+	if err != nil {
+		log.WithError(err).Error("invalid search criteria")
+		return nil, BACKEND_ERROR
+	}
+
+	groupTemplate := fmt.Sprintf(`SELECT %[1]s, COUNT(*)
+						  FROM Users
+						  %[2]s
+							GROUP BY %[1]s
+							ORDER BY COUNT(*) DESC, %[1]s ASC;`, column, whereClause)
+	log.Debugf("group query is %s", groupTemplate)
+
+	rows, err := c.db.Query(groupTemplate, args...)
+	if err != nil {
+		log.WithError(err).Error("could not group users")
+		return nil, BACKEND_ERROR
+	}
+	defer rows.Close()
+
+	groups := []GroupCount{}
+	for rows.Next() {
+		var group GroupCount
+		if err := rows.Scan(&group.Value, &group.Count); err != nil {
+			log.WithError(err).Error("could not scan group")
+			return nil, BACKEND_ERROR
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Error("could not read groups")
+		return nil, BACKEND_ERROR
+	}
+	return groups, OK
+}
@@ -0,0 +1,148 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	//apiKeySecretBytes is the number of random bytes in the secret of an API key
+	apiKeySecretBytes = 32
+	//apiKeyUseResolution is how precisely the last use of a key is recorded, so that keys sent with every request
+	//are not written to the DB on every request
+	apiKeyUseResolution = time.Minute
+	//apiKeySubjectPrefix prefixes the names of API keys in their principal's subject, so they cannot be mistaken for
+	//users
+	apiKeySubjectPrefix = "apikey:"
+)
+
+//APIKeyAuthenticator authenticates services sending API keys stored in the DB, and creates and revokes the keys
+type APIKeyAuthenticator struct {
+	sqlClient persistence.Clienter
+	now func() time.Time
+}
+
+//NewAPIKeyAuthenticator returns an authenticator checking API keys stored by the sql client
+func NewAPIKeyAuthenticator(sqlClient persistence.Clienter) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{sqlClient: sqlClient, now: time.Now}
+}
+
+//Scheme returns ApiKey, the scheme API keys are sent with
+func (a *APIKeyAuthenticator) Scheme() string {
+	return "ApiKey"
+}
+
+//Authenticate checks the key, made up of its ID and secret, has not been revoked, returning a principal with its
+//scopes whose subject is the key's name. Keys are granted the roles named by their scopes, and belong to the tenant
+//they were created for if any
+func (a *APIKeyAuthenticator) Authenticate(credentials string) (Principal, error) {
+	parts := strings.SplitN(credentials, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Principal{}, errors.New("API key is malformed")
+	}
+	key, status := a.sqlClient.RetrieveAPIKey(parts[0])
+	if status == persistence.NOT_FOUND {
+		return Principal{}, errors.New("API key is invalid")
+	} else if status != persistence.OK {
+		return Principal{}, errAuthenticationUnavailable
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(key.SecretHash)) != 1 {
+		return Principal{}, errors.New("API key is invalid")
+	}
+	if key.RevokedAt != nil {
+		return Principal{}, errors.New("API key has been revoked")
+	}
+
+	now := a.now()
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-apiKeyUseResolution)) {
+		//failing to record use does not stop the key being used
+		a.sqlClient.RecordAPIKeyUse(key.KeyID, now, now.Add(-apiKeyUseResolution))
+	}
+	return Principal{
+		Subject: apiKeySubjectPrefix + key.Name,
+		Scopes: key.Scopes,
+		Roles: key.Scopes,
+		Tenant: key.TenantID,
+		Claims: map[string]interface{}{"keyID": key.KeyID, "name": key.Name},
+	}, nil
+}
+
+//Create stores a new key for the named service with the scopes, restricted to the tenant unless it is empty,
+//returning the key to send, which cannot be retrieved again, and the stored key
+func (a *APIKeyAuthenticator) Create(name string, scopes []string, tenant string) (string, persistence.APIKey, error) {
+	if strings.TrimSpace(name) == "" || len(name) > 255 {
+		return "", persistence.APIKey{}, errors.New("name must be between 1 and 255 characters")
+	}
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\n") {
+			return "", persistence.APIKey{}, fmt.Errorf("scope %q must not be empty or contain spaces", scope)
+		}
+	}
+	if len(strings.Join(scopes, " ")) > 1024 {
+		return "", persistence.APIKey{}, errors.New("scopes must total at most 1024 characters")
+	}
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return "", persistence.APIKey{}, errors.New(invalidTenantMsg)
+	}
+
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", persistence.APIKey{}, fmt.Errorf("could not generate API key: %v", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key := persistence.APIKey{
+		KeyID: uuid.New().String(),
+		Name: name,
+		Scopes: scopes,
+		TenantID: tenant,
+		SecretHash: hashSecret(encoded),
+	}
+	if status := a.sqlClient.CreateAPIKey(key); status != persistence.CREATED {
+		return "", persistence.APIKey{}, errors.New("could not store API key")
+	}
+	log.WithField("KeyID", key.KeyID).Infof("created API key for %s", name)
+	return key.KeyID + "." + encoded, key, nil
+}
+
+//List returns every key, including revoked keys, oldest first
+func (a *APIKeyAuthenticator) List() ([]persistence.APIKey, error) {
+	keys, status := a.sqlClient.RetrieveAPIKeys()
+	switch status {
+	case persistence.OK:
+		return keys, nil
+	case persistence.NOT_FOUND:
+		return []persistence.APIKey{}, nil
+	default:
+		return nil, errors.New("could not retrieve API keys")
+	}
+}
+
+//Revoke stops the key authenticating requests. Revoked keys are kept so their use can still be audited
+func (a *APIKeyAuthenticator) Revoke(keyID string) error {
+	switch a.sqlClient.RevokeAPIKey(keyID) {
+	case persistence.DELETED:
+		log.WithField("KeyID", keyID).Info("revoked API key")
+		return nil
+	case persistence.NOT_FOUND:
+		return fmt.Errorf("no unrevoked API key exists with ID: %s", keyID)
+	default:
+		return errors.New("could not revoke API key")
+	}
+}
+
+//hashSecret returns the hex encoded SHA-256 hash of an API key's secret. Secrets are random so do not need a slow,
+//salted hash
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
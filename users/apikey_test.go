@@ -0,0 +1,158 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	assert := assert.New(t)
+	sqlClient := &mockAPIKeyClient{
+		mockSQLClient: mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+		keys: make(map[string]persistence.APIKey),
+	}
+	apiKeys := NewAPIKeyAuthenticator(sqlClient)
+	apiKeys.now = func() time.Time { return authNow }
+	billingKey, created, err := apiKeys.Create("billing", []string{"read-only"}, "")
+	assert.NoError(err)
+	assert.Equal(hashSecret(strings.SplitN(billingKey, ".", 2)[1]), sqlClient.keys[created.KeyID].SecretHash, "test failed: only the hash of the secret should be stored")
+	revokedKey, revoked, err := apiKeys.Create("reporting", nil, "")
+	assert.NoError(err)
+	assert.NoError(apiKeys.Revoke(revoked.KeyID))
+
+	//API keys compose with JWTs, either authenticates a request
+	jwts := &JWTAuthenticator{keys: []jsonWebKey{{kid: "hmac", alg: "HS256", key: hmacSecret}}, now: func() time.Time { return authNow }}
+	r := mux.NewRouter()
+	handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), Config{
+		Authenticators: []Authenticator{jwts, apiKeys},
+	})
+	handler.RegisterHandlers(r)
+
+	tests := []struct {
+		name string
+		authorization string
+		status persistence.Status
+		statusCode int
+		detail string
+	}{
+		{
+			name: "Accepts API key",
+			authorization: "ApiKey " + billingKey,
+			status: persistence.OK,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Accepts JWT",
+			authorization: "Bearer " + signToken("HS256", "hmac", hmacSecret, validClaims()),
+			status: persistence.OK,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Rejects request without credentials",
+			status: persistence.OK,
+			statusCode: http.StatusUnauthorized,
+			detail: "authentication is required",
+		},
+		{
+			name: "Rejects malformed API key",
+			authorization: "ApiKey " + created.KeyID,
+			status: persistence.OK,
+			statusCode: http.StatusUnauthorized,
+			detail: "API key is malformed",
+		},
+		{
+			name: "Rejects API key with the wrong secret",
+			authorization: "ApiKey " + created.KeyID + ".guessed",
+			status: persistence.OK,
+			statusCode: http.StatusUnauthorized,
+			detail: "API key is invalid",
+		},
+		{
+			name: "Rejects unknown API key",
+			authorization: "ApiKey unknown.guessed",
+			status: persistence.OK,
+			statusCode: http.StatusUnauthorized,
+			detail: "API key is invalid",
+		},
+		{
+			name: "Rejects revoked API key",
+			authorization: "ApiKey " + revokedKey,
+			status: persistence.OK,
+			statusCode: http.StatusUnauthorized,
+			detail: "API key has been revoked",
+		},
+		{
+			name: "Error when API key cannot be checked",
+			authorization: "ApiKey " + billingKey,
+			status: persistence.BACKEND_ERROR,
+			statusCode: http.StatusInternalServerError,
+			detail: "could not process request",
+		},
+	}
+
+	for _, test := range tests {
+		sqlClient.expectedStatus = test.status
+		rec := httptest.NewRecorder()
+		req := newRequest("GET", "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		if test.detail == "" {
+			continue
+		}
+		var problem Problem
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&problem), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.detail, problem.Detail, fmt.Sprintf("%s: Wrong body", test.name))
+	}
+
+	sqlClient.expectedStatus = persistence.OK
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users", nil))
+	assert.Equal([]string{`Bearer realm="users-rw-sql"`, `ApiKey realm="users-rw-sql"`}, rec.Header()["Www-Authenticate"], "test failed: every scheme should be challenged for")
+
+	//use is recorded at most once a minute
+	assert.Equal(1, sqlClient.uses)
+	assert.Equal(authNow, *sqlClient.keys[created.KeyID].LastUsedAt)
+	apiKeys.now = func() time.Time { return authNow.Add(2 * time.Minute) }
+	principal, err := apiKeys.Authenticate(billingKey)
+	assert.NoError(err)
+	assert.Equal(2, sqlClient.uses)
+	assert.Equal(Principal{Subject: "apikey:billing", Scopes: []string{"read-only"}, Roles: []string{"read-only"}, Claims: map[string]interface{}{"keyID": created.KeyID, "name": "billing"}}, principal)
+}
+
+func TestAPIKeyManagement(t *testing.T) {
+	assert := assert.New(t)
+	apiKeys := NewAPIKeyAuthenticator(&mockAPIKeyClient{keys: make(map[string]persistence.APIKey)})
+
+	_, _, err := apiKeys.Create(" ", nil, "")
+	assert.EqualError(err, "name must be between 1 and 255 characters")
+	_, _, err = apiKeys.Create("billing", []string{"users:read users:write"}, "")
+	assert.EqualError(err, `scope "users:read users:write" must not be empty or contain spaces`)
+
+	_, _, err = apiKeys.Create("billing", nil, "acme corp")
+	assert.EqualError(err, invalidTenantMsg)
+
+	key, created, err := apiKeys.Create("billing", []string{"users:read", "users:write"}, "acme")
+	assert.NoError(err)
+	assert.Equal("acme", created.TenantID)
+	assert.True(strings.HasPrefix(key, created.KeyID + "."), "test failed: keys should start with their ID")
+	assert.NotContains(key, created.SecretHash)
+
+	assert.NoError(apiKeys.Revoke(created.KeyID))
+	assert.EqualError(apiKeys.Revoke(created.KeyID), "no unrevoked API key exists with ID: " + created.KeyID)
+
+	keys, err := NewAPIKeyAuthenticator(&mockSQLClient{persistence.OK, nil}).List()
+	assert.NoError(err)
+	assert.Empty(keys)
+}
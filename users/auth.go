@@ -0,0 +1,106 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+//authRealm is the realm of the credentials challenged for on unauthenticated requests
+const authRealm = "users-rw-sql"
+
+//publicPaths are served without authenticating requests
+var publicPaths = map[string]bool{
+	"/__health": true,
+}
+
+//errAuthenticationUnavailable is returned by authenticators which could not check credentials, rather than finding
+//them invalid
+var errAuthenticationUnavailable = errors.New("credentials could not be checked")
+
+//Principal is the authenticated caller of a request
+type Principal struct {
+	//Subject identifies the caller and is recorded as the actor of their changes
+	Subject string
+	//Scopes are the scopes the caller has been granted
+	Scopes []string
+	//Roles are the roles the caller has been granted, which authorize the operations they may perform
+	Roles []string
+	//Tenant is the only tenant whose users the caller may access. Admins without a tenant choose the tenant of each
+	//request with the X-Tenant-ID header, while other callers without one access the default tenant
+	Tenant string
+	//Claims are every claim made by the caller's credentials
+	Claims map[string]interface{}
+}
+
+//Authenticator authenticates the credentials sent with an Authorization scheme such as Bearer
+type Authenticator interface {
+	//Scheme is the Authorization scheme the authenticator accepts credentials with
+	Scheme() string
+	//Authenticate returns the principal identified by the credentials, or an error describing why they are invalid
+	Authenticate(credentials string) (Principal, error)
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	tenantKey
+)
+
+//PrincipalFromContext returns the principal who made an authenticated request, or false if the request was not
+//authenticated
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	return principal, ok
+}
+
+//authenticate returns middleware responding 401 to requests for anything but the public paths which do not send
+//valid credentials for one of the authenticators, and adding the principal to the context of those which do
+func authenticate(authenticators []Authenticator) mux.MiddlewareFunc {
+	schemes := make(map[string]Authenticator)
+	for _, authenticator := range authenticators {
+		schemes[strings.ToLower(authenticator.Scheme())] = authenticator
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if publicPaths[request.URL.Path] {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			scheme, credentials := splitAuthorization(request.Header.Get("Authorization"))
+			authenticator, ok := schemes[strings.ToLower(scheme)]
+			if !ok {
+				for _, authenticator := range authenticators {
+					writer.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=%q", authenticator.Scheme(), authRealm))
+				}
+				writeProblem(writer, request, http.StatusUnauthorized, "authentication is required")
+				return
+			}
+			principal, err := authenticator.Authenticate(credentials)
+			if err == errAuthenticationUnavailable {
+				writeProblem(writer, request, http.StatusInternalServerError, "could not process request")
+				return
+			} else if err != nil {
+				log.WithError(err).Infof("could not authenticate %s credentials", authenticator.Scheme())
+				writer.Header().Set("WWW-Authenticate", fmt.Sprintf("%s realm=%q, error=\"invalid_token\", error_description=%q", authenticator.Scheme(), authRealm, err.Error()))
+				writeProblem(writer, request, http.StatusUnauthorized, err.Error())
+				return
+			}
+			next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), principalKey, principal)))
+		})
+	}
+}
+
+//splitAuthorization splits an Authorization header into its scheme and credentials
+func splitAuthorization(header string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
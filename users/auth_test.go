@@ -0,0 +1,280 @@
+package users
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	authNow = time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+)
+
+//testKeys are a key of each supported algorithm and a JWKS file of their public keys
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec *ecdsa.PrivateKey
+	jwksFile string
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	encode := func(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hmac", "k": encode(hmacSecret)},
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+	}})
+	dir, err := ioutil.TempDir("", "jwks")
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwksFile, jwks, 0600))
+	return testKeys{rsa: rsaKey, ec: ecKey, jwksFile: jwksFile}
+}
+
+//signToken returns a JWT of the claims signed with the key, a secret for HS256 or a private key
+func signToken(alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "support-agent-1",
+		"iss": "https://auth.example.com",
+		"aud": []string{"users-rw-sql", "billing"},
+		"exp": authNow.Add(time.Hour).Unix(),
+		"scope": "users:read users:write",
+		"roles": []string{"read-only"},
+	}
+}
+
+func withClaim(name string, value interface{}) map[string]interface{} {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	assert := assert.New(t)
+	keys := newTestKeys(t)
+	defer os.RemoveAll(filepath.Dir(keys.jwksFile))
+	authenticator, err := NewJWTAuthenticator(keys.jwksFile, "https://auth.example.com", "users-rw-sql")
+	assert.NoError(err)
+	authenticator.now = func() time.Time { return authNow }
+
+	tests := []struct {
+		name string
+		url string
+		authorization string
+		statusCode int
+		detail string
+	}{
+		{
+			name: "Accepts HS256 token",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("HS256", "hmac", hmacSecret, validClaims()),
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Accepts RS256 token",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "rsa", keys.rsa, validClaims()),
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Accepts ES256 token without a kid",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "bearer " + signToken("ES256", "", keys.ec, validClaims()),
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Accepts token expired within the leeway",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "rsa", keys.rsa, withClaim("exp", authNow.Add(-10*time.Second).Unix())),
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Health check is public",
+			url: "/__health",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Rejects request without credentials",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			statusCode: http.StatusUnauthorized,
+			detail: "authentication is required",
+		},
+		{
+			name: "Rejects other schemes",
+			url: "/users",
+			authorization: "Basic dXNlcjpwYXNz",
+			statusCode: http.StatusUnauthorized,
+			detail: "authentication is required",
+		},
+		{
+			name: "Rejects malformed token",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer not.a-token",
+			statusCode: http.StatusUnauthorized,
+			detail: "token is malformed",
+		},
+		{
+			name: "Rejects expired token",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "rsa", keys.rsa, withClaim("exp", authNow.Add(-time.Minute).Unix())),
+			statusCode: http.StatusUnauthorized,
+			detail: "token has expired",
+		},
+		{
+			name: "Rejects token without an expiry",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "rsa", keys.rsa, withClaim("exp", nil)),
+			statusCode: http.StatusUnauthorized,
+			detail: "token has no expiry",
+		},
+		{
+			name: "Rejects token not valid yet",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "rsa", keys.rsa, withClaim("nbf", authNow.Add(time.Minute).Unix())),
+			statusCode: http.StatusUnauthorized,
+			detail: "token is not valid yet",
+		},
+		{
+			name: "Rejects token without a subject",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("HS256", "hmac", hmacSecret, withClaim("sub", nil)),
+			statusCode: http.StatusUnauthorized,
+			detail: "token has no subject",
+		},
+		{
+			name: "Rejects token from untrusted issuer",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("HS256", "hmac", hmacSecret, withClaim("iss", "https://evil.example.com")),
+			statusCode: http.StatusUnauthorized,
+			detail: "token issuer is not trusted",
+		},
+		{
+			name: "Rejects token for another audience",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("HS256", "hmac", hmacSecret, withClaim("aud", "billing")),
+			statusCode: http.StatusUnauthorized,
+			detail: "token audience does not include users-rw-sql",
+		},
+		{
+			name: "Rejects token signed by an unknown key",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("HS256", "hmac", []byte("guessed"), validClaims()),
+			statusCode: http.StatusUnauthorized,
+			detail: "token signature is invalid",
+		},
+		{
+			name: "Rejects token signed by a key with another kid",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("RS256", "encryption", keys.rsa, validClaims()),
+			statusCode: http.StatusUnauthorized,
+			detail: "token signature is invalid",
+		},
+		{
+			name: "Rejects unsigned token",
+			url: "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
+			authorization: "Bearer " + signToken("none", "", nil, validClaims()),
+			statusCode: http.StatusUnauthorized,
+			detail: `token algorithm "none" is not supported`,
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(&mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}}, newTestQueueClient(), notification.NewEventStream(10), Config{
+			Authenticators: []Authenticator{authenticator},
+		})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("GET", test.url, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		if test.statusCode != http.StatusUnauthorized {
+			continue
+		}
+		var problem Problem
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&problem), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.detail, problem.Detail, fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Contains(rec.Header().Get("WWW-Authenticate"), `Bearer realm="users-rw-sql"`, fmt.Sprintf("%s: Wrong challenge", test.name))
+	}
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	assert := assert.New(t)
+	keys := newTestKeys(t)
+	defer os.RemoveAll(filepath.Dir(keys.jwksFile))
+	authenticator, err := NewJWTAuthenticator(keys.jwksFile, "", "")
+	assert.NoError(err)
+	authenticator.now = func() time.Time { return authNow }
+
+	var principal Principal
+	var authenticated bool
+	handler := authenticate([]Authenticator{authenticator})(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, authenticated = PrincipalFromContext(request.Context())
+		assert.Equal("support-agent-1", callerFromRequest(writer, request).Actor, "test failed: changes should be made by the principal")
+	}))
+	req := newRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer " + signToken("ES256", "ec", keys.ec, withClaim("tenant", "acme")))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(authenticated)
+	assert.Equal("support-agent-1", principal.Subject)
+	assert.Equal([]string{"users:read", "users:write"}, principal.Scopes)
+	assert.Equal([]string{"read-only"}, principal.Roles)
+	assert.Equal("acme", principal.Tenant)
+
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "RSA", "alg": "PS256", "n": "AQAB", "e": "AQAB"}]}`))
+	assert.EqualError(err, "JWKS has no keys able to verify HS256, RS256 or ES256 tokens")
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "oct", "kid": "empty"}]}`))
+	assert.EqualError(err, "JWKS key empty is invalid: missing key parameter")
+}
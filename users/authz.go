@@ -0,0 +1,151 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//roles principals can be granted
+const (
+	adminRole = "admin"
+	supportRole = "support"
+	selfServiceRole = "self-service"
+	readOnlyRole = "read-only"
+)
+
+//access is how much of an operation a role permits
+type access int
+
+const (
+	noAccess access = iota
+	//selfAccess permits the operation only on the principal's own user, whose userID is their subject
+	selfAccess
+	fullAccess
+)
+
+//permissions are the access each role has to each operation, named by its swagger operation ID. Replacing a user sets
+//every field, so only roles permitted to change every field may replaceUser
+var permissions = map[string]map[string]access{
+	"addUser": {adminRole: fullAccess, supportRole: fullAccess},
+	"getUser": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess},
+	"getUserByID": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess, selfServiceRole: selfAccess},
+	"replaceUser": {adminRole: fullAccess},
+	"editUser": {adminRole: fullAccess, supportRole: fullAccess, selfServiceRole: selfAccess},
+	"deleteUser": {adminRole: fullAccess},
+	"restoreUser": {adminRole: fullAccess, supportRole: fullAccess},
+	"getUserHistory": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess, selfServiceRole: selfAccess},
+	"getUserDuplicates": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess},
+	"mergeUser": {adminRole: fullAccess, supportRole: fullAccess},
+	"batchCreateUsers": {adminRole: fullAccess},
+	"batchUpdateUsers": {adminRole: fullAccess},
+	"batchDeleteUsers": {adminRole: fullAccess},
+	"exportUsers": {adminRole: fullAccess, readOnlyRole: fullAccess},
+	"getUserStats": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess},
+	"countUsers": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess},
+	"searchUsers": {adminRole: fullAccess, supportRole: fullAccess, readOnlyRole: fullAccess},
+	"streamEvents": {adminRole: fullAccess, readOnlyRole: fullAccess},
+}
+
+//authorize returns a handler responding 403 to authenticated requests whose principal's roles do not permit the
+//operation, or only permit it on their own user and the request is for another. Requests are not authorized when
+//authentication is disabled
+func authorize(operation string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, ok := PrincipalFromContext(request.Context())
+		if !ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		granted := noAccess
+		for _, role := range principal.Roles {
+			if permitted := permissions[operation][role]; permitted > granted {
+				granted = permitted
+			}
+		}
+		switch {
+		case granted == fullAccess:
+			next.ServeHTTP(writer, request)
+		case granted == selfAccess && mux.Vars(request)["userID"] == principal.Subject:
+			next.ServeHTTP(writer, request)
+		case granted == selfAccess:
+			log.WithField("UserID", mux.Vars(request)["userID"]).Infof("%s is only permitted to %s themselves", principal.Subject, operation)
+			writeProblem(writer, request, http.StatusForbidden, "only permitted to " + operation + " on your own user")
+		default:
+			log.Infof("%s with roles %v is not permitted to %s", principal.Subject, principal.Roles, operation)
+			writeProblem(writer, request, http.StatusForbidden, "not permitted to " + operation)
+		}
+	})
+}
+
+//checkIncludeDeleted responds 403 and returns false if the criteria include deleted users and the principal who made
+//the request is not an admin. Anyone may include deleted users when requests are not authenticated
+func checkIncludeDeleted(writer http.ResponseWriter, request *http.Request, criteria persistence.SearchCriteria) bool {
+	principal, ok := PrincipalFromContext(request.Context())
+	if !criteria.IncludeDeleted || !ok || contains(principal.Roles, adminRole) {
+		return true
+	}
+	log.Infof("%s with roles %v is not permitted to include deleted users", principal.Subject, principal.Roles)
+	writeProblem(writer, request, http.StatusForbidden, "not permitted to include deleted users")
+	return false
+}
+
+//forbiddenFields returns the json names of the fields, given by db column, which the principal who made the request
+//is not permitted to change, sorted. Every field is permitted when requests are not authenticated
+func forbiddenFields(request *http.Request, columns []string) []string {
+	principal, ok := PrincipalFromContext(request.Context())
+	if !ok {
+		return nil
+	}
+	var forbidden []string
+	for name, field := range userFields {
+		if len(field.writeRoles) == 0 || !contains(columns, field.column) {
+			continue
+		}
+		permitted := false
+		for _, role := range principal.Roles {
+			permitted = permitted || contains(field.writeRoles, role)
+		}
+		if !permitted {
+			forbidden = append(forbidden, name)
+		}
+	}
+	sort.Strings(forbidden)
+	return forbidden
+}
+
+//checkFields responds 403 and returns false if the principal is not permitted to change any of the fields
+func checkFields(writer http.ResponseWriter, request *http.Request, columns []string) bool {
+	forbidden := forbiddenFields(request, columns)
+	if len(forbidden) == 0 {
+		return true
+	}
+	writeProblem(writer, request, http.StatusForbidden, forbiddenFieldsMsg(forbidden))
+	return false
+}
+
+func forbiddenFieldsMsg(forbidden []string) string {
+	return fmt.Sprintf("not permitted to change %s", strings.Join(forbidden, ", "))
+}
+
+//updatedColumns returns the columns of the updates
+func updatedColumns(updates map[string]string) []string {
+	columns := make([]string, 0, len(updates))
+	for column := range updates {
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//stubAuthenticator authenticates credentials of the form subject:role,role or subject@tenant:role,role
+type stubAuthenticator struct{}
+
+func (stubAuthenticator) Scheme() string {
+	return "Stub"
+}
+
+func (stubAuthenticator) Authenticate(credentials string) (Principal, error) {
+	parts := strings.SplitN(credentials, ":", 2)
+	principal := Principal{Subject: parts[0]}
+	if at := strings.Index(parts[0], "@"); at >= 0 {
+		principal.Subject, principal.Tenant = parts[0][:at], parts[0][at+1:]
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		principal.Roles = strings.Split(parts[1], ",")
+	}
+	return principal, nil
+}
+
+func TestAuthorization(t *testing.T) {
+	assert := assert.New(t)
+	johnSmith := johnSmithUser.UserID
+	tests := []struct {
+		name string
+		principal string
+		status persistence.Status
+		method string
+		url string
+		reqBody string
+		statusCode int
+		detail string
+	}{
+		{
+			name: "Admin can delete users",
+			principal: "admin-1:admin",
+			status: persistence.DELETED,
+			method: "DELETE",
+			url: "/users/" + janeDoeID,
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name: "Support cannot delete users",
+			principal: "support-1:support",
+			status: persistence.DELETED,
+			method: "DELETE",
+			url: "/users/" + janeDoeID,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to deleteUser",
+		},
+		{
+			name: "Any role granting access permits the operation",
+			principal: "support-1:read-only,admin",
+			status: persistence.DELETED,
+			method: "DELETE",
+			url: "/users/" + janeDoeID,
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name: "Principals without roles cannot do anything",
+			principal: "nobody",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/" + johnSmith,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to getUserByID",
+		},
+		{
+			name: "Unknown roles grant nothing",
+			principal: "nobody:superuser",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?country=UK",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to getUser",
+		},
+		{
+			name: "Read-only can search users",
+			principal: "reporting:read-only",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?country=UK",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Read-only cannot edit users",
+			principal: "reporting:read-only",
+			status: persistence.UPDATED,
+			method: "PATCH",
+			url: "/users/" + johnSmith,
+			reqBody: `{"nickname": "smithy"}`,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to editUser",
+		},
+		{
+			name: "Self-service can read themselves",
+			principal: johnSmith + ":self-service",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/" + johnSmith,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Self-service cannot read other users",
+			principal: janeDoeID + ":self-service",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/" + johnSmith,
+			statusCode: http.StatusForbidden,
+			detail: "only permitted to getUserByID on your own user",
+		},
+		{
+			name: "Self-service cannot search users",
+			principal: johnSmith + ":self-service",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?userID=" + johnSmith,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to getUser",
+		},
+		{
+			name: "Self-service can change their own password",
+			principal: johnSmith + ":self-service",
+			status: persistence.UPDATED,
+			method: "PATCH",
+			url: "/users/" + johnSmith,
+			reqBody: `{"password": "correct-horse", "nickname": "smithy"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Self-service cannot edit other users",
+			principal: janeDoeID + ":self-service",
+			status: persistence.UPDATED,
+			method: "PATCH",
+			url: "/users/" + johnSmith,
+			reqBody: `{"nickname": "smithy"}`,
+			statusCode: http.StatusForbidden,
+			detail: "only permitted to editUser on your own user",
+		},
+		{
+			name: "Support can edit users",
+			principal: "support-1:support",
+			status: persistence.UPDATED,
+			method: "PATCH",
+			url: "/users/" + johnSmith,
+			reqBody: `{"nickname": "smithy"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Support cannot change passwords",
+			principal: "support-1:support",
+			status: persistence.UPDATED,
+			method: "PATCH",
+			url: "/users/" + johnSmith,
+			reqBody: `{"password": "correct-horse", "nickname": "smithy"}`,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to change password",
+		},
+		{
+			name: "Support cannot replace users",
+			principal: "support-1:support",
+			status: persistence.UPDATED,
+			method: "PUT",
+			url: "/users/" + johnSmith,
+			reqBody: johnSmithJSON,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to replaceUser",
+		},
+		{
+			name: "Support can merge users",
+			principal: "support-1:support",
+			status: persistence.MERGED,
+			method: "POST",
+			url: "/users/" + johnSmith + "/merge",
+			reqBody: `{"sourceUserID": "` + janeDoeID + `", "fields": {"nickname": "source", "password": "target"}}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Support cannot merge passwords",
+			principal: "support-1:support",
+			status: persistence.MERGED,
+			method: "POST",
+			url: "/users/" + johnSmith + "/merge",
+			reqBody: `{"sourceUserID": "` + janeDoeID + `", "fields": {"password": "nonEmpty"}}`,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to change password",
+		},
+		{
+			name: "Admin can include deleted users",
+			principal: "admin-1:admin",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?userID=" + johnSmith + "&includeDeleted=true",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Support cannot include deleted users",
+			principal: "support-1:support",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?userID=" + johnSmith + "&includeDeleted=true",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to include deleted users",
+		},
+		{
+			name: "Support can exclude deleted users",
+			principal: "support-1:support",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users?userID=" + johnSmith + "&includeDeleted=false",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Read-only cannot search deleted users",
+			principal: "reader-1:read-only",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/search?q=smith&includeDeleted=true",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to include deleted users",
+		},
+		{
+			name: "Read-only cannot count deleted users",
+			principal: "reader-1:read-only",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/count?includeDeleted=true",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to include deleted users",
+		},
+		{
+			name: "Read-only cannot group deleted users",
+			principal: "reader-1:read-only",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/stats?groupBy=country&includeDeleted=true",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to include deleted users",
+		},
+		{
+			name: "Read-only cannot export deleted users",
+			principal: "reader-1:read-only",
+			status: persistence.OK,
+			method: "GET",
+			url: "/users/export?includeDeleted=true",
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to include deleted users",
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(&mockSQLClient{test.status, []persistence.UserRecord{johnSmithUser}}, newTestQueueClient(), notification.NewEventStream(10), Config{
+			Authenticators: []Authenticator{stubAuthenticator{}},
+		})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest(test.method, test.url, strings.NewReader(test.reqBody))
+		req.Header.Set("Authorization", "Stub " + test.principal)
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		if test.detail == "" {
+			continue
+		}
+		assert.Equal("application/problem+json", rec.Header().Get("Content-Type"), fmt.Sprintf("%s: Wrong content type", test.name))
+		var problem Problem
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&problem), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.detail, problem.Detail, fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestBatchUpdateFieldAuthorization(t *testing.T) {
+	//only admins can batch update, so field rules are checked against a role which could be permitted to
+	permissions["batchUpdateUsers"][supportRole] = fullAccess
+	defer delete(permissions["batchUpdateUsers"], supportRole)
+
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockBatchClient{expectedStatuses: []persistence.Status{persistence.UPDATED}}, newTestQueueClient(), notification.NewEventStream(10), Config{
+		Authenticators: []Authenticator{stubAuthenticator{}},
+	})
+	handler.RegisterHandlers(r)
+	rec := httptest.NewRecorder()
+	req := newRequest("PATCH", "/users:batchUpdate", strings.NewReader(`{"mode": "partial", "updates": [
+		{"userID": "` + janeDoeID + `", "patch": {"nickname": "GIJoe"}},
+		{"userID": "` + caesarID + `", "patch": {"password": "et-tu"}}]}`))
+	req.Header.Set("Authorization", "Stub support-1:support")
+	r.ServeHTTP(rec, req)
+
+	results := decodeBatchResults(t, rec)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Equal(t, BatchResult{Index: 1, UserID: caesarID, Status: http.StatusForbidden, Message: "not permitted to change password"}, results[1])
+}
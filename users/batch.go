@@ -0,0 +1,363 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const (
+	//defaultMaxBatchSize is used when the handler config does not set the maximum operations in a batch
+	defaultMaxBatchSize = 1000
+	atomicBatch = "atomic"
+	partialBatch = "partial"
+	abortedMessage = "not applied as another operation in the atomic batch failed"
+)
+
+//BatchResult models the outcome of one operation of a batch, in the order the operations were supplied
+// swagger:model BatchResult
+type BatchResult struct {
+	Index int `json:"index"`
+	UserID string `json:"userID,omitempty"`
+	Status int `json:"status"`
+	Message string `json:"message"`
+}
+
+//BatchResponse models the outcome of a batch
+// swagger:model BatchResponse
+type BatchResponse struct {
+	Mode string `json:"mode"`
+	Succeeded int `json:"succeeded"`
+	Failed int `json:"failed"`
+	Results []BatchResult `json:"results"`
+}
+
+type batchCreateRequest struct {
+	Mode string `json:"mode"`
+	Users []persistence.UserRecord `json:"users"`
+}
+
+//batchUpdate is an update of a batch, where patch is a JSON merge patch of the user's fields
+type batchUpdate struct {
+	UserID string `json:"userID"`
+	Version int `json:"version"`
+	Patch json.RawMessage `json:"patch"`
+}
+
+type batchUpdateRequest struct {
+	Mode string `json:"mode"`
+	Updates []batchUpdate `json:"updates"`
+}
+
+type batchDelete struct {
+	UserID string `json:"userID"`
+	Version int `json:"version"`
+}
+
+type batchDeleteRequest struct {
+	Mode string `json:"mode"`
+	Users []batchDelete `json:"users"`
+}
+
+// swagger:operation POST /users:batchCreate users batchCreateUsers
+// ---
+// summary: Add users in bulk
+// description: Adds up to MAX_BATCH_SIZE users, assigning their IDs as POST /users does. In atomic mode, the default,
+//   no users are added unless all of them can be. Publishes a single USERS_CREATED message for the added users
+// parameters:
+// - name: body
+//   in: body
+//   description: the mode, atomic or partial, and the users to add
+//   required: true
+// responses:
+//   200: ok
+//   207: multiStatus
+//   400: badRequest
+//   500: internal
+func (h *UsersHandler) BatchCreate(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	var batch batchCreateRequest
+	if !decodeBatch(writer, request, &batch) {
+		return
+	}
+	atomic, ok := h.checkBatch(writer, batch.Mode, len(batch.Users))
+	if !ok {
+		return
+	}
+
+	results := make([]BatchResult, len(batch.Users))
+	for i := range batch.Users {
+		//generates unique user ID using email, as AddUser does
+		batch.Users[i].UserID = uuid.NewMD5(uuid.UUID{}, []byte(batch.Users[i].EmailAddress)).String()
+		results[i] = BatchResult{Index: i, UserID: batch.Users[i].UserID}
+	}
+
+	h.applyBatch(writer, request, batch.Mode, atomic, results, "USERS_CREATED", func(caller persistence.Caller, valid []int) []persistence.Status {
+		records := make([]persistence.UserRecord, len(valid))
+		for n, i := range valid {
+			records[n] = batch.Users[i]
+		}
+		return h.sqlClient.CreateRecords(caller, records, atomic)
+	}, func(i int, status persistence.Status) (int, string) {
+		switch status {
+		case persistence.CREATED:
+			return http.StatusCreated, "created user with ID: " + results[i].UserID
+		case persistence.ALREADY_EXISTS:
+			return http.StatusConflict, fmt.Sprintf("user with email: %s already exists in db!", batch.Users[i].EmailAddress)
+		default:
+			return http.StatusInternalServerError, "could not add user to db"
+		}
+	})
+}
+
+// swagger:operation PATCH /users:batchUpdate users batchUpdateUsers
+// ---
+// summary: Edit users in bulk
+// description: Applies up to MAX_BATCH_SIZE updates, each a JSON merge patch of a user's fields optionally
+//   conditional on the user's version. In atomic mode, the default, no users are updated unless all of them can be.
+//   Publishes a single USERS_UPDATED message for the updated users
+// parameters:
+// - name: body
+//   in: body
+//   description: the mode, atomic or partial, and the updates to apply
+//   required: true
+// responses:
+//   200: ok
+//   207: multiStatus
+//   400: badRequest
+//   500: internal
+func (h *UsersHandler) BatchUpdate(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	var batch batchUpdateRequest
+	if !decodeBatch(writer, request, &batch) {
+		return
+	}
+	atomic, ok := h.checkBatch(writer, batch.Mode, len(batch.Updates))
+	if !ok {
+		return
+	}
+
+	results := make([]BatchResult, len(batch.Updates))
+	updates := make([]persistence.RecordUpdate, len(batch.Updates))
+	seen := make(map[string]bool)
+	for i, update := range batch.Updates {
+		results[i] = BatchResult{Index: i, UserID: update.UserID}
+		if !h.checkBatchUser(&results[i], seen, update.Version) {
+			continue
+		}
+		fields, err := mergePatchUpdates(bytes.NewReader(update.Patch))
+		if err != nil {
+			results[i].Status, results[i].Message = http.StatusBadRequest, err.Error()
+			if e, ok := err.(patchError); ok {
+				results[i].Status = e.status
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			results[i].Status, results[i].Message = http.StatusBadRequest, "supplied fields are not valid for update"
+			continue
+		}
+		if forbidden := forbiddenFields(request, updatedColumns(fields)); len(forbidden) > 0 {
+			results[i].Status, results[i].Message = http.StatusForbidden, forbiddenFieldsMsg(forbidden)
+			continue
+		}
+		updates[i] = persistence.RecordUpdate{UserID: update.UserID, Fields: fields, ExpectedVersion: update.Version}
+	}
+
+	h.applyBatch(writer, request, batch.Mode, atomic, results, "USERS_UPDATED", func(caller persistence.Caller, valid []int) []persistence.Status {
+		subset := make([]persistence.RecordUpdate, len(valid))
+		for n, i := range valid {
+			subset[n] = updates[i]
+		}
+		return h.sqlClient.UpdateRecords(caller, subset, atomic)
+	}, func(i int, status persistence.Status) (int, string) {
+		userID := results[i].UserID
+		switch status {
+		case persistence.UPDATED:
+			return http.StatusOK, "updated user: " + userID
+		case persistence.NOT_FOUND:
+			return http.StatusNotFound, "could not update user: " + userID + " as they did not exist"
+		case persistence.VERSION_MISMATCH:
+			return http.StatusPreconditionFailed, fmt.Sprintf("user: %s is not at version %d", userID, updates[i].ExpectedVersion)
+		default:
+			return http.StatusInternalServerError, "could not update user: " + userID
+		}
+	})
+}
+
+// swagger:operation POST /users:batchDelete users batchDeleteUsers
+// ---
+// summary: Delete users in bulk
+// description: Soft deletes up to MAX_BATCH_SIZE users, optionally conditional on their versions. In atomic mode, the
+//   default, no users are deleted unless all of them can be. Publishes a single USERS_DELETED message for the deleted users
+// parameters:
+// - name: body
+//   in: body
+//   description: the mode, atomic or partial, and the users to delete
+//   required: true
+// responses:
+//   200: ok
+//   207: multiStatus
+//   400: badRequest
+//   500: internal
+func (h *UsersHandler) BatchDelete(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	var batch batchDeleteRequest
+	if !decodeBatch(writer, request, &batch) {
+		return
+	}
+	atomic, ok := h.checkBatch(writer, batch.Mode, len(batch.Users))
+	if !ok {
+		return
+	}
+
+	results := make([]BatchResult, len(batch.Users))
+	seen := make(map[string]bool)
+	for i, user := range batch.Users {
+		results[i] = BatchResult{Index: i, UserID: user.UserID}
+		h.checkBatchUser(&results[i], seen, user.Version)
+	}
+
+	h.applyBatch(writer, request, batch.Mode, atomic, results, "USERS_DELETED", func(caller persistence.Caller, valid []int) []persistence.Status {
+		users := make([]persistence.RecordVersion, len(valid))
+		for n, i := range valid {
+			users[n] = persistence.RecordVersion{UserID: batch.Users[i].UserID, ExpectedVersion: batch.Users[i].Version}
+		}
+		return h.sqlClient.DeleteRecords(caller, users, atomic)
+	}, func(i int, status persistence.Status) (int, string) {
+		userID := results[i].UserID
+		switch status {
+		case persistence.DELETED:
+			return http.StatusOK, "deleted user: " + userID
+		case persistence.NOT_FOUND:
+			return http.StatusNotFound, "user: " + userID + " does not exist"
+		case persistence.VERSION_MISMATCH:
+			return http.StatusPreconditionFailed, fmt.Sprintf("user: %s is not at version %d", userID, batch.Users[i].Version)
+		default:
+			return http.StatusInternalServerError, "could not delete user: " + userID
+		}
+	})
+}
+
+//decodeBatch decodes the body of a batch request, writing the response and returning false if it is invalid
+func decodeBatch(writer http.ResponseWriter, request *http.Request, batch interface{}) bool {
+	if err := json.NewDecoder(request.Body).Decode(batch); err != nil {
+		log.WithError(err).Error("could not decode request body")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not decode request body"))
+		return false
+	}
+	return true
+}
+
+//checkBatch validates the mode and size of a batch, returning whether it is atomic. Writes the response and
+//returns false if the batch is invalid
+func (h *UsersHandler) checkBatch(writer http.ResponseWriter, mode string, size int) (bool, bool) {
+	if mode != "" && mode != atomicBatch && mode != partialBatch {
+		log.Infof("invalid batch mode: %s", mode)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "mode must be atomic or partial"))
+		return false, false
+	}
+	maxSize := h.config.MaxBatchSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchSize
+	}
+	if size < 1 || size > maxSize {
+		log.Infof("invalid batch size: %d", size)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("batch must contain between 1 and %d operations", maxSize)))
+		return false, false
+	}
+	return mode != partialBatch, true
+}
+
+//checkBatchUser validates the user and version an operation changes, setting the result and returning false if they
+//are invalid. Users may only be changed once per batch so the version they are expected to be at is unambiguous
+func (h *UsersHandler) checkBatchUser(result *BatchResult, seen map[string]bool, version int) bool {
+	switch {
+	case result.UserID == "":
+		result.Status, result.Message = http.StatusBadRequest, "userID is required"
+	case seen[result.UserID]:
+		result.Status, result.Message = http.StatusBadRequest, "user: " + result.UserID + " appears more than once in the batch"
+	case version < 0:
+		result.Status, result.Message = http.StatusBadRequest, "version must not be negative"
+	case version == 0 && h.config.RequireIfMatch:
+		result.Status, result.Message = http.StatusPreconditionRequired, "version of user: " + result.UserID + " is required"
+	default:
+		seen[result.UserID] = true
+		return true
+	}
+	return false
+}
+
+//applyBatch applies the operations of a batch which passed validation, those without a result status, and writes the
+//response. apply is given the indexes of the operations to apply and returns their statuses, which outcome converts to
+//results. In atomic mode nothing is applied if any operation is invalid. A single message of the event type is
+//published for the users changed
+func (h *UsersHandler) applyBatch(writer http.ResponseWriter, request *http.Request, mode string, atomic bool, results []BatchResult, eventType string,
+	apply func(persistence.Caller, []int) []persistence.Status, outcome func(int, persistence.Status) (int, string)) {
+	caller := callerFromRequest(writer, request)
+	var valid []int
+	for i, result := range results {
+		if result.Status == 0 {
+			valid = append(valid, i)
+		}
+	}
+
+	switch {
+	case len(valid) == 0:
+	case atomic && len(valid) < len(results):
+		for _, i := range valid {
+			results[i].Status, results[i].Message = http.StatusFailedDependency, abortedMessage
+		}
+	default:
+		statuses := apply(caller, valid)
+		for n, i := range valid {
+			if statuses[n] == persistence.ABORTED {
+				results[i].Status, results[i].Message = http.StatusFailedDependency, abortedMessage
+				continue
+			}
+			results[i].Status, results[i].Message = outcome(i, statuses[n])
+		}
+	}
+
+	if mode == "" {
+		mode = atomicBatch
+	}
+	response := BatchResponse{Mode: mode, Results: results}
+	var changed []string
+	statusCode := http.StatusOK
+	for _, result := range results {
+		if result.Status < http.StatusMultipleChoices {
+			response.Succeeded++
+			changed = append(changed, result.UserID)
+			continue
+		}
+		response.Failed++
+		if statusCode == http.StatusOK {
+			statusCode = http.StatusMultiStatus
+		}
+		//atomic batches which failed on the server changed nothing, so are reported as such so that they can be retried,
+		//while the results of partial batches report which users were changed
+		if mode == atomicBatch && result.Status >= http.StatusInternalServerError {
+			statusCode = http.StatusInternalServerError
+		}
+	}
+	if len(changed) > 0 {
+		h.publish(persistence.Message{
+			Type: eventType,
+			UserIDs: changed,
+			TenantID: requestTenant(request),
+		})
+	}
+
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		log.WithError(err).Error("could not encode returned payload")
+	}
+}
@@ -0,0 +1,279 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	janeDoeID = "16f701dc-5e71-497b-a197-ef7b8618cbea"
+	caesarID = "ff7dfd22-9134-429b-9482-0888ffdfc64b"
+	//johnSmithGeneratedID and caesarGeneratedID are the IDs generated from the emails in batchCreateBody
+	johnSmithGeneratedID = "3f685356-02a0-3c55-8b8d-c8bac4b79426"
+	caesarGeneratedID = "73323933-e3aa-3f17-b959-254e5f915d9a"
+)
+
+var batchCreateBody = `{
+  "mode": "%s",
+  "users": [
+    {"firstName": "John", "lastName": "Smith", "emailAddress": "john.smith@gmail.com", "password": "password1", "nickname": "smithy12345", "country": "UK"},
+    {"firstName": "Julius", "lastName": "Caesar", "emailAddress": "caesar@gmail.com", "password": "password4", "nickname": "ETuBrute", "country": "Italy"}
+  ]
+}`
+
+func TestBatchCreateHandler(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		reqBody    string
+		statuses   []persistence.Status
+		statusCode int
+		results    []BatchResult
+		events     []persistence.Message
+	}{
+		{
+			name:       "Creates every user",
+			reqBody:    fmt.Sprintf(batchCreateBody, "atomic"),
+			statuses:   []persistence.Status{persistence.CREATED, persistence.CREATED},
+			statusCode: http.StatusOK,
+			results: []BatchResult{
+				{Index: 0, UserID: johnSmithGeneratedID, Status: http.StatusCreated, Message: "created user with ID: " + johnSmithGeneratedID},
+				{Index: 1, UserID: caesarGeneratedID, Status: http.StatusCreated, Message: "created user with ID: " + caesarGeneratedID},
+			},
+			events: []persistence.Message{{Type: "USERS_CREATED", UserIDs: []string{johnSmithGeneratedID, caesarGeneratedID}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name:       "Atomic batch aborts other users",
+			reqBody:    fmt.Sprintf(batchCreateBody, "atomic"),
+			statuses:   []persistence.Status{persistence.ABORTED, persistence.ALREADY_EXISTS},
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: johnSmithGeneratedID, Status: http.StatusFailedDependency, Message: abortedMessage},
+				{Index: 1, UserID: caesarGeneratedID, Status: http.StatusConflict, Message: "user with email: caesar@gmail.com already exists in db!"},
+			},
+		},
+		{
+			name:       "Partial batch creates the users it can",
+			reqBody:    fmt.Sprintf(batchCreateBody, "partial"),
+			statuses:   []persistence.Status{persistence.CREATED, persistence.ALREADY_EXISTS},
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: johnSmithGeneratedID, Status: http.StatusCreated, Message: "created user with ID: " + johnSmithGeneratedID},
+				{Index: 1, UserID: caesarGeneratedID, Status: http.StatusConflict, Message: "user with email: caesar@gmail.com already exists in db!"},
+			},
+			events: []persistence.Message{{Type: "USERS_CREATED", UserIDs: []string{johnSmithGeneratedID}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name:       "Partial batches report the users changed despite server errors",
+			reqBody:    fmt.Sprintf(batchCreateBody, "partial"),
+			statuses:   []persistence.Status{persistence.CREATED, persistence.BACKEND_ERROR},
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: johnSmithGeneratedID, Status: http.StatusCreated, Message: "created user with ID: " + johnSmithGeneratedID},
+				{Index: 1, UserID: caesarGeneratedID, Status: http.StatusInternalServerError, Message: "could not add user to db"},
+			},
+			events: []persistence.Message{{Type: "USERS_CREATED", UserIDs: []string{johnSmithGeneratedID}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name:       "Server errors fail atomic batches",
+			reqBody:    fmt.Sprintf(batchCreateBody, "atomic"),
+			statuses:   []persistence.Status{persistence.BACKEND_ERROR, persistence.BACKEND_ERROR},
+			statusCode: http.StatusInternalServerError,
+			results: []BatchResult{
+				{Index: 0, UserID: johnSmithGeneratedID, Status: http.StatusInternalServerError, Message: "could not add user to db"},
+				{Index: 1, UserID: caesarGeneratedID, Status: http.StatusInternalServerError, Message: "could not add user to db"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		events := notification.NewEventStream(10)
+		sqlClient := &mockBatchClient{expectedStatuses: test.statuses}
+		rec := serveBatch(sqlClient, events, Config{}, "POST", "/users:batchCreate", test.reqBody)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.results, decodeBatchResults(t, rec), fmt.Sprintf("%s: Wrong results", test.name))
+		assert.Equal(test.events, publishedMessages(events), fmt.Sprintf("%s: Wrong events", test.name))
+	}
+}
+
+func TestBatchUpdateHandler(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		config     Config
+		reqBody    string
+		statuses   []persistence.Status
+		statusCode int
+		results    []BatchResult
+		updates    []persistence.RecordUpdate
+		events     []persistence.Message
+	}{
+		{
+			name: "Applies merge patches to every user",
+			reqBody: `{"updates": [
+				{"userID": "` + janeDoeID + `", "version": 2, "patch": {"nickname": "GIJoe"}},
+				{"userID": "` + caesarID + `", "patch": {"nickname": null, "country": "Rome"}}
+			]}`,
+			statuses:   []persistence.Status{persistence.UPDATED, persistence.UPDATED},
+			statusCode: http.StatusOK,
+			results: []BatchResult{
+				{Index: 0, UserID: janeDoeID, Status: http.StatusOK, Message: "updated user: " + janeDoeID},
+				{Index: 1, UserID: caesarID, Status: http.StatusOK, Message: "updated user: " + caesarID},
+			},
+			updates: []persistence.RecordUpdate{
+				{UserID: janeDoeID, Fields: map[string]string{"nickname": "GIJoe"}, ExpectedVersion: 2},
+				{UserID: caesarID, Fields: map[string]string{"nickname": "", "country": "Rome"}},
+			},
+			events: []persistence.Message{{Type: "USERS_UPDATED", UserIDs: []string{janeDoeID, caesarID}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name: "Invalid updates abort atomic batches without changing users",
+			reqBody: `{"mode": "atomic", "updates": [
+				{"userID": "` + janeDoeID + `", "patch": {"nickname": "GIJoe"}},
+				{"userID": "` + caesarID + `", "patch": {"emailAddress": "brutus@gmail.com"}},
+				{"userID": "` + janeDoeID + `", "patch": {"country": "Canada"}},
+				{"patch": {"country": "Canada"}}
+			]}`,
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: janeDoeID, Status: http.StatusFailedDependency, Message: abortedMessage},
+				{Index: 1, UserID: caesarID, Status: http.StatusForbidden, Message: "emailAddress cannot be modified"},
+				{Index: 2, UserID: janeDoeID, Status: http.StatusBadRequest, Message: "user: " + janeDoeID + " appears more than once in the batch"},
+				{Index: 3, Status: http.StatusBadRequest, Message: "userID is required"},
+			},
+		},
+		{
+			name: "Partial batches apply valid updates",
+			reqBody: `{"mode": "partial", "updates": [
+				{"userID": "` + janeDoeID + `", "version": 1, "patch": {"nickname": "GIJoe"}},
+				{"userID": "` + caesarID + `", "patch": {"address": "The Forum"}},
+				{"userID": "` + johnSmithGeneratedID + `", "patch": {"nickname": "KingSmithy"}}
+			]}`,
+			statuses:   []persistence.Status{persistence.VERSION_MISMATCH, persistence.UPDATED},
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: janeDoeID, Status: http.StatusPreconditionFailed, Message: "user: " + janeDoeID + " is not at version 1"},
+				{Index: 1, UserID: caesarID, Status: http.StatusBadRequest, Message: "address is not a user field"},
+				{Index: 2, UserID: johnSmithGeneratedID, Status: http.StatusOK, Message: "updated user: " + johnSmithGeneratedID},
+			},
+			updates: []persistence.RecordUpdate{
+				{UserID: janeDoeID, Fields: map[string]string{"nickname": "GIJoe"}, ExpectedVersion: 1},
+				{UserID: johnSmithGeneratedID, Fields: map[string]string{"nickname": "KingSmithy"}},
+			},
+			events: []persistence.Message{{Type: "USERS_UPDATED", UserIDs: []string{johnSmithGeneratedID}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name:   "Versions are required when If-Match is",
+			config: Config{RequireIfMatch: true},
+			reqBody: `{"mode": "partial", "updates": [
+				{"userID": "` + janeDoeID + `", "patch": {"nickname": "GIJoe"}}
+			]}`,
+			statusCode: http.StatusMultiStatus,
+			results: []BatchResult{
+				{Index: 0, UserID: janeDoeID, Status: http.StatusPreconditionRequired, Message: "version of user: " + janeDoeID + " is required"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		events := notification.NewEventStream(10)
+		sqlClient := &mockBatchClient{expectedStatuses: test.statuses}
+		rec := serveBatch(sqlClient, events, test.config, "PATCH", "/users:batchUpdate", test.reqBody)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.results, decodeBatchResults(t, rec), fmt.Sprintf("%s: Wrong results", test.name))
+		assert.Equal(test.updates, sqlClient.updated, fmt.Sprintf("%s: Wrong updates", test.name))
+		assert.Equal(test.events, publishedMessages(events), fmt.Sprintf("%s: Wrong events", test.name))
+	}
+}
+
+func TestBatchDeleteHandler(t *testing.T) {
+	assert := assert.New(t)
+	events := notification.NewEventStream(10)
+	sqlClient := &mockBatchClient{expectedStatuses: []persistence.Status{persistence.DELETED, persistence.NOT_FOUND}}
+	rec := serveBatch(sqlClient, events, Config{}, "POST", "/users:batchDelete", `{"mode": "partial", "users": [
+		{"userID": "` + janeDoeID + `", "version": 3},
+		{"userID": "` + caesarID + `"}
+	]}`)
+	assert.Equal(http.StatusMultiStatus, rec.Code)
+	assert.Equal([]BatchResult{
+		{Index: 0, UserID: janeDoeID, Status: http.StatusOK, Message: "deleted user: " + janeDoeID},
+		{Index: 1, UserID: caesarID, Status: http.StatusNotFound, Message: "user: " + caesarID + " does not exist"},
+	}, decodeBatchResults(t, rec))
+	assert.Equal([]persistence.RecordVersion{{UserID: janeDoeID, ExpectedVersion: 3}, {UserID: caesarID}}, sqlClient.deleted)
+	assert.Equal([]persistence.Message{{Type: "USERS_DELETED", UserIDs: []string{janeDoeID}, TenantID: persistence.DefaultTenant}}, publishedMessages(events))
+}
+
+func TestBatchValidation(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		reqBody    string
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Invalid body",
+			reqBody:    "{,}",
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "could not decode request body"),
+		},
+		{
+			name:       "Invalid mode",
+			reqBody:    `{"mode": "best-effort", "users": [{"userID": "` + janeDoeID + `"}]}`,
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "mode must be atomic or partial"),
+		},
+		{
+			name:       "Empty batch",
+			reqBody:    `{"users": []}`,
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "batch must contain between 1 and 2 operations"),
+		},
+		{
+			name:       "Batch too large",
+			reqBody:    `{"users": [{"userID": "1"}, {"userID": "2"}, {"userID": "3"}]}`,
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "batch must contain between 1 and 2 operations"),
+		},
+	}
+
+	for _, test := range tests {
+		rec := serveBatch(&mockBatchClient{}, notification.NewEventStream(10), Config{MaxBatchSize: 2}, "POST", "/users:batchDelete", test.reqBody)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func serveBatch(sqlClient persistence.Clienter, events *notification.EventStream, config Config, method, url, body string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	handler := NewUsersHandler(sqlClient, newTestQueueClient(), events, config)
+	handler.RegisterHandlers(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest(method, url, strings.NewReader(body)))
+	return rec
+}
+
+func decodeBatchResults(t *testing.T, rec *httptest.ResponseRecorder) []BatchResult {
+	var response BatchResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&response), "test failed: could not decode batch response")
+	assert.Equal(t, len(response.Results), response.Succeeded + response.Failed, "test failed: results should be counted")
+	return response.Results
+}
+
+func publishedMessages(events *notification.EventStream) []persistence.Message {
+	replayed, _, cancel := events.Subscribe(0)
+	cancel()
+	var published []persistence.Message
+	for _, event := range replayed {
+		published = append(published, event.Message)
+	}
+	return published
+}
@@ -0,0 +1,284 @@
+package users
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//weights of each field in the score of a duplicate, summing to 1
+const (
+	emailWeight = 0.4
+	firstNameWeight = 0.2
+	lastNameWeight = 0.25
+	nicknameWeight = 0.15
+)
+
+const (
+	//defaultMinDuplicateScore is the lowest score of a duplicate reported by default. Users must share more than a
+	//first name to reach it
+	defaultMinDuplicateScore = 0.4
+	//soundsAlikeScore is the score of a name sounding like another, as a fraction of the score of the same name
+	soundsAlikeScore = 0.8
+	//minNicknameSimilarity is the least similar nicknames can be and still count towards the score
+	minNicknameSimilarity = 0.5
+)
+
+//Duplicate is the model for a user who may be a duplicate of another
+// swagger:model Duplicate
+type Duplicate struct {
+	User persistence.UserRecord `json:"user"`
+	//Score is how likely the users are duplicates, from 0 to 1
+	Score float64 `json:"score"`
+	//Matches are the fields which matched and how e.g. sounds alike
+	Matches map[string]string `json:"matches"`
+}
+
+//scoreDuplicate scores how likely the candidate is a duplicate of the user, from normalised emails, the Soundex and
+//Double Metaphone codes of their names and the Levenshtein distance between their nicknames
+func scoreDuplicate(user, candidate persistence.UserRecord) Duplicate {
+	duplicate := Duplicate{User: candidate, Matches: make(map[string]string)}
+	if persistence.NormaliseEmail(user.EmailAddress) == persistence.NormaliseEmail(candidate.EmailAddress) {
+		duplicate.Score += emailWeight
+		duplicate.Matches["emailAddress"] = "same when normalised"
+	}
+	for _, name := range []struct {
+		field string
+		weight float64
+		user, candidate string
+	}{
+		{"firstName", firstNameWeight, user.FirstName, candidate.FirstName},
+		{"lastName", lastNameWeight, user.LastName, candidate.LastName},
+	} {
+		switch {
+		case strings.EqualFold(strings.TrimSpace(name.user), strings.TrimSpace(name.candidate)):
+			duplicate.Score += name.weight
+			duplicate.Matches[name.field] = "same"
+		case soundsAlike(name.user, name.candidate):
+			duplicate.Score += name.weight * soundsAlikeScore
+			duplicate.Matches[name.field] = "sounds alike"
+		}
+	}
+	if nickname := similarity(user.NickName, candidate.NickName); nickname == 1 {
+		duplicate.Score += nicknameWeight
+		duplicate.Matches["nickname"] = "same"
+	} else if nickname >= minNicknameSimilarity {
+		duplicate.Score += nicknameWeight * nickname
+		duplicate.Matches["nickname"] = fmt.Sprintf("%.0f%% similar", nickname*100)
+	}
+	duplicate.Score = math.Round(duplicate.Score*100) / 100
+	return duplicate
+}
+
+//findDuplicates scores the candidates, returning those scoring at least minScore, most likely duplicates first
+func findDuplicates(user persistence.UserRecord, candidates []persistence.UserRecord, minScore float64) []Duplicate {
+	duplicates := []Duplicate{}
+	for _, candidate := range candidates {
+		if candidate.UserID == user.UserID {
+			continue
+		}
+		if duplicate := scoreDuplicate(user, candidate); duplicate.Score >= minScore {
+			duplicates = append(duplicates, duplicate)
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool { return duplicates[i].Score > duplicates[j].Score })
+	return duplicates
+}
+
+// swagger:operation GET /users/{userID}/duplicates users getUserDuplicates
+// ---
+// summary: Return possible duplicates of a user
+// description: Scores the users whose last name sounds like the user's, or whose email has the same part before the @
+//   ignoring case, +tags and for Gmail dots, by how likely they are duplicates of the user, most likely first
+// parameters:
+// - name: userID
+//   in: path
+//   description: users uuid
+//   type: string
+//   required: true
+// - name: minScore
+//   in: query
+//   description: lowest score of the duplicates to return, from 0 to 1, defaults to 0.4
+//   type: number
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   404: notFound
+//   410: gone
+//   500: internal
+func (h *UsersHandler) GetDuplicates(writer http.ResponseWriter, request *http.Request) {
+	userID := mux.Vars(request)["userID"]
+	minScore, err := minScoreParam(request.URL.Query().Get("minScore"))
+	if err != nil {
+		log.WithField("UserID", userID).Infof("invalid minScore param: %s", request.URL.Query().Get("minScore"))
+		writeProblem(writer, request, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, status := h.sqlClient.RetrieveRecords(persistence.SearchCriteria{
+		TenantID: requestTenant(request),
+		Fields: map[string]string{"user_id": userID},
+		IncludeDeleted: true,
+	})
+	switch {
+	case status == persistence.NOT_FOUND:
+		writeProblem(writer, request, http.StatusNotFound, "no user exists with ID: " + userID)
+		return
+	case status != persistence.OK || len(users) != 1:
+		writeProblem(writer, request, http.StatusInternalServerError, "could not process request")
+		return
+	case users[0].DeletedAt != nil:
+		writeProblem(writer, request, http.StatusGone, "user: " + userID + " has been deleted")
+		return
+	}
+
+	candidates, status := h.sqlClient.RetrieveDuplicateCandidates(requestTenant(request), users[0])
+	if status != persistence.OK {
+		writeProblem(writer, request, http.StatusInternalServerError, "could not process request")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(findDuplicates(users[0], candidates, minScore)); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not encode returned payload")
+	}
+}
+
+//minScoreParam parses an optional minimum duplicate score, returning the default if it is missing
+func minScoreParam(value string) (float64, error) {
+	if value == "" {
+		return defaultMinDuplicateScore, nil
+	}
+	minScore, err := strconv.ParseFloat(value, 64)
+	if err != nil || minScore < 0 || minScore > 1 {
+		return 0, fmt.Errorf("minScore must be between 0 and 1")
+	}
+	return minScore, nil
+}
+
+//DedupeOptions configures a report of the possible duplicate users in the DB
+type DedupeOptions struct {
+	//MinScore is the lowest score of the pairs of users reported
+	MinScore float64
+	BatchSize int
+	//TenantID is the tenant whose users are compared, users are never compared with those of other tenants
+	TenantID string
+}
+
+//DedupeResult summarises a duplicate report
+type DedupeResult struct {
+	Scanned int
+	Duplicates int
+}
+
+//DuplicateReporter reports the possible duplicate users in the DB
+type DuplicateReporter struct {
+	sqlClient persistence.Clienter
+}
+
+//NewDuplicateReporter returns a reporter reading from the sql client
+func NewDuplicateReporter(sqlClient persistence.Clienter) DuplicateReporter {
+	return DuplicateReporter{sqlClient: sqlClient}
+}
+
+//Run reads every user who has not been deleted and writes each pair of users who could be duplicates to out as csv,
+//most likely duplicates first. As with GET /users/{userID}/duplicates only users whose last names sound alike or
+//whose emails are the same ignoring dots and +tags are compared, so the names, emails and nicknames of every user are
+//held in memory but not every pair of users is scored
+func (dr DuplicateReporter) Run(out io.Writer, opts DedupeOptions) (DedupeResult, error) {
+	if opts.BatchSize < 1 {
+		return DedupeResult{}, fmt.Errorf("batch size must be positive")
+	}
+	criteria := persistence.SearchCriteria{TenantID: opts.TenantID, Columns: []string{"first_name", "last_name", "email", "nickname"}}
+	var users []persistence.UserRecord
+	blocks := make(map[string][]int)
+	var lastUserID string
+	for {
+		page, status := dr.sqlClient.ScanRecords(criteria, lastUserID, opts.BatchSize)
+		if status == persistence.NOT_FOUND {
+			break
+		} else if status != persistence.OK {
+			return DedupeResult{Scanned: len(users)}, fmt.Errorf("could not read users after %s from db", lastUserID)
+		}
+		for _, user := range page {
+			for _, key := range blockingKeys(user) {
+				blocks[key] = append(blocks[key], len(users))
+			}
+			users = append(users, user)
+		}
+		lastUserID = page[len(page)-1].UserID
+		if len(page) < opts.BatchSize {
+			break
+		}
+	}
+
+	type pair struct {
+		user int
+		duplicate Duplicate
+	}
+	var pairs []pair
+	compared := make(map[[2]int]bool)
+	for _, block := range blocks {
+		for i, first := range block {
+			for _, second := range block[i+1:] {
+				if compared[[2]int{first, second}] {
+					continue
+				}
+				compared[[2]int{first, second}] = true
+				if duplicate := scoreDuplicate(users[first], users[second]); duplicate.Score >= opts.MinScore {
+					pairs = append(pairs, pair{first, duplicate})
+				}
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].duplicate.Score != pairs[j].duplicate.Score {
+			return pairs[i].duplicate.Score > pairs[j].duplicate.Score
+		}
+		if pairs[i].user != pairs[j].user {
+			return pairs[i].user < pairs[j].user
+		}
+		return pairs[i].duplicate.User.UserID < pairs[j].duplicate.User.UserID
+	})
+
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"userID", "duplicateUserID", "score", "emailAddress", "firstName", "lastName", "nickname"})
+	for _, p := range pairs {
+		matches := p.duplicate.Matches
+		writer.Write([]string{
+			users[p.user].UserID,
+			p.duplicate.User.UserID,
+			strconv.FormatFloat(p.duplicate.Score, 'f', 2, 64),
+			matches["emailAddress"],
+			matches["firstName"],
+			matches["lastName"],
+			matches["nickname"],
+		})
+	}
+	writer.Flush()
+	result := DedupeResult{Scanned: len(users), Duplicates: len(pairs)}
+	if err := writer.Error(); err != nil {
+		return result, fmt.Errorf("could not write report: %v", err)
+	}
+	return result, nil
+}
+
+//blockingKeys are the keys of the blocks of users compared with each other by the duplicate report, matching the
+//candidates of RetrieveDuplicateCandidates
+func blockingKeys(user persistence.UserRecord) []string {
+	keys := []string{"email:" + persistence.EmailLocalKey(user.EmailAddress)}
+	if code := persistence.Soundex(user.LastName); code != "" {
+		keys = append(keys, "lastName:" + code)
+	}
+	return keys
+}
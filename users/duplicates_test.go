@@ -0,0 +1,173 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var duplicateUsers = []persistence.UserRecord{
+	{UserID: "1", FirstName: "Jon", LastName: "Smith", EmailAddress: "jonsmith@gmail.com", NickName: "jonny", Country: "UK"},
+	{UserID: "2", FirstName: "John", LastName: "Smyth", EmailAddress: "Jon.Smith+shop@googlemail.com", NickName: "johnny", Country: "UK"},
+	{UserID: "3", FirstName: "Mary", LastName: "Smith", EmailAddress: "mary@example.com", NickName: "jonnie", Country: "UK"},
+	{UserID: "4", FirstName: "Julius", LastName: "Caesar", EmailAddress: "caesar@gmail.com", NickName: "ETuBrute", Country: "Italy"},
+}
+
+func TestSimilarity(t *testing.T) {
+	assert := assert.New(t)
+	for name, code := range map[string]string{
+		"Smith": "S530",
+		"Smyth": "S530",
+		"Jon": "J500",
+		"John": "J500",
+		"Robert": "R163",
+		"Rupert": "R163",
+		"Ashcraft": "A261",
+		"Tymczak": "T522",
+		"Pfister": "P236",
+		"O'Hara": "O600",
+		"42": "",
+	} {
+		assert.Equal(code, persistence.Soundex(name), fmt.Sprintf("Wrong soundex code of %s", name))
+	}
+	for name, codes := range map[string][2]string{
+		"Smith": {"SM0", "XMT"},
+		"Schmidt": {"XMT", "SMT"},
+		"Jon": {"JN", "AN"},
+		"John": {"JN", "AN"},
+		"Jose": {"HS", "HS"},
+		"Thomas": {"TMS", "TMS"},
+		"Caesar": {"SSR", "SSR"},
+		"Michael": {"MKL", "MXL"},
+		"Czerny": {"SRN", "XRN"},
+		"Xavier": {"SF", "SFR"},
+		"Wasserman": {"ASRM", "FSRM"},
+		"Arnow": {"ARN", "ARNF"},
+		"Filipowicz": {"FLPT", "FLPF"},
+		"Knight": {"NT", "NT"},
+		"42": {"", ""},
+	} {
+		primary, alternate := doubleMetaphone(name)
+		assert.Equal(codes, [2]string{primary, alternate}, fmt.Sprintf("Wrong double metaphone codes of %s", name))
+	}
+	assert.True(soundsAlike("Smith", "Schmidt"), "Names sharing a double metaphone code should sound alike")
+	assert.True(soundsAlike("Robert", "Rupert"), "Names with the same soundex code should sound alike")
+	assert.False(soundsAlike("Smith", "Jones"))
+	assert.False(soundsAlike("42", "42"), "Names without codes should not sound alike")
+
+	assert.Equal(0, levenshtein("smithy", "smithy"))
+	assert.Equal(3, levenshtein("kitten", "sitting"))
+	assert.Equal(4, levenshtein("", "café"))
+	assert.Equal(1.0, similarity("Jonny", "jONNY"))
+	assert.Equal(0.5, similarity("abcd", "abef"))
+
+	assert.Equal("jonsmith@gmail.com", persistence.NormaliseEmail(" Jon.Smith+shop@GoogleMail.com"))
+	assert.Equal("jon.smith@example.com", persistence.NormaliseEmail("jon.smith+news@example.com"))
+	assert.Equal("jonsmith", persistence.EmailLocalKey(" Jon.Smith+shop@GoogleMail.com"))
+	assert.Equal("jon.smith", persistence.EmailLocalKey("jon.smith+news@example.com"), "test failed: dots are only ignored for Gmail")
+}
+
+func TestGetDuplicates(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	deletedAt := exportCreatedAt
+	tests := []struct {
+		name string
+		users []persistence.UserRecord
+		status persistence.Status
+		reqURL string
+		statusCode int
+		body string
+	}{
+		{
+			name: "Scores likely duplicates",
+			users: duplicateUsers,
+			status: persistence.OK,
+			reqURL: "/users/1/duplicates",
+			statusCode: http.StatusOK,
+			body: `[{"user":{"userID":"2","firstName":"John","lastName":"Smyth","emailAddress":"Jon.Smith+shop@googlemail.com","nickname":"johnny","country":"UK"},"score":0.89,` +
+				`"matches":{"emailAddress":"same when normalised","firstName":"sounds alike","lastName":"sounds alike","nickname":"83% similar"}}]` + "\n",
+		},
+		{
+			name: "Scores less likely duplicates",
+			users: duplicateUsers,
+			status: persistence.OK,
+			reqURL: "/users/1/duplicates?minScore=0.3",
+			statusCode: http.StatusOK,
+			body: `[{"user":{"userID":"2","firstName":"John","lastName":"Smyth","emailAddress":"Jon.Smith+shop@googlemail.com","nickname":"johnny","country":"UK"},"score":0.89,` +
+				`"matches":{"emailAddress":"same when normalised","firstName":"sounds alike","lastName":"sounds alike","nickname":"83% similar"}},` +
+				`{"user":{"userID":"3","firstName":"Mary","lastName":"Smith","emailAddress":"mary@example.com","nickname":"jonnie","country":"UK"},"score":0.35,` +
+				`"matches":{"lastName":"same","nickname":"67% similar"}}]` + "\n",
+		},
+		{
+			name: "Returns no duplicates",
+			users: duplicateUsers,
+			status: persistence.OK,
+			reqURL: "/users/4/duplicates",
+			statusCode: http.StatusOK,
+			body: "[]\n",
+		},
+		{
+			name: "Error on invalid minScore",
+			users: duplicateUsers,
+			status: persistence.OK,
+			reqURL: "/users/1/duplicates?minScore=2",
+			statusCode: http.StatusBadRequest,
+			body: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"minScore must be between 0 and 1","instance":"/users/1/duplicates"}` + "\n",
+		},
+		{
+			name: "Error when user does not exist",
+			users: duplicateUsers,
+			status: persistence.OK,
+			reqURL: "/users/5/duplicates",
+			statusCode: http.StatusNotFound,
+			body: `{"type":"about:blank","title":"Not Found","status":404,"detail":"no user exists with ID: 5","instance":"/users/5/duplicates"}` + "\n",
+		},
+		{
+			name: "Error when user has been deleted",
+			users: []persistence.UserRecord{{UserID: "1", DeletedAt: &deletedAt}},
+			status: persistence.OK,
+			reqURL: "/users/1/duplicates",
+			statusCode: http.StatusGone,
+			body: `{"type":"about:blank","title":"Gone","status":410,"detail":"user: 1 has been deleted","instance":"/users/1/duplicates"}` + "\n",
+		},
+		{
+			name: "Error when candidates cannot be read",
+			users: duplicateUsers,
+			status: persistence.BACKEND_ERROR,
+			reqURL: "/users/1/duplicates",
+			statusCode: http.StatusInternalServerError,
+			body: `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"could not process request","instance":"/users/1/duplicates"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(&mockDuplicatesClient{mockSQLClient{test.status, test.users}}, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestDuplicateReporter(t *testing.T) {
+	var out bytes.Buffer
+	result, err := NewDuplicateReporter(&mockSQLClient{persistence.OK, duplicateUsers}).Run(&out, DedupeOptions{MinScore: 0.3, BatchSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, DedupeResult{Scanned: 4, Duplicates: 2}, result)
+	assert.Equal(t, `userID,duplicateUserID,score,emailAddress,firstName,lastName,nickname
+1,2,0.89,same when normalised,sounds alike,sounds alike,83% similar
+1,3,0.35,,,same,67% similar
+`, out.String())
+
+	_, err = NewDuplicateReporter(&mockScanClient{mockSQLClient: mockSQLClient{persistence.OK, duplicateUsers}, failAfter: 1}).Run(&out, DedupeOptions{MinScore: 0.3, BatchSize: 2})
+	assert.EqualError(t, err, "could not read users after 2 from db")
+}
@@ -0,0 +1,162 @@
+package users
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//EncodeFunc writes the users returned by GET /users to the response. Only the selected fields are written, in order,
+//or every field if none were selected
+type EncodeFunc func(writer io.Writer, users []persistence.UserRecord, fields []string) error
+
+//mediaEncoder is an encoder registered for a media type
+type mediaEncoder struct {
+	mediaType string
+	encode EncodeFunc
+}
+
+var (
+	encodersMu sync.RWMutex
+	//encoders are the media types GET /users can respond with, in order of preference when the Accept header
+	//rates several equally
+	encoders = []mediaEncoder{
+		{"application/json", encodeJSON},
+		{"application/x-ndjson", recordEncoder("ndjson")},
+		{"text/csv", recordEncoder("csv")},
+		{"application/xml", encodeXML},
+	}
+)
+
+//RegisterEncoder makes GET /users able to respond with the media type, replacing any encoder already registered
+//for it. New media types are least preferred
+func RegisterEncoder(mediaType string, encode EncodeFunc) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	for i, encoder := range encoders {
+		if encoder.mediaType == mediaType {
+			encoders[i].encode = encode
+			return
+		}
+	}
+	encoders = append(encoders, mediaEncoder{mediaType, encode})
+}
+
+func encodeJSON(writer io.Writer, users []persistence.UserRecord, fields []string) error {
+	columns, err := projectColumns(fields)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(writer).Encode(projectUsers(users, columns))
+}
+
+//recordEncoder encodes users with the export record writer for the format
+func recordEncoder(format string) EncodeFunc {
+	return func(writer io.Writer, users []persistence.UserRecord, fields []string) error {
+		columns, err := projectColumns(fields)
+		if err != nil {
+			return err
+		}
+		records, err := newRecordWriter(format, writer, columns)
+		if err != nil {
+			return err
+		}
+		if err := records.write(users); err != nil {
+			return err
+		}
+		return records.close()
+	}
+}
+
+//xmlUsers is the root element of xml responses
+type xmlUsers struct {
+	XMLName xml.Name `xml:"users"`
+	Users []projectedUser `xml:"user"`
+}
+
+func encodeXML(writer io.Writer, users []persistence.UserRecord, fields []string) error {
+	columns, err := projectColumns(fields)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(writer, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(writer).Encode(xmlUsers{Users: projectUsers(users, columns)})
+}
+
+//negotiateEncoder chooses the registered encoder the Accept header rates highest, using the most specific media
+//range matching each type. Requests without an Accept header get the most preferred encoder
+func negotiateEncoder(accept string) (mediaEncoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	if strings.TrimSpace(accept) == "" {
+		return encoders[0], true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	var best mediaEncoder
+	var bestQ float64
+	for _, encoder := range encoders {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			s := rangeSpecificity(r.mediaType, encoder.mediaType)
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoder, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+//rangeSpecificity returns how specifically the media range matches the media type, or -1 if it does not
+func rangeSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	case mediaRange == "*/*":
+		return 0
+	default:
+		return -1
+	}
+}
+
+//supportedMediaTypes lists the registered media types for 406 responses
+func supportedMediaTypes() string {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	mediaTypes := make([]string, len(encoders))
+	for i, encoder := range encoders {
+		mediaTypes[i] = encoder.mediaType
+	}
+	return fmt.Sprintf("[%s]", strings.Join(mediaTypes, ", "))
+}
@@ -0,0 +1,115 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetHandlerContentNegotiation(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		accept string
+		statusCode int
+		contentType string
+		body string
+	}{
+		{
+			name: "Returns json without an Accept header",
+			statusCode: http.StatusOK,
+			contentType: "application/json",
+			body: convertBody(johnSmithReadJSON),
+		},
+		{
+			name: "Returns json for any media type",
+			accept: "*/*",
+			statusCode: http.StatusOK,
+			contentType: "application/json",
+			body: convertBody(johnSmithReadJSON),
+		},
+		{
+			name: "Returns csv",
+			accept: "text/csv",
+			statusCode: http.StatusOK,
+			contentType: "text/csv",
+			body: "userID,firstName,lastName,emailAddress,nickname,country,deletedAt,version,createdAt,updatedAt\n" +
+				"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d,John,Smith,john.smith@gmail.com,smithy12345,UK,,0,,\n",
+		},
+		{
+			name: "Returns ndjson",
+			accept: "application/x-ndjson",
+			statusCode: http.StatusOK,
+			contentType: "application/x-ndjson",
+			body: `{"userID":"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d","firstName":"John","lastName":"Smith","emailAddress":"john.smith@gmail.com","nickname":"smithy12345","country":"UK"}` + "\n",
+		},
+		{
+			name: "Returns xml",
+			accept: "application/xml",
+			statusCode: http.StatusOK,
+			contentType: "application/xml",
+			body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<users><user><userID>e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d</userID><firstName>John</firstName><lastName>Smith</lastName><emailAddress>john.smith@gmail.com</emailAddress><nickname>smithy12345</nickname><country>UK</country></user></users>`,
+		},
+		{
+			name: "Returns the acceptable type with the highest quality",
+			accept: "application/json;q=0.5, text/*;q=0.8, application/xml;q=0.1",
+			statusCode: http.StatusOK,
+			contentType: "text/csv",
+			body: "userID,firstName,lastName,emailAddress,nickname,country,deletedAt,version,createdAt,updatedAt\n" +
+				"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d,John,Smith,john.smith@gmail.com,smithy12345,UK,,0,,\n",
+		},
+		{
+			name: "More specific media ranges take precedence",
+			accept: "*/*;q=0.1, application/json;q=0, application/x-ndjson",
+			statusCode: http.StatusOK,
+			contentType: "application/x-ndjson",
+			body: `{"userID":"e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d","firstName":"John","lastName":"Smith","emailAddress":"john.smith@gmail.com","nickname":"smithy12345","country":"UK"}` + "\n",
+		},
+		{
+			name: "Error on no acceptable media type",
+			accept: "application/pdf, application/json;q=0",
+			statusCode: http.StatusNotAcceptable,
+			contentType: "application/json",
+			body: fmt.Sprintf(msgTemplate + "\n", "supported media types are [application/json, application/x-ndjson, text/csv, application/xml]"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(&mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}}, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("GET", "/users?country=UK", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.contentType, rec.Header().Get("Content-Type"), fmt.Sprintf("%s: Wrong content type", test.name))
+		assert.Equal("Accept", rec.Header().Get("Vary"), fmt.Sprintf("%s: Responses should vary by Accept", test.name))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	defer func(registered []mediaEncoder) { encoders = registered }(append([]mediaEncoder{}, encoders...))
+	RegisterEncoder("text/plain", func(writer io.Writer, users []persistence.UserRecord, _ []string) error {
+		_, err := fmt.Fprintf(writer, "%d users", len(users))
+		return err
+	})
+
+	encoder, ok := negotiateEncoder("text/plain")
+	assert.True(t, ok, "test failed: registered media types should be acceptable")
+	assert.Equal(t, "text/plain", encoder.mediaType)
+	encoder, _ = negotiateEncoder("text/*")
+	assert.Equal(t, "text/csv", encoder.mediaType, "test failed: registered media types should be least preferred")
+	assert.Equal(t, "[application/json, application/x-ndjson, text/csv, application/xml, text/plain]", supportedMediaTypes())
+}
@@ -0,0 +1,91 @@
+package users
+
+import (
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//etag returns the strong entity tag of a version of a user
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+//expectedVersion returns the version of the user the request's If-Match header expects to change, or 0 for any version.
+//Writes the response and returns false if the header is missing when required or can never match a user's ETag
+func (h *UsersHandler) expectedVersion(writer http.ResponseWriter, request *http.Request) (int, bool) {
+	return parseIfMatch(writer, request, h.config.RequireIfMatch)
+}
+
+//parseIfMatch returns the version in the request's If-Match header, or 0 for any version
+func parseIfMatch(writer http.ResponseWriter, request *http.Request, required bool) (int, bool) {
+	ifMatch := strings.TrimSpace(request.Header.Get("If-Match"))
+	if ifMatch == "" {
+		if required {
+			log.Infof("%s request to %s has no If-Match header", request.Method, request.URL.Path)
+			writer.WriteHeader(http.StatusPreconditionRequired)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "If-Match header with the ETag of the user is required"))
+			return 0, false
+		}
+		return 0, true
+	}
+	if ifMatch == "*" {
+		return 0, true
+	}
+
+	//weak tags never match as If-Match uses strong comparison
+	unquoted, err := strconv.Unquote(ifMatch)
+	version, convErr := strconv.Atoi(unquoted)
+	if err != nil || convErr != nil || version < 1 {
+		log.Infof("If-Match header %s is not a valid ETag", ifMatch)
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "If-Match header does not match the ETag of the user"))
+		return 0, false
+	}
+	return version, true
+}
+
+func writeVersionMismatch(writer http.ResponseWriter, userID string) {
+	writer.WriteHeader(http.StatusPreconditionFailed)
+	fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "user: " + userID + " has been modified since the supplied ETag was read"))
+}
+
+//writeValidators sets the headers clients use to make conditional requests for the user
+func writeValidators(writer http.ResponseWriter, user persistence.UserRecord) {
+	writer.Header().Set("ETag", etag(user.Version))
+	if user.UpdatedAt != nil {
+		writer.Header().Set("Last-Modified", user.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+//notModified returns true if the request's If-None-Match or If-Modified-Since header shows the client already has
+//the latest version of the user. If-None-Match takes precedence as ETags change on every update, while HTTP dates
+//have second precision so the user's update time is truncated to compare them
+func notModified(request *http.Request, user persistence.UserRecord) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		current := etag(user.Version)
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			//If-None-Match uses weak comparison
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == current {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := request.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || user.UpdatedAt == nil {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		log.Infof("ignoring invalid If-Modified-Since header %s", ifModifiedSince)
+		return false
+	}
+	return !user.UpdatedAt.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,142 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//heartbeatInterval is how often a comment is sent to keep idle event streams open
+var heartbeatInterval = 15 * time.Second
+
+//eventWriteTimeout replaces the server write timeout for event streams, which stay open indefinitely, so each event
+//and heartbeat must be written within it
+const eventWriteTimeout = 5 * time.Second
+
+// swagger:operation GET /users/events users streamEvents
+// ---
+// summary: Stream user events
+// description: Streams lifecycle events about the users of the request's tenant as Server-Sent Events
+// parameters:
+// - name: Last-Event-ID
+//   in: header
+//   description: ID of the last event received, buffered events after it are replayed
+//   type: integer
+//   required: false
+// - name: type
+//   in: query
+//   description: comma separated event types to receive e.g. USER_CREATED,NICKNAME_CHANGED
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   500: internal
+func (h *UsersHandler) StreamEvents(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		log.Error("response writer does not support streaming")
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "streaming is not supported"))
+		return
+	}
+
+	var lastEventID uint64
+	if header := request.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			log.WithError(err).Errorf("invalid Last-Event-ID header: %s", header)
+			writer.Header().Add("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "Last-Event-ID must be a numeric event ID"))
+			return
+		}
+		lastEventID = id
+	}
+	types := eventTypeFilter(request.URL.Query()["type"])
+	tenant := requestTenant(request)
+
+	replay, live, cancel := h.events.Subscribe(lastEventID)
+	defer cancel()
+
+	controller := http.NewResponseController(writer)
+	extendDeadline(controller)
+	writer.Header().Add("Content-Type", "text/event-stream")
+	writer.Header().Add("Cache-Control", "no-cache")
+	writer.Header().Add("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		if err := writeEvent(writer, event, tenant, types); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event, open := <-live:
+			if !open {
+				log.Info("event stream subscriber fell behind and was disconnected")
+				return
+			}
+			extendDeadline(controller)
+			if err := writeEvent(writer, event, tenant, types); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			extendDeadline(controller)
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+//extendDeadline gives the stream eventWriteTimeout to write what it sends next
+func extendDeadline(controller *http.ResponseController) {
+	if err := controller.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err != nil && err != http.ErrNotSupported {
+		log.WithError(err).Error("could not extend event stream write deadline")
+	}
+}
+
+//eventTypeFilter returns the set of requested event types, or nil when all types are wanted
+func eventTypeFilter(params []string) map[string]bool {
+	var types map[string]bool
+	for _, param := range params {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				if types == nil {
+					types = make(map[string]bool)
+				}
+				types[t] = true
+			}
+		}
+	}
+	return types
+}
+
+//writeEvent writes the event if it is of one of the types and about users of the tenant
+func writeEvent(writer http.ResponseWriter, event notification.Event, tenant string, types map[string]bool) error {
+	if event.Message.TenantID != tenant || types != nil && !types[event.Message.Type] {
+		return nil
+	}
+	data, err := json.Marshal(event.Message)
+	if err != nil {
+		log.WithError(err).Errorf("could not encode event %d", event.ID)
+		return nil
+	}
+	_, err = fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Message.Type, data)
+	return err
+}
@@ -0,0 +1,451 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	//exportPageSize is the number of users read from the db at a time when exporting over http
+	exportPageSize = 500
+	//exportPageTimeout replaces the server write timeout for exports, which may take much longer, so each page
+	//must be written within it instead
+	exportPageTimeout = 30 * time.Second
+)
+
+//exportFormats maps the formats users can be exported in to their content type
+var exportFormats = map[string]string{
+	"csv": "text/csv",
+	"ndjson": "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+type exportKind int
+
+const (
+	exportText exportKind = iota
+	exportInt
+	exportTime
+)
+
+//exportColumn is a user field which can be read, value returns a string, int or *time.Time
+type exportColumn struct {
+	name string
+	column string
+	kind exportKind
+	value func(persistence.UserRecord) interface{}
+}
+
+//exportColumns are the fields returned by reads, in order, when no fields are selected. Passwords are never read
+var exportColumns = []exportColumn{
+	{"userID", "user_id", exportText, func(u persistence.UserRecord) interface{} { return u.UserID }},
+	{"firstName", "first_name", exportText, func(u persistence.UserRecord) interface{} { return u.FirstName }},
+	{"lastName", "last_name", exportText, func(u persistence.UserRecord) interface{} { return u.LastName }},
+	{"emailAddress", "email", exportText, func(u persistence.UserRecord) interface{} { return u.EmailAddress }},
+	{"nickname", "nickname", exportText, func(u persistence.UserRecord) interface{} { return u.NickName }},
+	{"country", "country", exportText, func(u persistence.UserRecord) interface{} { return u.Country }},
+	{"deletedAt", "deleted_at", exportTime, func(u persistence.UserRecord) interface{} { return u.DeletedAt }},
+	{"version", "version", exportInt, func(u persistence.UserRecord) interface{} { return u.Version }},
+	{"createdAt", "created_at", exportTime, func(u persistence.UserRecord) interface{} { return u.CreatedAt }},
+	{"updatedAt", "updated_at", exportTime, func(u persistence.UserRecord) interface{} { return u.UpdatedAt }},
+}
+
+//projectColumns returns the columns of the selected fields in the order they were selected, or every column if
+//none were. Secret fields can never be selected
+func projectColumns(fields []string) ([]exportColumn, error) {
+	if len(fields) == 0 {
+		return exportColumns, nil
+	}
+	var columns []exportColumn
+	selected := make(map[string]bool)
+	for _, name := range fields {
+		if userFields[name].secret {
+			return nil, fmt.Errorf("%s can never be selected", name)
+		}
+		column, ok := exportColumn{}, false
+		for _, c := range exportColumns {
+			if c.name == name {
+				column, ok = c, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("cannot select %s; valid fields are [userID, firstName, lastName, emailAddress, nickname, country, deletedAt, version, createdAt, updatedAt]", name)
+		}
+		if !selected[name] {
+			columns = append(columns, column)
+			selected[name] = true
+		}
+	}
+	return columns, nil
+}
+
+//dbColumns returns the db columns to select for the export columns
+func dbColumns(columns []exportColumn) []string {
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = column.column
+	}
+	return selected
+}
+
+//projectedUser encodes the projected columns of a user, in order. Times and versions which are not set are omitted
+type projectedUser struct {
+	user persistence.UserRecord
+	columns []exportColumn
+}
+
+func projectUsers(users []persistence.UserRecord, columns []exportColumn) []projectedUser {
+	projected := make([]projectedUser, len(users))
+	for i, user := range users {
+		projected[i] = projectedUser{user: user, columns: columns}
+	}
+	return projected
+}
+
+//values returns the names and values of the columns which are set
+func (pu projectedUser) values() ([]string, []interface{}) {
+	var names []string
+	var values []interface{}
+	for _, column := range pu.columns {
+		value := column.value(pu.user)
+		switch v := value.(type) {
+		case int:
+			if v == 0 {
+				continue
+			}
+		case *time.Time:
+			if v == nil {
+				continue
+			}
+		}
+		names = append(names, column.name)
+		values = append(values, value)
+	}
+	return names, values
+}
+
+func (pu projectedUser) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	names, values := pu.values()
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		value, err := json.Marshal(values[i])
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (pu projectedUser) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	names, values := pu.values()
+	for i, name := range names {
+		if err := encoder.EncodeElement(values[i], xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+//recordWriter incrementally encodes users a page at a time. Nothing is written until the first page or close,
+//and close finishes the output so must be called once every page has been written
+type recordWriter interface {
+	write([]persistence.UserRecord) error
+	close() error
+}
+
+//newRecordWriter returns a writer encoding the columns of users in the format
+func newRecordWriter(format string, writer io.Writer, columns []exportColumn) (recordWriter, error) {
+	switch format {
+	case "csv":
+		return &csvRecordWriter{writer: csv.NewWriter(writer), columns: columns}, nil
+	case "ndjson":
+		buffered := bufio.NewWriter(writer)
+		return &ndjsonRecordWriter{writer: buffered, encoder: json.NewEncoder(buffered), columns: columns}, nil
+	case "parquet":
+		return newParquetWriter(writer, columns), nil
+	default:
+		return nil, fmt.Errorf("unsupported export format %s; valid formats are [csv, ndjson, parquet]", format)
+	}
+}
+
+//csvRecordWriter writes users as csv with a header row naming the columns
+type csvRecordWriter struct {
+	writer *csv.Writer
+	columns []exportColumn
+	wroteHeader bool
+}
+
+func (cw *csvRecordWriter) write(users []persistence.UserRecord) error {
+	cw.writeHeader()
+	for _, user := range users {
+		row := make([]string, len(cw.columns))
+		for i, column := range cw.columns {
+			switch value := column.value(user).(type) {
+			case string:
+				row[i] = value
+			case int:
+				row[i] = strconv.Itoa(value)
+			case *time.Time:
+				if value != nil {
+					row[i] = value.Format(time.RFC3339)
+				}
+			}
+		}
+		cw.writer.Write(row)
+	}
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+func (cw *csvRecordWriter) close() error {
+	cw.writeHeader()
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+func (cw *csvRecordWriter) writeHeader() {
+	if cw.wroteHeader {
+		return
+	}
+	header := make([]string, len(cw.columns))
+	for i, column := range cw.columns {
+		header[i] = column.name
+	}
+	cw.writer.Write(header)
+	cw.wroteHeader = true
+}
+
+//ndjsonRecordWriter writes users as newline delimited json
+type ndjsonRecordWriter struct {
+	writer *bufio.Writer
+	encoder *json.Encoder
+	columns []exportColumn
+}
+
+func (nw *ndjsonRecordWriter) write(users []persistence.UserRecord) error {
+	for _, user := range projectUsers(users, nw.columns) {
+		if err := nw.encoder.Encode(user); err != nil {
+			return err
+		}
+	}
+	return nw.writer.Flush()
+}
+
+func (nw *ndjsonRecordWriter) close() error {
+	return nw.writer.Flush()
+}
+
+//ExportOptions configures an export of users
+type ExportOptions struct {
+	//Format of the export, csv, ndjson or parquet
+	Format string
+	//Filters are GET /users search params restricting which users are exported, including includeDeleted and the
+	//time range params. All users are exported if there are none
+	Filters url.Values
+	//Fields are the user fields to export, in order, all of them if there are none
+	Fields []string
+	BatchSize int
+	//TenantID is the tenant whose users are exported
+	TenantID string
+}
+
+//ExportResult summarises an export
+type ExportResult struct {
+	Exported int
+	LastUserID string
+}
+
+//Exporter streams users from the DB to a file or response
+type Exporter struct {
+	sqlClient persistence.Clienter
+}
+
+//NewExporter returns an exporter reading from the sql client
+func NewExporter(sqlClient persistence.Clienter) Exporter {
+	return Exporter{sqlClient: sqlClient}
+}
+
+//Run pages through the users matching the filters in user ID order, writing each page as it is read so exports
+//of any size are never held in memory. Writers which are http.Flushers are flushed after every page. Nothing is
+//written if the first page cannot be read
+func (e Exporter) Run(out io.Writer, opts ExportOptions) (ExportResult, error) {
+	criteria, err := filterCriteria(opts.Filters)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if opts.BatchSize < 1 {
+		return ExportResult{}, fmt.Errorf("batch size must be positive")
+	}
+	columns, err := projectColumns(opts.Fields)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	criteria.TenantID = opts.TenantID
+	criteria.Columns = dbColumns(columns)
+	writer, err := newRecordWriter(opts.Format, out, columns)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	flusher, _ := out.(http.Flusher)
+
+	var result ExportResult
+	for {
+		users, status := e.sqlClient.ScanRecords(criteria, result.LastUserID, opts.BatchSize)
+		if status == persistence.NOT_FOUND {
+			break
+		} else if status != persistence.OK {
+			return result, fmt.Errorf("could not read users after %s from db", result.LastUserID)
+		}
+		if err := writer.write(users); err != nil {
+			return result, fmt.Errorf("could not write users: %v", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		result.Exported += len(users)
+		result.LastUserID = users[len(users)-1].UserID
+		if len(users) < opts.BatchSize {
+			break
+		}
+	}
+	if err := writer.close(); err != nil {
+		return result, fmt.Errorf("could not write users: %v", err)
+	}
+	return result, nil
+}
+
+// swagger:operation GET /users/export users exportUsers
+// ---
+// summary: Export users
+// description: Streams every user matching the search params, or all users if there are none, as csv, ndjson or
+//   parquet. Passwords are never exported. If the export fails part way through the response is aborted
+// produces:
+// - text/csv
+// - application/x-ndjson
+// - application/vnd.apache.parquet
+// parameters:
+// - name: format
+//   in: query
+//   description: format of the export, csv, ndjson or parquet, defaults to csv
+//   type: string
+//   required: false
+// - name: fields
+//   in: query
+//   description: comma separated user fields to export, in order, defaults to every field except password
+//   type: string
+//   required: false
+// - name: country
+//   in: query
+//   description: any of the GET /users search params, including includeDeleted and the time ranges
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   403: forbidden
+//   422: unprocessable
+//   500: internal
+func (h *UsersHandler) ExportUsers(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	params, err := url.ParseQuery(request.URL.RawQuery)
+	if err != nil {
+		log.WithError(err).Errorf("malformed request query: %v", request.URL.RawQuery)
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "malformed request query"))
+		return
+	}
+
+	format := "csv"
+	if _, ok := params["format"]; ok {
+		format = params.Get("format")
+		params.Del("format")
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "format must be one of [csv, ndjson, parquet]"))
+		return
+	}
+	fields, ok := selectFields(writer, params)
+	if !ok {
+		return
+	}
+	criteria, err := filterCriteria(params)
+	if err != nil {
+		log.WithError(err).Infof("supplied export params %s are invalid", params)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	if !checkIncludeDeleted(writer, request, criteria) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"users.%s\"", format))
+	response := exportResponse{ResponseWriter: writer, controller: http.NewResponseController(writer)}
+	response.extendDeadline()
+	result, err := NewExporter(h.sqlClient).Run(response, ExportOptions{
+		Format: format,
+		Filters: params,
+		Fields: fields,
+		BatchSize: exportPageSize,
+		TenantID: requestTenant(request),
+	})
+	if err == nil {
+		log.Infof("exported %d users as %s", result.Exported, format)
+		return
+	}
+	log.WithError(err).Errorf("export stopped after user %s", result.LastUserID)
+	if result.Exported == 0 {
+		writer.Header().Del("Content-Disposition")
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process request"))
+		return
+	}
+	//the status has already been sent, so the response is aborted rather than ended to stop a truncated export
+	//being mistaken for a complete one
+	panic(http.ErrAbortHandler)
+}
+
+//exportResponse extends the write deadline of the response each time a page is flushed, so exports are only cut
+//short if a page cannot be written in time
+type exportResponse struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+}
+
+func (er exportResponse) Flush() {
+	if err := er.controller.Flush(); err != nil {
+		log.WithError(err).Error("could not flush export")
+	}
+	er.extendDeadline()
+}
+
+func (er exportResponse) extendDeadline() {
+	if err := er.controller.SetWriteDeadline(time.Now().Add(exportPageTimeout)); err != nil && err != http.ErrNotSupported {
+		log.WithError(err).Error("could not extend export write deadline")
+	}
+}
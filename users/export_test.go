@@ -0,0 +1,155 @@
+package users
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var exportCreatedAt = time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+var exportUsers = []persistence.UserRecord{
+	{UserID: "1", FirstName: "Cleo", LastName: "Patra", EmailAddress: "cleo@gmail.com", Password: "password3", NickName: "Cle0", Country: "Egypt", Version: 1, CreatedAt: &exportCreatedAt, UpdatedAt: &exportCreatedAt},
+	{UserID: "2", FirstName: "Jane", LastName: "Doe", EmailAddress: "jane.doe@gmail.com", Password: "password2", NickName: "GIJane", Country: "USA", DeletedAt: &exportCreatedAt, Version: 3, CreatedAt: &exportCreatedAt, UpdatedAt: &exportCreatedAt},
+	{UserID: "3", FirstName: "Julius", LastName: "Caesar, Gaius", EmailAddress: "caesar@gmail.com", Password: "password4", NickName: "ETuBrute", Country: "Italy", Version: 2, CreatedAt: &exportCreatedAt, UpdatedAt: &exportCreatedAt},
+}
+
+func TestExportHandler(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		sqlClient persistence.Clienter
+		reqURL string
+		statusCode int
+		contentType string
+		body string
+	}{
+		{
+			name: "Exports users as csv by default",
+			sqlClient: &mockSQLClient{persistence.OK, exportUsers},
+			reqURL: "/users/export",
+			statusCode: http.StatusOK,
+			contentType: "text/csv",
+			body: `userID,firstName,lastName,emailAddress,nickname,country,deletedAt,version,createdAt,updatedAt
+1,Cleo,Patra,cleo@gmail.com,Cle0,Egypt,,1,2020-04-01T12:00:00Z,2020-04-01T12:00:00Z
+2,Jane,Doe,jane.doe@gmail.com,GIJane,USA,2020-04-01T12:00:00Z,3,2020-04-01T12:00:00Z,2020-04-01T12:00:00Z
+3,Julius,"Caesar, Gaius",caesar@gmail.com,ETuBrute,Italy,,2,2020-04-01T12:00:00Z,2020-04-01T12:00:00Z
+`,
+		},
+		{
+			name: "Exports users as ndjson",
+			sqlClient: &mockSQLClient{persistence.OK, exportUsers},
+			reqURL: "/users/export?format=ndjson",
+			statusCode: http.StatusOK,
+			contentType: "application/x-ndjson",
+			body: `{"userID":"1","firstName":"Cleo","lastName":"Patra","emailAddress":"cleo@gmail.com","nickname":"Cle0","country":"Egypt","version":1,"createdAt":"2020-04-01T12:00:00Z","updatedAt":"2020-04-01T12:00:00Z"}
+{"userID":"2","firstName":"Jane","lastName":"Doe","emailAddress":"jane.doe@gmail.com","nickname":"GIJane","country":"USA","deletedAt":"2020-04-01T12:00:00Z","version":3,"createdAt":"2020-04-01T12:00:00Z","updatedAt":"2020-04-01T12:00:00Z"}
+{"userID":"3","firstName":"Julius","lastName":"Caesar, Gaius","emailAddress":"caesar@gmail.com","nickname":"ETuBrute","country":"Italy","version":2,"createdAt":"2020-04-01T12:00:00Z","updatedAt":"2020-04-01T12:00:00Z"}
+`,
+		},
+		{
+			name: "Exports only a header when there are no users",
+			sqlClient: &mockSQLClient{persistence.OK, nil},
+			reqURL: "/users/export?includeDeleted=true&createdAfter=2020-04-01T12:00:00Z",
+			statusCode: http.StatusOK,
+			contentType: "text/csv",
+			body: "userID,firstName,lastName,emailAddress,nickname,country,deletedAt,version,createdAt,updatedAt\n",
+		},
+		{
+			name: "Error on unsupported format",
+			sqlClient: &mockSQLClient{persistence.OK, exportUsers},
+			reqURL: "/users/export?format=xlsx",
+			statusCode: http.StatusBadRequest,
+			contentType: "application/json",
+			body: fmt.Sprintf(msgTemplate + "\n", "format must be one of [csv, ndjson, parquet]"),
+		},
+		{
+			name: "Error on invalid filter",
+			sqlClient: &mockSQLClient{persistence.OK, exportUsers},
+			reqURL: "/users/export?password=12345",
+			statusCode: http.StatusBadRequest,
+			contentType: "application/json",
+			body: fmt.Sprintf(msgTemplate + "\n", "supplied filters are invalid; valid filters are [userID, firstName, lastName, emailAddress, nickname, country, includeDeleted, createdAfter, createdBefore, updatedAfter, updatedBefore]"),
+		},
+		{
+			name: "Error on invalid includeDeleted param",
+			sqlClient: &mockSQLClient{persistence.OK, exportUsers},
+			reqURL: "/users/export?includeDeleted=maybe",
+			statusCode: http.StatusBadRequest,
+			contentType: "application/json",
+			body: fmt.Sprintf(msgTemplate + "\n", "includeDeleted must be true or false"),
+		},
+		{
+			name: "Error on unable to read first page of users",
+			sqlClient: &mockSQLClient{persistence.BACKEND_ERROR, nil},
+			reqURL: "/users/export?format=parquet",
+			statusCode: http.StatusInternalServerError,
+			contentType: "application/json",
+			body: fmt.Sprintf(msgTemplate + "\n", "could not process request"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.contentType, rec.Header().Get("Content-Type"), fmt.Sprintf("%s: Wrong content type", test.name))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.NotContains(rec.Body.String(), "password", fmt.Sprintf("%s: Passwords should never be exported", test.name))
+	}
+}
+
+func TestExportHandler_AbortsFailedStream(t *testing.T) {
+	r := mux.NewRouter()
+	sqlClient := &mockScanClient{mockSQLClient: mockSQLClient{persistence.OK, make([]persistence.UserRecord, exportPageSize+1)}, failAfter: 1}
+	for i := range sqlClient.expectedRecords {
+		sqlClient.expectedRecords[i].UserID = fmt.Sprintf("%04d", i)
+	}
+	handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), Config{})
+	handler.RegisterHandlers(r)
+	rec := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		r.ServeHTTP(rec, newRequest("GET", "/users/export?format=ndjson", nil))
+	}, "test failed: a partially written export should be aborted")
+	assert.True(t, rec.Flushed, "test failed: pages should be flushed as they are written")
+	assert.Equal(t, exportPageSize, strings.Count(rec.Body.String(), "\n"))
+}
+
+func TestExporter_Parquet(t *testing.T) {
+	var out bytes.Buffer
+	result, err := NewExporter(&mockSQLClient{persistence.OK, exportUsers}).Run(&out, ExportOptions{Format: "parquet", BatchSize: 2})
+	assert.NoError(t, err, "test failed: export should complete")
+	assert.Equal(t, ExportResult{Exported: 3, LastUserID: "3"}, result)
+
+	file := out.Bytes()
+	assert.Equal(t, parquetMagic, file[:4], "test failed: parquet files should start with the magic number")
+	assert.Equal(t, parquetMagic, file[len(file)-4:], "test failed: parquet files should end with the magic number")
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerSize : len(file)-8]
+	for _, column := range exportColumns {
+		assert.Equal(t, 3, bytes.Count(footer, []byte(column.name)), fmt.Sprintf("test failed: %s should be in the schema and each row group", column.name))
+	}
+	assert.Contains(t, string(file), "Caesar, Gaius")
+	assert.NotContains(t, string(file), "password")
+}
+
+func TestExporter_InvalidOptions(t *testing.T) {
+	exporter := NewExporter(&mockSQLClient{persistence.OK, exportUsers})
+	_, err := exporter.Run(&bytes.Buffer{}, ExportOptions{Format: "xlsx", BatchSize: 2})
+	assert.Error(t, err, "test failed: unknown formats should be rejected")
+	_, err = exporter.Run(&bytes.Buffer{}, ExportOptions{Format: "csv"})
+	assert.Error(t, err, "test failed: batch size should be positive")
+}
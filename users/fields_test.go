@@ -0,0 +1,109 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSparseFieldsets(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		reqURL string
+		accept string
+		statusCode int
+		body string
+		columns []string
+	}{
+		{
+			name: "Selects only the requested fields in order",
+			reqURL: "/users?country=UK&fields=nickname,firstName",
+			statusCode: http.StatusOK,
+			body: `[{"nickname":"smithy12345","firstName":"John"}]` + "\n",
+			columns: []string{"nickname", "first_name"},
+		},
+		{
+			name: "Selects the validators of lookups by ID",
+			reqURL: "/users?userID=e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d&fields=country",
+			statusCode: http.StatusOK,
+			body: `[{"country":"UK"}]` + "\n",
+			columns: []string{"country", "version", "updated_at"},
+		},
+		{
+			name: "Selects fields in other media types",
+			reqURL: "/users?country=UK&fields=%20lastName%20,,emailAddress,lastName",
+			accept: "text/csv",
+			statusCode: http.StatusOK,
+			body: "lastName,emailAddress\nSmith,john.smith@gmail.com\n",
+			columns: []string{"last_name", "email"},
+		},
+		{
+			name: "Selects every field but passwords by default",
+			reqURL: "/users?country=UK",
+			statusCode: http.StatusOK,
+			body: convertBody(johnSmithReadJSON),
+		},
+		{
+			name: "Passwords can never be selected",
+			reqURL: "/users?country=UK&fields=firstName,password",
+			statusCode: http.StatusForbidden,
+			body: fmt.Sprintf(msgTemplate + "\n", "password can never be selected"),
+		},
+		{
+			name: "Error on unknown field",
+			reqURL: "/users?country=UK&fields=address",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "cannot select address; valid fields are [userID, firstName, lastName, emailAddress, nickname, country, deletedAt, version, createdAt, updatedAt]"),
+		},
+		{
+			name: "Error on no fields",
+			reqURL: "/users?country=UK&fields=",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "fields must list at least one field"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		sqlClient := &mockSearchClient{mockSQLClient: mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}}}
+		handler := NewUsersHandler(sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("GET", test.reqURL, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.columns, sqlClient.criteria.Columns, fmt.Sprintf("%s: Wrong columns selected", test.name))
+	}
+}
+
+func TestExportFields(t *testing.T) {
+	r := mux.NewRouter()
+	sqlClient := &mockSearchClient{mockSQLClient: mockSQLClient{persistence.OK, exportUsers}}
+	handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), Config{})
+	handler.RegisterHandlers(r)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users/export?format=ndjson&fields=userID,country", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"userID":"1","country":"Egypt"}
+{"userID":"2","country":"USA"}
+{"userID":"3","country":"Italy"}
+`, rec.Body.String())
+	assert.Equal(t, []string{"user_id", "country"}, sqlClient.criteria.Columns, "test failed: only the exported fields should be selected")
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users/export?fields=password", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "test failed: passwords should never be exported")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
@@ -2,6 +2,7 @@ package users
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
@@ -10,9 +11,12 @@ import (
 	"github.com/scott-ace-newton/users-rw-sql/persistence"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const msgTemplate = "{\"message\": \"%s\"}"
@@ -24,44 +28,137 @@ type Check struct {
 	Status string `json:"status"`
 }
 
-//UsersHandler stores configured sql and queue clients
+//Config configures the behaviour of the handlers
+type Config struct {
+	//RequireIfMatch rejects changes to users which do not supply the ETag of the version they are changing
+	RequireIfMatch bool
+	//IdempotencyKeyTTL is how long responses to requests with an Idempotency-Key are replayed for, 0 disables them
+	IdempotencyKeyTTL time.Duration
+	//MaxBatchSize is the most operations a batch request may contain, 0 uses the default of 1000
+	MaxBatchSize int
+	//Authenticators authenticate requests for every endpoint but the health check, none disables authentication
+	Authenticators []Authenticator
+	//RequireTenant rejects requests which do not name a tenant, unless their principal belongs to one, rather than
+	//using the default tenant
+	RequireTenant bool
+}
+
+//UsersHandler stores configured sql and queue clients, the event stream and handler config
 type UsersHandler struct {
 	sqlClient persistence.Clienter
 	queueClient notification.QueueClient
+	events *notification.EventStream
+	config Config
 }
 
-//NewUsersHandler returns handler with configured sql and queue clients
-func NewUsersHandler(sqlClient persistence.Clienter, queueClient notification.QueueClient) UsersHandler {
+//NewUsersHandler returns handler with configured sql and queue clients, event stream and handler config
+func NewUsersHandler(sqlClient persistence.Clienter, queueClient notification.QueueClient, events *notification.EventStream, config Config) UsersHandler {
 	return UsersHandler{
 		sqlClient: sqlClient,
 		queueClient: queueClient,
+		events: events,
+		config: config,
 	}
 }
 
 //RegisterHandlers registers application endpoints
 func (h *UsersHandler) RegisterHandlers(router *mux.Router) {
 	log.Info("registering handlers")
-	editDeleteUserHandler := handlers.MethodHandler{
-		"PATCH": http.HandlerFunc(h.EditUser),
-		"DELETE": http.HandlerFunc(h.DeleteUser),
+	userHandler := handlers.MethodHandler{
+		"GET": authorize("getUserByID", http.HandlerFunc(h.GetUser)),
+		"HEAD": authorize("getUserByID", http.HandlerFunc(h.GetUser)),
+		"PUT": authorize("replaceUser", http.HandlerFunc(h.ReplaceUser)),
+		"PATCH": authorize("editUser", h.idempotent(http.HandlerFunc(h.EditUser))),
+		"DELETE": authorize("deleteUser", h.idempotent(http.HandlerFunc(h.DeleteUser))),
 	}
 	addGetUserHandler := handlers.MethodHandler{
-		"PUT": http.HandlerFunc(h.AddUser),
-		"GET": http.HandlerFunc(h.GetRecords),
+		"POST": authorize("addUser", h.idempotent(http.HandlerFunc(h.AddUser))),
+		"PUT": deprecated(authorize("addUser", h.idempotent(http.HandlerFunc(h.AddUser))), "/users"),
+		"GET": authorize("getUser", http.HandlerFunc(h.GetRecords)),
+	}
+	restoreUserHandler := handlers.MethodHandler{
+		"POST": authorize("restoreUser", http.HandlerFunc(h.RestoreUser)),
+	}
+	historyHandler := handlers.MethodHandler{
+		"GET": authorize("getUserHistory", http.HandlerFunc(h.GetHistory)),
+	}
+	mergeHandler := handlers.MethodHandler{
+		"POST": authorize("mergeUser", h.idempotent(http.HandlerFunc(h.MergeUser))),
+	}
+	duplicatesHandler := handlers.MethodHandler{
+		"GET": authorize("getUserDuplicates", http.HandlerFunc(h.GetDuplicates)),
+	}
+	batchCreateHandler := handlers.MethodHandler{
+		"POST": authorize("batchCreateUsers", h.idempotent(http.HandlerFunc(h.BatchCreate))),
+	}
+	batchUpdateHandler := handlers.MethodHandler{
+		"PATCH": authorize("batchUpdateUsers", h.idempotent(http.HandlerFunc(h.BatchUpdate))),
+	}
+	batchDeleteHandler := handlers.MethodHandler{
+		"POST": authorize("batchDeleteUsers", h.idempotent(http.HandlerFunc(h.BatchDelete))),
+	}
+	exportHandler := handlers.MethodHandler{
+		"GET": authorize("exportUsers", http.HandlerFunc(h.ExportUsers)),
+	}
+	statsHandler := handlers.MethodHandler{
+		"GET": authorize("getUserStats", http.HandlerFunc(h.GetStats)),
+	}
+	searchHandler := handlers.MethodHandler{
+		"GET": authorize("searchUsers", http.HandlerFunc(h.SearchUsers)),
+	}
+	countHandler := handlers.MethodHandler{
+		"GET": authorize("countUsers", http.HandlerFunc(h.CountUsers)),
+	}
+	eventsHandler := handlers.MethodHandler{
+		"GET": authorize("streamEvents", http.HandlerFunc(h.StreamEvents)),
 	}
 	healthHandler := handlers.MethodHandler{
 		"GET": http.HandlerFunc(h.IsHealthy),
 	}
 
-	router.Handle("/users/{userID}", editDeleteUserHandler)
+	router.Handle("/users/events", eventsHandler)
+	router.Handle("/users/export", exportHandler)
+	router.Handle("/users/stats", statsHandler)
+	router.Handle("/users/count", countHandler)
+	router.Handle("/users/search", searchHandler)
+	router.Handle("/users/{userID}", userHandler)
+	router.Handle("/users/{userID}/restore", restoreUserHandler)
+	router.Handle("/users/{userID}/history", historyHandler)
+	router.Handle("/users/{userID}/duplicates", duplicatesHandler)
+	router.Handle("/users/{userID}/merge", mergeHandler)
 	router.Handle("/users", addGetUserHandler)
+	router.Handle("/users:batchCreate", batchCreateHandler)
+	router.Handle("/users:batchUpdate", batchUpdateHandler)
+	router.Handle("/users:batchDelete", batchDeleteHandler)
 	router.Handle("/__health", healthHandler)
+	if len(h.config.Authenticators) > 0 {
+		router.Use(authenticate(h.config.Authenticators))
+	}
+	router.Use(h.resolveTenant)
+}
+
+//deprecated marks responses from a legacy route as deprecated, linking to the route replacing it
+func deprecated(next http.Handler, successor string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Deprecation", "true")
+		writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next.ServeHTTP(writer, request)
+	})
 }
 
-// AddUser swagger:route PUT /users users addUser
+//publish sends the message to the configured queue and to any event stream subscribers.
+//Messages the queue client cannot deliver are dead lettered by it, so failures are only logged
+func (h *UsersHandler) publish(msg persistence.Message) {
+	if err := h.queueClient.AddMessageToQueue(msg); err != nil {
+		log.WithError(err).WithField("UserID", msg.UserID).Errorf("could not publish %s message", msg.Type)
+	}
+	h.events.Publish(msg)
+}
+
+// AddUser swagger:route POST /users users addUser
 // ---
 // summary: Add users
-// description: Add user records to DB
+// description: Add user records to DB, assigning their ID. PUT /users is deprecated in favour of POST
 // parameters:
 // - name: userID
 //   in: body
@@ -119,12 +216,14 @@ func (h *UsersHandler) AddUser(writer http.ResponseWriter, request *http.Request
 	ur.UserID = uuid.NewMD5(uuid.UUID{}, []byte(ur.EmailAddress)).String()
 	log.Debugf("generated ID: %s for new user with email: %s", ur.UserID, ur.EmailAddress)
 
-	switch h.sqlClient.CreateRecord(ur) {
+	switch h.sqlClient.CreateRecord(callerFromRequest(writer, request), ur) {
 	case persistence.CREATED:
-		h.queueClient.AddMessageToQueue(persistence.Message{
+		h.publish(persistence.Message{
 			Type: "USER_CREATED",
 			UserID: ur.UserID,
+			TenantID: requestTenant(request),
 		})
+		writer.Header().Set("Location", "/users/" + ur.UserID)
 		writer.WriteHeader(http.StatusCreated)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "created user with ID: " + ur.UserID))
 	case persistence.ALREADY_EXISTS:
@@ -136,6 +235,200 @@ func (h *UsersHandler) AddUser(writer http.ResponseWriter, request *http.Request
 	}
 }
 
+// swagger:operation GET /users/{userID} users getUserByID
+// ---
+// summary: Return user
+// description: Returns the user with the specified UserID. HEAD returns the headers only. Users who were merged
+//   into another redirect to them
+// parameters:
+// - name: userID
+//   in: path
+//   description: users uuid
+//   type: string
+//   required: true
+// - name: If-None-Match
+//   in: header
+//   description: ETag of the version of the user the client already has
+//   type: string
+//   required: false
+// - name: If-Modified-Since
+//   in: header
+//   description: only return the user if they have been updated since this time
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   301: movedPermanently
+//   304: notModified
+//   404: notFound
+//   410: gone
+//   500: internal
+func (h *UsersHandler) GetUser(writer http.ResponseWriter, request *http.Request) {
+	userID := mux.Vars(request)["userID"]
+	users, status := h.sqlClient.RetrieveRecords(persistence.SearchCriteria{
+		TenantID: requestTenant(request),
+		Fields: map[string]string{"user_id": userID},
+		IncludeDeleted: true,
+	})
+	switch {
+	case status == persistence.NOT_FOUND:
+		if !h.redirectAlias(writer, request, userID) {
+			writeProblem(writer, request, http.StatusNotFound, "no user exists with ID: " + userID)
+		}
+		return
+	case status != persistence.OK || len(users) != 1:
+		writeProblem(writer, request, http.StatusInternalServerError, "could not process request")
+		return
+	case users[0].DeletedAt != nil:
+		if !h.redirectAlias(writer, request, userID) {
+			writeProblem(writer, request, http.StatusGone, "user: " + userID + " has been deleted")
+		}
+		return
+	}
+
+	user := users[0]
+	user.Password = ""
+	writer.Header().Set("Content-Type", "application/json")
+	writeValidators(writer, user)
+	if notModified(request, user) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	if request.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(writer).Encode(user); err != nil {
+		log.WithError(err).WithField("UserID", userID).Error("could not encode returned payload")
+	}
+}
+
+// swagger:operation PUT /users/{userID} users replaceUser
+// ---
+// summary: Create or replace users
+// description: Creates the user with the specified UserID, or replaces all of their fields if they exist
+// parameters:
+// - name: userID
+//   in: path
+//   description: users uuid
+//   type: string
+//   required: true
+// - name: user
+//   in: body
+//   description: all fields of the user, userID may be omitted but must match the path if supplied
+//   required: true
+// - name: If-Match
+//   in: header
+//   description: ETag of the version of the user being replaced
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   201: created
+//   400: badRequest
+//   409: conflict
+//   410: gone
+//   412: preconditionFailed
+//   500: internal
+func (h *UsersHandler) ReplaceUser(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	userID := mux.Vars(request)["userID"]
+
+	ur := persistence.UserRecord{}
+	if err := json.NewDecoder(request.Body).Decode(&ur); err != nil {
+		log.WithError(err).Error("could not decode request body")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not decode request body"))
+		return
+	}
+	if ur.UserID != "" && ur.UserID != userID {
+		log.WithField("UserID", userID).Infof("body user ID %s does not match path", ur.UserID)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "userID in body does not match path"))
+		return
+	}
+	if missing := missingFields(ur); len(missing) > 0 {
+		log.WithField("UserID", userID).Infof("replacement user is missing fields %v", missing)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("all user fields are required, missing %v", missing)))
+		return
+	}
+	ur.UserID = userID
+
+	//If-Match is optional as PUT also creates users, so is not affected by RequireIfMatch
+	expectedVersion, ok := parseIfMatch(writer, request, false)
+	if !ok {
+		return
+	}
+
+	previous, status := h.sqlClient.UpsertRecord(callerFromRequest(writer, request), ur, expectedVersion)
+	switch status {
+	case persistence.CREATED:
+		h.publish(persistence.Message{
+			Type: "USER_CREATED",
+			UserID: userID,
+			TenantID: requestTenant(request),
+		})
+		writer.Header().Set("Location", "/users/" + userID)
+		writer.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "created user with ID: " + userID))
+	case persistence.UPDATED:
+		if previous.NickName != ur.NickName {
+			h.publish(persistence.Message{
+				Type: "NICKNAME_CHANGED",
+				UserID: userID,
+				Nickname: ur.NickName,
+				TenantID: requestTenant(request),
+			})
+		}
+		writer.WriteHeader(http.StatusOK)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "replaced user: " + userID))
+	case persistence.ALREADY_EXISTS:
+		writer.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("user with email: %s already exists in db!", ur.EmailAddress)))
+	case persistence.DELETED:
+		writer.WriteHeader(http.StatusGone)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "user: " + userID + " has been deleted, restore them before replacing them"))
+	case persistence.VERSION_MISMATCH:
+		writeVersionMismatch(writer, userID)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not replace user: " + userID))
+	}
+}
+
+//missingFields returns the json names of the required user fields which are empty
+func missingFields(ur persistence.UserRecord) []string {
+	var missing []string
+	for _, field := range []struct {
+		name string
+		value string
+	}{
+		{"firstName", ur.FirstName},
+		{"lastName", ur.LastName},
+		{"emailAddress", ur.EmailAddress},
+		{"password", ur.Password},
+		{"nickname", ur.NickName},
+		{"country", ur.Country},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	return missing
+}
+
+//newUser validates an imported user and generates their ID from their email as AddUser does, so the same user is
+//never imported twice
+func newUser(ur *persistence.UserRecord) error {
+	if missing := missingFields(*ur); len(missing) > 0 {
+		return fmt.Errorf("all user fields are required, missing %v", missing)
+	}
+	ur.UserID = uuid.NewMD5(uuid.UUID{}, []byte(ur.EmailAddress)).String()
+	log.Debugf("generated ID: %s for new user with email: %s", ur.UserID, ur.EmailAddress)
+	return nil
+}
+
 // swagger:operation PATCH /users/{userID} users editUser
 // ---
 // summary: Modify users
@@ -171,48 +464,113 @@ func (h *UsersHandler) AddUser(writer http.ResponseWriter, request *http.Request
 //   description: users country
 //   type: string
 //   required: false
+// - name: If-Match
+//   in: header
+//   description: ETag of the version of the user being modified
+//   type: string
+//   required: false
+// - name: Content-Type
+//   in: header
+//   description: application/json where empty fields are left unchanged, application/merge-patch+json where null
+//     clears a field, or application/json-patch+json for a list of patch operations including test
+//   type: string
+//   required: false
 // responses:
 //   200: ok
 //   400: badRequest
+//   403: forbidden
 //   404: notFound
+//   409: conflict
+//   412: preconditionFailed
+//   415: unsupportedMediaType
+//   428: preconditionRequired
 //   500: internal
 func (h *UsersHandler) EditUser(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Add("Content-Type", "application/json")
 	vars := mux.Vars(request)
 	userID := vars["userID"]
 
-	var body io.Reader = request.Body
-	dec := json.NewDecoder(body)
-	ur := persistence.UserRecord{}
-	if err := dec.Decode(&ur); err != nil {
-		log.WithError(err).Error("could not decode request body")
-		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not decode request body"))
-		return
+	mediaType := "application/json"
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			mediaType = contentType
+		}
 	}
 
-	if ur.EmailAddress != "" {
-		log.WithField("UserID", userID).Error( "users are currently unable to change their email address")
-		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "users are currently unable to change their email address"))
+	var updates map[string]string
+	var patchErr error
+	var current *persistence.UserRecord
+	switch mediaType {
+	case "application/json":
+		var ok bool
+		if updates, ok = decodeFieldsToUpdate(writer, request.Body, userID); !ok {
+			return
+		}
+	case mergePatchMediaType:
+		updates, patchErr = mergePatchUpdates(request.Body)
+	case jsonPatchMediaType:
+		//test operations are evaluated against the current user, which must not change before the patch is applied
+		users, status := h.sqlClient.RetrieveRecords(persistence.SearchCriteria{TenantID: requestTenant(request), Fields: map[string]string{"user_id": userID}})
+		switch {
+		case status == persistence.NOT_FOUND:
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not update user: " + userID + " as they did not exist"))
+			return
+		case status != persistence.OK || len(users) != 1:
+			writer.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("could not update user: %s", userID)))
+			return
+		}
+		current = &users[0]
+		updates, patchErr = jsonPatchUpdates(*current, request.Body)
+	default:
+		log.WithField("UserID", userID).Infof("unsupported patch content type %s", mediaType)
+		writer.Header().Set("Accept-Patch", strings.Join([]string{"application/json", mergePatchMediaType, jsonPatchMediaType}, ", "))
+		writer.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "Content-Type must be application/json, " + mergePatchMediaType + " or " + jsonPatchMediaType))
+		return
+	}
+	if patchErr != nil {
+		log.WithError(patchErr).WithField("UserID", userID).Info("could not apply patch")
+		status := http.StatusBadRequest
+		if e, ok := patchErr.(patchError); ok {
+			status = e.status
+		}
+		writer.WriteHeader(status)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, patchErr.Error()))
 		return
 	}
-
-	updates, nicknameChanged := extractFieldsToUpdate(ur)
 	if len(updates) == 0 {
-		log.WithField("UserID", userID).Infof( "supplied fields are not valid for update in request body: %v", body)
+		log.WithField("UserID", userID).Info("no fields to update supplied in request body")
 		writer.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "supplied fields are not valid for update"))
 		return
 	}
+	if !checkFields(writer, request, updatedColumns(updates)) {
+		return
+	}
 
-	switch h.sqlClient.UpdateRecord(userID, updates) {
+	expectedVersion, ok := h.expectedVersion(writer, request)
+	if !ok {
+		return
+	}
+	if current != nil {
+		if expectedVersion != 0 && expectedVersion != current.Version {
+			writeVersionMismatch(writer, userID)
+			return
+		}
+		expectedVersion = current.Version
+	}
+
+	switch h.sqlClient.UpdateRecord(callerFromRequest(writer, request), userID, updates, expectedVersion) {
 	case persistence.UPDATED:
-		if nicknameChanged {
-			h.queueClient.AddMessageToQueue(persistence.Message{
+		if nickname, nicknameChanged := updates["nickname"]; nicknameChanged {
+			h.publish(persistence.Message{
 				Type: "NICKNAME_CHANGED",
 				UserID: userID,
-				Nickname: updates["nickname"],
+				Nickname: nickname,
+				TenantID: requestTenant(request),
 			})
 		}
 		writer.WriteHeader(http.StatusOK)
@@ -220,6 +578,8 @@ func (h *UsersHandler) EditUser(writer http.ResponseWriter, request *http.Reques
 	case persistence.NOT_FOUND:
 		writer.WriteHeader(http.StatusNotFound)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not update user: " + userID + " as they did not exist"))
+	case persistence.VERSION_MISMATCH:
+		writeVersionMismatch(writer, userID)
 	default:
 		msg := fmt.Sprintf("could not update user: %s", userID)
 		writer.WriteHeader(http.StatusInternalServerError)
@@ -227,9 +587,38 @@ func (h *UsersHandler) EditUser(writer http.ResponseWriter, request *http.Reques
 	}
 }
 
-func extractFieldsToUpdate(ur persistence.UserRecord) (map[string]string, bool) {
+//decodeFieldsToUpdate returns the updates in a plain json body, where empty fields are not updated.
+//Writes the response and returns false if the body is invalid
+func decodeFieldsToUpdate(writer http.ResponseWriter, body io.Reader, userID string) (map[string]string, bool) {
+	ur := persistence.UserRecord{}
+	dec := json.NewDecoder(body)
+	//unknown fields are rejected, as they are by patches, rather than silently not updated
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ur); err != nil {
+		if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+			log.WithField("UserID", userID).Infof("unknown field %s in request body", name)
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("%s is not a user field", strings.Trim(name, `"`))))
+			return nil, false
+		}
+		log.WithError(err).Error("could not decode request body")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not decode request body"))
+		return nil, false
+	}
+
+	if ur.EmailAddress != "" {
+		log.WithField("UserID", userID).Error( "users are currently unable to change their email address")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "users are currently unable to change their email address"))
+		return nil, false
+	}
+
+	return extractFieldsToUpdate(ur), true
+}
+
+func extractFieldsToUpdate(ur persistence.UserRecord) map[string]string {
 	updates := make(map[string]string)
-	var nicknameChanged bool
 	if ur.FirstName != "" {
 		updates["first_name"] = ur.FirstName
 	}
@@ -241,19 +630,33 @@ func extractFieldsToUpdate(ur persistence.UserRecord) (map[string]string, bool)
 	}
 	if ur.NickName != "" {
 		updates["nickname"] = ur.NickName
-		nicknameChanged = true
 	}
 	if ur.Country != "" {
 		updates["country"] = ur.Country
 	}
-	return updates, nicknameChanged
+	return updates
 }
 
 // swagger:operation GET /users users getUser
 // ---
 // summary: Return userList
-// description: Returns list of users matching specified criteria
+// description: Returns list of users matching specified criteria, in the media type negotiated with the Accept header
+// produces:
+// - application/json
+// - application/x-ndjson
+// - text/csv
+// - application/xml
 // parameters:
+// - name: Accept
+//   in: header
+//   description: media types the client accepts, json is returned if there is no Accept header
+//   type: string
+//   required: false
+// - name: fields
+//   in: query
+//   description: comma separated user fields to return, in order, defaults to every field except password
+//   type: string
+//   required: false
 // - name: userID
 //   in: query
 //   description: users uuid
@@ -284,10 +687,47 @@ func extractFieldsToUpdate(ur persistence.UserRecord) (map[string]string, bool)
 //   description: users country
 //   type: string
 //   required: false
+// - name: includeDeleted
+//   in: query
+//   description: also return soft deleted users, only permitted for admins
+//   type: boolean
+//   required: false
+// - name: createdAfter
+//   in: query
+//   description: only return users created after this RFC 3339 time
+//   type: string
+//   format: date-time
+//   required: false
+// - name: createdBefore
+//   in: query
+//   description: only return users created before this RFC 3339 time
+//   type: string
+//   format: date-time
+//   required: false
+// - name: updatedAfter
+//   in: query
+//   description: only return users last updated after this RFC 3339 time
+//   type: string
+//   format: date-time
+//   required: false
+// - name: updatedBefore
+//   in: query
+//   description: only return users last updated before this RFC 3339 time
+//   type: string
+//   format: date-time
+//   required: false
+// - name: If-Modified-Since
+//   in: header
+//   description: when looking up a user by ID, only return them if they have been updated since this time
+//   type: string
+//   required: false
 // responses:
 //   200: ok
+//   304: notModified
 //   400: badRequest
+//   403: forbidden
 //   404: notFound
+//   406: notAcceptable
 //   422: unprocessable
 //   500: internal
 func (h *UsersHandler) GetRecords(writer http.ResponseWriter, request *http.Request) {
@@ -308,28 +748,62 @@ func (h *UsersHandler) GetRecords(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
-	searchCriteria := make(map[string]string)
-	for k, v := range params {
-		newKey := filterQueryParams(k)
-		if newKey != "" {
-			//remove quotes from values
-			searchCriteria[newKey] = strings.Replace(v[0], `"`, "", -1)
-		}
+	fields, ok := selectFields(writer, params)
+	if !ok {
+		return
+	}
+
+	//unlike the other searches, invalid params are ignored as long as there are valid ones
+	criteria, err := filterCriteria(params)
+	if err != nil && err != errInvalidFilters {
+		log.WithError(err).Infof("supplied request params %s are invalid", params)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	if !checkIncludeDeleted(writer, request, criteria) {
+		return
 	}
+	criteria.TenantID = requestTenant(request)
 
-	if len(searchCriteria) == 0 {
+	if len(criteria.Fields) == 0 && !hasTimeRange(criteria) {
 		log.Infof("supplied request params %s are invalid", params)
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "supplied request params are invalid; valid params are [userID, firstName, lastName, emailAddress, nickname, country]"))
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "supplied request params are invalid; valid params are [userID, firstName, lastName, emailAddress, nickname, country, createdAfter, createdBefore, updatedAfter, updatedBefore]"))
+		return
+	}
+
+	writer.Header().Set("Vary", "Accept")
+	encoder, ok := negotiateEncoder(request.Header.Get("Accept"))
+	if !ok {
+		log.Infof("no supported media type is acceptable: %s", request.Header.Get("Accept"))
+		writer.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "supported media types are "+supportedMediaTypes()))
 		return
 	}
 
-	users, retrievalStatus := h.sqlClient.RetrieveRecords(searchCriteria)
+	_, byID := criteria.Fields["user_id"]
+	if columns, _ := projectColumns(fields); len(fields) > 0 {
+		criteria.Columns = dbColumns(columns)
+		//lookups by ID always return the validators used to make conditional requests
+		if byID {
+			criteria.Columns = append(criteria.Columns, "version", "updated_at")
+		}
+	}
+	users, retrievalStatus := h.sqlClient.RetrieveRecords(criteria)
 	switch retrievalStatus {
 	case persistence.OK:
+		//a lookup by ID is a read of a single user, so can be used to make conditional requests for them
+		if byID && len(users) == 1 {
+			writeValidators(writer, users[0])
+			if notModified(request, users[0]) {
+				writer.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		writer.Header().Set("Content-Type", encoder.mediaType)
 		writer.WriteHeader(http.StatusOK)
-		enc := json.NewEncoder(writer)
-		if err := enc.Encode(users); err != nil {
+		if err := encoder.encode(writer, users, fields); err != nil {
 			log.WithError(err).Error("could not encode returned payload")
 			writer.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process request"))
@@ -344,6 +818,112 @@ func (h *UsersHandler) GetRecords(writer http.ResponseWriter, request *http.Requ
 	}
 }
 
+//selectFields removes the comma separated fields param from params, returning the fields selected, or nil to select
+//every field. Responds with 400 for unknown fields and 403 for fields which can never be selected
+func selectFields(writer http.ResponseWriter, params url.Values) ([]string, bool) {
+	if _, ok := params["fields"]; !ok {
+		return nil, true
+	}
+	var fields []string
+	for _, name := range strings.Split(params.Get("fields"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields = append(fields, name)
+		}
+	}
+	params.Del("fields")
+
+	if len(fields) == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "fields must list at least one field"))
+		return nil, false
+	}
+	for _, name := range fields {
+		if _, err := projectColumns([]string{name}); err != nil {
+			log.WithError(err).Info("invalid fields param")
+			status := http.StatusBadRequest
+			if userFields[name].secret {
+				status = http.StatusForbidden
+			}
+			writer.WriteHeader(status)
+			fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+			return nil, false
+		}
+	}
+	return fields, true
+}
+
+//timeRangeParams are the params restricting when users were created or updated
+var timeRangeParams = []string{"createdAfter", "createdBefore", "updatedAfter", "updatedBefore"}
+
+//extractTimeRanges removes any time range params from params and sets them on the criteria
+func extractTimeRanges(params url.Values, criteria *persistence.SearchCriteria) error {
+	ranges := map[string]*time.Time{
+		"createdAfter": &criteria.CreatedAfter,
+		"createdBefore": &criteria.CreatedBefore,
+		"updatedAfter": &criteria.UpdatedAfter,
+		"updatedBefore": &criteria.UpdatedBefore,
+	}
+	for _, param := range timeRangeParams {
+		if _, ok := params[param]; !ok {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, params.Get(param))
+		if err != nil {
+			return fmt.Errorf("%s must be an RFC 3339 time e.g. 2020-04-01T12:00:00Z", param)
+		}
+		*ranges[param] = value
+		params.Del(param)
+	}
+	return nil
+}
+
+func hasTimeRange(criteria persistence.SearchCriteria) bool {
+	return !criteria.CreatedAfter.IsZero() || !criteria.CreatedBefore.IsZero() ||
+		!criteria.UpdatedAfter.IsZero() || !criteria.UpdatedBefore.IsZero()
+}
+
+//buildSearchCriteria maps valid search params to the db columns they match on, ignoring invalid params
+func buildSearchCriteria(params url.Values) map[string]string {
+	searchCriteria := make(map[string]string)
+	for k, v := range params {
+		newKey := filterQueryParams(k)
+		if newKey != "" {
+			//remove quotes from values
+			searchCriteria[newKey] = strings.Replace(v[0], `"`, "", -1)
+		}
+	}
+	return searchCriteria
+}
+
+//errInvalidFilters is returned by filterCriteria, with the criteria of the valid filters, when any filters are invalid
+var errInvalidFilters = errors.New("supplied filters are invalid; valid filters are [userID, firstName, lastName, emailAddress, nickname, country, includeDeleted, createdAfter, createdBefore, updatedAfter, updatedBefore]")
+
+//filterCriteria builds the search criteria from GET /users search params, which unlike GET /users may be empty
+//to select every user, as when exporting or counting users
+func filterCriteria(filters url.Values) (persistence.SearchCriteria, error) {
+	params := url.Values{}
+	for k, v := range filters {
+		params[k] = v
+	}
+	var criteria persistence.SearchCriteria
+	if _, ok := params["includeDeleted"]; ok {
+		includeDeleted, err := strconv.ParseBool(params.Get("includeDeleted"))
+		if err != nil {
+			return criteria, fmt.Errorf("includeDeleted must be true or false")
+		}
+		criteria.IncludeDeleted = includeDeleted
+		params.Del("includeDeleted")
+	}
+	if err := extractTimeRanges(params, &criteria); err != nil {
+		return criteria, err
+	}
+	criteria.Fields = buildSearchCriteria(params)
+	if len(criteria.Fields) != len(params) {
+		return criteria, errInvalidFilters
+	}
+	return criteria, nil
+}
+
 func filterQueryParams(key string) string {
 	switch key {
 	case "userID":
@@ -362,40 +942,84 @@ func filterQueryParams(key string) string {
 		log.Errorf("supplied param %s is invalid", key)
 		return ""
 	}
-	return ""
 }
 
 // swagger:operation DELETE /users/{userID} users deleteUser
 // ---
 // summary: Delete users
-// description: Delete user with matching UserID from DB
+// description: Soft delete user with matching UserID from DB, they can be restored until they are purged
 // parameters:
 // - name: userID
 //   in: path
 //   description: users uuid
 //   type: string
 //   required: true
+// - name: If-Match
+//   in: header
+//   description: ETag of the version of the user being deleted
+//   type: string
+//   required: false
 // responses:
 //   204: noContent
 //   404: notFound
+//   412: preconditionFailed
+//   428: preconditionRequired
 //   500: internal
 func (h *UsersHandler) DeleteUser(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Add("Content-Type", "application/json")
 	vars := mux.Vars(request)
 	userID := vars["userID"]
-	switch h.sqlClient.DeleteRecord(userID) {
+	expectedVersion, ok := h.expectedVersion(writer, request)
+	if !ok {
+		return
+	}
+
+	switch h.sqlClient.DeleteRecord(callerFromRequest(writer, request), userID, expectedVersion) {
 	case persistence.DELETED:
 		writer.WriteHeader(http.StatusNoContent)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "user record deleted"))
 	case persistence.NOT_FOUND:
 		writer.WriteHeader(http.StatusNotFound)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "user does not exist"))
+	case persistence.VERSION_MISMATCH:
+		writeVersionMismatch(writer, userID)
 	default:
 		writer.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process delete request"))
 	}
 }
 
+// swagger:operation POST /users/{userID}/restore users restoreUser
+// ---
+// summary: Restore users
+// description: Restore soft deleted user with matching UserID in DB
+// parameters:
+// - name: userID
+//   in: path
+//   description: users uuid
+//   type: string
+//   required: true
+// responses:
+//   200: ok
+//   404: notFound
+//   500: internal
+func (h *UsersHandler) RestoreUser(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	vars := mux.Vars(request)
+	userID := vars["userID"]
+	switch h.sqlClient.RestoreRecord(callerFromRequest(writer, request), userID) {
+	case persistence.RESTORED:
+		writer.WriteHeader(http.StatusOK)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "restored user: " + userID))
+	case persistence.NOT_FOUND:
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "no deleted user exists with ID: " + userID))
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process restore request"))
+	}
+}
+
 //IsHealthy swagger:route GET /__health isHealthy
 //
 //Returns health of system
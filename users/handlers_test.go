@@ -1,6 +1,7 @@
 package users
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/scott-ace-newton/users-rw-sql/notification"
@@ -11,6 +12,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 var johnSmithJSON = `{
@@ -23,6 +25,9 @@ var johnSmithJSON = `{
   "country": "UK"
 }`
 
+//johnSmithReadJSON is johnSmithJSON as it is read, without the password
+var johnSmithReadJSON = strings.Replace(johnSmithJSON, "  \"password\": \"password1\",\n", "", 1)
+
 var johnSmithUser = persistence.UserRecord{
 	UserID: "e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d",
 	FirstName: "John",
@@ -46,7 +51,7 @@ var updateEmail = `{
 }`
 
 func TestPutHandler(t *testing.T) {
-	qc := notification.NewQueueClient("/dev/null")
+	qc := newTestQueueClient()
 	assert := assert.New(t)
 	tests := []struct {
 		name        string
@@ -86,18 +91,226 @@ func TestPutHandler(t *testing.T) {
 	}
 
 	for _, test := range tests {
+		//PUT /users is the deprecated route for POST /users
+		for _, method := range []string{"POST", "PUT"} {
+			r := mux.NewRouter()
+			handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
+			handler.RegisterHandlers(r)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, newRequest(method, "/users", strings.NewReader(test.reqBody)))
+			assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s %s: Wrong response code, was %d, should be %d", method, test.name, rec.Code, test.statusCode))
+			assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s %s: Wrong body", method, test.name))
+			if method == "PUT" {
+				assert.Equal("true", rec.Header().Get("Deprecation"), fmt.Sprintf("%s: PUT /users should be deprecated", test.name))
+				assert.Equal(`</users>; rel="successor-version"`, rec.Header().Get("Link"))
+			} else {
+				assert.Empty(rec.Header().Get("Deprecation"))
+			}
+			if test.statusCode == http.StatusCreated {
+				assert.Equal("/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", rec.Header().Get("Location"))
+			}
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	assert := assert.New(t)
+	newHandlerWithConfig := func(status persistence.Status, config Config) (*mux.Router, *mockIdempotencyClient) {
+		sqlClient := &mockIdempotencyClient{mockSQLClient: mockSQLClient{status, nil}, keys: make(map[string]persistence.IdempotencyRecord)}
 		r := mux.NewRouter()
-		handler := NewUsersHandler(test.sqlClient, qc)
+		handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), config)
 		handler.RegisterHandlers(r)
+		return r, sqlClient
+	}
+	newHandler := func(status persistence.Status, ttl time.Duration) (*mux.Router, *mockIdempotencyClient) {
+		return newHandlerWithConfig(status, Config{IdempotencyKeyTTL: ttl})
+	}
+	postAs := func(r *mux.Router, principal, key, body string) *httptest.ResponseRecorder {
+		req := newRequest("POST", "/users", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		if principal != "" {
+			req.Header.Set("Authorization", "Stub " + principal)
+		}
 		rec := httptest.NewRecorder()
-		r.ServeHTTP(rec, newRequest("PUT", "/users", strings.NewReader(test.reqBody)))
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(r *mux.Router, key, body string) *httptest.ResponseRecorder {
+		return postAs(r, "", key, body)
+	}
+	created := fmt.Sprintf(msgTemplate + "\n", "created user with ID: 3f685356-02a0-3c55-8b8d-c8bac4b79426")
+
+	//retries replay the first response
+	r, sqlClient := newHandler(persistence.CREATED, time.Hour)
+	first := post(r, "key-1", johnSmithJSON)
+	retry := post(r, "key-1", johnSmithJSON)
+	assert.Equal(http.StatusCreated, retry.Code)
+	assert.Equal(created, retry.Body.String())
+	assert.Equal("/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", retry.Header().Get("Location"))
+	assert.Equal(first.Header().Get("X-Request-ID"), retry.Header().Get("X-Request-ID"), "test failed: replay should have original request ID")
+	assert.Equal("true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Empty(first.Header().Get("Idempotent-Replayed"))
+	assert.Equal(1, sqlClient.created, "test failed: retry should not create user again")
+
+	//keys cannot be reused for different requests
+	reused := post(r, "key-1", strings.Replace(johnSmithJSON, "John", "Jon", 1))
+	assert.Equal(http.StatusUnprocessableEntity, reused.Code)
+	assert.Equal(fmt.Sprintf(msgTemplate + "\n", "Idempotency-Key has already been used for a different request"), reused.Body.String())
+	req := newRequest("PATCH", "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", strings.NewReader(johnSmithJSON))
+	req.Header.Set("Idempotency-Key", "key-1")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnprocessableEntity, rec.Code, "test failed: key reused for a different endpoint")
+
+	//concurrent retries are rejected until the first request completes
+	pending := newRequest("POST", "/users", nil)
+	sqlClient.keys["key-2"] = persistence.IdempotencyRecord{Key: "key-2", Fingerprint: requestFingerprint(pending, []byte(johnSmithJSON))}
+	inProgress := post(r, "key-2", johnSmithJSON)
+	assert.Equal(http.StatusConflict, inProgress.Code)
+	assert.Equal(fmt.Sprintf(msgTemplate + "\n", "a request with this Idempotency-Key is still being processed"), inProgress.Body.String())
+
+	invalid := post(r, "key\n3", johnSmithJSON)
+	assert.Equal(http.StatusBadRequest, invalid.Code)
+
+	//server errors are not stored so the request can be retried
+	r, sqlClient = newHandler(persistence.BACKEND_ERROR, time.Hour)
+	assert.Equal(http.StatusInternalServerError, post(r, "key-4", johnSmithJSON).Code)
+	assert.Empty(sqlClient.keys, "test failed: key should be released after server error")
+
+	//keys of requests which panic are released so the request can be retried
+	r, sqlClient = newHandler(persistence.CREATED, time.Hour)
+	sqlClient.panicCreate = true
+	assert.Panics(func() { post(r, "key-6", johnSmithJSON) })
+	assert.Empty(sqlClient.keys, "test failed: key should be released after panic")
+	sqlClient.panicCreate = false
+	assert.Equal(http.StatusCreated, post(r, "key-6", johnSmithJSON).Code)
+
+	//keys are scoped to the principal who sent them
+	r, sqlClient = newHandlerWithConfig(persistence.CREATED, Config{IdempotencyKeyTTL: time.Hour, Authenticators: []Authenticator{stubAuthenticator{}}})
+	assert.Equal(http.StatusCreated, postAs(r, "admin-1:admin", "key-7", johnSmithJSON).Code)
+	assert.Equal("true", postAs(r, "admin-1:admin", "key-7", johnSmithJSON).Header().Get("Idempotent-Replayed"))
+	other := postAs(r, "admin-2:admin", "key-7", johnSmithJSON)
+	assert.Equal(http.StatusCreated, other.Code)
+	assert.Empty(other.Header().Get("Idempotent-Replayed"), "test failed: another principal's response should not be replayed")
+	assert.Equal(2, sqlClient.created)
+
+	//keys are ignored when disabled
+	r, sqlClient = newHandler(persistence.CREATED, 0)
+	post(r, "key-5", johnSmithJSON)
+	post(r, "key-5", johnSmithJSON)
+	assert.Equal(2, sqlClient.created)
+	assert.Empty(sqlClient.keys)
+}
+
+func TestReplaceHandler(t *testing.T) {
+	assert := assert.New(t)
+	withNickname := johnSmithUser
+	withNickname.NickName = "KingSmithy"
+	tests := []struct {
+		name       string
+		sqlClient  *mockSQLClient
+		reqBody    string
+		ifMatch    string
+		statusCode int
+		body       string
+		events     []string
+	}{
+		{
+			name:       "Can create user with supplied ID",
+			sqlClient:  &mockSQLClient{persistence.CREATED, nil},
+			reqBody:    johnSmithJSON,
+			statusCode: http.StatusCreated,
+			body:       fmt.Sprintf(msgTemplate + "\n", "created user with ID: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"),
+			events:     []string{"USER_CREATED"},
+		},
+		{
+			name:       "Can replace existing user",
+			sqlClient:  &mockSQLClient{persistence.UPDATED, []persistence.UserRecord{johnSmithUser}},
+			reqBody:    johnSmithJSON,
+			ifMatch:    `"2"`,
+			statusCode: http.StatusOK,
+			body:       fmt.Sprintf(msgTemplate + "\n", "replaced user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"),
+		},
+		{
+			name:       "Replacing nickname publishes change",
+			sqlClient:  &mockSQLClient{persistence.UPDATED, []persistence.UserRecord{withNickname}},
+			reqBody:    johnSmithJSON,
+			statusCode: http.StatusOK,
+			body:       fmt.Sprintf(msgTemplate + "\n", "replaced user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"),
+			events:     []string{"NICKNAME_CHANGED"},
+		},
+		{
+			name:       "Error on user ID not matching path",
+			sqlClient:  &mockSQLClient{persistence.CREATED, nil},
+			reqBody:    strings.Replace(johnSmithJSON, "e41e62c8", "00000000", 1),
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "userID in body does not match path"),
+		},
+		{
+			name:       "Error on partial user",
+			sqlClient:  &mockSQLClient{persistence.CREATED, nil},
+			reqBody:    updateNickname,
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "all user fields are required, missing [firstName lastName emailAddress password country]"),
+		},
+		{
+			name:       "Error on email belonging to another user",
+			sqlClient:  &mockSQLClient{persistence.ALREADY_EXISTS, nil},
+			reqBody:    johnSmithJSON,
+			statusCode: http.StatusConflict,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user with email: john.smith@gmail.com already exists in db!"),
+		},
+		{
+			name:       "Cannot replace deleted user",
+			sqlClient:  &mockSQLClient{persistence.DELETED, nil},
+			reqBody:    johnSmithJSON,
+			statusCode: http.StatusGone,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d has been deleted, restore them before replacing them"),
+		},
+		{
+			name:       "Cannot replace user modified since ETag was read",
+			sqlClient:  &mockSQLClient{persistence.VERSION_MISMATCH, nil},
+			reqBody:    johnSmithJSON,
+			ifMatch:    `"2"`,
+			statusCode: http.StatusPreconditionFailed,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d has been modified since the supplied ETag was read"),
+		},
+		{
+			name:       "Error on unable to write to db",
+			sqlClient:  &mockSQLClient{persistence.BACKEND_ERROR, nil},
+			reqBody:    johnSmithJSON,
+			statusCode: http.StatusInternalServerError,
+			body:       fmt.Sprintf(msgTemplate + "\n", "could not replace user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"),
+		},
+	}
+
+	for _, test := range tests {
+		events := notification.NewEventStream(10)
+		r := mux.NewRouter()
+		//If-Match is optional for PUT even when required for changes
+		handler := NewUsersHandler(test.sqlClient, newTestQueueClient(), events, Config{RequireIfMatch: true})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("PUT", "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", strings.NewReader(test.reqBody))
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		r.ServeHTTP(rec, req)
 		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
 		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+
+		replayed, _, cancel := events.Subscribe(0)
+		cancel()
+		var published []string
+		for _, event := range replayed {
+			published = append(published, event.Message.Type)
+		}
+		assert.Equal(test.events, published, fmt.Sprintf("%s: Wrong events", test.name))
 	}
 }
 
 func TestGetHandler(t *testing.T) {
-	qc := notification.NewQueueClient("/dev/null")
+	qc := newTestQueueClient()
 	assert := assert.New(t)
 	tests := []struct {
 		name       string
@@ -111,7 +324,7 @@ func TestGetHandler(t *testing.T) {
 			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
 			reqURL:     "/users?userID=3f685356-02a0-3c55-8b8d-c8bac4b79426",
 			statusCode: http.StatusOK,
-			body:       convertBody(johnSmithJSON),
+			body:       convertBody(johnSmithReadJSON),
 		},
 		{
 			name:       "Will return empty list when no matching users in db",
@@ -139,7 +352,35 @@ func TestGetHandler(t *testing.T) {
 			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
 			reqURL:     `/users?password=12345`,
 			statusCode: http.StatusBadRequest,
-			body:       fmt.Sprintf(msgTemplate + "\n", "supplied request params are invalid; valid params are [userID, firstName, lastName, emailAddress, nickname, country]"),
+			body:       fmt.Sprintf(msgTemplate + "\n", "supplied request params are invalid; valid params are [userID, firstName, lastName, emailAddress, nickname, country, createdAfter, createdBefore, updatedAfter, updatedBefore]"),
+		},
+		{
+			name:       "Can include deleted users",
+			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			reqURL:     "/users?userID=3f685356-02a0-3c55-8b8d-c8bac4b79426&includeDeleted=true",
+			statusCode: http.StatusOK,
+			body:       convertBody(johnSmithReadJSON),
+		},
+		{
+			name:       "Error on invalid includeDeleted param",
+			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			reqURL:     "/users?userID=3f685356-02a0-3c55-8b8d-c8bac4b79426&includeDeleted=maybe",
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "includeDeleted must be true or false"),
+		},
+		{
+			name:       "Can search by time ranges alone",
+			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			reqURL:     "/users?createdAfter=2020-04-01T12:00:00Z&updatedBefore=2020-05-01T12:00:00%2B01:00",
+			statusCode: http.StatusOK,
+			body:       convertBody(johnSmithReadJSON),
+		},
+		{
+			name:       "Error on invalid time range param",
+			sqlClient:  &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			reqURL:     "/users?country=UK&createdAfter=yesterday",
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "createdAfter must be an RFC 3339 time e.g. 2020-04-01T12:00:00Z"),
 		},
 		{
 			name:       "Error on unable to search records in db",
@@ -152,7 +393,7 @@ func TestGetHandler(t *testing.T) {
 
 	for _, test := range tests {
 		r := mux.NewRouter()
-		handler := NewUsersHandler(test.sqlClient, qc)
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
 		handler.RegisterHandlers(r)
 		rec := httptest.NewRecorder()
 		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
@@ -161,8 +402,105 @@ func TestGetHandler(t *testing.T) {
 	}
 }
 
+func TestGetUserHandler(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	deletedAt := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	deletedUser := johnSmithUser
+	deletedUser.DeletedAt = &deletedAt
+	versionedUser := johnSmithUser
+	versionedUser.Version = 3
+	tests := []struct {
+		name        string
+		sqlClient   *mockSQLClient
+		method      string
+		ifNoneMatch string
+		statusCode  int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "Can return user",
+			sqlClient:   &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			method:      "GET",
+			statusCode:  http.StatusOK,
+			contentType: "application/json",
+			body:        strings.Trim(convertBody(johnSmithReadJSON), "[]\n") + "\n",
+		},
+		{
+			name:        "HEAD returns headers only",
+			sqlClient:   &mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}},
+			method:      "HEAD",
+			statusCode:  http.StatusOK,
+			contentType: "application/json",
+		},
+		{
+			name:        "Not modified when client has current version",
+			sqlClient:   &mockSQLClient{persistence.OK, []persistence.UserRecord{versionedUser}},
+			method:      "GET",
+			ifNoneMatch: `W/"2", "3"`,
+			statusCode:  http.StatusNotModified,
+			contentType: "application/json",
+		},
+		{
+			name:        "Returns user when client has earlier version",
+			sqlClient:   &mockSQLClient{persistence.OK, []persistence.UserRecord{versionedUser}},
+			method:      "HEAD",
+			ifNoneMatch: `"2"`,
+			statusCode:  http.StatusOK,
+			contentType: "application/json",
+		},
+		{
+			name:        "Problem when user does not exist",
+			sqlClient:   &mockSQLClient{persistence.NOT_FOUND, nil},
+			method:      "GET",
+			statusCode:  http.StatusNotFound,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Not Found","status":404,"detail":"no user exists with ID: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d","instance":"/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}` + "\n",
+		},
+		{
+			name:        "HEAD problem has no body",
+			sqlClient:   &mockSQLClient{persistence.NOT_FOUND, nil},
+			method:      "HEAD",
+			statusCode:  http.StatusNotFound,
+			contentType: "application/problem+json",
+		},
+		{
+			name:        "Gone when user has been deleted",
+			sqlClient:   &mockSQLClient{persistence.OK, []persistence.UserRecord{deletedUser}},
+			method:      "GET",
+			statusCode:  http.StatusGone,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Gone","status":410,"detail":"user: e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d has been deleted","instance":"/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}` + "\n",
+		},
+		{
+			name:        "Problem when unable to retrieve user from db",
+			sqlClient:   &mockSQLClient{persistence.BACKEND_ERROR, nil},
+			method:      "GET",
+			statusCode:  http.StatusInternalServerError,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"could not process request","instance":"/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest(test.method, "/users/e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.contentType, rec.Header().Get("Content-Type"), fmt.Sprintf("%s: Wrong content type", test.name))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
 func TestEditHandler(t *testing.T) {
-	qc := notification.NewQueueClient("/dev/null")
+	qc := newTestQueueClient()
 	assert := assert.New(t)
 	tests := []struct {
 		name        string
@@ -197,6 +535,20 @@ func TestEditHandler(t *testing.T) {
 			sqlClient: &mockSQLClient{persistence.NOT_FOUND, nil},
 			reqBody: updateAddress,
 			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "address is not a user field"),
+		},
+		{
+			name: "Error on unknown fields alongside valid ones",
+			sqlClient: &mockSQLClient{persistence.UPDATED, nil},
+			reqBody: `{"nickname": "KingSmithy", "title": "King"}`,
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "title is not a user field"),
+		},
+		{
+			name: "Error on no fields to update",
+			sqlClient: &mockSQLClient{persistence.NOT_FOUND, nil},
+			reqBody: `{}`,
+			statusCode: http.StatusBadRequest,
 			body:       fmt.Sprintf(msgTemplate + "\n", "supplied fields are not valid for update"),
 		},
 		{
@@ -217,7 +569,7 @@ func TestEditHandler(t *testing.T) {
 
 	for _, test := range tests {
 		r := mux.NewRouter()
-		handler := NewUsersHandler(test.sqlClient, qc)
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
 		handler.RegisterHandlers(r)
 		rec := httptest.NewRecorder()
 		r.ServeHTTP(rec, newRequest("PATCH", "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", strings.NewReader(test.reqBody)))
@@ -226,8 +578,307 @@ func TestEditHandler(t *testing.T) {
 	}
 }
 
+func TestPatchHandler(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	current := johnSmithUser
+	current.Version = 3
+	userID := johnSmithUser.UserID
+	tests := []struct {
+		name            string
+		current         *persistence.UserRecord
+		contentType     string
+		ifMatch         string
+		reqBody         string
+		statusCode      int
+		body            string
+		updates         map[string]string
+		expectedVersion int
+	}{
+		{
+			name:        "Merge patch null clears field",
+			contentType: "application/merge-patch+json",
+			reqBody:     `{"nickname": null, "country": "France"}`,
+			statusCode:  http.StatusOK,
+			body:        fmt.Sprintf(msgTemplate + "\n", "updated user: " + userID),
+			updates:     map[string]string{"nickname": "", "country": "France"},
+		},
+		{
+			name:        "Merge patch content type parameters are ignored",
+			contentType: "application/merge-patch+json; charset=utf-8",
+			reqBody:     `{"firstName": "Johnny"}`,
+			statusCode:  http.StatusOK,
+			body:        fmt.Sprintf(msgTemplate + "\n", "updated user: " + userID),
+			updates:     map[string]string{"first_name": "Johnny"},
+		},
+		{
+			name:        "Merge patch rejects unknown fields",
+			contentType: "application/merge-patch+json",
+			reqBody:     `{"address": "742 Evergreen Terrace"}`,
+			statusCode:  http.StatusBadRequest,
+			body:        fmt.Sprintf(msgTemplate + "\n", "address is not a user field"),
+		},
+		{
+			name:        "Merge patch rejects read only fields",
+			contentType: "application/merge-patch+json",
+			reqBody:     `{"emailAddress": "KingSmithy@gmail.com"}`,
+			statusCode:  http.StatusForbidden,
+			body:        fmt.Sprintf(msgTemplate + "\n", "emailAddress cannot be modified"),
+		},
+		{
+			name:        "Merge patch cannot clear required fields",
+			contentType: "application/merge-patch+json",
+			reqBody:     `{"firstName": null}`,
+			statusCode:  http.StatusBadRequest,
+			body:        fmt.Sprintf(msgTemplate + "\n", "firstName cannot be cleared"),
+		},
+		{
+			name:        "Merge patch rejects values which are not strings",
+			contentType: "application/merge-patch+json",
+			reqBody:     `{"country": 44}`,
+			statusCode:  http.StatusBadRequest,
+			body:        fmt.Sprintf(msgTemplate + "\n", "country must be a string or null"),
+		},
+		{
+			name:            "JSON patch applies operations when test passes",
+			current:         &current,
+			contentType:     "application/json-patch+json",
+			reqBody:         `[{"op": "test", "path": "/nickname", "value": "smithy12345"}, {"op": "remove", "path": "/nickname"}, {"op": "replace", "path": "/lastName", "value": "Smyth"}]`,
+			statusCode:      http.StatusOK,
+			body:            fmt.Sprintf(msgTemplate + "\n", "updated user: " + userID),
+			updates:         map[string]string{"nickname": "", "last_name": "Smyth"},
+			expectedVersion: 3,
+		},
+		{
+			name:            "JSON patch operations see earlier operations",
+			current:         &current,
+			contentType:     "application/json-patch+json",
+			reqBody:         `[{"op": "copy", "from": "/firstName", "path": "/nickname"}, {"op": "test", "path": "/nickname", "value": "John"}]`,
+			statusCode:      http.StatusOK,
+			body:            fmt.Sprintf(msgTemplate + "\n", "updated user: " + userID),
+			updates:         map[string]string{"nickname": "John"},
+			expectedVersion: 3,
+		},
+		{
+			name:        "JSON patch is rejected when test fails",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "test", "path": "/country", "value": "France"}, {"op": "replace", "path": "/country", "value": "Spain"}]`,
+			statusCode:  http.StatusConflict,
+			body:        fmt.Sprintf(msgTemplate + "\n", "test operation 0 failed, country does not match"),
+		},
+		{
+			name:        "JSON patch cannot test passwords",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "test", "path": "/password", "value": "password1"}]`,
+			statusCode:  http.StatusForbidden,
+			body:        fmt.Sprintf(msgTemplate + "\n", "operation 0: password cannot be tested"),
+		},
+		{
+			name:        "JSON patch cannot copy passwords",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "copy", "from": "/password", "path": "/nickname"}]`,
+			statusCode:  http.StatusForbidden,
+			body:        fmt.Sprintf(msgTemplate + "\n", "operation 0: password cannot be copied or moved"),
+		},
+		{
+			name:        "JSON patch rejects read only fields",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "replace", "path": "/version", "value": "7"}]`,
+			statusCode:  http.StatusForbidden,
+			body:        fmt.Sprintf(msgTemplate + "\n", "version cannot be modified"),
+		},
+		{
+			name:        "JSON patch rejects unsupported operations",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "increment", "path": "/nickname"}]`,
+			statusCode:  http.StatusBadRequest,
+			body:        fmt.Sprintf(msgTemplate + "\n", "operation 0: unsupported op increment"),
+		},
+		{
+			name:        "JSON patch rejects stale If-Match",
+			current:     &current,
+			contentType: "application/json-patch+json",
+			ifMatch:     `"2"`,
+			reqBody:     `[{"op": "replace", "path": "/country", "value": "Spain"}]`,
+			statusCode:  http.StatusPreconditionFailed,
+			body:        fmt.Sprintf(msgTemplate + "\n", "user: " + userID + " has been modified since the supplied ETag was read"),
+		},
+		{
+			name:        "JSON patch of non-existing user",
+			contentType: "application/json-patch+json",
+			reqBody:     `[{"op": "remove", "path": "/nickname"}]`,
+			statusCode:  http.StatusNotFound,
+			body:        fmt.Sprintf(msgTemplate + "\n", "could not update user: " + userID + " as they did not exist"),
+		},
+		{
+			name:        "Unsupported content type",
+			contentType: "text/plain",
+			reqBody:     "nickname=KingSmithy",
+			statusCode:  http.StatusUnsupportedMediaType,
+			body:        fmt.Sprintf(msgTemplate + "\n", "Content-Type must be application/json, application/merge-patch+json or application/json-patch+json"),
+		},
+	}
+
+	for _, test := range tests {
+		sqlClient := &mockPatchClient{mockSQLClient: mockSQLClient{persistence.UPDATED, nil}, current: test.current}
+		r := mux.NewRouter()
+		handler := NewUsersHandler(sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("PATCH", "/users/" + userID, strings.NewReader(test.reqBody))
+		req.Header.Set("Content-Type", test.contentType)
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.updates, sqlClient.updates, fmt.Sprintf("%s: Wrong updates", test.name))
+		assert.Equal(test.expectedVersion, sqlClient.expectedVersion, fmt.Sprintf("%s: Wrong expected version", test.name))
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		sqlClient  *mockSQLClient
+		config     Config
+		method     string
+		ifMatch    string
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Can edit user with matching ETag",
+			sqlClient:  &mockSQLClient{persistence.UPDATED, nil},
+			method:     "PATCH",
+			ifMatch:    `"3"`,
+			statusCode: http.StatusOK,
+			body:       fmt.Sprintf(msgTemplate + "\n", "updated user: 3f685356-02a0-3c55-8b8d-c8bac4b79426"),
+		},
+		{
+			name:       "Cannot edit user modified since ETag was read",
+			sqlClient:  &mockSQLClient{persistence.VERSION_MISMATCH, nil},
+			method:     "PATCH",
+			ifMatch:    `"3"`,
+			statusCode: http.StatusPreconditionFailed,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user: 3f685356-02a0-3c55-8b8d-c8bac4b79426 has been modified since the supplied ETag was read"),
+		},
+		{
+			name:       "Cannot delete user modified since ETag was read",
+			sqlClient:  &mockSQLClient{persistence.VERSION_MISMATCH, nil},
+			method:     "DELETE",
+			ifMatch:    `"3"`,
+			statusCode: http.StatusPreconditionFailed,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user: 3f685356-02a0-3c55-8b8d-c8bac4b79426 has been modified since the supplied ETag was read"),
+		},
+		{
+			name:       "Weak ETags never match",
+			sqlClient:  &mockSQLClient{persistence.UPDATED, nil},
+			method:     "PATCH",
+			ifMatch:    `W/"3"`,
+			statusCode: http.StatusPreconditionFailed,
+			body:       fmt.Sprintf(msgTemplate + "\n", "If-Match header does not match the ETag of the user"),
+		},
+		{
+			name:       "Wildcard matches any version",
+			sqlClient:  &mockSQLClient{persistence.DELETED, nil},
+			config:     Config{RequireIfMatch: true},
+			method:     "DELETE",
+			ifMatch:    "*",
+			statusCode: http.StatusNoContent,
+			body:       fmt.Sprintf(msgTemplate + "\n", "user record deleted"),
+		},
+		{
+			name:       "Error on missing If-Match when required",
+			sqlClient:  &mockSQLClient{persistence.UPDATED, nil},
+			config:     Config{RequireIfMatch: true},
+			method:     "PATCH",
+			statusCode: http.StatusPreconditionRequired,
+			body:       fmt.Sprintf(msgTemplate + "\n", "If-Match header with the ETag of the user is required"),
+		},
+		{
+			name:       "Error on missing If-Match on delete when required",
+			sqlClient:  &mockSQLClient{persistence.DELETED, nil},
+			config:     Config{RequireIfMatch: true},
+			method:     "DELETE",
+			statusCode: http.StatusPreconditionRequired,
+			body:       fmt.Sprintf(msgTemplate + "\n", "If-Match header with the ETag of the user is required"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), test.config)
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest(test.method, "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", strings.NewReader(updateNickname))
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+
+	//reads of a single user return their version as an ETag
+	versioned := johnSmithUser
+	versioned.Version = 3
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, []persistence.UserRecord{versioned}}, qc, notification.NewEventStream(10), Config{})
+	handler.RegisterHandlers(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users?userID=e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", nil))
+	assert.Equal(`"3"`, rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users?country=UK", nil))
+	assert.Empty(rec.Header().Get("ETag"), "test failed: searches should not return an ETag")
+}
+
+func TestConditionalReads(t *testing.T) {
+	assert := assert.New(t)
+	updatedAt := time.Date(2020, 4, 1, 12, 0, 0, 500, time.UTC)
+	user := johnSmithUser
+	user.UpdatedAt = &updatedAt
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, []persistence.UserRecord{user}}, newTestQueueClient(), notification.NewEventStream(10), Config{})
+	handler.RegisterHandlers(r)
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		statusCode      int
+	}{
+		{name: "Returns user without If-Modified-Since", statusCode: http.StatusOK},
+		{name: "Returns user updated since", ifModifiedSince: "Wed, 01 Apr 2020 11:59:59 GMT", statusCode: http.StatusOK},
+		{name: "Not modified at update time", ifModifiedSince: "Wed, 01 Apr 2020 12:00:00 GMT", statusCode: http.StatusNotModified},
+		{name: "Not modified after update time", ifModifiedSince: "Thu, 02 Apr 2020 12:00:00 GMT", statusCode: http.StatusNotModified},
+		{name: "Ignores invalid If-Modified-Since", ifModifiedSince: "yesterday", statusCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		req := newRequest("GET", "/users?userID=e41e62c8-6cf2-4fd7-a88b-41b86fcaa34d", nil)
+		if test.ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", test.ifModifiedSince)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal("Wed, 01 Apr 2020 12:00:00 GMT", rec.Header().Get("Last-Modified"), fmt.Sprintf("%s: Wrong Last-Modified", test.name))
+		if test.statusCode == http.StatusNotModified {
+			assert.Empty(rec.Body.String(), fmt.Sprintf("%s: Not modified responses should have no body", test.name))
+		}
+	}
+}
+
 func TestDeleteHandler(t *testing.T) {
-	qc := notification.NewQueueClient("/dev/null")
+	qc := newTestQueueClient()
 	assert := assert.New(t)
 	tests := []struct {
 		name       string
@@ -261,7 +912,7 @@ func TestDeleteHandler(t *testing.T) {
 
 	for _, test := range tests {
 		r := mux.NewRouter()
-		handler := NewUsersHandler(test.sqlClient, qc)
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
 		handler.RegisterHandlers(r)
 		rec := httptest.NewRecorder()
 		r.ServeHTTP(rec, newRequest("DELETE", test.reqURL, nil))
@@ -270,6 +921,242 @@ func TestDeleteHandler(t *testing.T) {
 	}
 }
 
+func TestRestoreHandler(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		sqlClient  *mockSQLClient
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Can restore deleted user",
+			sqlClient:  &mockSQLClient{persistence.RESTORED, nil},
+			statusCode: http.StatusOK,
+			body:       fmt.Sprintf(msgTemplate + "\n", "restored user: 3f685356-02a0-3c55-8b8d-c8bac4b79426"),
+		},
+		{
+			name:       "Cannot restore user who is not deleted",
+			sqlClient:  &mockSQLClient{persistence.NOT_FOUND, nil},
+			statusCode: http.StatusNotFound,
+			body:       fmt.Sprintf(msgTemplate + "\n", "no deleted user exists with ID: 3f685356-02a0-3c55-8b8d-c8bac4b79426"),
+		},
+		{
+			name:       "Error when unable to restore user in db",
+			sqlClient:  &mockSQLClient{persistence.BACKEND_ERROR, nil},
+			statusCode: http.StatusInternalServerError,
+			body:       fmt.Sprintf(msgTemplate + "\n", "could not process restore request"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("POST", "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/restore", nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	timestamp := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	entries := []persistence.AuditEntry{
+		{UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", Action: "update", Actor: "anonymous", RequestID: "req-2", SourceIP: "10.0.0.1", Changes: []persistence.FieldChange{{Field: "password", From: "[REDACTED]", To: "[REDACTED]"}}, Timestamp: timestamp},
+		{UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426", Action: "create", Actor: "anonymous", RequestID: "req-1", SourceIP: "10.0.0.1", Timestamp: timestamp},
+	}
+	tests := []struct {
+		name       string
+		sqlClient  *mockHistoryClient
+		reqURL     string
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Can page through user history",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.OK, nil}, entries},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history?limit=1&offset=1",
+			statusCode: http.StatusOK,
+			body:       `{"entries":[{"userID":"3f685356-02a0-3c55-8b8d-c8bac4b79426","action":"create","actor":"anonymous","requestID":"req-1","sourceIP":"10.0.0.1","timestamp":"2020-04-01T12:00:00Z"}],"total":2,"limit":1,"offset":1}` + "\n",
+		},
+		{
+			name:       "History redacts passwords",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.OK, nil}, entries[:1]},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history",
+			statusCode: http.StatusOK,
+			body:       `{"entries":[{"userID":"3f685356-02a0-3c55-8b8d-c8bac4b79426","action":"update","actor":"anonymous","requestID":"req-2","sourceIP":"10.0.0.1","changes":[{"field":"password","from":"[REDACTED]","to":"[REDACTED]"}],"timestamp":"2020-04-01T12:00:00Z"}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			name:       "Invalid limit is rejected",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.OK, nil}, entries},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history?limit=101",
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "limit must be between 1 and 100"),
+		},
+		{
+			name:       "Invalid offset is rejected",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.OK, nil}, entries},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history?offset=-1",
+			statusCode: http.StatusBadRequest,
+			body:       fmt.Sprintf(msgTemplate + "\n", "offset must not be negative"),
+		},
+		{
+			name:       "No history for unknown user",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.NOT_FOUND, nil}, nil},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history",
+			statusCode: http.StatusNotFound,
+			body:       fmt.Sprintf(msgTemplate + "\n", "no history exists for user: 3f685356-02a0-3c55-8b8d-c8bac4b79426"),
+		},
+		{
+			name:       "Error when unable to retrieve history from db",
+			sqlClient:  &mockHistoryClient{mockSQLClient{persistence.BACKEND_ERROR, nil}, nil},
+			reqURL:     "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426/history",
+			statusCode: http.StatusInternalServerError,
+			body:       fmt.Sprintf(msgTemplate + "\n", "could not process history request"),
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		handler := NewUsersHandler(test.sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestCallerFromRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newRequest("DELETE", "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", nil)
+	req.RemoteAddr = "192.168.1.5:51234"
+	req.Header.Set("X-Request-ID", "req-123")
+	rec := httptest.NewRecorder()
+	caller := callerFromRequest(rec, req)
+	assert.Equal(persistence.Caller{Actor: "anonymous", RequestID: "req-123", SourceIP: "192.168.1.5"}, caller)
+	assert.Equal("req-123", rec.Header().Get("X-Request-ID"), "test failed: request ID should be echoed")
+
+	req = newRequest("DELETE", "/users/3f685356-02a0-3c55-8b8d-c8bac4b79426", nil)
+	req.RemoteAddr = "10.0.0.2:443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	rec = httptest.NewRecorder()
+	caller = callerFromRequest(rec, req)
+	assert.Equal("203.0.113.7", caller.SourceIP, "test failed: source IP should be the forwarded client")
+	assert.NotEmpty(caller.RequestID, "test failed: request ID should be generated")
+	assert.Equal(caller.RequestID, rec.Header().Get("X-Request-ID"))
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	events := notification.NewEventStream(10)
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, []persistence.UserRecord{johnSmithUser}}, newTestQueueClient(), events, Config{})
+
+	purged, err := handler.PurgeDeletedUsers(time.Hour)
+	assert.NoError(t, err, "test failed: could not purge users")
+	assert.Equal(t, 1, purged)
+	published, _, cancel := events.Subscribe(0)
+	defer cancel()
+	assert.Equal(t, []notification.Event{{ID: 1, Message: persistence.Message{Type: "USER_PURGED", UserID: johnSmithUser.UserID, TenantID: persistence.DefaultTenant}}}, published)
+
+	handler = NewUsersHandler(&mockSQLClient{persistence.BACKEND_ERROR, nil}, newTestQueueClient(), events, Config{})
+	_, err = handler.PurgeDeletedUsers(time.Hour)
+	assert.Error(t, err, "test failed: purge should fail when db is unavailable")
+}
+
+func TestStreamEventsHandler(t *testing.T) {
+	assert := assert.New(t)
+	events := notification.NewEventStream(10)
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, nil}, newTestQueueClient(), events, Config{})
+	handler.RegisterHandlers(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "1", TenantID: persistence.DefaultTenant})
+	events.Publish(persistence.Message{Type: "NICKNAME_CHANGED", UserID: "1", Nickname: "Smithy", TenantID: persistence.DefaultTenant})
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "2", TenantID: persistence.DefaultTenant})
+
+	req := newRequest("GET", server.URL+"/users/events?type=USER_CREATED", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err, "test failed: could not connect to event stream")
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadString('\n')
+		assert.NoError(err, "test failed: could not read event stream")
+		lines = append(lines, line)
+	}
+	assert.Equal([]string{
+		"id: 3\n",
+		"event: USER_CREATED\n",
+		`data: {"type":"USER_CREATED","userID":"2","tenantID":"default"}` + "\n",
+		"\n",
+	}, lines, "test failed: should only replay matching events after Last-Event-ID")
+
+	bad := httptest.NewRecorder()
+	badReq := newRequest("GET", "/users/events", nil)
+	badReq.Header.Set("Last-Event-ID", "abc")
+	r.ServeHTTP(bad, badReq)
+	assert.Equal(http.StatusBadRequest, bad.Code)
+	assert.Equal(fmt.Sprintf(msgTemplate + "\n", "Last-Event-ID must be a numeric event ID"), bad.Body.String())
+}
+
+func TestStreamEventsOutlivesWriteTimeout(t *testing.T) {
+	assert := assert.New(t)
+	interval := heartbeatInterval
+	heartbeatInterval = 100 * time.Millisecond
+	defer func() { heartbeatInterval = interval }()
+
+	events := notification.NewEventStream(10)
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, nil}, newTestQueueClient(), events, Config{})
+	handler.RegisterHandlers(r)
+	server := httptest.NewUnstartedServer(r)
+	server.Config.WriteTimeout = 250 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.DefaultClient.Do(newRequest("GET", server.URL + "/users/events", nil))
+	assert.NoError(err, "test failed: could not connect to event stream")
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	deadline := time.Now().Add(4 * server.Config.WriteTimeout)
+	for time.Now().Before(deadline) {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(err, "test failed: stream should stay open past the server write timeout") {
+			return
+		}
+		assert.Equal(": keep-alive\n", line)
+		reader.ReadString('\n')
+	}
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "1", TenantID: persistence.DefaultTenant})
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(err, "test failed: events should be streamed past the server write timeout") || line == "id: 1\n" {
+			return
+		}
+	}
+}
+
+func newTestQueueClient() notification.QueueClient {
+	serializer, err := notification.NewSerializer("json")
+	if err != nil {
+		panic(err)
+	}
+	return notification.NewQueueClient("/dev/null", serializer, notification.DefaultRetryPolicy(), nil)
+}
+
 func newRequest(method, url string, body io.Reader) *http.Request {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -0,0 +1,134 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit = 100
+	//anonymousActor is recorded as the actor of changes when authentication is disabled
+	anonymousActor = "anonymous"
+)
+
+//HistoryPage models a page of a user's history
+// swagger:model HistoryPage
+type HistoryPage struct {
+	Entries []persistence.AuditEntry `json:"entries"`
+	Total int `json:"total"`
+	Limit int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+//callerFromRequest identifies who made the request for the audit trail, the authenticated principal's subject if
+//there is one, and the tenant whose users they are changing. The request ID is taken from the X-Request-ID header,
+//or generated if missing, and echoed in the response so callers can correlate changes
+func callerFromRequest(writer http.ResponseWriter, request *http.Request) persistence.Caller {
+	requestID := request.Header.Get("X-Request-ID")
+	if requestID == "" || len(requestID) > 64 {
+		requestID = uuid.New().String()
+	}
+	writer.Header().Set("X-Request-ID", requestID)
+	actor := anonymousActor
+	if principal, ok := PrincipalFromContext(request.Context()); ok {
+		actor = principal.Subject
+	}
+	return persistence.Caller{
+		Actor: actor,
+		RequestID: requestID,
+		SourceIP: sourceIP(request),
+		TenantID: requestTenant(request),
+	}
+}
+
+//sourceIP returns the address of the client which made the request, preferring the first
+//X-Forwarded-For entry added by any proxies in front of the service
+func sourceIP(request *http.Request) string {
+	if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// swagger:operation GET /users/{userID}/history users getUserHistory
+// ---
+// summary: Return user history
+// description: Returns the changes made to the user, most recent first
+// parameters:
+// - name: userID
+//   in: path
+//   description: users uuid
+//   type: string
+//   required: true
+// - name: limit
+//   in: query
+//   description: maximum number of entries to return, defaults to 20 and at most 100
+//   type: integer
+//   required: false
+// - name: offset
+//   in: query
+//   description: number of entries to skip
+//   type: integer
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   404: notFound
+//   500: internal
+func (h *UsersHandler) GetHistory(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	userID := mux.Vars(request)["userID"]
+
+	params := request.URL.Query()
+	limit, err := intParam(params.Get("limit"), defaultHistoryLimit)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		log.WithField("UserID", userID).Infof("invalid limit param: %s", params.Get("limit"))
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)))
+		return
+	}
+	offset, err := intParam(params.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		log.WithField("UserID", userID).Infof("invalid offset param: %s", params.Get("offset"))
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "offset must not be negative"))
+		return
+	}
+
+	entries, total, status := h.sqlClient.RetrieveAuditEntries(requestTenant(request), userID, limit, offset)
+	switch status {
+	case persistence.OK:
+		writer.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(writer)
+		if err := enc.Encode(HistoryPage{Entries: entries, Total: total, Limit: limit, Offset: offset}); err != nil {
+			log.WithError(err).Error("could not encode returned payload")
+		}
+	case persistence.NOT_FOUND:
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "no history exists for user: " + userID))
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process history request"))
+	}
+}
+
+//intParam parses an optional integer query param, returning the default if it is missing
+func intParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
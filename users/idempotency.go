@@ -0,0 +1,152 @@
+package users
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+//recordingWriter passes a response through to the client while keeping a copy of it
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header http.Header
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+//idempotent lets clients safely retry requests by sending an Idempotency-Key header. The response to the first
+//request with a key is stored for the configured TTL and replayed for retries, while reusing a key for a different
+//request is rejected. Keys are scoped to the tenant and the principal making the request. Requests which fail with a
+//server error or panic are not stored so they can be retried
+func (h *UsersHandler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get("Idempotency-Key")
+		if key == "" || h.config.IdempotencyKeyTTL <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeMessage(writer, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d printable ASCII characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			log.WithError(err).Error("could not read request body")
+			writeMessage(writer, http.StatusBadRequest, "could not read request body")
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		principal, _ := PrincipalFromContext(request.Context())
+		reservation := persistence.IdempotencyRecord{
+			TenantID: requestTenant(request),
+			Subject: principal.Subject,
+			Key: key,
+			Fingerprint: requestFingerprint(request, body),
+			ExpiresAt: time.Now().UTC().Add(h.config.IdempotencyKeyTTL),
+		}
+		existing, status := h.sqlClient.ReserveIdempotencyKey(reservation)
+		switch status {
+		case persistence.CREATED:
+		case persistence.ALREADY_EXISTS:
+			switch {
+			case existing.Fingerprint != reservation.Fingerprint:
+				log.Infof("Idempotency-Key %s reused for a different request", key)
+				writeMessage(writer, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request")
+			case !existing.Completed:
+				writeMessage(writer, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+			default:
+				replay(writer, existing)
+			}
+			return
+		default:
+			writeMessage(writer, http.StatusInternalServerError, "could not process Idempotency-Key")
+			return
+		}
+
+		defer func() {
+			//a request whose handler panicked did not complete, so its key is released before the panic carries on
+			if err := recover(); err != nil {
+				h.sqlClient.ReleaseIdempotencyKey(reservation)
+				panic(err)
+			}
+		}()
+		recorder := &recordingWriter{ResponseWriter: writer}
+		next.ServeHTTP(recorder, request)
+
+		if recorder.statusCode >= http.StatusInternalServerError {
+			h.sqlClient.ReleaseIdempotencyKey(reservation)
+			return
+		}
+		reservation.Completed = true
+		reservation.StatusCode = recorder.statusCode
+		reservation.Header = recorder.header
+		reservation.Body = recorder.body.Bytes()
+		if h.sqlClient.CompleteIdempotencyKey(reservation) != persistence.UPDATED {
+			//release the key so that a retry is processed rather than rejected as still in progress
+			h.sqlClient.ReleaseIdempotencyKey(reservation)
+		}
+	})
+}
+
+//replay writes the stored response to an earlier request with the same Idempotency-Key
+func replay(writer http.ResponseWriter, record persistence.IdempotencyRecord) {
+	//the original request ID is kept so the replay can be correlated with the change it made
+	for name, values := range record.Header {
+		writer.Header()[name] = values
+	}
+	writer.Header().Set("Idempotent-Replayed", "true")
+	writer.WriteHeader(record.StatusCode)
+	writer.Write(record.Body)
+}
+
+func writeMessage(writer http.ResponseWriter, statusCode int, msg string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, msg))
+}
+
+//requestFingerprint identifies a request by its method, path and body
+func requestFingerprint(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", request.Method, request.URL.Path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
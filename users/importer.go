@@ -0,0 +1,269 @@
+package users
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//importActor is recorded in the audit trail as the actor of users added by imports
+const importActor = "import"
+
+//maxImportLineSize is the longest ndjson line which can be imported
+const maxImportLineSize = 1024 * 1024
+
+//ImportOptions configures an import of users from a file
+type ImportOptions struct {
+	//Format of the file, csv with a header row naming the user fields, or ndjson with a user per line
+	Format string
+	BatchSize int
+	//StartLine is the first line of the file to import, earlier lines are skipped so an interrupted import can be resumed
+	StartLine int
+	//DryRun validates the file without adding any users
+	DryRun bool
+	//TenantID is the tenant the users are added to
+	TenantID string
+}
+
+//ImportResult summarises an import
+type ImportResult struct {
+	Imported int
+	Rejected int
+	//LastLine is the last line of the file which was processed, an interrupted import resumes from the line after it
+	LastLine int
+}
+
+//importRow is a user read from a line of the file being imported, or the reason the line was rejected
+type importRow struct {
+	line int
+	user persistence.UserRecord
+	err error
+}
+
+//userReader reads users from an import file, returning io.EOF once every row has been read.
+//Rows which cannot be read are returned with an error while errors reading the file itself are returned as such
+type userReader interface {
+	next() (importRow, error)
+}
+
+//Importer adds users to the DB from HR exports and other files
+type Importer struct {
+	sqlClient persistence.Clienter
+	queueClient publisher
+}
+
+//NewImporter returns an importer writing to the sql client and publishing to the queue client
+func NewImporter(sqlClient persistence.Clienter, queueClient publisher) Importer {
+	return Importer{
+		sqlClient: sqlClient,
+		queueClient: queueClient,
+	}
+}
+
+//Run streams users from the file, validating them and generating their IDs as AddUser does, and adds them in
+//batches. Rejected rows are written to rejects as csv with their line number and the reason. A USERS_CREATED message
+//is published for each batch. If a batch cannot be written the import stops, and can be resumed from the line after
+//the returned LastLine
+func (im Importer) Run(file io.Reader, rejects io.Writer, opts ImportOptions) (ImportResult, error) {
+	if opts.BatchSize < 1 {
+		return ImportResult{}, fmt.Errorf("batch size must be positive")
+	}
+	reader, err := newUserReader(opts.Format, file)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	caller := persistence.Caller{Actor: importActor, RequestID: uuid.New().String(), TenantID: opts.TenantID}
+	log.Infof("importing users with request ID %s", caller.RequestID)
+	rejectWriter := csv.NewWriter(rejects)
+	result := ImportResult{LastLine: opts.StartLine - 1}
+
+	//rows are held until the batch they were read with is written, so that rejected rows are reported in order and
+	//only once when an interrupted import is resumed
+	var rows []importRow
+	var valid int
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		defer func() { rows, valid = rows[:0], 0 }()
+		if !opts.DryRun && valid > 0 {
+			if err := im.addUsers(caller, rows); err != nil {
+				return err
+			}
+		}
+		for _, row := range rows {
+			if row.err == nil {
+				result.Imported++
+				continue
+			}
+			result.Rejected++
+			if err := rejectWriter.Write([]string{strconv.Itoa(row.line), row.user.EmailAddress, row.err.Error()}); err != nil {
+				return err
+			}
+		}
+		result.LastLine = rows[len(rows)-1].line
+		rejectWriter.Flush()
+		return rejectWriter.Error()
+	}
+
+	for {
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		if row.line < opts.StartLine {
+			continue
+		}
+		if row.err == nil {
+			row.err = newUser(&row.user)
+		}
+		if rows = append(rows, row); row.err == nil {
+			valid++
+		}
+		if valid == opts.BatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
+
+//addUsers adds the valid rows to the db, rejecting those whose users already exist, and publishes the users created
+func (im Importer) addUsers(caller persistence.Caller, rows []importRow) error {
+	var records []persistence.UserRecord
+	var indexes []int
+	for i, row := range rows {
+		if row.err == nil {
+			records = append(records, row.user)
+			indexes = append(indexes, i)
+		}
+	}
+	statuses := im.sqlClient.CreateRecords(caller, records, false)
+	var created []string
+	var failed bool
+	for i, status := range statuses {
+		row := &rows[indexes[i]]
+		switch status {
+		case persistence.CREATED:
+			created = append(created, row.user.UserID)
+		case persistence.ALREADY_EXISTS:
+			row.err = fmt.Errorf("user with email: %s already exists in db!", row.user.EmailAddress)
+		default:
+			failed = true
+		}
+	}
+	if len(created) > 0 {
+		err := im.queueClient.AddMessageToQueue(persistence.Message{
+			Type: "USERS_CREATED",
+			UserIDs: created,
+			TenantID: caller.TenantID,
+		})
+		if err != nil {
+			log.WithError(err).Error("could not publish imported users")
+		}
+	}
+	//the users which were created are published before the import is stopped
+	if failed {
+		return fmt.Errorf("could not add users from lines %d to %d to db", rows[0].line, rows[len(rows)-1].line)
+	}
+	return nil
+}
+
+func newUserReader(format string, file io.Reader) (userReader, error) {
+	switch format {
+	case "csv":
+		return newCSVUserReader(file)
+	case "ndjson":
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+		return &ndjsonUserReader{scanner: scanner}, nil
+	default:
+		return nil, fmt.Errorf("unsupported import format %s; valid formats are [csv, ndjson]", format)
+	}
+}
+
+//csvUserReader reads users from csv with a header row naming the user fields, as in the json model.
+//Columns which are not user fields are ignored
+type csvUserReader struct {
+	reader *csv.Reader
+	columns map[string]int
+}
+
+func newCSVUserReader(file io.Reader) (*csvUserReader, error) {
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("csv file is empty")
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read csv header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	return &csvUserReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvUserReader) next() (importRow, error) {
+	fields, err := r.reader.Read()
+	if err == io.EOF {
+		return importRow{}, err
+	}
+	if parseErr, ok := err.(*csv.ParseError); ok {
+		return importRow{line: parseErr.StartLine, err: parseErr.Err}, nil
+	} else if err != nil {
+		return importRow{}, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	return importRow{line: line, user: persistence.UserRecord{
+		FirstName: field("firstName"),
+		LastName: field("lastName"),
+		EmailAddress: field("emailAddress"),
+		Password: field("password"),
+		NickName: field("nickname"),
+		Country: field("country"),
+	}}, nil
+}
+
+//ndjsonUserReader reads users from newline delimited json, skipping blank lines
+type ndjsonUserReader struct {
+	scanner *bufio.Scanner
+	line int
+}
+
+func (r *ndjsonUserReader) next() (importRow, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := strings.TrimSpace(r.scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := importRow{line: r.line}
+		if err := json.Unmarshal([]byte(text), &row.user); err != nil {
+			row.err = fmt.Errorf("could not decode user: %v", err)
+		}
+		return row, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return importRow{}, fmt.Errorf("could not read line %d: %v", r.line+1, err)
+	}
+	return importRow{}, io.EOF
+}
@@ -0,0 +1,101 @@
+package users
+
+import (
+	"bytes"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var importCSV = `firstName,lastName,emailAddress,password,nickname,country,department
+John,Smith,john.smith@gmail.com,password1,smithy12345,UK,Sales
+Jane,Doe,jane.doe@gmail.com,password2,GIJane,USA,Legal
+Cleo,Patra,,password3,Cle0,Egypt,Legal
+Julius,Caesar,caesar@gmail.com,password4
+James,Bond,j.bond@mi6.co.uk,password007,BondJamesBond,UK,"Double ""O"" section"
+John,Smith,john.smith@gmail.com,password1,smithy12345,UK,Sales
+`
+
+var importNDJSON = `{"firstName": "John", "lastName": "Smith", "emailAddress": "john.smith@gmail.com", "password": "password1", "nickname": "smithy12345", "country": "UK"}
+
+{"firstName": "Jane", "lastName": "Doe", "emailAddress": "jane.doe@gmail.com"
+{"firstName": "Jane", "lastName": "Doe", "emailAddress": "jane.doe@gmail.com", "password": "password2", "nickname": "GIJane", "country": "USA"}
+`
+
+func TestImporter_CSV(t *testing.T) {
+	qc := &recordingPublisher{}
+	sqlClient := &mockImportClient{emails: map[string]bool{"jane.doe@gmail.com": true}}
+	var rejects bytes.Buffer
+	result, err := NewImporter(sqlClient, qc).Run(strings.NewReader(importCSV), &rejects, ImportOptions{Format: "csv", BatchSize: 2, StartLine: 1})
+	assert.NoError(t, err, "test failed: import should complete")
+	assert.Equal(t, ImportResult{Imported: 2, Rejected: 4, LastLine: 7}, result)
+	assert.Equal(t, `3,jane.doe@gmail.com,user with email: jane.doe@gmail.com already exists in db!
+4,,"all user fields are required, missing [emailAddress]"
+5,,wrong number of fields
+7,john.smith@gmail.com,user with email: john.smith@gmail.com already exists in db!
+`, rejects.String())
+
+	assert.Len(t, sqlClient.batches, 2)
+	assert.Equal(t, persistence.UserRecord{
+		UserID: "3f685356-02a0-3c55-8b8d-c8bac4b79426",
+		FirstName: "John",
+		LastName: "Smith",
+		EmailAddress: "john.smith@gmail.com",
+		Password: "password1",
+		NickName: "smithy12345",
+		Country: "UK",
+	}, sqlClient.batches[0][0], "test failed: users should be given the same ID as AddUser gives them")
+	assert.Equal(t, []persistence.Message{
+		{Type: "USERS_CREATED", UserIDs: []string{"3f685356-02a0-3c55-8b8d-c8bac4b79426"}},
+		{Type: "USERS_CREATED", UserIDs: []string{sqlClient.batches[1][0].UserID}},
+	}, qc.published)
+}
+
+func TestImporter_NDJSON(t *testing.T) {
+	qc := &recordingPublisher{}
+	sqlClient := &mockImportClient{emails: map[string]bool{}}
+	var rejects bytes.Buffer
+	result, err := NewImporter(sqlClient, qc).Run(strings.NewReader(importNDJSON), &rejects, ImportOptions{Format: "ndjson", BatchSize: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 2, Rejected: 1, LastLine: 4}, result)
+	assert.Equal(t, `3,,could not decode user: unexpected end of JSON input`+"\n", rejects.String())
+}
+
+func TestImporter_DryRunAddsNothing(t *testing.T) {
+	qc := &recordingPublisher{}
+	sqlClient := &mockImportClient{emails: map[string]bool{}}
+	var rejects bytes.Buffer
+	result, err := NewImporter(sqlClient, qc).Run(strings.NewReader(importCSV), &rejects, ImportOptions{Format: "csv", BatchSize: 2, DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 4, Rejected: 2, LastLine: 7}, result)
+	assert.Empty(t, sqlClient.batches)
+	assert.Empty(t, qc.published)
+}
+
+func TestImporter_ResumesFromLine(t *testing.T) {
+	sqlClient := &mockImportClient{emails: map[string]bool{}, failBatch: 2}
+	importer := NewImporter(sqlClient, &recordingPublisher{})
+	var rejects bytes.Buffer
+	result, err := importer.Run(strings.NewReader(importCSV), &rejects, ImportOptions{Format: "csv", BatchSize: 2})
+	assert.Error(t, err, "test failed: import should stop when a batch cannot be written")
+	assert.Equal(t, 3, result.LastLine, "test failed: should resume after the last batch written")
+	assert.Empty(t, rejects.String(), "test failed: rows read with the failed batch should not be rejected until it is retried")
+
+	sqlClient.failBatch = 0
+	result, err = importer.Run(strings.NewReader(importCSV), &rejects, ImportOptions{Format: "csv", BatchSize: 2, StartLine: result.LastLine + 1})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 1, Rejected: 3, LastLine: 7}, result)
+	assert.Equal(t, 3, strings.Count(rejects.String(), "\n"), "test failed: each row should be rejected once")
+	assert.Equal(t, "j.bond@mi6.co.uk", sqlClient.batches[len(sqlClient.batches)-1][0].EmailAddress)
+}
+
+func TestImporter_InvalidOptions(t *testing.T) {
+	importer := NewImporter(&mockImportClient{}, &recordingPublisher{})
+	_, err := importer.Run(strings.NewReader(importCSV), &bytes.Buffer{}, ImportOptions{Format: "xlsx", BatchSize: 2})
+	assert.Error(t, err, "test failed: unknown formats should be rejected")
+	_, err = importer.Run(strings.NewReader(importCSV), &bytes.Buffer{}, ImportOptions{Format: "csv"})
+	assert.Error(t, err, "test failed: batch size should be positive")
+	_, err = importer.Run(strings.NewReader(""), &bytes.Buffer{}, ImportOptions{Format: "csv", BatchSize: 2})
+	assert.Error(t, err, "test failed: csv without a header should be rejected")
+}
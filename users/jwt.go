@@ -0,0 +1,281 @@
+package users
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//jwtLeeway allows for clock skew between the service and token issuers when checking when tokens are valid
+const jwtLeeway = 30 * time.Second
+
+//jsonWebKey is a key from a JWKS which verifies tokens signed with its alg
+type jsonWebKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+//JWTAuthenticator authenticates Bearer JSON Web Tokens signed with HS256, RS256 or ES256 by a key of its key set
+type JWTAuthenticator struct {
+	keys []jsonWebKey
+	issuer string
+	audience string
+	now func() time.Time
+}
+
+//NewJWTAuthenticator returns an authenticator verifying tokens with the keys of the JWKS file. Tokens must be issued
+//by the issuer and for the audience unless they are empty
+func NewJWTAuthenticator(jwksFile, issuer, audience string) (*JWTAuthenticator, error) {
+	data, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read JWKS file: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTAuthenticator{keys: keys, issuer: issuer, audience: audience, now: time.Now}, nil
+}
+
+//parseJWKS parses the signing keys of a JSON Web Key Set. Keys for other uses or algorithms are skipped, but the set
+//must contain at least one key able to verify tokens
+func parseJWKS(data []byte) ([]jsonWebKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			K string `json:"k"`
+			N string `json:"n"`
+			E string `json:"e"`
+			Crv string `json:"crv"`
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("could not parse JWKS: %v", err)
+	}
+
+	var keys []jsonWebKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key := jsonWebKey{kid: jwk.Kid, alg: jwk.Alg}
+		var err error
+		switch jwk.Kty {
+		case "oct":
+			var secret []byte
+			if secret, err = base64.RawURLEncoding.DecodeString(jwk.K); err == nil && len(secret) == 0 {
+				err = errors.New("missing key parameter")
+			}
+			key.key = secret
+			if key.alg == "" {
+				key.alg = "HS256"
+			}
+		case "RSA":
+			var n, e *big.Int
+			if n, err = decodeBigInt(jwk.N); err == nil {
+				e, err = decodeBigInt(jwk.E)
+			}
+			if err == nil {
+				key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+			if key.alg == "" {
+				key.alg = "RS256"
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				log.Warnf("skipping JWKS key %s on unsupported curve %s", jwk.Kid, jwk.Crv)
+				continue
+			}
+			var x, y *big.Int
+			if x, err = decodeBigInt(jwk.X); err == nil {
+				y, err = decodeBigInt(jwk.Y)
+			}
+			if err == nil {
+				key.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+			}
+			if key.alg == "" {
+				key.alg = "ES256"
+			}
+		default:
+			log.Warnf("skipping JWKS key %s of unsupported type %s", jwk.Kid, jwk.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %s is invalid: %v", jwk.Kid, err)
+		}
+		if !supportedAlg(key.alg, jwk.Kty) {
+			log.Warnf("skipping JWKS key %s for unsupported algorithm %s", jwk.Kid, key.alg)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no keys able to verify HS256, RS256 or ES256 tokens")
+	}
+	return keys, nil
+}
+
+//supportedAlg returns whether tokens signed with the algorithm are verified by keys of the type
+func supportedAlg(alg, kty string) bool {
+	return (alg == "HS256" && kty == "oct") || (alg == "RS256" && kty == "RSA") || (alg == "ES256" && kty == "EC")
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+//Scheme returns Bearer, the scheme JWTs are sent with
+func (a *JWTAuthenticator) Scheme() string {
+	return "Bearer"
+}
+
+//Authenticate verifies the token's signature and that it is valid now, returning the principal of its subject with
+//the roles of its roles claim, an array or space separated string, belonging to the tenant of its tenant claim
+func (a *JWTAuthenticator) Authenticate(token string) (Principal, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return Principal{}, errors.New("token is malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims map[string]interface{}
+	if decodeSegment(segments[0], &header) != nil || decodeSegment(segments[1], &claims) != nil {
+		return Principal{}, errors.New("token is malformed")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return Principal{}, errors.New("token is malformed")
+	}
+	if header.Alg != "HS256" && header.Alg != "RS256" && header.Alg != "ES256" {
+		return Principal{}, fmt.Errorf("token algorithm %q is not supported", header.Alg)
+	}
+	if !a.verify(header.Alg, header.Kid, segments[0] + "." + segments[1], signature) {
+		return Principal{}, errors.New("token signature is invalid")
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return Principal{}, err
+	}
+
+	principal := Principal{Subject: claims["sub"].(string), Claims: claims}
+	if scope, ok := claims["scope"].(string); ok {
+		principal.Scopes = strings.Fields(scope)
+	}
+	if tenant, ok := claims["tenant"].(string); ok {
+		principal.Tenant = tenant
+	}
+	switch roles := claims["roles"].(type) {
+	case string:
+		principal.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, role)
+			}
+		}
+	}
+	return principal, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//verify returns whether a key for the algorithm, with the kid if the token names one, signed the token
+func (a *JWTAuthenticator) verify(alg, kid, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	for _, key := range a.keys {
+		if key.alg != alg || (kid != "" && key.kid != kid) {
+			continue
+		}
+		switch k := key.key.(type) {
+		case []byte:
+			mac := hmac.New(sha256.New, k)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			//ES256 signatures are the 32 byte r and s values concatenated
+			if len(signature) == 64 && ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//validateClaims checks the token has a subject and expiry, is valid now and was issued by the issuer for the
+//audience if they are configured
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	if sub, ok := claims["sub"].(string); !ok || sub == "" {
+		return errors.New("token has no subject")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return errors.New("token issuer is not trusted")
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return fmt.Errorf("token audience does not include %s", a.audience)
+	}
+	return nil
+}
+
+//hasAudience returns whether the aud claim, a string or array of strings, includes the audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
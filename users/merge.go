@@ -0,0 +1,152 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+//MergeRequest is the body of a request to merge a user into another
+// swagger:model MergeRequest
+type MergeRequest struct {
+	//SourceUserID is the user merged into the surviving user, who is deleted
+	SourceUserID string `json:"sourceUserID"`
+	//Fields maps fields of the surviving user to the strategy resolving them, target to keep the surviving user's
+	//value, source to take the merged user's or nonEmpty to take the merged user's only if the surviving user's is
+	//empty. Fields which are not listed keep the surviving user's value
+	Fields map[string]persistence.MergeStrategy `json:"fields"`
+}
+
+// swagger:operation POST /users/{userID}/merge users mergeUser
+// ---
+// summary: Merge users
+// description: Atomically merges the source user into the user, resolving each field with its strategy, soft
+//   deleting the source and redirecting lookups of the source's ID to the user. Publishes a USERS_MERGED message
+// parameters:
+// - name: userID
+//   in: path
+//   description: uuid of the surviving user
+//   type: string
+//   required: true
+// - name: sourceUserID
+//   in: body
+//   description: uuid of the user merged into the surviving user
+//   type: string
+//   required: true
+// - name: fields
+//   in: body
+//   description: strategies resolving the surviving user's fields, target, source or nonEmpty, by field name
+//   type: object
+//   required: false
+// - name: If-Match
+//   in: header
+//   description: ETag of the version of the surviving user
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   404: notFound
+//   412: preconditionFailed
+//   422: unprocessable
+//   428: preconditionRequired
+//   500: internal
+func (h *UsersHandler) MergeUser(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	userID := mux.Vars(request)["userID"]
+
+	var merge MergeRequest
+	if err := json.NewDecoder(request.Body).Decode(&merge); err != nil {
+		log.WithError(err).Error("could not decode request body")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not decode request body"))
+		return
+	}
+	strategies, err := mergeStrategies(userID, merge)
+	if err != nil {
+		log.WithError(err).WithField("UserID", userID).Info("invalid merge request")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	var changed []string
+	for column, strategy := range strategies {
+		if strategy != persistence.KEEP_TARGET {
+			changed = append(changed, column)
+		}
+	}
+	if !checkFields(writer, request, changed) {
+		return
+	}
+	expectedVersion, ok := h.expectedVersion(writer, request)
+	if !ok {
+		return
+	}
+
+	survivor, status := h.sqlClient.MergeRecords(callerFromRequest(writer, request), userID, merge.SourceUserID, strategies, expectedVersion)
+	switch {
+	case status == persistence.MERGED:
+		h.publish(persistence.Message{
+			Type: "USERS_MERGED",
+			UserID: userID,
+			UserIDs: []string{merge.SourceUserID},
+			TenantID: requestTenant(request),
+		})
+		writeValidators(writer, survivor)
+		writer.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(writer).Encode(survivor); err != nil {
+			log.WithError(err).WithField("UserID", userID).Error("could not encode returned payload")
+		}
+	case status == persistence.NOT_FOUND && survivor.UserID == "":
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "no user exists with ID: " + userID))
+	case status == persistence.NOT_FOUND:
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "no user exists with sourceUserID: " + merge.SourceUserID))
+	case status == persistence.VERSION_MISMATCH:
+		writeVersionMismatch(writer, userID)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process merge request"))
+	}
+}
+
+//mergeStrategies validates the merge request, returning its strategies keyed by db column
+func mergeStrategies(userID string, merge MergeRequest) (map[string]persistence.MergeStrategy, error) {
+	if merge.SourceUserID == "" {
+		return nil, fmt.Errorf("sourceUserID is required")
+	}
+	if merge.SourceUserID == userID {
+		return nil, fmt.Errorf("a user cannot be merged into themselves")
+	}
+	strategies := make(map[string]persistence.MergeStrategy)
+	for name, strategy := range merge.Fields {
+		field, ok := userFields[name]
+		if !ok || !field.writable {
+			return nil, fmt.Errorf("cannot merge %s; mergeable fields are [firstName, lastName, password, nickname, country]", name)
+		}
+		switch strategy {
+		case persistence.KEEP_TARGET, persistence.KEEP_SOURCE, persistence.KEEP_NON_EMPTY:
+			strategies[field.column] = strategy
+		default:
+			return nil, fmt.Errorf("strategy for %s must be one of [target, source, nonEmpty]", name)
+		}
+	}
+	return strategies, nil
+}
+
+//redirectAlias redirects a request for a user who was merged into another to the user they were merged into,
+//returning false if the user was not merged
+func (h *UsersHandler) redirectAlias(writer http.ResponseWriter, request *http.Request, userID string) bool {
+	survivor, status := h.sqlClient.RetrieveAlias(requestTenant(request), userID)
+	if status != persistence.OK {
+		return false
+	}
+	log.WithField("UserID", userID).Infof("redirecting to user %s they were merged into", survivor)
+	writer.Header().Set("Location", "/users/" + survivor)
+	writer.WriteHeader(http.StatusMovedPermanently)
+	return true
+}
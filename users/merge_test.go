@@ -0,0 +1,177 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMergeUser(t *testing.T) {
+	assert := assert.New(t)
+	survivor := persistence.UserRecord{UserID: "1", FirstName: "Jon", LastName: "Smith", EmailAddress: "jon@example.com", NickName: "johnny", Country: "UK", Version: 4}
+	tests := []struct {
+		name string
+		status persistence.Status
+		users []persistence.UserRecord
+		reqURL string
+		reqBody string
+		ifMatch string
+		statusCode int
+		body string
+		strategies map[string]persistence.MergeStrategy
+		events []persistence.Message
+	}{
+		{
+			name: "Merges users",
+			status: persistence.MERGED,
+			users: []persistence.UserRecord{survivor},
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2", "fields": {"nickname": "source", "country": "nonEmpty", "firstName": "target"}}`,
+			ifMatch: `"3"`,
+			statusCode: http.StatusOK,
+			body: `{"userID":"1","firstName":"Jon","lastName":"Smith","emailAddress":"jon@example.com","nickname":"johnny","country":"UK","version":4}` + "\n",
+			strategies: map[string]persistence.MergeStrategy{"nickname": persistence.KEEP_SOURCE, "country": persistence.KEEP_NON_EMPTY, "first_name": persistence.KEEP_TARGET},
+			events: []persistence.Message{{Type: "USERS_MERGED", UserID: "1", UserIDs: []string{"2"}, TenantID: persistence.DefaultTenant}},
+		},
+		{
+			name: "Error when source is missing",
+			reqURL: "/users/1/merge",
+			reqBody: `{"fields": {"nickname": "source"}}`,
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "sourceUserID is required"),
+		},
+		{
+			name: "Error when merging a user into themselves",
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "1"}`,
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "a user cannot be merged into themselves"),
+		},
+		{
+			name: "Error when field cannot be merged",
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2", "fields": {"emailAddress": "source"}}`,
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "cannot merge emailAddress; mergeable fields are [firstName, lastName, password, nickname, country]"),
+		},
+		{
+			name: "Error on unknown strategy",
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2", "fields": {"nickname": "longest"}}`,
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "strategy for nickname must be one of [target, source, nonEmpty]"),
+		},
+		{
+			name: "Error when user does not exist",
+			status: persistence.NOT_FOUND,
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2"}`,
+			statusCode: http.StatusNotFound,
+			body: fmt.Sprintf(msgTemplate + "\n", "no user exists with ID: 1"),
+			strategies: map[string]persistence.MergeStrategy{},
+		},
+		{
+			name: "Error when source does not exist",
+			status: persistence.NOT_FOUND,
+			users: []persistence.UserRecord{survivor},
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			body: fmt.Sprintf(msgTemplate + "\n", "no user exists with sourceUserID: 2"),
+			strategies: map[string]persistence.MergeStrategy{},
+		},
+		{
+			name: "Error when user modified since ETag was read",
+			status: persistence.VERSION_MISMATCH,
+			users: []persistence.UserRecord{survivor},
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2"}`,
+			ifMatch: `"3"`,
+			statusCode: http.StatusPreconditionFailed,
+			body: fmt.Sprintf(msgTemplate + "\n", "user: 1 has been modified since the supplied ETag was read"),
+			strategies: map[string]persistence.MergeStrategy{},
+		},
+		{
+			name: "Error when merge fails",
+			status: persistence.BACKEND_ERROR,
+			reqURL: "/users/1/merge",
+			reqBody: `{"sourceUserID": "2"}`,
+			statusCode: http.StatusInternalServerError,
+			body: fmt.Sprintf(msgTemplate + "\n", "could not process merge request"),
+			strategies: map[string]persistence.MergeStrategy{},
+		},
+	}
+
+	for _, test := range tests {
+		sqlClient := &mockMergeClient{mockSQLClient: mockSQLClient{test.status, test.users}}
+		events := notification.NewEventStream(10)
+		r := mux.NewRouter()
+		handler := NewUsersHandler(sqlClient, newTestQueueClient(), events, Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest("POST", test.reqURL, strings.NewReader(test.reqBody))
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.strategies, sqlClient.strategies, fmt.Sprintf("%s: Wrong strategies", test.name))
+		assert.Equal(test.events, publishedMessages(events), fmt.Sprintf("%s: Wrong events", test.name))
+		if test.ifMatch != "" {
+			assert.Equal(3, sqlClient.expectedVersion, fmt.Sprintf("%s: Wrong expected version", test.name))
+		}
+	}
+}
+
+func TestGetMergedUser(t *testing.T) {
+	assert := assert.New(t)
+	deletedAt := exportCreatedAt
+	tests := []struct {
+		name string
+		status persistence.Status
+		users []persistence.UserRecord
+		statusCode int
+		location string
+	}{
+		{
+			name: "Redirects merged user to survivor",
+			status: persistence.OK,
+			users: []persistence.UserRecord{{UserID: "2", DeletedAt: &deletedAt}},
+			statusCode: http.StatusMovedPermanently,
+			location: "/users/1",
+		},
+		{
+			name: "Redirects merged user who was purged to survivor",
+			status: persistence.NOT_FOUND,
+			statusCode: http.StatusMovedPermanently,
+			location: "/users/1",
+		},
+	}
+
+	for _, test := range tests {
+		sqlClient := &mockMergeClient{mockSQLClient: mockSQLClient{test.status, test.users}, aliases: map[string]string{"2": "1"}}
+		r := mux.NewRouter()
+		handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", "/users/2", nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.location, rec.Header().Get("Location"), fmt.Sprintf("%s: Wrong location", test.name))
+	}
+
+	//users who were deleted without being merged are still gone
+	sqlClient := &mockMergeClient{mockSQLClient: mockSQLClient{persistence.OK, []persistence.UserRecord{{UserID: "3", DeletedAt: &deletedAt}}}}
+	r := mux.NewRouter()
+	handler := NewUsersHandler(sqlClient, newTestQueueClient(), notification.NewEventStream(10), Config{})
+	handler.RegisterHandlers(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", "/users/3", nil))
+	assert.Equal(http.StatusGone, rec.Code)
+}
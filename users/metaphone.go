@@ -0,0 +1,553 @@
+package users
+
+import (
+	"strings"
+)
+
+//metaphoneLength is the length of the Double Metaphone codes of a name
+const metaphoneLength = 4
+
+//metaphone builds the primary and alternate Double Metaphone codes of a name. The methods named after letters code
+//the letter at the index, returning the index of the next letter to code
+type metaphone struct {
+	value []rune
+	slavoGermanic bool
+	primary string
+	alternate string
+}
+
+//doubleMetaphone returns the primary and alternate Double Metaphone codes of the name, so that names which sound alike
+//in English or the languages English names come from, such as Smith and Schmidt, share a code. The alternate code is
+//the same as the primary one unless the name could be pronounced another way
+func doubleMetaphone(name string) (string, string) {
+	value := strings.ToUpper(strings.TrimSpace(name))
+	if value == "" {
+		return "", ""
+	}
+	m := &metaphone{value: []rune(value)}
+	m.slavoGermanic = strings.Contains(value, "W") || strings.Contains(value, "K") || strings.Contains(value, "CZ") || strings.Contains(value, "WITZ")
+
+	index := 0
+	//the first letter is silent in names such as Gnome, Knight, Pneumann, Wright and Psmith
+	if m.contains(0, 2, "GN", "KN", "PN", "WR", "PS") {
+		index = 1
+	}
+	for !m.complete() && index < len(m.value) {
+		switch m.at(index) {
+		case 'A', 'E', 'I', 'O', 'U', 'Y':
+			//only the first vowel is coded
+			if index == 0 {
+				m.add("A")
+			}
+			index++
+		case 'B':
+			m.add("P")
+			index = m.skipDouble(index, "B")
+		case 'Ç':
+			m.add("S")
+			index++
+		case 'C':
+			index = m.c(index)
+		case 'D':
+			index = m.d(index)
+		case 'F':
+			m.add("F")
+			index = m.skipDouble(index, "F")
+		case 'G':
+			index = m.g(index)
+		case 'H':
+			//h is only sounded first or between vowels
+			if (index == 0 || isVowel(m.at(index-1))) && isVowel(m.at(index+1)) {
+				m.add("H")
+				index += 2
+			} else {
+				index++
+			}
+		case 'J':
+			index = m.j(index)
+		case 'K':
+			m.add("K")
+			index = m.skipDouble(index, "K")
+		case 'L':
+			index = m.l(index)
+		case 'M':
+			m.add("M")
+			//the b of -umb is silent, as in Dumb and Thumb
+			if m.at(index+1) == 'M' || (m.contains(index-1, 3, "UMB") && (index+1 == len(m.value)-1 || m.contains(index+2, 2, "ER"))) {
+				index += 2
+			} else {
+				index++
+			}
+		case 'N':
+			m.add("N")
+			index = m.skipDouble(index, "N")
+		case 'Ñ':
+			m.add("N")
+			index++
+		case 'P':
+			if m.at(index+1) == 'H' {
+				m.add("F")
+				index += 2
+			} else {
+				m.add("P")
+				index = m.skipDouble(index, "P", "B")
+			}
+		case 'Q':
+			m.add("K")
+			index = m.skipDouble(index, "Q")
+		case 'R':
+			index = m.r(index)
+		case 'S':
+			index = m.s(index)
+		case 'T':
+			index = m.t(index)
+		case 'V':
+			m.add("F")
+			index = m.skipDouble(index, "V")
+		case 'W':
+			index = m.w(index)
+		case 'X':
+			index = m.x(index)
+		case 'Z':
+			index = m.z(index)
+		default:
+			index++
+		}
+	}
+	return m.primary, m.alternate
+}
+
+//at returns the letter at the index of the name, or 0 if it has none
+func (m *metaphone) at(index int) rune {
+	if index < 0 || index >= len(m.value) {
+		return 0
+	}
+	return m.value[index]
+}
+
+//contains returns whether the letters of the name from start are one of the options
+func (m *metaphone) contains(start, length int, options ...string) bool {
+	if start < 0 || start+length > len(m.value) {
+		return false
+	}
+	letters := string(m.value[start : start+length])
+	for _, option := range options {
+		if letters == option {
+			return true
+		}
+	}
+	return false
+}
+
+//skipDouble returns the index of the letter after the one at the index, skipping any of the options which follow it
+func (m *metaphone) skipDouble(index int, options ...string) int {
+	if m.contains(index+1, 1, options...) {
+		return index + 2
+	}
+	return index + 1
+}
+
+//complete returns whether both codes are full
+func (m *metaphone) complete() bool {
+	return len(m.primary) >= metaphoneLength && len(m.alternate) >= metaphoneLength
+}
+
+//add adds the sound to both codes, or alternate to the alternate code when it is given
+func (m *metaphone) add(primary string, alternate ...string) {
+	m.addPrimary(primary)
+	if len(alternate) > 0 {
+		m.addAlternate(alternate[0])
+	} else {
+		m.addAlternate(primary)
+	}
+}
+
+//addPrimary adds the sound to the primary code only
+func (m *metaphone) addPrimary(sound string) {
+	m.primary = truncate(m.primary+sound, metaphoneLength)
+}
+
+//addAlternate adds the sound to the alternate code only
+func (m *metaphone) addAlternate(sound string) {
+	m.alternate = truncate(m.alternate+sound, metaphoneLength)
+}
+
+//truncate returns the first length characters of the code
+func truncate(code string, length int) string {
+	if len(code) > length {
+		return code[:length]
+	}
+	return code
+}
+
+//isVowel returns whether the letter is a vowel, including y
+func isVowel(r rune) bool {
+	return strings.ContainsRune("AEIOUY", r)
+}
+
+func (m *metaphone) c(index int) int {
+	switch {
+	case m.germanicCh(index):
+		//as in Bacher and Macher
+		m.add("K")
+		return index + 2
+	case index == 0 && m.contains(index, 6, "CAESAR"):
+		m.add("S")
+		return index + 2
+	case m.contains(index, 2, "CH"):
+		return m.ch(index)
+	case m.contains(index, 2, "CZ") && !m.contains(index-2, 4, "WICZ"):
+		//as in Czerny
+		m.add("S", "X")
+		return index + 2
+	case m.contains(index+1, 3, "CIA"):
+		//as in Focaccia
+		m.add("X")
+		return index + 3
+	case m.contains(index, 2, "CC") && !(index == 1 && m.at(0) == 'M'):
+		//but not McClelland
+		return m.cc(index)
+	case m.contains(index, 2, "CK", "CG", "CQ"):
+		m.add("K")
+		return index + 2
+	case m.contains(index, 2, "CI", "CE", "CY"):
+		//Italian or English
+		if m.contains(index, 3, "CIO", "CIE", "CIA") {
+			m.add("S", "X")
+		} else {
+			m.add("S")
+		}
+		return index + 2
+	}
+	m.add("K")
+	switch {
+	case m.contains(index+1, 2, " C", " Q", " G"):
+		//as in Mac Caffrey and Mac Gregor
+		return index + 3
+	case m.contains(index+1, 1, "C", "K", "Q") && !m.contains(index+1, 2, "CE", "CI"):
+		return index + 2
+	}
+	return index + 1
+}
+
+//germanicCh returns whether the c at the index is the hard ch of Germanic names
+func (m *metaphone) germanicCh(index int) bool {
+	if m.contains(index, 4, "CHIA") {
+		return true
+	}
+	if index <= 1 || isVowel(m.at(index-2)) || !m.contains(index-1, 3, "ACH") {
+		return false
+	}
+	next := m.at(index + 2)
+	return (next != 'I' && next != 'E') || m.contains(index-2, 6, "BACHER", "MACHER")
+}
+
+//ch codes the ch at the index
+func (m *metaphone) ch(index int) int {
+	switch {
+	case index > 0 && m.contains(index, 4, "CHAE"):
+		//as in Michael
+		m.add("K", "X")
+	case index == 0 && (m.contains(index+1, 5, "HARAC", "HARIS") || m.contains(index+1, 3, "HOR", "HYM", "HIA", "HEM")) &&
+		!m.contains(0, 5, "CHORE"):
+		//Greek roots as in Character and Chorus
+		m.add("K")
+	case m.contains(0, 4, "VAN ", "VON ") || m.contains(0, 3, "SCH") ||
+		m.contains(index-2, 6, "ORCHES", "ARCHIT", "ORCHID") || m.contains(index+2, 1, "T", "S") ||
+		((m.contains(index-1, 1, "A", "O", "U", "E") || index == 0) &&
+			(m.contains(index+2, 1, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ") || index+1 == len(m.value)-1)):
+		//Germanic and Greek ch sounded kh
+		m.add("K")
+	case index > 0 && m.contains(0, 2, "MC"):
+		m.add("K")
+	case index > 0:
+		m.add("X", "K")
+	default:
+		m.add("X")
+	}
+	return index + 2
+}
+
+//cc codes the cc at the index
+func (m *metaphone) cc(index int) int {
+	//as in Bellocchio but not Bacchus
+	if !m.contains(index+2, 1, "I", "E", "H") || m.contains(index+2, 2, "HU") {
+		m.add("K")
+		return index + 2
+	}
+	if (index == 1 && m.at(index-1) == 'A') || m.contains(index-1, 5, "UCCEE", "UCCES") {
+		//as in Accident, Accede and Succeed
+		m.add("KS")
+	} else {
+		//as in Bacci and Bertucci
+		m.add("X")
+	}
+	return index + 3
+}
+
+func (m *metaphone) d(index int) int {
+	switch {
+	case m.contains(index, 2, "DG"):
+		if m.contains(index+2, 1, "I", "E", "Y") {
+			//as in Edge
+			m.add("J")
+			return index + 3
+		}
+		//as in Edgar
+		m.add("TK")
+		return index + 2
+	case m.contains(index, 2, "DT", "DD"):
+		m.add("T")
+		return index + 2
+	}
+	m.add("T")
+	return index + 1
+}
+
+func (m *metaphone) g(index int) int {
+	switch {
+	case m.at(index+1) == 'H':
+		return m.gh(index)
+	case m.at(index+1) == 'N':
+		switch {
+		case index == 1 && isVowel(m.at(0)) && !m.slavoGermanic:
+			m.add("KN", "N")
+		case !m.contains(index+2, 2, "EY") && m.at(index+1) != 'Y' && !m.slavoGermanic:
+			m.add("N", "KN")
+		default:
+			m.add("KN")
+		}
+		return index + 2
+	case m.contains(index+1, 2, "LI") && !m.slavoGermanic:
+		//as in Tagliaro
+		m.add("KL", "L")
+		return index + 2
+	case index == 0 && (m.at(index+1) == 'Y' || m.contains(index+1, 2, "ES", "EP", "EB", "EL", "EY", "IB", "IL", "IN", "IE", "EI", "ER")):
+		m.add("K", "J")
+		return index + 2
+	case (m.contains(index+1, 2, "ER") || m.at(index+1) == 'Y') && !m.contains(0, 6, "DANGER", "RANGER", "MANGER") &&
+		!m.contains(index-1, 1, "E", "I") && !m.contains(index-1, 3, "RGY", "OGY"):
+		m.add("K", "J")
+		return index + 2
+	case m.contains(index+1, 1, "E", "I", "Y") || m.contains(index-1, 4, "AGGI", "OGGI"):
+		switch {
+		case m.contains(0, 4, "VAN ", "VON ") || m.contains(0, 3, "SCH") || m.contains(index+1, 2, "ET"):
+			//Germanic
+			m.add("K")
+		case m.contains(index+1, 3, "IER"):
+			m.add("J")
+		default:
+			m.add("J", "K")
+		}
+		return index + 2
+	case m.at(index+1) == 'G':
+		m.add("K")
+		return index + 2
+	}
+	m.add("K")
+	return index + 1
+}
+
+//gh codes the gh at the index
+func (m *metaphone) gh(index int) int {
+	switch {
+	case index > 0 && !isVowel(m.at(index-1)):
+		m.add("K")
+	case index == 0:
+		if m.at(index+2) == 'I' {
+			m.add("J")
+		} else {
+			m.add("K")
+		}
+	case (index > 1 && m.contains(index-2, 1, "B", "H", "D")) || (index > 2 && m.contains(index-3, 1, "B", "H", "D")) ||
+		(index > 3 && m.contains(index-4, 1, "B", "H")):
+		//silent, as in Hugh
+	case index > 2 && m.at(index-1) == 'U' && m.contains(index-3, 1, "C", "G", "L", "R", "T"):
+		//as in Laugh, McLaughlin and Tough
+		m.add("F")
+	case m.at(index-1) != 'I':
+		m.add("K")
+	}
+	return index + 2
+}
+
+func (m *metaphone) j(index int) int {
+	if m.contains(index, 4, "JOSE") || m.contains(0, 4, "SAN ") {
+		//Spanish, as in Jose and San Jacinto
+		if (index == 0 && m.at(index+4) == ' ') || len(m.value) == 4 || m.contains(0, 4, "SAN ") {
+			m.add("H")
+		} else {
+			m.add("J", "H")
+		}
+		return index + 1
+	}
+	switch {
+	case index == 0:
+		m.add("J", "A")
+	case isVowel(m.at(index-1)) && !m.slavoGermanic && (m.at(index+1) == 'A' || m.at(index+1) == 'O'):
+		m.add("J", "H")
+	case index == len(m.value)-1:
+		m.add("J", "")
+	case !m.contains(index+1, 1, "L", "T", "K", "S", "N", "M", "B", "Z") && !m.contains(index-1, 1, "S", "K", "L"):
+		m.add("J")
+	}
+	return m.skipDouble(index, "J")
+}
+
+func (m *metaphone) l(index int) int {
+	if m.at(index+1) != 'L' {
+		m.add("L")
+		return index + 1
+	}
+	//the ll of Spanish names such as Cabrillo and Gallegos is silent in the primary code
+	if (index == len(m.value)-3 && m.contains(index-1, 4, "ILLO", "ILLA", "ALLE")) ||
+		((m.contains(len(m.value)-2, 2, "AS", "OS") || m.contains(len(m.value)-1, 1, "A", "O")) && m.contains(index-1, 4, "ALLE")) {
+		m.addPrimary("L")
+	} else {
+		m.add("L")
+	}
+	return index + 2
+}
+
+func (m *metaphone) r(index int) int {
+	//the final r of French names such as Rogier is only sounded in the alternate code
+	if index == len(m.value)-1 && !m.slavoGermanic && m.contains(index-2, 2, "IE") && !m.contains(index-4, 2, "ME", "MA") {
+		m.addAlternate("R")
+	} else {
+		m.add("R")
+	}
+	return m.skipDouble(index, "R")
+}
+
+func (m *metaphone) s(index int) int {
+	switch {
+	case m.contains(index-1, 3, "ISL", "YSL"):
+		//silent, as in Island and Carlisle
+		return index + 1
+	case index == 0 && m.contains(index, 5, "SUGAR"):
+		m.add("X", "S")
+		return index + 1
+	case m.contains(index, 2, "SH"):
+		if m.contains(index+1, 4, "HEIM", "HOEK", "HOLM", "HOLZ") {
+			//Germanic
+			m.add("S")
+		} else {
+			m.add("X")
+		}
+		return index + 2
+	case m.contains(index, 3, "SIO", "SIA") || m.contains(index, 4, "SIAN"):
+		//Italian and Armenian
+		if m.slavoGermanic {
+			m.add("S")
+		} else {
+			m.add("S", "X")
+		}
+		return index + 3
+	case (index == 0 && m.contains(index+1, 1, "M", "N", "L", "W")) || m.contains(index+1, 1, "Z"):
+		//anglicised German names, so that Smith matches Schmidt and Snider Schneider, and the Slavic sz
+		m.add("S", "X")
+		return m.skipDouble(index, "Z")
+	case m.contains(index, 2, "SC"):
+		return m.sc(index)
+	}
+	if index == len(m.value)-1 && m.contains(index-2, 2, "AI", "OI") {
+		//French, as in Resnais and Artois
+		m.addAlternate("S")
+	} else {
+		m.add("S")
+	}
+	return m.skipDouble(index, "S", "Z")
+}
+
+//sc codes the sc at the index
+func (m *metaphone) sc(index int) int {
+	switch {
+	case m.at(index+2) == 'H':
+		switch {
+		case m.contains(index+3, 2, "ER", "EN"):
+			//Dutch, as in Schermerhorn and Schenker
+			m.add("X", "SK")
+		case m.contains(index+3, 2, "OO", "UY", "ED", "EM"):
+			//Dutch, as in School and Schooner
+			m.add("SK")
+		case index == 0 && !isVowel(m.at(3)) && m.at(3) != 'W':
+			m.add("X", "S")
+		default:
+			m.add("X")
+		}
+	case m.contains(index+2, 1, "I", "E", "Y"):
+		m.add("S")
+	default:
+		m.add("SK")
+	}
+	return index + 3
+}
+
+func (m *metaphone) t(index int) int {
+	switch {
+	case m.contains(index, 4, "TION") || m.contains(index, 3, "TIA", "TCH"):
+		m.add("X")
+		return index + 3
+	case m.contains(index, 2, "TH") || m.contains(index, 3, "TTH"):
+		if m.contains(index+2, 2, "OM", "AM") || m.contains(0, 4, "VAN ", "VON ") || m.contains(0, 3, "SCH") {
+			//as in Thomas and Thames, or Germanic
+			m.add("T")
+		} else {
+			m.add("0", "T")
+		}
+		return index + 2
+	}
+	m.add("T")
+	return m.skipDouble(index, "T", "D")
+}
+
+func (m *metaphone) w(index int) int {
+	switch {
+	case m.contains(index, 2, "WR"):
+		m.add("R")
+		return index + 2
+	case index == 0 && isVowel(m.at(index+1)):
+		//so that Wasserman matches Vasserman
+		m.add("A", "F")
+		return index + 1
+	case index == 0 && m.contains(index, 2, "WH"):
+		m.add("A")
+		return index + 1
+	case (index == len(m.value)-1 && isVowel(m.at(index-1))) || m.contains(index-1, 5, "EWSKI", "EWSKY", "OWSKI", "OWSKY") ||
+		m.contains(0, 3, "SCH"):
+		//so that Arnow matches Arnoff
+		m.addAlternate("F")
+		return index + 1
+	case m.contains(index, 4, "WICZ", "WITZ"):
+		//Polish, as in Filipowicz
+		m.add("TS", "FX")
+		return index + 4
+	}
+	return index + 1
+}
+
+func (m *metaphone) x(index int) int {
+	if index == 0 {
+		m.add("S")
+		return index + 1
+	}
+	//the final x of French names such as Breaux is silent
+	if !(index == len(m.value)-1 && (m.contains(index-3, 3, "IAU", "EAU") || m.contains(index-2, 2, "AU", "OU"))) {
+		m.add("KS")
+	}
+	return m.skipDouble(index, "C", "X")
+}
+
+func (m *metaphone) z(index int) int {
+	if m.at(index+1) == 'H' {
+		//Chinese, as in Zhao
+		m.add("J")
+		return index + 2
+	}
+	if m.contains(index+1, 2, "ZO", "ZI", "ZA") || (m.slavoGermanic && index > 0 && m.at(index-1) != 'T') {
+		m.add("S", "TS")
+	} else {
+		m.add("S")
+	}
+	return m.skipDouble(index, "Z")
+}
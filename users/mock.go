@@ -2,6 +2,8 @@ package users
 
 import (
 	p "github.com/scott-ace-newton/users-rw-sql/persistence"
+	"strings"
+	"time"
 )
 
 type mockSQLClient struct {
@@ -9,22 +11,459 @@ type mockSQLClient struct {
 	expectedRecords []p.UserRecord
 }
 
-func(mc *mockSQLClient) CreateRecord(p.UserRecord) p.Status {
+func(mc *mockSQLClient) CreateRecord(p.Caller, p.UserRecord) p.Status {
 	return mc.expectedStatus
 }
 
-func(mc *mockSQLClient) UpdateRecord(string, map[string]string) p.Status {
+func(mc *mockSQLClient) UpsertRecord(p.Caller, p.UserRecord, int) (p.UserRecord, p.Status) {
+	if len(mc.expectedRecords) > 0 {
+		return mc.expectedRecords[0], mc.expectedStatus
+	}
+	return p.UserRecord{}, mc.expectedStatus
+}
+
+func(mc *mockSQLClient) UpdateRecord(p.Caller, string, map[string]string, int) p.Status {
 	return mc.expectedStatus
 }
 
-func(mc *mockSQLClient) RetrieveRecords(map[string]string) ([]p.UserRecord, p.Status) {
+func(mc *mockSQLClient) CreateRecords(_ p.Caller, records []p.UserRecord, _ bool) []p.Status {
+	return mc.batchStatuses(len(records))
+}
+
+func(mc *mockSQLClient) UpdateRecords(_ p.Caller, updates []p.RecordUpdate, _ bool) []p.Status {
+	return mc.batchStatuses(len(updates))
+}
+
+func(mc *mockSQLClient) DeleteRecords(_ p.Caller, users []p.RecordVersion, _ bool) []p.Status {
+	return mc.batchStatuses(len(users))
+}
+
+func(mc *mockSQLClient) batchStatuses(size int) []p.Status {
+	statuses := make([]p.Status, size)
+	for i := range statuses {
+		statuses[i] = mc.expectedStatus
+	}
+	return statuses
+}
+
+func(mc *mockSQLClient) RetrieveRecords(p.SearchCriteria) ([]p.UserRecord, p.Status) {
 	return mc.expectedRecords, mc.expectedStatus
 }
 
-func(mc *mockSQLClient) DeleteRecord(string) p.Status {
+func(mc *mockSQLClient) ScanRecords(_ p.SearchCriteria, afterUserID string, limit int) ([]p.UserRecord, p.Status) {
+	if mc.expectedStatus != p.OK {
+		return nil, mc.expectedStatus
+	}
+	var page []p.UserRecord
+	for _, record := range mc.expectedRecords {
+		if record.UserID > afterUserID && len(page) < limit {
+			page = append(page, record)
+		}
+	}
+	if len(page) == 0 {
+		return page, p.NOT_FOUND
+	}
+	return page, p.OK
+}
+
+func(mc *mockSQLClient) CountRecords(p.SearchCriteria) (int, p.Status) {
+	return len(mc.expectedRecords), mc.expectedStatus
+}
+
+//GroupRecords groups the expected records by the export column reading the db column, in the order first seen
+func(mc *mockSQLClient) GroupRecords(_ p.SearchCriteria, column string) ([]p.GroupCount, p.Status) {
+	if mc.expectedStatus != p.OK {
+		return nil, mc.expectedStatus
+	}
+	groups := []p.GroupCount{}
+	for _, c := range exportColumns {
+		if c.column != column {
+			continue
+		}
+		indexes := make(map[string]int)
+		for _, record := range mc.expectedRecords {
+			value := c.value(record).(string)
+			if i, ok := indexes[value]; ok {
+				groups[i].Count++
+				continue
+			}
+			indexes[value] = len(groups)
+			groups = append(groups, p.GroupCount{Value: value, Count: 1})
+		}
+	}
+	return groups, p.OK
+}
+
+//SearchRecords returns the expected records with a field containing every term, the first being most relevant
+func(mc *mockSQLClient) SearchRecords(_ p.SearchCriteria, query string, limit int) ([]p.SearchResult, p.Status) {
+	if mc.expectedStatus != p.OK {
+		return nil, mc.expectedStatus
+	}
+	results := []p.SearchResult{}
+	for _, record := range mc.expectedRecords {
+		searched := strings.ToLower(strings.Join([]string{record.FirstName, record.LastName, record.NickName, record.EmailAddress}, " "))
+		matches := true
+		for _, term := range p.SearchTerms(query) {
+			matches = matches && strings.Contains(searched, strings.ToLower(term))
+		}
+		if matches && len(results) < limit {
+			results = append(results, p.SearchResult{User: record, Relevance: float64(len(mc.expectedRecords) - len(results))})
+		}
+	}
+	return results, p.OK
+}
+
+func(mc *mockSQLClient) RetrieveDuplicateCandidates(_ string, user p.UserRecord) ([]p.UserRecord, p.Status) {
+	candidates := []p.UserRecord{}
+	for _, record := range mc.expectedRecords {
+		if record.UserID != user.UserID {
+			candidates = append(candidates, record)
+		}
+	}
+	return candidates, mc.expectedStatus
+}
+
+func(mc *mockSQLClient) MergeRecords(p.Caller, string, string, map[string]p.MergeStrategy, int) (p.UserRecord, p.Status) {
+	if len(mc.expectedRecords) > 0 {
+		return mc.expectedRecords[0], mc.expectedStatus
+	}
+	return p.UserRecord{}, mc.expectedStatus
+}
+
+func(mc *mockSQLClient) RetrieveAlias(string, string) (string, p.Status) {
+	return "", p.NOT_FOUND
+}
+
+func(mc *mockSQLClient) CreateAPIKey(p.APIKey) p.Status {
+	return mc.expectedStatus
+}
+
+func(mc *mockSQLClient) RetrieveAPIKey(string) (p.APIKey, p.Status) {
+	return p.APIKey{}, p.NOT_FOUND
+}
+
+func(mc *mockSQLClient) RetrieveAPIKeys() ([]p.APIKey, p.Status) {
+	return nil, p.NOT_FOUND
+}
+
+func(mc *mockSQLClient) RecordAPIKeyUse(string, time.Time, time.Time) p.Status {
+	return p.UPDATED
+}
+
+func(mc *mockSQLClient) RevokeAPIKey(string) p.Status {
 	return mc.expectedStatus
 }
 
+func(mc *mockSQLClient) DeleteRecord(p.Caller, string, int) p.Status {
+	return mc.expectedStatus
+}
+
+func(mc *mockSQLClient) RestoreRecord(p.Caller, string) p.Status {
+	return mc.expectedStatus
+}
+
+func(mc *mockSQLClient) PurgeRecords(time.Time) (map[string][]string, p.Status) {
+	purged := make(map[string][]string)
+	for _, record := range mc.expectedRecords {
+		purged[p.DefaultTenant] = append(purged[p.DefaultTenant], record.UserID)
+	}
+	return purged, mc.expectedStatus
+}
+
+func(mc *mockSQLClient) RetrieveAuditEntries(string, string, int, int) ([]p.AuditEntry, int, p.Status) {
+	return nil, 0, mc.expectedStatus
+}
+
+//mockHistoryClient additionally returns pages of the expected audit entries
+type mockHistoryClient struct {
+	mockSQLClient
+	expectedAuditEntries []p.AuditEntry
+}
+
+func(mc *mockHistoryClient) RetrieveAuditEntries(_, _ string, limit, offset int) ([]p.AuditEntry, int, p.Status) {
+	if mc.expectedStatus != p.OK {
+		return nil, 0, mc.expectedStatus
+	}
+	page := []p.AuditEntry{}
+	for i, entry := range mc.expectedAuditEntries {
+		if i >= offset && len(page) < limit {
+			page = append(page, entry)
+		}
+	}
+	return page, len(mc.expectedAuditEntries), p.OK
+}
+
+func(mc *mockSQLClient) ReserveIdempotencyKey(record p.IdempotencyRecord) (p.IdempotencyRecord, p.Status) {
+	return record, p.CREATED
+}
+
+func(mc *mockSQLClient) CompleteIdempotencyKey(p.IdempotencyRecord) p.Status {
+	return p.UPDATED
+}
+
+func(mc *mockSQLClient) ReleaseIdempotencyKey(p.IdempotencyRecord) p.Status {
+	return p.DELETED
+}
+
+func(mc *mockSQLClient) PurgeIdempotencyKeys(time.Time) (int, p.Status) {
+	return 0, p.OK
+}
+
 func(mc *mockSQLClient) ActiveConnection() bool {
 	return true
-}
\ No newline at end of file
+}
+//mockIdempotencyClient additionally stores idempotency keys in memory, by subject and key, and counts the users
+//created, panicking instead when panicCreate is set
+type mockIdempotencyClient struct {
+	mockSQLClient
+	keys map[string]p.IdempotencyRecord
+	created int
+	panicCreate bool
+}
+
+func(mc *mockIdempotencyClient) CreateRecord(p.Caller, p.UserRecord) p.Status {
+	if mc.panicCreate {
+		panic("could not create user")
+	}
+	mc.created++
+	return mc.expectedStatus
+}
+
+func(mc *mockIdempotencyClient) ReserveIdempotencyKey(record p.IdempotencyRecord) (p.IdempotencyRecord, p.Status) {
+	if existing, ok := mc.keys[idempotencyMockKey(record)]; ok {
+		return existing, p.ALREADY_EXISTS
+	}
+	mc.keys[idempotencyMockKey(record)] = record
+	return record, p.CREATED
+}
+
+func(mc *mockIdempotencyClient) CompleteIdempotencyKey(record p.IdempotencyRecord) p.Status {
+	mc.keys[idempotencyMockKey(record)] = record
+	return p.UPDATED
+}
+
+func(mc *mockIdempotencyClient) ReleaseIdempotencyKey(record p.IdempotencyRecord) p.Status {
+	delete(mc.keys, idempotencyMockKey(record))
+	return p.DELETED
+}
+
+//idempotencyMockKey is the key, prefixed by the subject of authenticated callers
+func idempotencyMockKey(record p.IdempotencyRecord) string {
+	if record.Subject == "" {
+		return record.Key
+	}
+	return record.Subject + "/" + record.Key
+}
+
+//mockPatchClient additionally returns the current user when it exists and records the updates applied to them
+type mockPatchClient struct {
+	mockSQLClient
+	current *p.UserRecord
+	updates map[string]string
+	expectedVersion int
+}
+
+func(mc *mockPatchClient) RetrieveRecords(p.SearchCriteria) ([]p.UserRecord, p.Status) {
+	if mc.current == nil {
+		return nil, p.NOT_FOUND
+	}
+	return []p.UserRecord{*mc.current}, p.OK
+}
+
+func(mc *mockPatchClient) UpdateRecord(_ p.Caller, _ string, updates map[string]string, expectedVersion int) p.Status {
+	mc.updates = updates
+	mc.expectedVersion = expectedVersion
+	return mc.expectedStatus
+}
+
+//mockBatchClient additionally returns the expected status of each operation of a batch and records the
+//operations it is given
+type mockBatchClient struct {
+	mockSQLClient
+	expectedStatuses []p.Status
+	created []p.UserRecord
+	updated []p.RecordUpdate
+	deleted []p.RecordVersion
+}
+
+func(mc *mockBatchClient) CreateRecords(_ p.Caller, records []p.UserRecord, _ bool) []p.Status {
+	mc.created = records
+	return mc.expectedStatuses[:len(records)]
+}
+
+func(mc *mockBatchClient) UpdateRecords(_ p.Caller, updates []p.RecordUpdate, _ bool) []p.Status {
+	mc.updated = updates
+	return mc.expectedStatuses[:len(updates)]
+}
+
+func(mc *mockBatchClient) DeleteRecords(_ p.Caller, users []p.RecordVersion, _ bool) []p.Status {
+	mc.deleted = users
+	return mc.expectedStatuses[:len(users)]
+}
+
+//mockImportClient additionally adds users in memory, recording each batch, and fails the batch numbered failBatch
+type mockImportClient struct {
+	mockSQLClient
+	emails map[string]bool
+	batches [][]p.UserRecord
+	failBatch int
+}
+
+func(mc *mockImportClient) CreateRecords(_ p.Caller, records []p.UserRecord, _ bool) []p.Status {
+	mc.batches = append(mc.batches, records)
+	statuses := make([]p.Status, len(records))
+	for i, record := range records {
+		switch {
+		case len(mc.batches) == mc.failBatch:
+			statuses[i] = p.BACKEND_ERROR
+		case mc.emails[record.EmailAddress]:
+			statuses[i] = p.ALREADY_EXISTS
+		default:
+			mc.emails[record.EmailAddress] = true
+			statuses[i] = p.CREATED
+		}
+	}
+	return statuses
+}
+
+//mockScanClient additionally fails to scan any pages after the first failAfter
+type mockScanClient struct {
+	mockSQLClient
+	failAfter int
+	scans int
+}
+
+func(mc *mockScanClient) ScanRecords(criteria p.SearchCriteria, afterUserID string, limit int) ([]p.UserRecord, p.Status) {
+	if mc.scans++; mc.scans > mc.failAfter {
+		return nil, p.BACKEND_ERROR
+	}
+	return mc.mockSQLClient.ScanRecords(criteria, afterUserID, limit)
+}
+
+//mockSearchClient additionally records the criteria users were last read with
+type mockSearchClient struct {
+	mockSQLClient
+	criteria p.SearchCriteria
+}
+
+func(mc *mockSearchClient) RetrieveRecords(criteria p.SearchCriteria) ([]p.UserRecord, p.Status) {
+	mc.criteria = criteria
+	return mc.mockSQLClient.RetrieveRecords(criteria)
+}
+
+func(mc *mockSearchClient) ScanRecords(criteria p.SearchCriteria, afterUserID string, limit int) ([]p.UserRecord, p.Status) {
+	mc.criteria = criteria
+	return mc.mockSQLClient.ScanRecords(criteria, afterUserID, limit)
+}
+
+func(mc *mockSearchClient) CountRecords(criteria p.SearchCriteria) (int, p.Status) {
+	mc.criteria = criteria
+	return mc.mockSQLClient.CountRecords(criteria)
+}
+
+func(mc *mockSearchClient) GroupRecords(criteria p.SearchCriteria, column string) ([]p.GroupCount, p.Status) {
+	mc.criteria = criteria
+	return mc.mockSQLClient.GroupRecords(criteria, column)
+}
+
+func(mc *mockSearchClient) SearchRecords(criteria p.SearchCriteria, query string, limit int) ([]p.SearchResult, p.Status) {
+	mc.criteria = criteria
+	return mc.mockSQLClient.SearchRecords(criteria, query, limit)
+}
+
+//mockDuplicatesClient additionally looks the expected records up by user ID
+type mockDuplicatesClient struct {
+	mockSQLClient
+}
+
+func(mc *mockDuplicatesClient) RetrieveRecords(criteria p.SearchCriteria) ([]p.UserRecord, p.Status) {
+	for _, record := range mc.expectedRecords {
+		if record.UserID == criteria.Fields["user_id"] {
+			return []p.UserRecord{record}, p.OK
+		}
+	}
+	return nil, p.NOT_FOUND
+}
+
+//mockTenantClient additionally records the tenant of the caller or criteria each user was last added or read with
+type mockTenantClient struct {
+	mockSQLClient
+	tenant string
+}
+
+func(mc *mockTenantClient) CreateRecord(caller p.Caller, record p.UserRecord) p.Status {
+	mc.tenant = caller.TenantID
+	return mc.mockSQLClient.CreateRecord(caller, record)
+}
+
+func(mc *mockTenantClient) RetrieveRecords(criteria p.SearchCriteria) ([]p.UserRecord, p.Status) {
+	mc.tenant = criteria.TenantID
+	return mc.mockSQLClient.RetrieveRecords(criteria)
+}
+
+//mockMergeClient additionally records the strategies users were merged with and resolves the expected aliases
+type mockMergeClient struct {
+	mockSQLClient
+	aliases map[string]string
+	strategies map[string]p.MergeStrategy
+	expectedVersion int
+}
+
+func(mc *mockMergeClient) MergeRecords(caller p.Caller, targetID, sourceID string, strategies map[string]p.MergeStrategy, expectedVersion int) (p.UserRecord, p.Status) {
+	mc.strategies = strategies
+	mc.expectedVersion = expectedVersion
+	return mc.mockSQLClient.MergeRecords(caller, targetID, sourceID, strategies, expectedVersion)
+}
+
+func(mc *mockMergeClient) RetrieveAlias(_, aliasID string) (string, p.Status) {
+	if userID, ok := mc.aliases[aliasID]; ok {
+		return userID, p.OK
+	}
+	return "", p.NOT_FOUND
+}
+
+//mockAPIKeyClient stores API keys in memory
+type mockAPIKeyClient struct {
+	mockSQLClient
+	keys map[string]p.APIKey
+	uses int
+}
+
+func(mc *mockAPIKeyClient) CreateAPIKey(key p.APIKey) p.Status {
+	createdAt := time.Now()
+	key.CreatedAt = &createdAt
+	mc.keys[key.KeyID] = key
+	return p.CREATED
+}
+
+func(mc *mockAPIKeyClient) RetrieveAPIKey(keyID string) (p.APIKey, p.Status) {
+	if mc.expectedStatus != p.OK {
+		return p.APIKey{}, mc.expectedStatus
+	}
+	key, ok := mc.keys[keyID]
+	if !ok {
+		return p.APIKey{}, p.NOT_FOUND
+	}
+	return key, p.OK
+}
+
+func(mc *mockAPIKeyClient) RecordAPIKeyUse(keyID string, usedAt time.Time, usedSince time.Time) p.Status {
+	key := mc.keys[keyID]
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(usedSince) {
+		key.LastUsedAt = &usedAt
+		mc.keys[keyID] = key
+		mc.uses++
+	}
+	return p.UPDATED
+}
+
+func(mc *mockAPIKeyClient) RevokeAPIKey(keyID string) p.Status {
+	key, ok := mc.keys[keyID]
+	if !ok || key.RevokedAt != nil {
+		return p.NOT_FOUND
+	}
+	revokedAt := time.Now()
+	key.RevokedAt = &revokedAt
+	mc.keys[keyID] = key
+	return p.DELETED
+}
@@ -0,0 +1,281 @@
+package users
+
+import (
+	"encoding/binary"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"io"
+	"time"
+)
+
+//parquetMagic starts and ends every parquet file
+var parquetMagic = []byte("PAR1")
+
+//parquet physical types, repetitions, converted types, encodings and page types used by the writer,
+//as numbered in the parquet thrift definitions
+const (
+	parquetInt32 = 1
+	parquetInt64 = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8 = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE = 3
+
+	parquetDataPage = 0
+)
+
+//thrift compact protocol types
+const (
+	thriftI32 = 5
+	thriftI64 = 6
+	thriftBinary = 8
+	thriftList = 9
+	thriftStruct = 12
+)
+
+//parquetWriter writes users as an uncompressed parquet file with a row group per page of users, so only one page
+//is held in memory. The footer describing the row groups is written when the writer is closed
+type parquetWriter struct {
+	writer io.Writer
+	columns []exportColumn
+	offset int64
+	rows int64
+	rowGroups [][]parquetChunk
+}
+
+//parquetChunk is the metadata of a column chunk already written to the file
+type parquetChunk struct {
+	column exportColumn
+	offset int64
+	size int64
+	values int64
+}
+
+func newParquetWriter(writer io.Writer, columns []exportColumn) *parquetWriter {
+	return &parquetWriter{writer: writer, columns: columns}
+}
+
+func (pw *parquetWriter) write(users []persistence.UserRecord) error {
+	if pw.offset == 0 {
+		if err := pw.append(parquetMagic); err != nil {
+			return err
+		}
+	}
+	chunks := make([]parquetChunk, len(pw.columns))
+	for i, column := range pw.columns {
+		page := encodeParquetPage(column, users)
+		var header compactWriter
+		header.message(func() {
+			header.i32(1, parquetDataPage)
+			header.i32(2, int32(len(page)))
+			header.i32(3, int32(len(page)))
+			header.structField(5, func() {
+				header.i32(1, int32(len(users)))
+				header.i32(2, parquetPlain)
+				header.i32(3, parquetRLE)
+				header.i32(4, parquetRLE)
+			})
+		})
+		chunks[i] = parquetChunk{column: column, offset: pw.offset, size: int64(len(header.buf) + len(page)), values: int64(len(users))}
+		if err := pw.append(header.buf); err != nil {
+			return err
+		}
+		if err := pw.append(page); err != nil {
+			return err
+		}
+	}
+	pw.rowGroups = append(pw.rowGroups, chunks)
+	pw.rows += int64(len(users))
+	return nil
+}
+
+func (pw *parquetWriter) close() error {
+	if pw.offset == 0 {
+		if err := pw.append(parquetMagic); err != nil {
+			return err
+		}
+	}
+	var footer compactWriter
+	footer.message(func() {
+		footer.i32(1, 1)
+		footer.listHeader(2, thriftStruct, len(pw.columns)+1)
+		footer.message(func() {
+			footer.str(4, "user")
+			footer.i32(5, int32(len(pw.columns)))
+		})
+		for _, column := range pw.columns {
+			physical, converted, repetition := column.parquetType()
+			footer.message(func() {
+				footer.i32(1, physical)
+				footer.i32(3, repetition)
+				footer.str(4, column.name)
+				if converted >= 0 {
+					footer.i32(6, converted)
+				}
+			})
+		}
+		footer.i64(3, pw.rows)
+		footer.listHeader(4, thriftStruct, len(pw.rowGroups))
+		for _, chunks := range pw.rowGroups {
+			var groupSize int64
+			for _, chunk := range chunks {
+				groupSize += chunk.size
+			}
+			footer.message(func() {
+				footer.listHeader(1, thriftStruct, len(chunks))
+				for _, chunk := range chunks {
+					physical, _, _ := chunk.column.parquetType()
+					footer.message(func() {
+						footer.i64(2, chunk.offset)
+						footer.structField(3, func() {
+							footer.i32(1, physical)
+							footer.listHeader(2, thriftI32, 2)
+							footer.varint(parquetPlain)
+							footer.varint(parquetRLE)
+							footer.listHeader(3, thriftBinary, 1)
+							footer.bytes([]byte(chunk.column.name))
+							footer.i32(4, 0)
+							footer.i64(5, chunk.values)
+							footer.i64(6, chunk.size)
+							footer.i64(7, chunk.size)
+							footer.i64(9, chunk.offset)
+						})
+					})
+				}
+				footer.i64(2, groupSize)
+				footer.i64(3, chunks[0].values)
+			})
+		}
+		footer.str(6, "users-rw-sql")
+	})
+	footer.buf = binary.LittleEndian.AppendUint32(footer.buf, uint32(len(footer.buf)))
+	return pw.append(append(footer.buf, parquetMagic...))
+}
+
+func (pw *parquetWriter) append(data []byte) error {
+	n, err := pw.writer.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+//parquetType returns the physical type, converted type (-1 for none) and repetition of the column
+func (column exportColumn) parquetType() (int32, int32, int32) {
+	switch column.kind {
+	case exportInt:
+		return parquetInt32, -1, parquetRequired
+	case exportTime:
+		return parquetInt64, parquetTimestampMillis, parquetOptional
+	default:
+		return parquetByteArray, parquetUTF8, parquetRequired
+	}
+}
+
+//encodeParquetPage plain encodes the column's values for a data page. Times are optional so are preceded by
+//their definition levels, run length encoded, with only the times which are set being encoded
+func encodeParquetPage(column exportColumn, users []persistence.UserRecord) []byte {
+	var levels, values []byte
+	var run, runLevel int
+	endRun := func() {
+		if run > 0 {
+			levels = binary.AppendUvarint(levels, uint64(run)<<1)
+			levels = append(levels, byte(runLevel))
+		}
+	}
+	for _, user := range users {
+		switch value := column.value(user).(type) {
+		case string:
+			values = binary.LittleEndian.AppendUint32(values, uint32(len(value)))
+			values = append(values, value...)
+		case int:
+			values = binary.LittleEndian.AppendUint32(values, uint32(value))
+		case *time.Time:
+			level := 0
+			if value != nil {
+				level = 1
+				values = binary.LittleEndian.AppendUint64(values, uint64(value.UnixNano()/int64(time.Millisecond)))
+			}
+			if level != runLevel {
+				endRun()
+				run, runLevel = 0, level
+			}
+			run++
+		}
+	}
+	if column.kind != exportTime {
+		return values
+	}
+	endRun()
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	return append(append(page, levels...), values...)
+}
+
+//compactWriter encodes the parquet metadata using the thrift compact protocol
+type compactWriter struct {
+	buf []byte
+	//lastField is the ID of the previous field of each struct being written, field IDs are encoded as deltas from it
+	lastField []int16
+}
+
+//message writes a struct which is not itself a field, such as a top level struct or a list element
+func (cw *compactWriter) message(fields func()) {
+	cw.lastField = append(cw.lastField, 0)
+	fields()
+	cw.buf = append(cw.buf, 0)
+	cw.lastField = cw.lastField[:len(cw.lastField)-1]
+}
+
+func (cw *compactWriter) field(id int16, thriftType byte) {
+	last := &cw.lastField[len(cw.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		cw.buf = append(cw.buf, byte(delta)<<4|thriftType)
+	} else {
+		cw.buf = append(cw.buf, thriftType)
+		cw.varint(int64(id))
+	}
+	*last = id
+}
+
+func (cw *compactWriter) structField(id int16, fields func()) {
+	cw.field(id, thriftStruct)
+	cw.message(fields)
+}
+
+func (cw *compactWriter) i32(id int16, value int32) {
+	cw.field(id, thriftI32)
+	cw.varint(int64(value))
+}
+
+func (cw *compactWriter) i64(id int16, value int64) {
+	cw.field(id, thriftI64)
+	cw.varint(value)
+}
+
+func (cw *compactWriter) str(id int16, value string) {
+	cw.field(id, thriftBinary)
+	cw.bytes([]byte(value))
+}
+
+func (cw *compactWriter) listHeader(id int16, elementType byte, size int) {
+	cw.field(id, thriftList)
+	if size < 15 {
+		cw.buf = append(cw.buf, byte(size)<<4|elementType)
+	} else {
+		cw.buf = append(cw.buf, 0xF0|elementType)
+		cw.buf = binary.AppendUvarint(cw.buf, uint64(size))
+	}
+}
+
+//varint writes a zigzag encoded integer
+func (cw *compactWriter) varint(value int64) {
+	cw.buf = binary.AppendUvarint(cw.buf, uint64(value<<1^value>>63))
+}
+
+func (cw *compactWriter) bytes(value []byte) {
+	cw.buf = binary.AppendUvarint(cw.buf, uint64(len(value)))
+	cw.buf = append(cw.buf, value...)
+}
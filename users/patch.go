@@ -0,0 +1,213 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	jsonPatchMediaType = "application/json-patch+json"
+)
+
+//userField describes how a user field may be patched
+type userField struct {
+	column string
+	//writable fields may be changed by patches
+	writable bool
+	//clearable fields may be set to an empty value with null or remove
+	clearable bool
+	//secret fields cannot be compared by test operations
+	secret bool
+	//writeRoles are the only roles permitted to change the field, if any are listed
+	writeRoles []string
+}
+
+//userFields are the fields of the user model by json name. Fields which are not writable are managed by the
+//service, or like emailAddress, cannot currently be changed
+var userFields = map[string]userField{
+	"userID": {column: "user_id"},
+	"firstName": {column: "first_name", writable: true},
+	"lastName": {column: "last_name", writable: true},
+	"emailAddress": {column: "email"},
+	"password": {column: "password", writable: true, secret: true, writeRoles: []string{adminRole, selfServiceRole}},
+	"nickname": {column: "nickname", writable: true, clearable: true},
+	"country": {column: "country", writable: true, clearable: true},
+	"deletedAt": {},
+	"version": {},
+	"createdAt": {},
+	"updatedAt": {},
+}
+
+//patchError is a patch which cannot be applied along with the status to respond with
+type patchError struct {
+	status int
+	msg string
+}
+
+func (e patchError) Error() string {
+	return e.msg
+}
+
+func badPatch(format string, args ...interface{}) error {
+	return patchError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+//setField checks the field may be set to the value and adds it to the updates. A nil value clears the field
+func setField(updates map[string]string, name string, value *string) error {
+	field, ok := userFields[name]
+	if !ok {
+		return badPatch("%s is not a user field", name)
+	}
+	if !field.writable {
+		return patchError{status: http.StatusForbidden, msg: fmt.Sprintf("%s cannot be modified", name)}
+	}
+	if value == nil || *value == "" {
+		if !field.clearable {
+			return badPatch("%s cannot be cleared", name)
+		}
+		updates[field.column] = ""
+		return nil
+	}
+	updates[field.column] = *value
+	return nil
+}
+
+//mergePatchUpdates returns the column updates made by an RFC 7396 JSON merge patch, where null clears a field
+func mergePatchUpdates(body io.Reader) (map[string]string, error) {
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return nil, badPatch("could not decode request body")
+	}
+	//sort so that errors are reported consistently
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	updates := make(map[string]string)
+	for _, name := range names {
+		var value *string
+		if err := json.Unmarshal(patch[name], &value); err != nil {
+			return nil, badPatch("%s must be a string or null", name)
+		}
+		if err := setField(updates, name, value); err != nil {
+			return nil, err
+		}
+	}
+	return updates, nil
+}
+
+//jsonPatchOperation is an RFC 6902 JSON patch operation
+type jsonPatchOperation struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+//jsonPatchUpdates applies an RFC 6902 JSON patch to the current user and returns the resulting column updates.
+//Operations apply in order and the whole patch fails if any test operation does not match
+func jsonPatchUpdates(current persistence.UserRecord, body io.Reader) (map[string]string, error) {
+	var operations []jsonPatchOperation
+	if err := json.NewDecoder(body).Decode(&operations); err != nil {
+		return nil, badPatch("could not decode request body")
+	}
+
+	values := fieldValues(current)
+	updates := make(map[string]string)
+	for i, operation := range operations {
+		name, err := pointerField(operation.Path)
+		if err != nil {
+			return nil, badPatch("operation %d: %v", i, err)
+		}
+		var value *string
+		if operation.Op == "add" || operation.Op == "replace" || operation.Op == "test" {
+			if operation.Value == nil {
+				return nil, badPatch("operation %d: %s requires a value", i, operation.Op)
+			}
+			if err := json.Unmarshal(*operation.Value, &value); err != nil {
+				return nil, badPatch("operation %d: value must be a string or null", i)
+			}
+		}
+
+		switch operation.Op {
+		case "test":
+			if _, ok := values[name]; !ok {
+				return nil, badPatch("operation %d: %s is not a user field", i, name)
+			}
+			if userFields[name].secret {
+				return nil, patchError{status: http.StatusForbidden, msg: fmt.Sprintf("operation %d: %s cannot be tested", i, name)}
+			}
+			if values[name] != stringValue(value) {
+				return nil, patchError{status: http.StatusConflict, msg: fmt.Sprintf("test operation %d failed, %s does not match", i, name)}
+			}
+		case "add", "replace":
+			err = setField(updates, name, value)
+		case "remove":
+			err = setField(updates, name, nil)
+		case "move", "copy":
+			from, fromErr := pointerField(operation.From)
+			if fromErr != nil {
+				return nil, badPatch("operation %d: from %v", i, fromErr)
+			}
+			if _, ok := values[from]; !ok {
+				return nil, badPatch("operation %d: %s is not a user field", i, from)
+			}
+			//secret fields are not read so cannot be copied
+			if userFields[from].secret {
+				return nil, patchError{status: http.StatusForbidden, msg: fmt.Sprintf("operation %d: %s cannot be copied or moved", i, from)}
+			}
+			moved := values[from]
+			if err = setField(updates, name, &moved); err == nil && operation.Op == "move" && from != name {
+				err = setField(updates, from, nil)
+			}
+		default:
+			return nil, badPatch("operation %d: unsupported op %s", i, operation.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		//later operations see the result of earlier ones
+		for field, value := range userFields {
+			if update, ok := updates[value.column]; ok {
+				values[field] = update
+			}
+		}
+	}
+	return updates, nil
+}
+
+//pointerField returns the user field referenced by a JSON pointer
+func pointerField(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") || strings.Count(pointer, "/") != 1 {
+		return "", fmt.Errorf("path %q must reference a user field", pointer)
+	}
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(pointer[1:]), nil
+}
+
+//fieldValues returns the string fields of the user which patches can reference by json name
+func fieldValues(user persistence.UserRecord) map[string]string {
+	return map[string]string{
+		"userID": user.UserID,
+		"firstName": user.FirstName,
+		"lastName": user.LastName,
+		"emailAddress": user.EmailAddress,
+		"password": user.Password,
+		"nickname": user.NickName,
+		"country": user.Country,
+	}
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
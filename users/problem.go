@@ -0,0 +1,36 @@
+package users
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+//Problem models an RFC 7807 problem details response
+// swagger:model Problem
+type Problem struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+//writeProblem responds with an application/problem+json body describing why the request failed
+func writeProblem(writer http.ResponseWriter, request *http.Request, status int, detail string) {
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.WriteHeader(status)
+	if request.Method == http.MethodHead {
+		return
+	}
+	problem := Problem{
+		Type: "about:blank",
+		Title: http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Instance: request.URL.Path,
+	}
+	if err := json.NewEncoder(writer).Encode(problem); err != nil {
+		log.WithError(err).Error("could not encode problem response")
+	}
+}
@@ -0,0 +1,54 @@
+package users
+
+import (
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+//PurgeDeletedUsers permanently removes users of every tenant which were soft deleted longer ago than the retention
+//period, publishing a USER_PURGED message for each, and returns how many were purged
+func (h *UsersHandler) PurgeDeletedUsers(retention time.Duration) (int, error) {
+	purged, status := h.sqlClient.PurgeRecords(time.Now().UTC().Add(-retention))
+	if status != persistence.OK {
+		return 0, fmt.Errorf("could not purge users deleted more than %s ago", retention)
+	}
+	var count int
+	for tenantID, userIDs := range purged {
+		for _, userID := range userIDs {
+			h.publish(persistence.Message{
+				Type: "USER_PURGED",
+				UserID: userID,
+				TenantID: tenantID,
+			})
+		}
+		count += len(userIDs)
+	}
+	return count, nil
+}
+
+//RunPurgeJob purges deleted users and expired idempotency keys every interval until stop is closed
+func (h *UsersHandler) RunPurgeJob(interval, retention time.Duration, stop <-chan struct{}) {
+	log.Infof("purging users deleted more than %s ago every %s", retention, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			purged, err := h.PurgeDeletedUsers(retention)
+			if err != nil {
+				log.WithError(err).Error("purge job failed")
+				continue
+			}
+			log.Infof("purge job removed %d deleted users", purged)
+			if expired, status := h.sqlClient.PurgeIdempotencyKeys(time.Now().UTC()); status == persistence.OK {
+				log.Infof("purge job removed %d expired idempotency keys", expired)
+			} else {
+				log.Error("purge job could not remove expired idempotency keys")
+			}
+		}
+	}
+}
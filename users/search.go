@@ -0,0 +1,151 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit = 100
+)
+
+//searchedFields are the fields matched by searches, which are highlighted in results
+var searchedFields = []string{"firstName", "lastName", "nickname", "emailAddress"}
+
+// swagger:operation GET /users/search users searchUsers
+// ---
+// summary: Search users
+// description: Finds users whose first name, last name, nickname or email contain words starting with every term of
+//   the query, most relevant first, highlighting the matches
+// parameters:
+// - name: q
+//   in: query
+//   description: terms to search for, separated by spaces or punctuation
+//   type: string
+//   required: true
+// - name: limit
+//   in: query
+//   description: maximum number of users to return, defaults to 20 and at most 100
+//   type: integer
+//   required: false
+// - name: country
+//   in: query
+//   description: any of the GET /users search params, including includeDeleted and the time ranges
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   403: forbidden
+//   422: unprocessable
+//   500: internal
+func (h *UsersHandler) SearchUsers(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	params, ok := filterParams(writer, request)
+	if !ok {
+		return
+	}
+
+	query := params.Get("q")
+	params.Del("q")
+	terms := persistence.SearchTerms(query)
+	if len(terms) == 0 {
+		log.Infof("invalid search query: %s", query)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "q must contain at least one word to search for"))
+		return
+	}
+	limit, err := intParam(params.Get("limit"), defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		log.Infof("invalid limit param: %s", params.Get("limit"))
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)))
+		return
+	}
+	params.Del("limit")
+
+	criteria, err := filterCriteria(params)
+	if err != nil {
+		log.WithError(err).Infof("supplied search params %s are invalid", params)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	if !checkIncludeDeleted(writer, request, criteria) {
+		return
+	}
+	criteria.TenantID = requestTenant(request)
+
+	results, status := h.sqlClient.SearchRecords(criteria, query, limit)
+	if status != persistence.OK {
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process request"))
+		return
+	}
+	highlighter := newHighlighter(terms)
+	for i := range results {
+		results[i].Highlights = highlighter.highlight(results[i].User)
+	}
+	writer.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(writer)
+	//highlights are already html escaped
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(results); err != nil {
+		log.WithError(err).Error("could not encode returned payload")
+	}
+}
+
+//highlighter wraps the search terms found in a user's fields in <em> tags
+type highlighter struct {
+	terms *regexp.Regexp
+}
+
+func newHighlighter(terms []string) highlighter {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	//longer terms are preferred so a term which is a prefix of another does not split its highlight
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return highlighter{terms: regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))}
+}
+
+//highlight returns the searched fields of the user which contain a term, html escaped with the terms highlighted
+func (hl highlighter) highlight(user persistence.UserRecord) map[string]string {
+	highlights := make(map[string]string)
+	for _, name := range searchedFields {
+		value := fieldValue(user, name)
+		matches := hl.terms.FindAllStringIndex(value, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var highlighted strings.Builder
+		end := 0
+		for _, match := range matches {
+			highlighted.WriteString(html.EscapeString(value[end:match[0]]))
+			highlighted.WriteString("<em>" + html.EscapeString(value[match[0]:match[1]]) + "</em>")
+			end = match[1]
+		}
+		highlighted.WriteString(html.EscapeString(value[end:]))
+		highlights[name] = highlighted.String()
+	}
+	return highlights
+}
+
+//fieldValue returns the value of the searched field of the user
+func fieldValue(user persistence.UserRecord, name string) string {
+	for _, column := range exportColumns {
+		if column.name == name {
+			return column.value(user).(string)
+		}
+	}
+	return ""
+}
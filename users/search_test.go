@@ -0,0 +1,100 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var searchUsers = []persistence.UserRecord{
+	{UserID: "1", FirstName: "John", LastName: "Smith", EmailAddress: "john.smith@gmail.com", NickName: "smithy12345", Country: "UK"},
+	{UserID: "2", FirstName: "Sam", LastName: "O'Smith", EmailAddress: "sam@example.com", NickName: "<Sammy>", Country: "UK"},
+}
+
+func TestSearchUsers(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		status persistence.Status
+		reqURL string
+		statusCode int
+		body string
+		criteria persistence.SearchCriteria
+	}{
+		{
+			name: "Highlights every match in searched fields",
+			status: persistence.OK,
+			reqURL: "/users/search?q=smith",
+			statusCode: http.StatusOK,
+			body: `[{"user":{"userID":"1","firstName":"John","lastName":"Smith","emailAddress":"john.smith@gmail.com","nickname":"smithy12345","country":"UK"},"relevance":2,` +
+				`"highlights":{"emailAddress":"john.<em>smith</em>@gmail.com","lastName":"<em>Smith</em>","nickname":"<em>smith</em>y12345"}},` +
+				`{"user":{"userID":"2","firstName":"Sam","lastName":"O'Smith","emailAddress":"sam@example.com","nickname":"<Sammy>","country":"UK"},"relevance":1,` +
+				`"highlights":{"lastName":"O&#39;<em>Smith</em>"}}]` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+		{
+			name: "Highlights every term and escapes fields",
+			status: persistence.OK,
+			reqURL: "/users/search?q=sam%20example&country=UK&limit=1",
+			statusCode: http.StatusOK,
+			body: `[{"user":{"userID":"2","firstName":"Sam","lastName":"O'Smith","emailAddress":"sam@example.com","nickname":"<Sammy>","country":"UK"},"relevance":2,` +
+				`"highlights":{"emailAddress":"<em>sam</em>@<em>example</em>.com","firstName":"<em>Sam</em>","nickname":"&lt;<em>Sam</em>my&gt;"}}]` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{"country": "UK"}},
+		},
+		{
+			name: "Returns no results",
+			status: persistence.OK,
+			reqURL: "/users/search?q=brutus",
+			statusCode: http.StatusOK,
+			body: "[]\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+		{
+			name: "Error when query has no terms",
+			status: persistence.OK,
+			reqURL: "/users/search?q=%40.",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "q must contain at least one word to search for"),
+		},
+		{
+			name: "Error on invalid limit",
+			status: persistence.OK,
+			reqURL: "/users/search?q=smith&limit=101",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "limit must be between 1 and 100"),
+		},
+		{
+			name: "Error on invalid filter",
+			status: persistence.OK,
+			reqURL: "/users/search?q=smith&address=London",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "supplied filters are invalid; valid filters are [userID, firstName, lastName, emailAddress, nickname, country, includeDeleted, createdAfter, createdBefore, updatedAfter, updatedBefore]"),
+		},
+		{
+			name: "Error when users cannot be searched",
+			status: persistence.BACKEND_ERROR,
+			reqURL: "/users/search?q=smith",
+			statusCode: http.StatusInternalServerError,
+			body: fmt.Sprintf(msgTemplate + "\n", "could not process request"),
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		sqlClient := &mockSearchClient{mockSQLClient: mockSQLClient{test.status, searchUsers}}
+		handler := NewUsersHandler(sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.criteria, sqlClient.criteria, fmt.Sprintf("%s: Wrong criteria", test.name))
+	}
+}
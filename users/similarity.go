@@ -0,0 +1,63 @@
+package users
+
+import (
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"strings"
+)
+
+//soundsAlike returns whether the names have the same Soundex code or share a Double Metaphone code. Names without any
+//code do not sound like anything
+func soundsAlike(a, b string) bool {
+	if code := persistence.Soundex(a); code != "" && code == persistence.Soundex(b) {
+		return true
+	}
+	primaryA, alternateA := doubleMetaphone(a)
+	primaryB, alternateB := doubleMetaphone(b)
+	for _, code := range []string{primaryA, alternateA} {
+		if code != "" && (code == primaryB || code == alternateB) {
+			return true
+		}
+	}
+	return false
+}
+
+//levenshtein returns the number of single character insertions, deletions and substitutions needed to change a into b
+func levenshtein(a, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := range source {
+		current[0] = i + 1
+		for j := range target {
+			substitution := previous[j]
+			if source[i] != target[j] {
+				substitution++
+			}
+			current[j+1] = substitution
+			if deletion := previous[j+1] + 1; deletion < current[j+1] {
+				current[j+1] = deletion
+			}
+			if insertion := current[j] + 1; insertion < current[j+1] {
+				current[j+1] = insertion
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
+
+//similarity returns how alike the strings are ignoring case, from 0 for nothing in common to 1 for equal strings
+func similarity(a, b string) float64 {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	longest := len([]rune(a))
+	if n := len([]rune(b)); n > longest {
+		longest = n
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
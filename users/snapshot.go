@@ -0,0 +1,172 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+)
+
+//publisher sends messages to the queue
+type publisher interface {
+	AddMessageToQueue(persistence.Message) error
+}
+
+//SnapshotOptions configures a snapshot export
+type SnapshotOptions struct {
+	//Filters are GET /users search params restricting which users are exported
+	Filters url.Values
+	//Rate is the maximum number of events published per second, 0 for no limit
+	Rate int
+	BatchSize int
+	//CheckpointFile records progress so an interrupted export can be resumed, optional
+	CheckpointFile string
+	//DryRun counts the users which would be exported without publishing anything
+	DryRun bool
+	//TenantID is the tenant whose users are exported
+	TenantID string
+}
+
+//SnapshotResult summarises a snapshot export
+type SnapshotResult struct {
+	Published int
+	Failed int
+	LastUserID string
+}
+
+//snapshotCheckpoint is the progress of an export stored between runs
+type snapshotCheckpoint struct {
+	TenantID string `json:"tenantID"`
+	Criteria map[string]string `json:"criteria"`
+	LastUserID string `json:"lastUserID"`
+	Published int `json:"published"`
+	Failed int `json:"failed"`
+}
+
+//Snapshotter publishes a USER_SNAPSHOT event for every user so downstream consumers can rebuild their state
+type Snapshotter struct {
+	sqlClient persistence.Clienter
+	queueClient publisher
+}
+
+//NewSnapshotter returns a snapshotter reading from the sql client and publishing to the queue client
+func NewSnapshotter(sqlClient persistence.Clienter, queueClient publisher) Snapshotter {
+	return Snapshotter{
+		sqlClient: sqlClient,
+		queueClient: queueClient,
+	}
+}
+
+//Run pages through the users matching the filters in user ID order and publishes an event for each.
+//When a checkpoint file is configured progress is saved after every batch and a later run resumes after
+//the last saved user, so users in an interrupted batch may be published twice
+func (s Snapshotter) Run(opts SnapshotOptions) (SnapshotResult, error) {
+	searchCriteria := buildSearchCriteria(opts.Filters)
+	if len(searchCriteria) != len(opts.Filters) {
+		return SnapshotResult{}, fmt.Errorf("invalid filters; valid filters are [userID, firstName, lastName, emailAddress, nickname, country]")
+	}
+	if opts.BatchSize < 1 {
+		return SnapshotResult{}, fmt.Errorf("batch size must be positive")
+	}
+
+	checkpoint := snapshotCheckpoint{TenantID: opts.TenantID, Criteria: searchCriteria}
+	if opts.CheckpointFile != "" {
+		saved, found, err := readCheckpoint(opts.CheckpointFile)
+		if err != nil {
+			return SnapshotResult{}, err
+		}
+		if found {
+			if saved.TenantID != opts.TenantID {
+				return SnapshotResult{}, fmt.Errorf("checkpoint %s was created for tenant %s", opts.CheckpointFile, saved.TenantID)
+			}
+			if !reflect.DeepEqual(saved.Criteria, searchCriteria) {
+				return SnapshotResult{}, fmt.Errorf("checkpoint %s was created with different filters %v", opts.CheckpointFile, saved.Criteria)
+			}
+			checkpoint = saved
+			log.Infof("resuming snapshot after user %s", checkpoint.LastUserID)
+		}
+	}
+
+	var throttle <-chan time.Time
+	if opts.Rate > 0 && !opts.DryRun {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	result := SnapshotResult{Published: checkpoint.Published, Failed: checkpoint.Failed, LastUserID: checkpoint.LastUserID}
+	for {
+		users, status := s.sqlClient.ScanRecords(persistence.SearchCriteria{TenantID: opts.TenantID, Fields: searchCriteria}, result.LastUserID, opts.BatchSize)
+		if status == persistence.NOT_FOUND {
+			break
+		} else if status != persistence.OK {
+			return result, fmt.Errorf("could not read users after %s from db", result.LastUserID)
+		}
+
+		for _, user := range users {
+			if !opts.DryRun {
+				if throttle != nil {
+					<-throttle
+				}
+				err := s.queueClient.AddMessageToQueue(persistence.Message{
+					Type: "USER_SNAPSHOT",
+					UserID: user.UserID,
+					Nickname: user.NickName,
+					TenantID: opts.TenantID,
+				})
+				if err != nil {
+					log.WithError(err).WithField("UserID", user.UserID).Error("could not publish snapshot")
+					result.Failed++
+				} else {
+					result.Published++
+				}
+			} else {
+				result.Published++
+			}
+			result.LastUserID = user.UserID
+		}
+
+		if opts.CheckpointFile != "" && !opts.DryRun {
+			checkpoint.LastUserID, checkpoint.Published, checkpoint.Failed = result.LastUserID, result.Published, result.Failed
+			if err := writeCheckpoint(opts.CheckpointFile, checkpoint); err != nil {
+				return result, err
+			}
+		}
+		if len(users) < opts.BatchSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+func readCheckpoint(path string) (snapshotCheckpoint, bool, error) {
+	var checkpoint snapshotCheckpoint
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, false, nil
+	} else if err != nil {
+		return checkpoint, false, fmt.Errorf("could not read checkpoint: %v", err)
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, false, fmt.Errorf("could not decode checkpoint: %v", err)
+	}
+	return checkpoint, true, nil
+}
+
+func writeCheckpoint(path string, checkpoint snapshotCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	//replace the checkpoint atomically so an interrupted write cannot corrupt it
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write checkpoint: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
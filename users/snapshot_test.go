@@ -0,0 +1,84 @@
+package users
+
+import (
+	"errors"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type recordingPublisher struct {
+	published []persistence.Message
+	failFor map[string]bool
+}
+
+func (rp *recordingPublisher) AddMessageToQueue(msg persistence.Message) error {
+	if rp.failFor[msg.UserID] {
+		return errors.New("queue unavailable")
+	}
+	rp.published = append(rp.published, msg)
+	return nil
+}
+
+var snapshotUsers = []persistence.UserRecord{
+	{UserID: "1", NickName: "Cle0"},
+	{UserID: "2", NickName: "GIJane"},
+	{UserID: "3", NickName: "ETuBrute"},
+}
+
+func TestSnapshotter_PublishesEventPerUser(t *testing.T) {
+	qc := &recordingPublisher{failFor: map[string]bool{"2": true}}
+	result, err := NewSnapshotter(&mockSQLClient{persistence.OK, snapshotUsers}, qc).Run(SnapshotOptions{BatchSize: 2})
+	assert.NoError(t, err, "test failed: snapshot should complete")
+	assert.Equal(t, SnapshotResult{Published: 2, Failed: 1, LastUserID: "3"}, result)
+	assert.Equal(t, []persistence.Message{
+		{Type: "USER_SNAPSHOT", UserID: "1", Nickname: "Cle0"},
+		{Type: "USER_SNAPSHOT", UserID: "3", Nickname: "ETuBrute"},
+	}, qc.published)
+}
+
+func TestSnapshotter_DryRunPublishesNothing(t *testing.T) {
+	qc := &recordingPublisher{}
+	result, err := NewSnapshotter(&mockSQLClient{persistence.OK, snapshotUsers}, qc).Run(SnapshotOptions{BatchSize: 10, DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Published)
+	assert.Empty(t, qc.published)
+}
+
+func TestSnapshotter_ResumesFromCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	filters := url.Values{"country": []string{"Italy"}}
+
+	assert.NoError(t, writeCheckpoint(checkpointFile, snapshotCheckpoint{
+		Criteria: map[string]string{"country": "Italy"},
+		LastUserID: "1",
+		Published: 1,
+	}))
+
+	qc := &recordingPublisher{}
+	result, err := NewSnapshotter(&mockSQLClient{persistence.OK, snapshotUsers}, qc).Run(SnapshotOptions{Filters: filters, BatchSize: 10, CheckpointFile: checkpointFile})
+	assert.NoError(t, err)
+	assert.Equal(t, SnapshotResult{Published: 3, LastUserID: "3"}, result)
+	assert.Len(t, qc.published, 2, "test failed: users before the checkpoint should not be published again")
+
+	saved, found, err := readCheckpoint(checkpointFile)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "3", saved.LastUserID)
+
+	//a checkpoint cannot be resumed with different filters
+	_, err = NewSnapshotter(&mockSQLClient{persistence.OK, snapshotUsers}, qc).Run(SnapshotOptions{BatchSize: 10, CheckpointFile: checkpointFile})
+	assert.Error(t, err)
+}
+
+func TestSnapshotter_RejectsInvalidFilters(t *testing.T) {
+	_, err := NewSnapshotter(&mockSQLClient{persistence.OK, snapshotUsers}, &recordingPublisher{}).Run(SnapshotOptions{Filters: url.Values{"password": []string{"x"}}, BatchSize: 10})
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+)
+
+//groupableFields are the fields users can be counted by, fields unique to each user cannot be
+var groupableFields = []string{"firstName", "lastName", "nickname", "country"}
+
+//UserStats models the number of users sharing each value of a field
+// swagger:model UserStats
+type UserStats struct {
+	GroupBy string `json:"groupBy"`
+	Total int `json:"total"`
+	Groups []persistence.GroupCount `json:"groups"`
+}
+
+//UserCount models the number of users matching a search
+// swagger:model UserCount
+type UserCount struct {
+	Count int `json:"count"`
+}
+
+// swagger:operation GET /users/stats users getUserStats
+// ---
+// summary: Count users by field
+// description: Counts the users matching the search params, or all users if there are none, sharing each value of
+//   the groupBy field, largest groups first
+// parameters:
+// - name: groupBy
+//   in: query
+//   description: field to count users by, firstName, lastName, nickname or country
+//   type: string
+//   required: true
+// - name: country
+//   in: query
+//   description: any of the GET /users search params, including includeDeleted and the time ranges
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   403: forbidden
+//   422: unprocessable
+//   500: internal
+func (h *UsersHandler) GetStats(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	params, ok := filterParams(writer, request)
+	if !ok {
+		return
+	}
+
+	groupBy := params.Get("groupBy")
+	params.Del("groupBy")
+	column := ""
+	for _, field := range groupableFields {
+		if field == groupBy {
+			column = userFields[field].column
+		}
+	}
+	if column == "" {
+		log.Infof("invalid groupBy param: %s", groupBy)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "groupBy must be one of [firstName, lastName, nickname, country]"))
+		return
+	}
+
+	criteria, err := filterCriteria(params)
+	if err != nil {
+		log.WithError(err).Infof("supplied stats params %s are invalid", params)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	if !checkIncludeDeleted(writer, request, criteria) {
+		return
+	}
+	criteria.TenantID = requestTenant(request)
+
+	groups, status := h.sqlClient.GroupRecords(criteria, column)
+	if status != persistence.OK {
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process request"))
+		return
+	}
+	stats := UserStats{GroupBy: groupBy, Groups: groups}
+	for _, group := range groups {
+		stats.Total += group.Count
+	}
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(stats); err != nil {
+		log.WithError(err).Error("could not encode returned payload")
+	}
+}
+
+// swagger:operation GET /users/count users countUsers
+// ---
+// summary: Count users
+// description: Counts the users matching the search params, or all users if there are none, without returning them
+// parameters:
+// - name: country
+//   in: query
+//   description: any of the GET /users search params, including includeDeleted and the time ranges
+//   type: string
+//   required: false
+// responses:
+//   200: ok
+//   400: badRequest
+//   403: forbidden
+//   422: unprocessable
+//   500: internal
+func (h *UsersHandler) CountUsers(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	params, ok := filterParams(writer, request)
+	if !ok {
+		return
+	}
+
+	criteria, err := filterCriteria(params)
+	if err != nil {
+		log.WithError(err).Infof("supplied count params %s are invalid", params)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, err.Error()))
+		return
+	}
+	if !checkIncludeDeleted(writer, request, criteria) {
+		return
+	}
+	criteria.TenantID = requestTenant(request)
+
+	count, status := h.sqlClient.CountRecords(criteria)
+	if status != persistence.OK {
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "could not process request"))
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(UserCount{Count: count}); err != nil {
+		log.WithError(err).Error("could not encode returned payload")
+	}
+}
+
+//filterParams parses the search params of the request, responding with 422 if they are malformed
+func filterParams(writer http.ResponseWriter, request *http.Request) (url.Values, bool) {
+	params, err := url.ParseQuery(request.URL.RawQuery)
+	if err != nil {
+		log.WithError(err).Errorf("malformed request query: %v", request.URL.RawQuery)
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintln(writer, fmt.Sprintf(msgTemplate, "malformed request query"))
+		return nil, false
+	}
+	return params, true
+}
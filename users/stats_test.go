@@ -0,0 +1,121 @@
+package users
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var statsUsers = []persistence.UserRecord{
+	{UserID: "1", FirstName: "John", Country: "UK"},
+	{UserID: "2", FirstName: "James", Country: "UK"},
+	{UserID: "3", FirstName: "Julius", Country: "Italy"},
+}
+
+func TestStatsAndCount(t *testing.T) {
+	qc := newTestQueueClient()
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		status persistence.Status
+		reqURL string
+		statusCode int
+		body string
+		criteria persistence.SearchCriteria
+	}{
+		{
+			name: "Counts users by country",
+			status: persistence.OK,
+			reqURL: "/users/stats?groupBy=country",
+			statusCode: http.StatusOK,
+			body: `{"groupBy":"country","total":3,"groups":[{"value":"UK","count":2},{"value":"Italy","count":1}]}` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+		{
+			name: "Counts users by field with GET /users filters",
+			status: persistence.OK,
+			reqURL: "/users/stats?groupBy=firstName&country=UK&includeDeleted=true",
+			statusCode: http.StatusOK,
+			body: `{"groupBy":"firstName","total":3,"groups":[{"value":"John","count":1},{"value":"James","count":1},{"value":"Julius","count":1}]}` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{"country": "UK"}, IncludeDeleted: true},
+		},
+		{
+			name: "Error when grouping by unique field",
+			status: persistence.OK,
+			reqURL: "/users/stats?groupBy=emailAddress",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "groupBy must be one of [firstName, lastName, nickname, country]"),
+		},
+		{
+			name: "Error when not grouping",
+			status: persistence.OK,
+			reqURL: "/users/stats",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "groupBy must be one of [firstName, lastName, nickname, country]"),
+		},
+		{
+			name: "Error on invalid stats filter",
+			status: persistence.OK,
+			reqURL: "/users/stats?groupBy=country&address=London",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "supplied filters are invalid; valid filters are [userID, firstName, lastName, emailAddress, nickname, country, includeDeleted, createdAfter, createdBefore, updatedAfter, updatedBefore]"),
+		},
+		{
+			name: "Error when stats cannot be read",
+			status: persistence.BACKEND_ERROR,
+			reqURL: "/users/stats?groupBy=country",
+			statusCode: http.StatusInternalServerError,
+			body: fmt.Sprintf(msgTemplate + "\n", "could not process request"),
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+		{
+			name: "Counts all users",
+			status: persistence.OK,
+			reqURL: "/users/count",
+			statusCode: http.StatusOK,
+			body: `{"count":3}` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+		{
+			name: "Counts users matching GET /users filters",
+			status: persistence.OK,
+			reqURL: "/users/count?country=UK&createdAfter=2020-04-01T12:00:00Z",
+			statusCode: http.StatusOK,
+			body: `{"count":3}` + "\n",
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{"country": "UK"}, CreatedAfter: exportCreatedAt},
+		},
+		{
+			name: "Error on invalid count filter",
+			status: persistence.OK,
+			reqURL: "/users/count?createdAfter=yesterday",
+			statusCode: http.StatusBadRequest,
+			body: fmt.Sprintf(msgTemplate + "\n", "createdAfter must be an RFC 3339 time e.g. 2020-04-01T12:00:00Z"),
+		},
+		{
+			name: "Error when users cannot be counted",
+			status: persistence.BACKEND_ERROR,
+			reqURL: "/users/count",
+			statusCode: http.StatusInternalServerError,
+			body: fmt.Sprintf(msgTemplate + "\n", "could not process request"),
+			criteria: persistence.SearchCriteria{TenantID: persistence.DefaultTenant, Fields: map[string]string{}},
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		sqlClient := &mockSearchClient{mockSQLClient: mockSQLClient{test.status, statsUsers}}
+		handler := NewUsersHandler(sqlClient, qc, notification.NewEventStream(10), Config{})
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", test.reqURL, nil))
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal("application/json", rec.Header().Get("Content-Type"), fmt.Sprintf("%s: Wrong content type", test.name))
+		assert.Equal(test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.criteria, sqlClient.criteria, fmt.Sprintf("%s: Wrong criteria", test.name))
+	}
+}
@@ -0,0 +1,65 @@
+package users
+
+import (
+	"context"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+)
+
+//TenantHeader names the tenant a request is for when it is not authenticated or is made by an admin who does not
+//belong to a tenant
+const TenantHeader = "X-Tenant-ID"
+
+const invalidTenantMsg = "tenant must be 1 to 64 letters, digits, hyphens or underscores"
+
+//tenantPattern matches valid tenant IDs
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+//resolveTenant is middleware adding the tenant each request is for to its context. Requests by principals who belong
+//to a tenant are for their tenant, and requests by other principals who are not admins are for the default tenant,
+//both being rejected with 403 if they name another. Otherwise requests are for the tenant named by the X-Tenant-ID
+//header, or the default tenant if they do not name one and a tenant is not required
+func (h *UsersHandler) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if publicPaths[request.URL.Path] {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		tenant := request.Header.Get(TenantHeader)
+		if tenant != "" && !tenantPattern.MatchString(tenant) {
+			log.Infof("invalid %s header: %q", TenantHeader, tenant)
+			writeProblem(writer, request, http.StatusBadRequest, invalidTenantMsg)
+			return
+		}
+		if principal, ok := PrincipalFromContext(request.Context()); ok && (principal.Tenant != "" || !contains(principal.Roles, adminRole)) {
+			//only admins may choose the tenant of their requests
+			principalTenant := principal.Tenant
+			if principalTenant == "" {
+				principalTenant = persistence.DefaultTenant
+			}
+			if tenant != "" && tenant != principalTenant {
+				log.Infof("%s of tenant %s is not permitted to access tenant %s", principal.Subject, principalTenant, tenant)
+				writeProblem(writer, request, http.StatusForbidden, "not permitted to access tenant: " + tenant)
+				return
+			}
+			tenant = principalTenant
+		}
+		if tenant == "" {
+			if h.config.RequireTenant {
+				writeProblem(writer, request, http.StatusBadRequest, TenantHeader + " header is required")
+				return
+			}
+			tenant = persistence.DefaultTenant
+		}
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), tenantKey, tenant)))
+	})
+}
+
+//requestTenant returns the tenant the request is for, or an empty tenant, which the sql client rejects, if it was
+//not resolved
+func requestTenant(request *http.Request) string {
+	tenant, _ := request.Context().Value(tenantKey).(string)
+	return tenant
+}
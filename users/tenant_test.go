@@ -0,0 +1,272 @@
+package users
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scott-ace-newton/users-rw-sql/notification"
+	"github.com/scott-ace-newton/users-rw-sql/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTenantResolution(t *testing.T) {
+	assert := assert.New(t)
+	getURL := "/users/" + johnSmithUser.UserID
+	tests := []struct {
+		name string
+		principal string
+		header string
+		requireTenant bool
+		status persistence.Status
+		method string
+		url string
+		reqBody string
+		statusCode int
+		tenant string
+		detail string
+	}{
+		{
+			name: "Requests without a tenant are for the default tenant",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: persistence.DefaultTenant,
+		},
+		{
+			name: "Requests are for the tenant named by the header",
+			header: "acme",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name: "Users are added to the tenant named by the header",
+			header: "acme",
+			status: persistence.CREATED,
+			method: "POST",
+			url: "/users",
+			reqBody: johnSmithJSON,
+			statusCode: http.StatusCreated,
+			tenant: "acme",
+		},
+		{
+			name: "Invalid tenants are rejected",
+			header: "acme corp",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusBadRequest,
+			detail: invalidTenantMsg,
+		},
+		{
+			name: "Requests must name a tenant when one is required",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusBadRequest,
+			detail: "X-Tenant-ID header is required",
+		},
+		{
+			name: "Requests naming a tenant are accepted when one is required",
+			header: "acme",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name: "Health checks do not need a tenant",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: "/__health",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "Requests by principals of a tenant are for their tenant",
+			principal: "admin-1@acme:admin",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name: "Principals of a tenant can name their own tenant",
+			principal: "admin-1@acme:admin",
+			header: "acme",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name: "Principals of a tenant cannot access other tenants",
+			principal: "admin-1@acme:admin",
+			header: "globex",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to access tenant: globex",
+		},
+		{
+			name: "Principals of a tenant cannot add users to other tenants",
+			principal: "admin-1@acme:admin",
+			header: "globex",
+			status: persistence.CREATED,
+			method: "POST",
+			url: "/users",
+			reqBody: johnSmithJSON,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to access tenant: globex",
+		},
+		{
+			name: "Admins without a tenant can access any tenant",
+			principal: "admin-1:admin",
+			header: "globex",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: "globex",
+		},
+		{
+			name: "Admins without a tenant must name one when one is required",
+			principal: "admin-1:admin",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusBadRequest,
+			detail: "X-Tenant-ID header is required",
+		},
+		{
+			name: "Other principals without a tenant are for the default tenant",
+			principal: "reader-1:read-only",
+			requireTenant: true,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: persistence.DefaultTenant,
+		},
+		{
+			name: "Other principals without a tenant can name the default tenant",
+			principal: "support-1:support",
+			header: persistence.DefaultTenant,
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusOK,
+			tenant: persistence.DefaultTenant,
+		},
+		{
+			name: "Other principals without a tenant cannot choose their tenant",
+			principal: "support-1:support",
+			header: "globex",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to access tenant: globex",
+		},
+		{
+			name: "Self-service principals without a tenant cannot choose their tenant",
+			principal: johnSmithUser.UserID + ":self-service",
+			header: "globex",
+			status: persistence.OK,
+			method: "GET",
+			url: getURL,
+			statusCode: http.StatusForbidden,
+			detail: "not permitted to access tenant: globex",
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		sqlClient := &mockTenantClient{mockSQLClient: mockSQLClient{test.status, []persistence.UserRecord{johnSmithUser}}}
+		events := notification.NewEventStream(10)
+		config := Config{RequireTenant: test.requireTenant}
+		if test.principal != "" {
+			config.Authenticators = []Authenticator{stubAuthenticator{}}
+		}
+		handler := NewUsersHandler(sqlClient, newTestQueueClient(), events, config)
+		handler.RegisterHandlers(r)
+		rec := httptest.NewRecorder()
+		req := newRequest(test.method, test.url, strings.NewReader(test.reqBody))
+		if test.principal != "" {
+			req.Header.Set("Authorization", "Stub " + test.principal)
+		}
+		if test.header != "" {
+			req.Header.Set(TenantHeader, test.header)
+		}
+		r.ServeHTTP(rec, req)
+		assert.Equal(test.statusCode, rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.Equal(test.tenant, sqlClient.tenant, fmt.Sprintf("%s: Wrong tenant", test.name))
+		if test.method == "POST" && test.statusCode == http.StatusCreated {
+			assert.Equal([]persistence.Message{{Type: "USER_CREATED", UserID: johnSmithGeneratedID, TenantID: test.tenant}}, publishedMessages(events), fmt.Sprintf("%s: Wrong events", test.name))
+		}
+		if test.detail == "" {
+			continue
+		}
+		var problem Problem
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&problem), fmt.Sprintf("%s: Wrong body", test.name))
+		assert.Equal(test.detail, problem.Detail, fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+func TestStreamEventsTenantIsolation(t *testing.T) {
+	assert := assert.New(t)
+	events := notification.NewEventStream(10)
+	r := mux.NewRouter()
+	handler := NewUsersHandler(&mockSQLClient{persistence.OK, nil}, newTestQueueClient(), events, Config{})
+	handler.RegisterHandlers(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "1", TenantID: "globex"})
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "2", TenantID: "acme"})
+	events.Publish(persistence.Message{Type: "USER_CREATED", UserID: "3", TenantID: persistence.DefaultTenant})
+
+	req := newRequest("GET", server.URL + "/users/events", nil)
+	req.Header.Set(TenantHeader, "acme")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err, "test failed: could not connect to event stream")
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	//only the acme event is replayed, so the stream then waits for live events
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadString('\n')
+		assert.NoError(err, "test failed: could not read event stream")
+		lines = append(lines, line)
+	}
+	assert.Equal([]string{
+		"id: 2\n",
+		"event: USER_CREATED\n",
+		`data: {"type":"USER_CREATED","userID":"2","tenantID":"acme"}` + "\n",
+		"\n",
+	}, lines)
+
+	events.Publish(persistence.Message{Type: "USER_DELETED", UserID: "1", TenantID: "globex"})
+	events.Publish(persistence.Message{Type: "USER_DELETED", UserID: "2", TenantID: "acme"})
+	line, err := reader.ReadString('\n')
+	assert.NoError(err, "test failed: could not read event stream")
+	assert.Equal("id: 5\n", line, "test failed: events of other tenants should not be streamed")
+}